@@ -3,16 +3,21 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	locksmith "github.com/maansthoernvik/locksmith/pkg"
+	"github.com/maansthoernvik/locksmith/pkg/connection"
 	"github.com/maansthoernvik/locksmith/pkg/env"
 	"github.com/maansthoernvik/locksmith/pkg/vault"
 	"github.com/maansthoernvik/locksmith/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -39,16 +44,23 @@ func main() {
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
+	// A server taking over from another waits for it to let go of its ports.
+	handingOver, _ := env.GetOptionalString(env.LOCKSMITH_HANDOFF_SOCKET, env.LOCKSMITH_HANDOFF_SOCKET_DEFAULT)
 
 	// Check if Prometheus metrics are enabled, start the metrics server if so.
 	var metricsServer *http.Server
 	metrics, _ := env.GetOptionalBool(env.LOCKSMITH_METRICS, env.LOCKSMITH_METRICS_DEFAULT)
 	if metrics {
-		http.Handle("/metrics", promhttp.Handler())
+		// OpenMetrics is needed to expose the trace IDs of traced operations
+		// as exemplars.
+		http.Handle("/metrics", promhttp.InstrumentMetricHandler(
+			prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+		))
 		metricsServer = &http.Server{Addr: ":20000"}
 		go func() {
 			log.Info().Str("address", metricsServer.Addr).Msg("starting metrics server")
-			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			if err := listenAndServe(metricsServer, handingOver != ""); err != http.ErrServerClosed {
 				log.Error().Err(err).Msg("metrics server failure")
 			} else {
 				log.Info().Msg("stopped metrics server")
@@ -73,24 +85,180 @@ func main() {
 	queueType, _ := env.GetOptionalString(env.LOCKSMITH_Q_TYPE, env.LOCKSMITH_Q_TYPE_DEFAULT)
 	concurrency, _ := env.GetOptionalInteger(env.LOCKSMITH_Q_CONCURRENCY, env.LOCKSMITH_Q_CONCURRENCY_DEFAULT)
 	capacity, _ := env.GetOptionalInteger(env.LOCKSMITH_Q_CAPACITY, env.LOCKSMITH_Q_CAPACITY_DEFAULT)
+	heartbeatTimeout, _ := env.GetOptionalDuration(env.LOCKSMITH_HEARTBEAT_TIMEOUT, env.LOCKSMITH_HEARTBEAT_TIMEOUT_DEFAULT)
+	drainTimeout, _ := env.GetOptionalDuration(env.LOCKSMITH_DRAIN_TIMEOUT, env.LOCKSMITH_DRAIN_TIMEOUT_DEFAULT)
+	handshakeTimeout, _ := env.GetOptionalDuration(env.LOCKSMITH_HANDSHAKE_TIMEOUT, env.LOCKSMITH_HANDSHAKE_TIMEOUT_DEFAULT)
+	idleTimeout, _ := env.GetOptionalDuration(env.LOCKSMITH_IDLE_TIMEOUT, env.LOCKSMITH_IDLE_TIMEOUT_DEFAULT)
+	writeTimeout, _ := env.GetOptionalDuration(env.LOCKSMITH_WRITE_TIMEOUT, env.LOCKSMITH_WRITE_TIMEOUT_DEFAULT)
+	writeQueueSize, _ := env.GetOptionalInteger(env.LOCKSMITH_WRITE_QUEUE_SIZE, env.LOCKSMITH_WRITE_QUEUE_SIZE_DEFAULT)
+	maxLockTagSize, _ := env.GetOptionalInteger(env.LOCKSMITH_MAX_LOCK_TAG_SIZE, env.LOCKSMITH_MAX_LOCK_TAG_SIZE_DEFAULT)
+	maxConnections, _ := env.GetOptionalInteger(env.LOCKSMITH_MAX_CONNECTIONS, env.LOCKSMITH_MAX_CONNECTIONS_DEFAULT)
+	maxConnectionsPerIP, _ := env.GetOptionalInteger(env.LOCKSMITH_MAX_CONNECTIONS_PER_IP, env.LOCKSMITH_MAX_CONNECTIONS_PER_IP_DEFAULT)
 
 	locksmithOptions := &locksmith.LocksmithOptions{
-		Port:             port,
-		QueueType:        vault.QueueType(queueType),
-		QueueConcurrency: concurrency,
-		QueueCapacity:    capacity,
+		Port:                port,
+		QueueType:           vault.QueueType(queueType),
+		QueueConcurrency:    concurrency,
+		QueueCapacity:       capacity,
+		HeartbeatTimeout:    heartbeatTimeout,
+		DrainTimeout:        drainTimeout,
+		HandshakeTimeout:    handshakeTimeout,
+		IdleTimeout:         idleTimeout,
+		WriteTimeout:        writeTimeout,
+		WriteQueueSize:      writeQueueSize,
+		MaxLockTagSize:      maxLockTagSize,
+		MaxConnections:      maxConnections,
+		MaxConnectionsPerIP: maxConnectionsPerIP,
+	}
+	requestRate, rateErr := env.GetOptionalFloat(env.LOCKSMITH_RATE_LIMIT, env.LOCKSMITH_RATE_LIMIT_DEFAULT)
+	identityRequestRate, identityRateErr := env.GetOptionalFloat(env.LOCKSMITH_IDENTITY_RATE_LIMIT, env.LOCKSMITH_IDENTITY_RATE_LIMIT_DEFAULT)
+	if !validRate(requestRate, rateErr) || !validRate(identityRequestRate, identityRateErr) {
+		log.Error().
+			Str(env.LOCKSMITH_RATE_LIMIT, os.Getenv(env.LOCKSMITH_RATE_LIMIT)).
+			Str(env.LOCKSMITH_IDENTITY_RATE_LIMIT, os.Getenv(env.LOCKSMITH_IDENTITY_RATE_LIMIT)).
+			Msg("invalid rate limit, expected requests per second as a positive number, or 0 for no limit")
+		os.Exit(1)
+	}
+	if requestRate > 0 || identityRequestRate > 0 {
+		locksmithOptions.RequestRate = requestRate
+		locksmithOptions.IdentityRequestRate = identityRequestRate
+		burst, burstErr := env.GetOptionalInteger(env.LOCKSMITH_RATE_LIMIT_BURST, env.LOCKSMITH_RATE_LIMIT_BURST_DEFAULT)
+		identityBurst, identityBurstErr := env.GetOptionalInteger(env.LOCKSMITH_IDENTITY_RATE_LIMIT_BURST, env.LOCKSMITH_IDENTITY_RATE_LIMIT_BURST_DEFAULT)
+		if burstErr != nil || identityBurstErr != nil || burst < 1 || identityBurst < 1 {
+			log.Error().
+				Str(env.LOCKSMITH_RATE_LIMIT_BURST, os.Getenv(env.LOCKSMITH_RATE_LIMIT_BURST)).
+				Str(env.LOCKSMITH_IDENTITY_RATE_LIMIT_BURST, os.Getenv(env.LOCKSMITH_IDENTITY_RATE_LIMIT_BURST)).
+				Msg("invalid rate limit burst, expected a positive integer")
+			os.Exit(1)
+		}
+		locksmithOptions.RequestBurst = burst
+		locksmithOptions.IdentityRequestBurst = identityBurst
+		policy, _ := env.GetOptionalString(env.LOCKSMITH_RATE_LIMIT_POLICY, env.LOCKSMITH_RATE_LIMIT_POLICY_DEFAULT)
+		rateLimitPolicy, err := locksmith.ParseRateLimitPolicy(policy)
+		if err != nil {
+			log.Error().Err(err).Msg("invalid rate limit policy")
+			os.Exit(1)
+		}
+		locksmithOptions.RateLimitPolicy = rateLimitPolicy
+	}
+	if text, _ := env.GetOptionalBool(env.LOCKSMITH_TEXT, env.LOCKSMITH_TEXT_DEFAULT); text {
+		locksmithOptions.TextPort, _ = env.GetOptionalUint16(env.LOCKSMITH_TEXT_PORT, env.LOCKSMITH_TEXT_PORT_DEFAULT)
+	}
+	if resp, _ := env.GetOptionalBool(env.LOCKSMITH_RESP, env.LOCKSMITH_RESP_DEFAULT); resp {
+		locksmithOptions.RESPPort, _ = env.GetOptionalUint16(env.LOCKSMITH_RESP_PORT, env.LOCKSMITH_RESP_PORT_DEFAULT)
+	}
+	if webSocket, _ := env.GetOptionalBool(env.LOCKSMITH_WEBSOCKET, env.LOCKSMITH_WEBSOCKET_DEFAULT); webSocket {
+		locksmithOptions.WebSocketPort, _ = env.GetOptionalUint16(env.LOCKSMITH_WEBSOCKET_PORT, env.LOCKSMITH_WEBSOCKET_PORT_DEFAULT)
+	}
+	if unixSocket, _ := env.GetOptionalString(env.LOCKSMITH_UNIX_SOCKET, env.LOCKSMITH_UNIX_SOCKET_DEFAULT); unixSocket != "" {
+		locksmithOptions.UnixSocketPath = unixSocket
+		// Given in octal, e.g. "0660".
+		mode, _ := env.GetOptionalInteger(env.LOCKSMITH_UNIX_SOCKET_MODE, env.LOCKSMITH_UNIX_SOCKET_MODE_DEFAULT)
+		locksmithOptions.UnixSocketMode = os.FileMode(mode)
 	}
 	if tls, _ := env.GetOptionalBool(env.LOCKSMITH_TLS, env.LOCKSMITH_TLS_DEFAULT); tls {
-		locksmithOptions.TlsConfig = getTlsConfig()
+		locksmithOptions.TlsConfig = getTlsConfig(ctx)
+		if requireClientCert, _ := env.GetOptionalBool(env.LOCKSMITH_TLS_REQUIRE_CLIENT_CERT, env.LOCKSMITH_TLS_REQUIRE_CLIENT_CERT_DEFAULT); requireClientCert {
+			identity, _ := env.GetOptionalString(env.LOCKSMITH_TLS_CLIENT_IDENTITY, env.LOCKSMITH_TLS_CLIENT_IDENTITY_DEFAULT)
+			clientIdentity, err := connection.ParseIdentitySource(identity)
+			if err != nil {
+				log.Error().Err(err).Msg("invalid client identity source")
+				os.Exit(1)
+			}
+			locksmithOptions.ClientIdentity = clientIdentity
+		}
+	}
+	if listen, _ := env.GetOptionalString(env.LOCKSMITH_LISTEN, env.LOCKSMITH_LISTEN_DEFAULT); listen != "" {
+		listeners, err := locksmith.ParseListeners(listen, locksmithOptions.TlsConfig)
+		if err != nil {
+			log.Error().Err(err).Msg("invalid listen addresses")
+			os.Exit(1)
+		}
+		locksmithOptions.Listeners = listeners
 	}
-	if err := locksmith.New(locksmithOptions).Start(ctx); err != nil {
+	if trustedProxies, _ := env.GetOptionalString(env.LOCKSMITH_TRUSTED_PROXIES, env.LOCKSMITH_TRUSTED_PROXIES_DEFAULT); trustedProxies != "" {
+		networks, err := connection.ParseTrustedProxies(trustedProxies)
+		if err != nil {
+			log.Error().Err(err).Msg("invalid trusted proxies")
+			os.Exit(1)
+		}
+		locksmithOptions.TrustedProxies = networks
+	}
+	httpGateway, _ := env.GetOptionalBool(env.LOCKSMITH_HTTP, env.LOCKSMITH_HTTP_DEFAULT)
+	if httpGateway {
+		locksmithOptions.HTTPSessionTimeout, _ = env.GetOptionalDuration(env.LOCKSMITH_HTTP_SESSION_TIMEOUT, env.LOCKSMITH_HTTP_SESSION_TIMEOUT_DEFAULT)
+	}
+	if handingOver != "" {
+		locksmithOptions.HandoffSocket = handingOver
+		// Take over from a running server, if there is one.
+		handoff, err := locksmith.ReceiveHandoff(handingOver)
+		if err != nil && !errors.Is(err, locksmith.ErrNoHandoff) {
+			log.Error().Err(err).Msg("failed to take over from running server")
+			os.Exit(1)
+		}
+		locksmithOptions.Handoff = handoff
+	}
+	// Listening sockets passed by systemd socket activation, if any.
+	activated, err := connection.ActivationListeners()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to adopt activated sockets")
+		os.Exit(1)
+	}
+	locksmithOptions.ListenerFiles = activated
+	server := locksmith.New(locksmithOptions)
+
+	// The HTTP gateway runs next to the metrics server, sharing the server's vault.
+	var gatewayServer *http.Server
+	if httpGateway {
+		httpPort, _ := env.GetOptionalUint16(env.LOCKSMITH_HTTP_PORT, env.LOCKSMITH_HTTP_PORT_DEFAULT)
+		gatewayServer = &http.Server{Addr: fmt.Sprintf(":%d", httpPort), Handler: server.HTTPHandler()}
+		go func() {
+			log.Info().Str("address", gatewayServer.Addr).Msg("starting HTTP gateway")
+			if err := listenAndServe(gatewayServer, handingOver != ""); err != http.ErrServerClosed {
+				log.Error().Err(err).Msg("HTTP gateway failure")
+			} else {
+				log.Info().Msg("stopped HTTP gateway")
+			}
+		}()
+	}
+
+	if err := server.Start(ctx); err != nil {
 		log.Error().Err(err).Msg("server start error")
 		os.Exit(1)
 	}
+	if httpGateway {
+		// Long-polling acquires may keep requests open, give them a moment to
+		// finish before cutting them off.
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := gatewayServer.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("error shutting down HTTP gateway")
+			gatewayServer.Close()
+		}
+		shutdownCancel()
+	}
 
 	log.Info().Msg("server stopped")
 }
 
+// Like server.ListenAndServe, but retries for a while if the port is in use
+// and retry is set.
+func listenAndServe(server *http.Server, retry bool) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := server.ListenAndServe()
+		if !retry || !errors.Is(err, syscall.EADDRINUSE) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Tells if a rate limit parsed from the environment is usable, a finite
+// number of requests per second, zero disabling the limit.
+func validRate(rate float64, err error) bool {
+	return err == nil && rate >= 0 && !math.IsInf(rate, 0) && !math.IsNaN(rate)
+}
+
 func translateToZerologLevel(level string) zerolog.Level {
 	switch level {
 	case "DEBUG":
@@ -111,30 +279,40 @@ func translateToZerologLevel(level string) zerolog.Level {
 	return zerolog.NoLevel
 }
 
-// Fetch TLS config to supply the TCP listener.
-func getTlsConfig() *tls.Config {
-	tlsConfig := &tls.Config{}
-
-	serverCertPath, _ := env.GetOptionalString(env.LOCKSMITH_TLS_CERT_PATH, env.LOCKSMITH_TLS_CERT_PATH_DEFAULT)
-	serverKeyPath, _ := env.GetOptionalString(env.LOCKSMITH_TLS_KEY_PATH, env.LOCKSMITH_TLS_KEY_PATH_DEFAULT)
-	cert, err := tls.LoadX509KeyPair(serverCertPath, serverKeyPath)
-	if err != nil {
-		panic("failed to load server cert/key pair")
-	}
-	tlsConfig.Certificates = []tls.Certificate{cert}
+// Fetch TLS config to supply the TCP listener. Certificates are reloaded
+// when their files change and on SIGHUP, for as long as the context lives.
+func getTlsConfig(ctx context.Context) *tls.Config {
+	options := &connection.CertReloaderOptions{}
+	options.CertPath, _ = env.GetOptionalString(env.LOCKSMITH_TLS_CERT_PATH, env.LOCKSMITH_TLS_CERT_PATH_DEFAULT)
+	options.KeyPath, _ = env.GetOptionalString(env.LOCKSMITH_TLS_KEY_PATH, env.LOCKSMITH_TLS_KEY_PATH_DEFAULT)
+	options.PollInterval, _ = env.GetOptionalDuration(env.LOCKSMITH_TLS_RELOAD_INTERVAL, env.LOCKSMITH_TLS_RELOAD_INTERVAL_DEFAULT)
 
 	requireClientVerify, _ := env.GetOptionalBool(env.LOCKSMITH_TLS_REQUIRE_CLIENT_CERT, env.LOCKSMITH_TLS_REQUIRE_CLIENT_CERT_DEFAULT)
 	if requireClientVerify {
-		clientCaCertPath, _ := env.GetOptionalString(env.LOCKSMITH_TLS_CLIENT_CA_CERT_PATH, env.LOCKSMITH_TLS_CLIENT_CA_CERT_PATH_DEFAULT)
-		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
-		caCert, err := os.ReadFile(clientCaCertPath)
-		if err != nil {
-			panic("failed to read client CA cert file")
-		}
-		pool := x509.NewCertPool()
-		pool.AppendCertsFromPEM(caCert)
-		tlsConfig.ClientCAs = pool
+		options.ClientCAPath, _ = env.GetOptionalString(env.LOCKSMITH_TLS_CLIENT_CA_CERT_PATH, env.LOCKSMITH_TLS_CLIENT_CA_CERT_PATH_DEFAULT)
+	}
+
+	reloader, err := connection.NewCertReloader(options)
+	if err != nil {
+		panic("failed to load TLS certificates: " + err.Error())
 	}
+	go reloader.Watch(ctx)
+	go func() {
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				log.Info().Msg("captured SIGHUP, reloading TLS certificates")
+				if err := reloader.Reload(); err != nil {
+					log.Error().Err(err).Msg("failed to reload TLS certificates, keeping the current ones")
+				}
+			}
+		}
+	}()
 
-	return tlsConfig
+	return reloader.TlsConfig()
 }
@@ -14,6 +14,7 @@ import (
 	"syscall"
 
 	"github.com/maansthoernvik/locksmith/pkg/client"
+	"github.com/maansthoernvik/locksmith/pkg/protocol"
 	"github.com/rs/zerolog"
 )
 
@@ -22,7 +23,16 @@ client implementation.`
 const COMMANDS = `Session started, the following commands are supported:
 
 acquire [lock]
-release [lock]`
+release [lock]
+watch [lock]
+watch-prefix [prefix]`
+
+var eventNames = map[protocol.EventKind]string{
+	protocol.EventAcquire: "acquired",
+	protocol.EventRelease: "released",
+	protocol.EventExpire:  "expired",
+	protocol.EventCleanup: "cleaned up",
+}
 
 var (
 	ErrExit              = errors.New("exiting")
@@ -121,6 +131,15 @@ func handleCommand(
 			return err
 		}
 
+	case "watch", "watch-prefix":
+		if len(cmd) != 2 {
+			return fmt.Errorf("expected '%s' followed by a lock", cmd[0])
+		}
+		err := c.(client.Watcher).Watch(cmd[1], cmd[0] == "watch-prefix")
+		if err != nil {
+			return err
+		}
+
 	default:
 		if cmd[0] != "" {
 			fmt.Println("did not recognize command:", cmd[0])
@@ -162,6 +181,9 @@ func initClient() error {
 		OnAcquired: func(lock string) {
 			fmt.Println("acquired ", lock)
 		},
+		OnEvent: func(lock string, kind protocol.EventKind, owner string) {
+			fmt.Println("event", eventNames[kind], lock, owner)
+		},
 	})
 
 	return c.Connect()
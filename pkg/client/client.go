@@ -2,10 +2,14 @@
 package client
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
-	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/maansthoernvik/locksmith/pkg/protocol"
 	"github.com/rs/zerolog/log"
@@ -19,31 +23,134 @@ type Client interface {
 	Close()
 }
 
+// The clients returned by NewClient also implement the interfaces below,
+// which are kept apart from Client so that other implementations of Client
+// need not implement them. Get at them with a type assertion, as in
+// NewClient(options).(BatchClient).
+
+// TracingClient is a Client whose acquires and releases may carry a W3C trace
+// parent.
+type TracingClient interface {
+	Client
+	TracedAcquire(lockTag string, traceParent string) error
+	TracedRelease(lockTag string, traceParent string) error
+}
+
+// BatchClient is a Client sending several acquires and releases at once.
+type BatchClient interface {
+	Client
+	Batch(operations []protocol.Operation) error
+}
+
+// Watcher is a Client subscribing to events about locks.
+type Watcher interface {
+	Client
+	Watch(lockTag string, prefix bool) error
+}
+
+// Heartbeat settings. Heartbeats are off unless ClientOptions.HeartbeatInterval
+// is set, as servers predating the Ping message disconnect clients sending it.
+const (
+	// A heartbeat interval suited to most deployments.
+	DEFAULT_HEARTBEAT_INTERVAL = 5 * time.Second
+	// The heartbeat timeout defaults to this many heartbeat intervals.
+	DEFAULT_HEARTBEAT_TIMEOUT_INTERVALS = 3
+)
+
 // ClientOptions to provide at client instantiation.
 type ClientOptions struct {
-	Host       string
-	Port       uint16
+	Host string
+	Port uint16
+	// Path of a Unix domain socket to connect to instead of Host and Port,
+	// TlsConfig is not used on Unix domain sockets.
+	SocketPath string
 	TlsConfig  *tls.Config
 	OnAcquired func(lockTag string)
+	// Called with the results of a batch once all its operations have
+	// completed, results are in the same order as the batch's operations.
+	OnBatchResult func(results []protocol.OperationResult)
+	// Called for every event about watched locks, with what happened to the
+	// lock and its owner.
+	OnEvent func(lockTag string, kind protocol.EventKind, owner string)
+	// Called when an acquire or release of the lock tag was dropped for
+	// exceeding the server's rate limit, it may be retried later.
+	OnThrottled func(lockTag string)
+	// How often to ping the server, such as DEFAULT_HEARTBEAT_INTERVAL. Zero
+	// or a negative value disables heartbeats, which is what servers without
+	// support for the Ping message need.
+	HeartbeatInterval time.Duration
+	// How long the server may stay silent before it is considered dead.
+	// Defaults to DEFAULT_HEARTBEAT_TIMEOUT_INTERVALS heartbeat intervals.
+	HeartbeatTimeout time.Duration
+	// Called when the server has stopped answering heartbeats, after which
+	// the connection is closed.
+	OnServerUnresponsive func()
+	// Called when the server tells it is shutting down. Locks should be
+	// released soon after, the server disconnects the client once its drain
+	// window has passed.
+	OnServerShuttingDown func()
+	// The wire format to talk to the server in, the server picks up on it
+	// from the first message. Defaults to protocol.BinaryCodec.
+	Codec protocol.Codec
+	// Dials the server in place of net.Dial, with "tcp" or "unix" and the
+	// address, such as connection.MemoryListener's DialContext to run
+	// against a server without opening sockets. TLS is negotiated over the
+	// dialed connection when TlsConfig is set.
+	DialContext func(ctx context.Context, network string, address string) (net.Conn, error)
 }
 
-// Implements the Client interface.
+// Implements the Client interface, along with TracingClient, BatchClient and
+// Watcher.
 type clientImpl struct {
-	host       string
-	port       uint16
-	tlsConfig  *tls.Config
-	onAcquired func(lockTag string)
-	conn       net.Conn
-	stop       chan interface{}
+	host                 string
+	port                 uint16
+	socketPath           string
+	tlsConfig            *tls.Config
+	dialContext          func(ctx context.Context, network string, address string) (net.Conn, error)
+	onAcquired           func(lockTag string)
+	onBatchResult        func(results []protocol.OperationResult)
+	onEvent              func(lockTag string, kind protocol.EventKind, owner string)
+	onThrottled          func(lockTag string)
+	heartbeatInterval    time.Duration
+	heartbeatTimeout     time.Duration
+	onServerUnresponsive func()
+	onServerShuttingDown func()
+	codec                protocol.Codec
+	conn                 net.Conn
+	stop                 chan interface{}
+	// Unix nano timestamp of the latest message from the server.
+	lastHeard atomic.Int64
 }
 
+var (
+	_ TracingClient = (*clientImpl)(nil)
+	_ BatchClient   = (*clientImpl)(nil)
+	_ Watcher       = (*clientImpl)(nil)
+)
+
 func NewClient(options *ClientOptions) Client {
+	heartbeatInterval := options.HeartbeatInterval
+	heartbeatTimeout := options.HeartbeatTimeout
+	if heartbeatTimeout == 0 {
+		heartbeatTimeout = DEFAULT_HEARTBEAT_TIMEOUT_INTERVALS * heartbeatInterval
+	}
+
 	return &clientImpl{
-		host:       options.Host,
-		port:       options.Port,
-		tlsConfig:  options.TlsConfig,
-		onAcquired: options.OnAcquired,
-		stop:       make(chan interface{}),
+		host:                 options.Host,
+		port:                 options.Port,
+		socketPath:           options.SocketPath,
+		tlsConfig:            options.TlsConfig,
+		dialContext:          options.DialContext,
+		onAcquired:           options.OnAcquired,
+		onBatchResult:        options.OnBatchResult,
+		onEvent:              options.OnEvent,
+		onThrottled:          options.OnThrottled,
+		heartbeatInterval:    heartbeatInterval,
+		heartbeatTimeout:     heartbeatTimeout,
+		onServerUnresponsive: options.OnServerUnresponsive,
+		onServerShuttingDown: options.OnServerShuttingDown,
+		codec:                options.Codec,
+		stop:                 make(chan interface{}),
 	}
 }
 
@@ -52,32 +159,46 @@ func NewClient(options *ClientOptions) Client {
 // error, even if something is wrong, until the first client write is issues. This is
 // because of how TLS 13 is implemented.
 func (clientImpl *clientImpl) Connect() (err error) {
-	address := fmt.Sprintf("%s:%d", clientImpl.host, clientImpl.port)
-	if clientImpl.tlsConfig != nil {
+	if clientImpl.codec == nil {
+		clientImpl.codec = protocol.BinaryCodec{}
+	}
+	dial := clientImpl.dialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	address := net.JoinHostPort(clientImpl.host, strconv.Itoa(int(clientImpl.port)))
+	if clientImpl.socketPath != "" {
+		log.Info().
+			Str("path", clientImpl.socketPath).
+			Msg("dialing server on Unix socket")
+		clientImpl.conn, err = dial(context.Background(), "unix", clientImpl.socketPath)
+	} else if clientImpl.tlsConfig != nil {
 		log.Info().
 			Str("address", address).
 			Msg("dialing (TLS) server")
-		clientImpl.conn, err = tls.Dial(
-			"tcp",
-			address,
-			clientImpl.tlsConfig,
-		)
+		clientImpl.conn, err = clientImpl.dialTLS(dial, address)
 	} else {
 		log.Info().
 			Str("address", address).
 			Msg("dialing server")
-		clientImpl.conn, err = net.Dial("tcp", address)
+		clientImpl.conn, err = dial(context.Background(), "tcp", address)
 	}
 	if err != nil {
 		return err
 	}
 	log.Info().Msg("connected")
+	clientImpl.lastHeard.Store(time.Now().UnixNano())
 
+	done := make(chan interface{})
 	go func(conn net.Conn) {
+		defer close(done)
 		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		// Decoded messages are handed to callbacks, only the frame buffer is
+		// reused.
+		var buffer []byte
 		for {
-			buffer := make([]byte, 257)
-			n, readErr := conn.Read(buffer)
+			frame, readErr := clientImpl.codec.ReadFrame(reader, buffer, protocol.MaxLockTagSize)
 			if readErr != nil {
 				if readErr == io.EOF {
 					log.Info().
@@ -96,8 +217,11 @@ func (clientImpl *clientImpl) Connect() (err error) {
 
 				break
 			}
+			clientImpl.lastHeard.Store(time.Now().UnixNano())
+			buffer = frame[:0]
 
-			clientMessage, decodeErr := protocol.DecodeClientMessage(buffer[:n])
+			clientMessage := &protocol.ClientMessage{}
+			decodeErr := clientImpl.codec.DecodeClientMessage(frame, clientMessage)
 			if decodeErr != nil {
 				log.Error().
 					Err(decodeErr).
@@ -108,6 +232,26 @@ func (clientImpl *clientImpl) Connect() (err error) {
 			switch clientMessage.Type {
 			case protocol.Acquired:
 				clientImpl.onAcquired(clientMessage.LockTag)
+			case protocol.Pong:
+				log.Debug().Msg("got pong")
+			case protocol.ShuttingDown:
+				log.Info().Msg("server is shutting down")
+				if clientImpl.onServerShuttingDown != nil {
+					clientImpl.onServerShuttingDown()
+				}
+			case protocol.BatchResult:
+				if clientImpl.onBatchResult != nil {
+					clientImpl.onBatchResult(clientMessage.Results)
+				}
+			case protocol.Event:
+				if clientImpl.onEvent != nil {
+					clientImpl.onEvent(clientMessage.LockTag, clientMessage.EventKind, clientMessage.Owner)
+				}
+			case protocol.Throttled:
+				log.Warn().Str("tag", clientMessage.LockTag).Msg("throttled by server")
+				if clientImpl.onThrottled != nil {
+					clientImpl.onThrottled(clientMessage.LockTag)
+				}
 			default:
 				log.Error().
 					Str("type", string(clientMessage.Type)).
@@ -116,9 +260,71 @@ func (clientImpl *clientImpl) Connect() (err error) {
 		}
 	}(clientImpl.conn)
 
+	if clientImpl.heartbeatInterval > 0 {
+		go clientImpl.heartbeat(clientImpl.conn, done)
+	}
+
 	return nil
 }
 
+// Dials the server and completes the TLS handshake, like tls.Dial does. The
+// server name defaults to the host.
+func (clientImpl *clientImpl) dialTLS(
+	dial func(ctx context.Context, network string, address string) (net.Conn, error),
+	address string,
+) (net.Conn, error) {
+	conn, err := dial(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	config := clientImpl.tlsConfig
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = clientImpl.host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Heartbeat loop, pings the server every heartbeat interval until the client
+// is closed or the connection's read loop exits. If nothing has been heard
+// from the server within the heartbeat timeout, the server is considered
+// unresponsive and the connection is closed.
+func (clientImpl *clientImpl) heartbeat(conn net.Conn, done chan interface{}) {
+	ticker := time.NewTicker(clientImpl.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-clientImpl.stop:
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		silence := time.Since(time.Unix(0, clientImpl.lastHeard.Load()))
+		if silence > clientImpl.heartbeatTimeout {
+			log.Error().
+				Dur("silence", silence).
+				Msg("server stopped answering heartbeats, closing connection")
+			if clientImpl.onServerUnresponsive != nil {
+				clientImpl.onServerUnresponsive()
+			}
+			conn.Close()
+			return
+		}
+
+		ping, _ := clientImpl.codec.AppendServerMessage(nil, &protocol.ServerMessage{Type: protocol.Ping})
+		if _, err := conn.Write(ping); err != nil {
+			log.Error().Err(err).Msg("failed to write ping")
+		}
+	}
+}
+
 // Close disconnects from the Locksmith instance.
 func (clientImpl *clientImpl) Close() {
 	close(clientImpl.stop)
@@ -127,23 +333,57 @@ func (clientImpl *clientImpl) Close() {
 
 // Acquire the given lock tag.
 // When the server responds, the onAcquired callback is called with the acquired lock tag.
+// An encoding error is returned, and nothing is sent, if the lock tag cannot be encoded.
 func (clientImpl *clientImpl) Acquire(lockTag string) error {
-	_, writeErr := clientImpl.conn.Write(
-		protocol.EncodeServerMessage(
-			&protocol.ServerMessage{Type: protocol.Acquire, LockTag: lockTag},
-		),
-	)
-
-	return writeErr
+	return clientImpl.send(&protocol.ServerMessage{Type: protocol.Acquire, LockTag: lockTag})
 }
 
 // Release the given lock tag.
+// An encoding error is returned, and nothing is sent, if the lock tag cannot be encoded.
 func (clientImpl *clientImpl) Release(lockTag string) error {
-	_, writeErr := clientImpl.conn.Write(
-		protocol.EncodeServerMessage(
-			&protocol.ServerMessage{Type: protocol.Release, LockTag: lockTag},
-		),
-	)
+	return clientImpl.send(&protocol.ServerMessage{Type: protocol.Release, LockTag: lockTag})
+}
+
+// TracedAcquire works like Acquire, sending a W3C traceparent along with the
+// acquire. Locksmith logs the acquire's timings with the trace ID, so slow
+// acquires can be told apart in traces. An error is returned, and nothing is
+// sent, if the trace parent is not valid.
+func (clientImpl *clientImpl) TracedAcquire(lockTag string, traceParent string) error {
+	return clientImpl.send(&protocol.ServerMessage{Type: protocol.Acquire, LockTag: lockTag, TraceParent: traceParent})
+}
+
+// TracedRelease works like Release, sending a W3C traceparent along with the
+// release.
+func (clientImpl *clientImpl) TracedRelease(lockTag string, traceParent string) error {
+	return clientImpl.send(&protocol.ServerMessage{Type: protocol.Release, LockTag: lockTag, TraceParent: traceParent})
+}
+
+// Batch sends several acquires and releases in a single frame. When all of
+// them have completed, the onBatchResult callback is called with their results.
+// Misbehaving operations in a batch are reported in the results rather than
+// getting the client disconnected.
+func (clientImpl *clientImpl) Batch(operations []protocol.Operation) error {
+	return clientImpl.send(&protocol.ServerMessage{Type: protocol.Batch, Operations: operations})
+}
+
+// Watch subscribes to events about the lock tag, or about every lock tag
+// starting with it if prefix is set. Events are passed to the onEvent
+// callback until the connection closes. The server drops events for clients
+// that do not keep up with them.
+func (clientImpl *clientImpl) Watch(lockTag string, prefix bool) error {
+	messageType := protocol.Watch
+	if prefix {
+		messageType = protocol.WatchPrefix
+	}
+	return clientImpl.send(&protocol.ServerMessage{Type: messageType, LockTag: lockTag})
+}
+
+func (clientImpl *clientImpl) send(serverMessage *protocol.ServerMessage) error {
+	bytes, encodeErr := clientImpl.codec.AppendServerMessage(nil, serverMessage)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	_, writeErr := clientImpl.conn.Write(bytes)
 
 	return writeErr
 }
@@ -10,14 +10,27 @@ import (
 	"testing"
 	"time"
 
+	"github.com/maansthoernvik/locksmith/pkg/conformance"
 	"github.com/maansthoernvik/locksmith/pkg/protocol"
 )
 
-func Test_ClientLifecycle(t *testing.T) {
-	listener, err := net.Listen("tcp", "localhost:30005")
+// Listens on a free port of localhost, for a stand-in server.
+func listenLocal(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		t.Fatal("Failed to start listener:", err)
 	}
+	return listener
+}
+
+// The port of a listener from listenLocal.
+func localPort(listener net.Listener) uint16 {
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func Test_ClientLifecycle(t *testing.T) {
+	listener := listenLocal(t)
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
@@ -44,9 +57,9 @@ func Test_ClientLifecycle(t *testing.T) {
 		}
 	}()
 
-	client := NewClient(&ClientOptions{Host: "localhost", Port: 30005})
+	client := NewClient(&ClientOptions{Host: "localhost", Port: localPort(listener)})
 	startErr := client.Connect()
-	if err != nil {
+	if startErr != nil {
 		t.Fatal("Failed to start client:", startErr)
 	}
 	client.Close()
@@ -57,10 +70,7 @@ func Test_ClientLifecycle(t *testing.T) {
 }
 
 func Test_ClientAcquireRelease(t *testing.T) {
-	listener, err := net.Listen("tcp", "localhost:30006")
-	if err != nil {
-		t.Fatal("Failed to start listener:", err)
-	}
+	listener := listenLocal(t)
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
@@ -99,9 +109,9 @@ func Test_ClientAcquireRelease(t *testing.T) {
 		}
 	}()
 
-	client := NewClient(&ClientOptions{Host: "localhost", Port: 30006})
+	client := NewClient(&ClientOptions{Host: "localhost", Port: localPort(listener)})
 	startErr := client.Connect()
-	if err != nil {
+	if startErr != nil {
 		t.Fatal("Failed to start client:", startErr)
 	}
 	_ = client.Acquire("123")
@@ -117,10 +127,7 @@ func Test_ClientAcquireRelease(t *testing.T) {
 func Test_ClientOnAcquired(t *testing.T) {
 	EXPECTED_LOCK_TAG := "locktag"
 
-	listener, err := net.Listen("tcp", "localhost:30007")
-	if err != nil {
-		t.Fatal("Failed to start listener:", err)
-	}
+	listener := listenLocal(t)
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
@@ -152,9 +159,10 @@ func Test_ClientOnAcquired(t *testing.T) {
 					t.Log("Acquire received")
 					wg.Done()
 
-					_, err := conn.Write(protocol.EncodeClientMessage(
+					acquired, _ := protocol.EncodeClientMessage(
 						&protocol.ClientMessage{Type: protocol.Acquired, LockTag: serverMessage.LockTag},
-					))
+					)
+					_, err := conn.Write(acquired)
 					if err != nil {
 						t.Error("Got error on write:", err)
 					}
@@ -163,14 +171,14 @@ func Test_ClientOnAcquired(t *testing.T) {
 		}
 	}()
 
-	client := NewClient(&ClientOptions{Host: "localhost", Port: 30007, OnAcquired: func(lockTag string) {
+	client := NewClient(&ClientOptions{Host: "localhost", Port: localPort(listener), OnAcquired: func(lockTag string) {
 		if lockTag == EXPECTED_LOCK_TAG {
 			t.Log("OnAcquired called")
 			wg.Done()
 		}
 	}})
 	startErr := client.Connect()
-	if err != nil {
+	if startErr != nil {
 		t.Fatal("Failed to start client:", startErr)
 	}
 	_ = client.Acquire(EXPECTED_LOCK_TAG)
@@ -180,6 +188,43 @@ func Test_ClientOnAcquired(t *testing.T) {
 	listener.Close()
 }
 
+func Test_ClientServerUnresponsive(t *testing.T) {
+	listener := listenLocal(t)
+	defer listener.Close()
+
+	// The server reads pings but never answers them.
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	unresponsive := make(chan interface{})
+	client := NewClient(&ClientOptions{
+		Host:              "localhost",
+		Port:              localPort(listener),
+		HeartbeatInterval: 10 * time.Millisecond,
+		HeartbeatTimeout:  50 * time.Millisecond,
+		OnServerUnresponsive: func() {
+			t.Log("OnServerUnresponsive called")
+			close(unresponsive)
+		},
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatal("Failed to start client:", err)
+	}
+	defer client.Close()
+
+	select {
+	case <-unresponsive:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Client did not detect the unresponsive server")
+	}
+}
+
 func Test_MutualTls(t *testing.T) {
 	cert, err := tls.LoadX509KeyPair("testcerts/testcert.pem", "testcerts/testkey.key")
 	if err != nil {
@@ -201,10 +246,7 @@ func Test_MutualTls(t *testing.T) {
 	}
 
 	t.Log("Creating listener")
-	listener, err := tls.Listen("tcp", "localhost:30008", tlsConfig)
-	if err != nil {
-		t.Fatal(err)
-	}
+	listener := tls.NewListener(listenLocal(t), tlsConfig)
 
 	// Lifecycle wait group for client/listener tests.
 	wg := sync.WaitGroup{}
@@ -231,13 +273,14 @@ func Test_MutualTls(t *testing.T) {
 					wg.Done()
 				}
 
-				//nolint
-				conn.Write(protocol.EncodeClientMessage(
+				acquired, _ := protocol.EncodeClientMessage(
 					&protocol.ClientMessage{
 						Type:    protocol.Acquired,
 						LockTag: "abc",
 					},
-				))
+				)
+				//nolint
+				conn.Write(acquired)
 
 				wg.Done()
 			}(conn)
@@ -254,7 +297,7 @@ func Test_MutualTls(t *testing.T) {
 	t.Log("Creating client")
 	c := &clientImpl{
 		host: "localhost",
-		port: 30008,
+		port: localPort(listener),
 		onAcquired: func(lockTag string) {
 			t.Log("Client got acquired signal for lock tag:", lockTag)
 			wg.Done()
@@ -289,3 +332,29 @@ func Test_MutualTls(t *testing.T) {
 	t.Log("waiting for listener to exit accept loop")
 	shutdownWg.Wait()
 }
+
+// Adapts the sample client for the conformance scenarios.
+type conformanceAdapter struct{}
+
+func (conformanceAdapter) Connect(
+	host string,
+	port uint16,
+	onAcquired func(lockTag string),
+) (conformance.Client, error) {
+	client := NewClient(&ClientOptions{Host: host, Port: port, OnAcquired: onAcquired})
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func Test_Conformance(t *testing.T) {
+	report, err := conformance.Run(conformanceAdapter{}, &conformance.Options{Listener: listenLocal(t)})
+	if err != nil {
+		t.Fatal("Failed to run conformance scenarios:", err)
+	}
+	t.Log("\n" + report.String())
+	for _, result := range report.Failed() {
+		t.Errorf("Scenario %s failed: %v", result.Scenario, result.Err)
+	}
+}
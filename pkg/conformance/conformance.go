@@ -0,0 +1,351 @@
+// Package conformance checks Locksmith client implementations against the
+// behavior of a Locksmith server.
+//
+// Run starts an in-process Locksmith and plays a number of scripted scenarios
+// against it, using an Adapter to create and drive clients. Each scenario
+// checks one aspect of talking to Locksmith: the order locks are granted in,
+// how misbehaving clients are handled, cleanup after disconnects, pipelined
+// messages and lock tags in either frame version. The returned Report tells
+// which scenarios passed.
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	locksmith "github.com/maansthoernvik/locksmith/pkg"
+	"github.com/maansthoernvik/locksmith/pkg/vault"
+)
+
+// Defaults used when Options leave fields unset.
+const (
+	DefaultPort    uint16 = 9100
+	DefaultTimeout        = 2 * time.Second
+	DefaultSettle         = 20 * time.Millisecond
+)
+
+// Client is the part of a client implementation the scenarios drive.
+type Client interface {
+	// Acquire sends an acquire for the lock tag. It must not wait for the lock
+	// to be granted, grants are reported to the callback given to
+	// Adapter.Connect.
+	Acquire(lockTag string) error
+	// Release sends a release for the lock tag.
+	Release(lockTag string) error
+	// Close disconnects from Locksmith. It is called once per client.
+	Close()
+}
+
+// Adapter creates connected clients for the scenarios.
+type Adapter interface {
+	// Connect returns a client connected to the Locksmith listening on host
+	// and port. The client is to call onAcquired with the lock tag of every
+	// Acquired message it receives.
+	Connect(host string, port uint16, onAcquired func(lockTag string)) (Client, error)
+}
+
+// Options to provide to Run.
+type Options struct {
+	// The port the in-process Locksmith listens on. Defaults to DefaultPort.
+	Port uint16
+	// A TCP listener for the in-process Locksmith to accept connections from,
+	// in place of listening on Port, such as one listening on a port picked
+	// by the system. Adapters are given its address to connect to.
+	Listener net.Listener
+	// How long to wait for an expected lock grant before failing a scenario.
+	// Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// How long to give messages to reach the server where the order of
+	// messages from different clients matters, and how long to wait before
+	// concluding that a lock will not be granted. Defaults to DefaultSettle.
+	Settle time.Duration
+}
+
+// Result of a single scenario.
+type Result struct {
+	Scenario    string
+	Description string
+	// Why the scenario failed, nil if it passed.
+	Err error
+}
+
+// Passed tells if the scenario passed.
+func (result Result) Passed() bool {
+	return result.Err == nil
+}
+
+// Report holds the results of all scenarios, in the order they were run.
+type Report struct {
+	Results []Result
+}
+
+// Passed tells if every scenario passed.
+func (report *Report) Passed() bool {
+	for _, result := range report.Results {
+		if !result.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed returns the results of the scenarios that failed.
+func (report *Report) Failed() []Result {
+	var failed []Result
+	for _, result := range report.Results {
+		if !result.Passed() {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// String lists every scenario with its outcome, one per line.
+func (report *Report) String() string {
+	builder := strings.Builder{}
+	for _, result := range report.Results {
+		if result.Passed() {
+			fmt.Fprintf(&builder, "PASS %s: %s\n", result.Scenario, result.Description)
+		} else {
+			fmt.Fprintf(&builder, "FAIL %s: %s: %v\n", result.Scenario, result.Description, result.Err)
+		}
+	}
+	return builder.String()
+}
+
+// Run starts a Locksmith on localhost, plays every scenario against clients
+// created by the adapter, and stops the Locksmith again. An error is only
+// returned if the Locksmith could not be started, failing scenarios are
+// reported in the Report.
+func Run(adapter Adapter, options *Options) (*Report, error) {
+	r := &runner{
+		adapter: adapter,
+		host:    "localhost",
+		port:    options.Port,
+		timeout: options.Timeout,
+		settle:  options.Settle,
+	}
+	if options.Listener != nil {
+		host, port, err := net.SplitHostPort(options.Listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		number, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		r.host, r.port = host, uint16(number)
+	}
+	if r.port == 0 {
+		r.port = DefaultPort
+	}
+	if r.timeout <= 0 {
+		r.timeout = DefaultTimeout
+	}
+	if r.settle <= 0 {
+		r.settle = DefaultSettle
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := locksmith.New(&locksmith.LocksmithOptions{
+		Port:             r.port,
+		Listener:         options.Listener,
+		QueueType:        vault.Multi,
+		QueueConcurrency: 10,
+		QueueCapacity:    100,
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	if err := r.awaitServer(stopped); err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	for _, scenario := range scenarios {
+		report.Results = append(report.Results, Result{
+			Scenario:    scenario.name,
+			Description: scenario.description,
+			Err:         r.run(scenario),
+		})
+	}
+
+	return report, nil
+}
+
+// Drives clients through a scenario, keeping track of them so they can all
+// be closed once the scenario is over.
+type runner struct {
+	adapter Adapter
+	host    string
+	port    uint16
+	timeout time.Duration
+	settle  time.Duration
+	clients []*client
+}
+
+// Dials the server until it accepts connections, or gives up after the
+// timeout.
+func (r *runner) awaitServer(stopped chan error) error {
+	address := net.JoinHostPort(r.host, strconv.Itoa(int(r.port)))
+	deadline := time.Now().Add(r.timeout)
+	for {
+		select {
+		case err := <-stopped:
+			if err == nil {
+				err = errors.New("locksmith stopped")
+			}
+			return err
+		default:
+		}
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (r *runner) run(scenario scenario) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("client panicked: %v", recovered)
+		}
+		for _, client := range r.clients {
+			client.close()
+		}
+		r.clients = nil
+	}()
+
+	return scenario.run(r)
+}
+
+// Connects a new client, named for error messages.
+func (r *runner) connect(name string) (*client, error) {
+	c := &client{name: name, acquired: make(chan string, 1024)}
+	adapted, err := r.adapter.Connect(r.host, r.port, func(lockTag string) {
+		c.acquired <- lockTag
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect %s client: %w", name, err)
+	}
+	c.Client = adapted
+	r.clients = append(r.clients, c)
+
+	return c, nil
+}
+
+// Connects several clients at once.
+func (r *runner) connectAll(names ...string) ([]*client, error) {
+	clients := make([]*client, len(names))
+	for i, name := range names {
+		c, err := r.connect(name)
+		if err != nil {
+			return nil, err
+		}
+		clients[i] = c
+	}
+	return clients, nil
+}
+
+// Gives messages already sent time to reach the server.
+func (r *runner) pause() {
+	time.Sleep(r.settle)
+}
+
+// A client along with the lock tags it has been granted.
+type client struct {
+	Client
+	name     string
+	acquired chan string
+	closed   bool
+}
+
+func (c *client) acquire(lockTag string) error {
+	if err := c.Acquire(lockTag); err != nil {
+		return fmt.Errorf("%s client failed to acquire %s: %w", c.name, describe(lockTag), err)
+	}
+	return nil
+}
+
+func (c *client) release(lockTag string) error {
+	if err := c.Release(lockTag); err != nil {
+		return fmt.Errorf("%s client failed to release %s: %w", c.name, describe(lockTag), err)
+	}
+	return nil
+}
+
+func (c *client) close() {
+	if !c.closed {
+		c.closed = true
+		c.Close()
+	}
+}
+
+// Waits for the next grant, which has to be for the lock tag.
+func (c *client) expect(r *runner, lockTag string) error {
+	select {
+	case got := <-c.acquired:
+		if got != lockTag {
+			return fmt.Errorf("%s client expected %s to be granted, got %s",
+				c.name, describe(lockTag), describe(got))
+		}
+		return nil
+	case <-time.After(r.timeout):
+		return fmt.Errorf("%s client was never granted %s", c.name, describe(lockTag))
+	}
+}
+
+// Waits for grants of all the lock tags, in any order.
+func (c *client) expectAll(r *runner, lockTags []string) error {
+	remaining := make(map[string]int, len(lockTags))
+	for _, lockTag := range lockTags {
+		remaining[lockTag]++
+	}
+	timeout := time.After(r.timeout)
+	for range lockTags {
+		select {
+		case got := <-c.acquired:
+			if remaining[got] == 0 {
+				return fmt.Errorf("%s client was unexpectedly granted %s", c.name, describe(got))
+			}
+			remaining[got]--
+		case <-timeout:
+			return fmt.Errorf("%s client was not granted all of %d lock tags in time",
+				c.name, len(lockTags))
+		}
+	}
+	return nil
+}
+
+// Makes sure no grant arrives within the settle time.
+func (c *client) expectNothing(r *runner) error {
+	select {
+	case got := <-c.acquired:
+		return fmt.Errorf("%s client was unexpectedly granted %s", c.name, describe(got))
+	case <-time.After(r.settle):
+		return nil
+	}
+}
+
+// Shortens long lock tags for error messages.
+func describe(lockTag string) string {
+	if len(lockTag) > 32 {
+		return fmt.Sprintf("%q... (%d bytes)", lockTag[:32], len(lockTag))
+	}
+	return strconv.Quote(lockTag)
+}
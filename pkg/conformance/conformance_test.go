@@ -0,0 +1,86 @@
+package conformance
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maansthoernvik/locksmith/pkg/protocol"
+)
+
+// A bare-bones client which cuts lock tags short to fit legacy frames.
+type truncatingClient struct {
+	conn net.Conn
+}
+
+func (client *truncatingClient) Acquire(lockTag string) error {
+	return client.send(protocol.Acquire, lockTag)
+}
+
+func (client *truncatingClient) Release(lockTag string) error {
+	return client.send(protocol.Release, lockTag)
+}
+
+func (client *truncatingClient) Close() {
+	client.conn.Close()
+}
+
+func (client *truncatingClient) send(messageType protocol.ServerMessageType, lockTag string) error {
+	if len(lockTag) > protocol.LegacyMaxLockTagSize {
+		lockTag = lockTag[:protocol.LegacyMaxLockTagSize]
+	}
+	frame, err := protocol.EncodeServerMessage(&protocol.ServerMessage{Type: messageType, LockTag: lockTag})
+	if err != nil {
+		return err
+	}
+	_, err = client.conn.Write(frame)
+	return err
+}
+
+type truncatingAdapter struct{}
+
+func (truncatingAdapter) Connect(host string, port uint16, onAcquired func(string)) (Client, error) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			frame, err := protocol.ReadFrame(reader, protocol.MaxLockTagSize)
+			if err != nil {
+				return
+			}
+			message, err := protocol.DecodeClientMessage(frame)
+			if err == nil && message.Type == protocol.Acquired {
+				onAcquired(message.LockTag)
+			}
+		}
+	}()
+	return &truncatingClient{conn: conn}, nil
+}
+
+func TestConformance_ReportsFailures(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	report, err := Run(truncatingAdapter{}, &Options{Listener: listener, Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to run conformance scenarios:", err)
+	}
+	t.Log("\n" + report.String())
+
+	if report.Passed() {
+		t.Fatal("Expected the truncating client to fail")
+	}
+	failed := report.Failed()
+	if len(failed) != 1 || failed[0].Scenario != "framing" {
+		t.Fatal("Expected only the framing scenario to fail, got:", failed)
+	}
+	if len(report.Results) != len(scenarios) {
+		t.Fatal("Expected a result per scenario, got:", len(report.Results))
+	}
+}
@@ -0,0 +1,373 @@
+package conformance
+
+import (
+	"fmt"
+	"strings"
+)
+
+type scenario struct {
+	name        string
+	description string
+	run         func(r *runner) error
+}
+
+// Scenarios in the order they are run. Lock tags are prefixed with the
+// scenario's name, so that scenarios do not interfere with each other.
+var scenarios = []scenario{
+	{
+		name:        "grant-order",
+		description: "waiting clients are granted a lock in the order they asked for it",
+		run:         grantOrder,
+	},
+	{
+		name:        "reacquire",
+		description: "a released lock can be acquired again by the same client",
+		run:         reacquire,
+	},
+	{
+		name:        "misbehavior-double-acquire",
+		description: "a client acquiring a lock it holds is disconnected and loses its locks",
+		run:         misbehaviorDoubleAcquire,
+	},
+	{
+		name:        "misbehavior-unnecessary-release",
+		description: "a client releasing a lock nobody holds is disconnected and loses its locks",
+		run:         misbehaviorUnnecessaryRelease,
+	},
+	{
+		name:        "misbehavior-foreign-release",
+		description: "a client releasing another client's lock is disconnected without releasing it",
+		run:         misbehaviorForeignRelease,
+	},
+	{
+		name:        "disconnect-holder",
+		description: "locks held by a disconnecting client are granted to waiting clients",
+		run:         disconnectHolder,
+	},
+	{
+		name:        "disconnect-waiter",
+		description: "a disconnecting client stops waiting for locks",
+		run:         disconnectWaiter,
+	},
+	{
+		name:        "pipelining",
+		description: "messages sent back to back without awaiting grants are all handled",
+		run:         pipelining,
+	},
+	{
+		name:        "framing",
+		description: "lock tags of every size and encoding survive both frame versions",
+		run:         framing,
+	},
+}
+
+func grantOrder(r *runner) error {
+	lockTag := "grant-order"
+	clients, err := r.connectAll("holder", "first", "second", "third")
+	if err != nil {
+		return err
+	}
+	holder, waiters := clients[0], clients[1:]
+
+	if err := holder.acquire(lockTag); err != nil {
+		return err
+	}
+	if err := holder.expect(r, lockTag); err != nil {
+		return err
+	}
+	for _, waiter := range waiters {
+		if err := waiter.acquire(lockTag); err != nil {
+			return err
+		}
+		r.pause()
+	}
+
+	previous := holder
+	for _, waiter := range waiters {
+		if err := previous.release(lockTag); err != nil {
+			return err
+		}
+		if err := waiter.expect(r, lockTag); err != nil {
+			return err
+		}
+		for _, other := range waiters {
+			if other == waiter {
+				continue
+			}
+			if err := other.expectNothing(r); err != nil {
+				return err
+			}
+		}
+		previous = waiter
+	}
+
+	return previous.release(lockTag)
+}
+
+func reacquire(r *runner) error {
+	lockTag := "reacquire"
+	c, err := r.connect("only")
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.acquire(lockTag); err != nil {
+			return err
+		}
+		if err := c.expect(r, lockTag); err != nil {
+			return err
+		}
+		if err := c.release(lockTag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Has the misbehaving client hold a lock another client waits for, then runs
+// misbehave and checks that the waiting client is granted the lock because
+// the misbehaving client was disconnected.
+func misbehaviorReleasesLocks(r *runner, lockTag string, misbehave func(*client) error) error {
+	clients, err := r.connectAll("misbehaving", "waiting")
+	if err != nil {
+		return err
+	}
+	misbehaving, waiting := clients[0], clients[1]
+
+	if err := misbehaving.acquire(lockTag); err != nil {
+		return err
+	}
+	if err := misbehaving.expect(r, lockTag); err != nil {
+		return err
+	}
+	if err := waiting.acquire(lockTag); err != nil {
+		return err
+	}
+	r.pause()
+	if err := waiting.expectNothing(r); err != nil {
+		return err
+	}
+
+	if err := misbehave(misbehaving); err != nil {
+		return err
+	}
+	if err := waiting.expect(r, lockTag); err != nil {
+		return fmt.Errorf("misbehaving client kept its lock: %w", err)
+	}
+	if err := misbehaving.expectNothing(r); err != nil {
+		return err
+	}
+
+	return waiting.release(lockTag)
+}
+
+func misbehaviorDoubleAcquire(r *runner) error {
+	lockTag := "misbehavior-double-acquire"
+	return misbehaviorReleasesLocks(r, lockTag, func(misbehaving *client) error {
+		return misbehaving.acquire(lockTag)
+	})
+}
+
+func misbehaviorUnnecessaryRelease(r *runner) error {
+	return misbehaviorReleasesLocks(r, "misbehavior-unnecessary-release", func(misbehaving *client) error {
+		return misbehaving.release("misbehavior-unnecessary-release/unlocked")
+	})
+}
+
+func misbehaviorForeignRelease(r *runner) error {
+	lockTag := "misbehavior-foreign-release"
+	clients, err := r.connectAll("holder", "misbehaving", "waiting")
+	if err != nil {
+		return err
+	}
+	holder, misbehaving, waiting := clients[0], clients[1], clients[2]
+
+	if err := holder.acquire(lockTag); err != nil {
+		return err
+	}
+	if err := holder.expect(r, lockTag); err != nil {
+		return err
+	}
+	if err := misbehaving.release(lockTag); err != nil {
+		return err
+	}
+	r.pause()
+
+	if err := waiting.acquire(lockTag); err != nil {
+		return err
+	}
+	r.pause()
+	if err := waiting.expectNothing(r); err != nil {
+		return fmt.Errorf("foreign release released the lock: %w", err)
+	}
+	if err := holder.release(lockTag); err != nil {
+		return err
+	}
+	if err := waiting.expect(r, lockTag); err != nil {
+		return err
+	}
+
+	return waiting.release(lockTag)
+}
+
+func disconnectHolder(r *runner) error {
+	lockTag := "disconnect-holder"
+	clients, err := r.connectAll("holder", "waiting")
+	if err != nil {
+		return err
+	}
+	holder, waiting := clients[0], clients[1]
+
+	if err := holder.acquire(lockTag); err != nil {
+		return err
+	}
+	if err := holder.expect(r, lockTag); err != nil {
+		return err
+	}
+	if err := waiting.acquire(lockTag); err != nil {
+		return err
+	}
+	r.pause()
+
+	holder.close()
+	if err := waiting.expect(r, lockTag); err != nil {
+		return err
+	}
+
+	return waiting.release(lockTag)
+}
+
+func disconnectWaiter(r *runner) error {
+	lockTag := "disconnect-waiter"
+	clients, err := r.connectAll("holder", "disconnecting", "waiting")
+	if err != nil {
+		return err
+	}
+	holder, disconnecting, waiting := clients[0], clients[1], clients[2]
+
+	if err := holder.acquire(lockTag); err != nil {
+		return err
+	}
+	if err := holder.expect(r, lockTag); err != nil {
+		return err
+	}
+	if err := disconnecting.acquire(lockTag); err != nil {
+		return err
+	}
+	r.pause()
+	if err := waiting.acquire(lockTag); err != nil {
+		return err
+	}
+	r.pause()
+
+	disconnecting.close()
+	r.pause()
+	if err := holder.release(lockTag); err != nil {
+		return err
+	}
+	if err := waiting.expect(r, lockTag); err != nil {
+		return fmt.Errorf("lock was not passed on past the disconnected client: %w", err)
+	}
+
+	return waiting.release(lockTag)
+}
+
+func pipelining(r *runner) error {
+	clients, err := r.connectAll("first", "second")
+	if err != nil {
+		return err
+	}
+	first, second := clients[0], clients[1]
+
+	lockTags := make([]string, 100)
+	for i := range lockTags {
+		lockTags[i] = fmt.Sprintf("pipelining/%d", i)
+	}
+
+	for _, lockTag := range lockTags {
+		if err := first.acquire(lockTag); err != nil {
+			return err
+		}
+	}
+	if err := first.expectAll(r, lockTags); err != nil {
+		return err
+	}
+
+	// The second client queues up for every lock, and gets them as the first
+	// client releases them all at once.
+	for _, lockTag := range lockTags {
+		if err := second.acquire(lockTag); err != nil {
+			return err
+		}
+	}
+	r.pause()
+	for _, lockTag := range lockTags {
+		if err := first.release(lockTag); err != nil {
+			return err
+		}
+	}
+	if err := second.expectAll(r, lockTags); err != nil {
+		return err
+	}
+
+	// Acquiring and releasing in the same breath works out as well.
+	lockTag := lockTags[0]
+	if err := second.release(lockTag); err != nil {
+		return err
+	}
+	if err := second.acquire(lockTag); err != nil {
+		return err
+	}
+	if err := second.release(lockTag); err != nil {
+		return err
+	}
+	if err := second.acquire(lockTag); err != nil {
+		return err
+	}
+	return second.expectAll(r, []string{lockTag, lockTag})
+}
+
+func framing(r *runner) error {
+	c, err := r.connect("only")
+	if err != nil {
+		return err
+	}
+
+	// Lock tags up to 255 bytes fit legacy frames, longer ones need versioned
+	// frames. They are pipelined, mixing both frame versions on the wire.
+	lockTags := []string{
+		"f",
+		"framing/unicode/läås/🔒",
+		paddedLockTag("framing/legacy-max/", 255),
+		paddedLockTag("framing/versioned-min/", 256),
+		paddedLockTag("framing/versioned/", 4096),
+		paddedLockTag("framing/versioned-max/", 65535),
+		"framing/after-versioned",
+	}
+	for _, lockTag := range lockTags {
+		if err := c.acquire(lockTag); err != nil {
+			return err
+		}
+	}
+	if err := c.expectAll(r, lockTags); err != nil {
+		return err
+	}
+	for _, lockTag := range lockTags {
+		if err := c.release(lockTag); err != nil {
+			return err
+		}
+	}
+
+	// Released locks are really released, so they can be acquired again.
+	for _, lockTag := range lockTags {
+		if err := c.acquire(lockTag); err != nil {
+			return err
+		}
+	}
+	return c.expectAll(r, lockTags)
+}
+
+// Pads the prefix to exactly size bytes.
+func paddedLockTag(prefix string, size int) string {
+	return prefix + strings.Repeat("x", size-len(prefix))
+}
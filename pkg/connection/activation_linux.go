@@ -0,0 +1,73 @@
+package connection
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The first file descriptor passed by systemd, following stdin, stdout and
+// stderr.
+const listenFDsStart = 3
+
+// ActivationListeners returns the listening sockets passed by systemd socket
+// activation, by the names given to them with FileDescriptorName=, for
+// adopting them through the acceptor options' File. Sockets without a name
+// are named after their socket unit, or "unknown". Nil is returned if the
+// process was not socket activated. The activation environment variables
+// are unset, so that they are not passed on to child processes.
+func ActivationListeners() (map[string]*os.File, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return activationListeners(os.Getenv, listenFDsStart)
+}
+
+// Reads the activation environment through getenv, with the sockets passed
+// from file descriptor start onwards.
+func activationListeners(getenv func(string) string, start int) (map[string]*os.File, error) {
+	if getenv("LISTEN_PID") == "" {
+		return nil, nil
+	}
+	pid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_PID: %w", ErrActivation)
+	}
+	// The sockets were meant for another process.
+	if pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("LISTEN_FDS: %w", ErrActivation)
+	}
+	var names []string
+	if fdNames := getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+		if len(names) != count {
+			return nil, fmt.Errorf("LISTEN_FDNAMES does not name %d sockets: %w", count, ErrActivation)
+		}
+	}
+
+	files := make(map[string]*os.File, count)
+	for i := 0; i < count; i++ {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if names != nil {
+			name = names[i]
+		}
+		if _, ok := files[name]; ok {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, fmt.Errorf("more than one socket named %q: %w", name, ErrActivation)
+		}
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+	return files, nil
+}
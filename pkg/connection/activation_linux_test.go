@@ -0,0 +1,95 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestActivationListeners(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	copied, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal("Failed to copy listener:", err)
+	}
+	// The bare descriptor stands in for the socket inherited from systemd.
+	inherited, err := syscall.Dup(int(copied.Fd()))
+	if err != nil {
+		t.Fatal("Failed to duplicate listener:", err)
+	}
+	copied.Close()
+	address := listener.Addr().String()
+	listener.Close()
+
+	env := map[string]string{
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "binary",
+	}
+	files, err := activationListeners(func(key string) string { return env[key] }, inherited)
+	if err != nil {
+		t.Fatal("Failed to read activation environment:", err)
+	}
+	file, ok := files["binary"]
+	if !ok || len(files) != 1 {
+		t.Fatal("Unexpected activated sockets:", files)
+	}
+	handled := make(chan net.Addr, 1)
+	tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
+		Handler: func(conn net.Conn) {
+			handled <- conn.LocalAddr()
+		},
+		File: file,
+	})
+	if err := tcpAcceptor.Start(); err != nil {
+		t.Fatal("Failed to start acceptor:", err)
+	}
+	defer tcpAcceptor.Stop()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal("Failed to dial activated socket:", err)
+	}
+	defer conn.Close()
+	select {
+	case addr := <-handled:
+		if addr.String() != address {
+			t.Fatal("Unexpected local address:", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Connection was not handled")
+	}
+}
+
+func TestActivationListeners_Environment(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name string
+		env  map[string]string
+		err  error
+	}{
+		{"not activated", map[string]string{}, nil},
+		{"other process", map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}, nil},
+		{"invalid pid", map[string]string{"LISTEN_PID": "x", "LISTEN_FDS": "1"}, ErrActivation},
+		{"invalid count", map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "-1"}, ErrActivation},
+		{"names mismatch", map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "0", "LISTEN_FDNAMES": "binary"}, ErrActivation},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := activationListeners(func(key string) string { return test.env[key] }, listenFDsStart)
+			if !errors.Is(err, test.err) {
+				t.Fatal("Unexpected error:", err)
+			}
+			if len(files) != 0 {
+				t.Fatal("Unexpected activated sockets:", files)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package connection
+
+import "os"
+
+// Socket activation is a systemd feature, elsewhere processes are never
+// socket activated.
+func ActivationListeners() (map[string]*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,217 @@
+package connection
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var certExpiryGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "locksmith_tls_cert_expiry_timestamp_seconds",
+	Help: "When the certificates currently in use expire, in seconds since the epoch, the earliest expiry for the client CA pool",
+}, []string{"cert"})
+
+// Certificates as labeled in the expiry metric.
+const (
+	CertServer   = "server"
+	CertClientCA = "client_ca"
+)
+
+var ErrNoClientCACerts = errors.New("no certificates found in client CA file")
+
+type CertReloaderOptions struct {
+	// Paths to the PEM encoded server certificate and private key.
+	CertPath string
+	KeyPath  string
+	// Path to the PEM encoded client CA certificates, clients are required
+	// to present a certificate signed by one of them. Empty disables client
+	// certificate verification.
+	ClientCAPath string
+	// How often to check the files for changes. Zero disables checking,
+	// leaving reloads to calls to Reload.
+	PollInterval time.Duration
+}
+
+// CertReloader keeps the server certificate and client CA pool of a TLS
+// configuration up to date with the files they were loaded from. Each TLS
+// handshake picks up the certificates current at the time, so connections
+// established before a reload keep going with the certificates they started
+// out with.
+type CertReloader struct {
+	certPath     string
+	keyPath      string
+	clientCAPath string
+	pollInterval time.Duration
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+// NewCertReloader loads the certificates, returning an error if they cannot
+// be loaded.
+func NewCertReloader(options *CertReloaderOptions) (*CertReloader, error) {
+	reloader := &CertReloader{
+		certPath:     options.CertPath,
+		keyPath:      options.KeyPath,
+		clientCAPath: options.ClientCAPath,
+		pollInterval: options.PollInterval,
+	}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// TlsConfig returns a TLS configuration serving the current certificates.
+func (reloader *CertReloader) TlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			reloader.mutex.RLock()
+			defer reloader.mutex.RUnlock()
+			config := &tls.Config{Certificates: []tls.Certificate{*reloader.cert}}
+			if reloader.clientCA != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = reloader.clientCA
+			}
+			return config, nil
+		},
+	}
+}
+
+// Reload loads the certificates from disk. Should loading fail, the
+// certificates in use are kept and the error returned.
+func (reloader *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(reloader.certPath, reloader.keyPath)
+	if err != nil {
+		return err
+	}
+	// Loading does not keep the parsed leaf before Go 1.23.
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+
+	var clientCA *x509.CertPool
+	var clientCAExpiry time.Time
+	if reloader.clientCAPath != "" {
+		if clientCA, clientCAExpiry, err = loadCertPool(reloader.clientCAPath); err != nil {
+			return err
+		}
+	}
+
+	reloader.mutex.Lock()
+	rotated := reloader.cert != nil
+	reloader.cert = &cert
+	reloader.clientCA = clientCA
+	reloader.mutex.Unlock()
+
+	certExpiryGauge.WithLabelValues(CertServer).Set(float64(cert.Leaf.NotAfter.Unix()))
+	event := log.Info().
+		Str("subject", cert.Leaf.Subject.String()).
+		Time("expires", cert.Leaf.NotAfter)
+	if clientCA != nil {
+		certExpiryGauge.WithLabelValues(CertClientCA).Set(float64(clientCAExpiry.Unix()))
+		event = event.Time("client_ca_expires", clientCAExpiry)
+	}
+	if rotated {
+		event.Msg("reloaded TLS certificates")
+	} else {
+		event.Msg("loaded TLS certificates")
+	}
+
+	return nil
+}
+
+// Watch checks the files for changes every poll interval, reloading the
+// certificates when they have changed, until the context is cancelled.
+// Returns right away if the poll interval is zero.
+func (reloader *CertReloader) Watch(ctx context.Context) {
+	if reloader.pollInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(reloader.pollInterval)
+	defer ticker.Stop()
+
+	previous := reloader.fileStates()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := reloader.fileStates()
+		if current == previous {
+			continue
+		}
+		// Certificate and key may be replaced one after the other, a failed
+		// reload is retried on the next change.
+		if err := reloader.Reload(); err != nil {
+			log.Error().Err(err).Msg("failed to reload TLS certificates, keeping the current ones")
+		}
+		previous = current
+	}
+}
+
+type fileState struct {
+	modified time.Time
+	size     int64
+}
+
+// Returns the modification time and size of each file, following symbolic
+// links, as swapped by Kubernetes when updating mounted secrets.
+func (reloader *CertReloader) fileStates() [3]fileState {
+	states := [3]fileState{}
+	for i, path := range []string{reloader.certPath, reloader.keyPath, reloader.clientCAPath} {
+		if info, err := os.Stat(path); err == nil {
+			states[i] = fileState{info.ModTime(), info.Size()}
+		}
+	}
+	return states
+}
+
+// Loads the PEM encoded certificates of a file into a pool, also returning
+// the earliest expiry among them.
+func loadCertPool(path string) (*x509.CertPool, time.Time, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	pool := x509.NewCertPool()
+	var expiry time.Time
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		pool.AddCert(cert)
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+	if expiry.IsZero() {
+		return nil, time.Time{}, ErrNoClientCACerts
+	}
+
+	return pool, expiry, nil
+}
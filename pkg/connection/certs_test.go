@@ -0,0 +1,220 @@
+package connection
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCertReloader_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	firstExpiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	writeTestCert(t, certPath, keyPath, "first", firstExpiry)
+
+	reloader, err := NewCertReloader(&CertReloaderOptions{
+		CertPath:     certPath,
+		KeyPath:      keyPath,
+		PollInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Failed to load certificates:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx)
+	if expiry := certExpiry(t, CertServer); expiry != float64(firstExpiry.Unix()) {
+		t.Fatal("Unexpected expiry:", expiry)
+	}
+
+	listener := listenLocal(t)
+	tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
+		Handler: func(conn net.Conn) {
+			_, _ = io.Copy(conn, conn)
+		},
+		Listener:  listener,
+		TlsConfig: reloader.TlsConfig(),
+	})
+	if err := tcpAcceptor.Start(); err != nil {
+		t.Fatal("Failed to start TCP acceptor:", err)
+	}
+	defer tcpAcceptor.Stop()
+
+	first := dialTestServer(t, listener.Addr().String(), "first")
+	defer first.Close()
+
+	secondExpiry := firstExpiry.Add(time.Hour)
+	writeTestCert(t, certPath, keyPath, "second", secondExpiry)
+	deadline := time.Now().Add(1 * time.Second)
+	for certExpiry(t, CertServer) != float64(secondExpiry.Unix()) {
+		if time.Now().After(deadline) {
+			t.Fatal("Certificates were not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// New connections get the new certificate, existing ones keep going.
+	second := dialTestServer(t, listener.Addr().String(), "second")
+	defer second.Close()
+	if _, err := first.Write([]byte("x")); err != nil {
+		t.Fatal("Existing connection broke:", err)
+	}
+	if _, err := io.ReadFull(first, make([]byte, 1)); err != nil {
+		t.Fatal("Existing connection broke:", err)
+	}
+
+	// A broken certificate is not loaded.
+	if err := os.WriteFile(keyPath, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("Expected reloading a broken key to fail")
+	}
+	third := dialTestServer(t, listener.Addr().String(), "second")
+	defer third.Close()
+}
+
+func TestCertReloader_ClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	writeTestCert(t, certPath, keyPath, "ca", expiry)
+
+	// The certificate doubles as client CA.
+	reloader, err := NewCertReloader(&CertReloaderOptions{
+		CertPath:     certPath,
+		KeyPath:      keyPath,
+		ClientCAPath: certPath,
+	})
+	if err != nil {
+		t.Fatal("Failed to load certificates:", err)
+	}
+	if got := certExpiry(t, CertClientCA); got != float64(expiry.Unix()) {
+		t.Fatal("Unexpected client CA expiry:", got)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", reloader.TlsConfig())
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	clientCert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, certificates := range [][]tls.Certificate{nil, {clientCert}} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certificates,
+		})
+		if err != nil {
+			t.Fatal("Failed to dial:", err)
+		}
+		// TLS 1.3 clients learn about a rejected certificate on reading.
+		_, _ = conn.Write([]byte("x"))
+		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		_, err = io.ReadFull(conn, make([]byte, 1))
+		conn.Close()
+		if certificates == nil && err == nil {
+			t.Fatal("Expected a client without certificate to be rejected")
+		}
+		if certificates != nil && err != nil {
+			t.Fatal("Expected a client with certificate to be accepted, got", err)
+		}
+	}
+}
+
+// Writes a self-signed certificate for localhost, which can also act as CA,
+// and its key.
+func writeTestCert(t *testing.T, certPath, keyPath, commonName string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Dials the server at the address, expecting it to present a certificate with
+// the common name.
+func dialTestServer(t *testing.T, address string, commonName string) *tls.Conn {
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != commonName {
+		conn.Close()
+		t.Fatalf("Expected certificate %q, got %q", commonName, got)
+	}
+	return conn
+}
+
+// Returns the expiry metric of the certificate.
+func certExpiry(t *testing.T, cert string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal("Failed to gather metrics:", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "locksmith_tls_cert_expiry_timestamp_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == cert {
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// ErrNotTransferable is returned for connections which can not be handed over
+// to another process, such as TLS connections, whose state lives in the
+// process.
+var ErrNotTransferable = errors.New("connection can not be handed over")
+
+var ErrTruncatedFiles = errors.New("files sent along with message were truncated")
+
+var ErrActivation = errors.New("invalid socket activation environment")
+
+// File returns a copy of the connection's socket, for handing it over to
+// another process along with the connection's remote address. Connections
+// from the acceptors are unwrapped to get at their socket.
+func File(conn net.Conn) (*os.File, error) {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return c.File()
+	case *net.UnixConn:
+		return c.File()
+	case *remoteAddrConn:
+		return File(c.Conn)
+	case *proxyConn:
+		// Data read past the header has yet to reach the handler.
+		if c.err != nil || c.reader.Buffered() > 0 {
+			return nil, ErrNotTransferable
+		}
+		return File(c.Conn)
+	}
+	return nil, ErrNotTransferable
+}
+
+// FileConn returns a connection for a socket handed over by another process,
+// keeping the remote address the connection had there.
+func FileConn(file *os.File, remoteAddr string) (net.Conn, error) {
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteAddrConn{Conn: conn, addr: &handedOverAddr{network: conn.RemoteAddr().Network(), addr: remoteAddr}}, nil
+}
+
+// The remote address of a handed over connection.
+type handedOverAddr struct {
+	network string
+	addr    string
+}
+
+func (addr *handedOverAddr) Network() string {
+	return addr.network
+}
+
+func (addr *handedOverAddr) String() string {
+	return addr.addr
+}
+
+// ConnectionSequence returns the number of the latest connection numbered by
+// the acceptors, see PeerAddr and IdentityAddr.
+func ConnectionSequence() uint64 {
+	return connectionCounter.Load()
+}
+
+// ResumeConnectionSequence continues numbering connections after sequence,
+// so that connections handed over from another process keep unique
+// addresses.
+func ResumeConnectionSequence(sequence uint64) {
+	for {
+		current := connectionCounter.Load()
+		if current >= sequence || connectionCounter.CompareAndSwap(current, sequence) {
+			return
+		}
+	}
+}
+
+// Adopts a listening socket, closing the file, which the listener has a copy
+// of.
+func adoptListener(file *os.File) (net.Listener, error) {
+	defer file.Close()
+	return net.FileListener(file)
+}
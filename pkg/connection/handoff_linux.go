@@ -0,0 +1,61 @@
+package connection
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// The most files sent along with a single message.
+const maxFilesPerMessage = 64
+
+// SendFiles sends a message along with copies of the files, over a Unix
+// domain socket. Sending a socket puts it in blocking mode, also for the
+// process sending it, so only send sockets that are no longer in use.
+func SendFiles(conn *net.UnixConn, message []byte, files []*os.File) error {
+	if len(files) > maxFilesPerMessage {
+		return ErrTruncatedFiles
+	}
+	var rights []byte
+	if len(files) > 0 {
+		fds := make([]int, len(files))
+		for i, file := range files {
+			fds[i] = int(file.Fd())
+		}
+		rights = syscall.UnixRights(fds...)
+	}
+	_, _, err := conn.WriteMsgUnix(message, rights, nil)
+	return err
+}
+
+// ReceiveFiles receives a message sent by SendFiles into buffer, returning
+// the message and the files sent along with it.
+func ReceiveFiles(conn *net.UnixConn, buffer []byte) ([]byte, []*os.File, error) {
+	oob := make([]byte, syscall.CmsgSpace(maxFilesPerMessage*4))
+	n, oobn, flags, _, err := conn.ReadMsgUnix(buffer, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, err
+	}
+	files := []*os.File{}
+	for i := range messages {
+		fds, err := syscall.ParseUnixRights(&messages[i])
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "handed-over"))
+		}
+	}
+	if flags&(syscall.MSG_CTRUNC|syscall.MSG_TRUNC) != 0 {
+		for _, file := range files {
+			file.Close()
+		}
+		return nil, nil, ErrTruncatedFiles
+	}
+	return buffer[:n], files, nil
+}
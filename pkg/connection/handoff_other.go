@@ -0,0 +1,18 @@
+//go:build !linux
+
+package connection
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// Handing sockets over to another process is only supported on Linux.
+func SendFiles(conn *net.UnixConn, message []byte, files []*os.File) error {
+	return errors.ErrUnsupported
+}
+
+func ReceiveFiles(conn *net.UnixConn, buffer []byte) ([]byte, []*os.File, error) {
+	return nil, nil, errors.ErrUnsupported
+}
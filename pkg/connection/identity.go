@@ -0,0 +1,99 @@
+package connection
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// IdentitySource tells where the identity of TLS clients comes from.
+type IdentitySource string
+
+const (
+	// Clients are identified by their address, as for plaintext connections.
+	IdentityAddress IdentitySource = ""
+	// Clients are identified by the common name of their certificate.
+	IdentityCommonName IdentitySource = "cn"
+	// Clients are identified by the first URI SAN of their certificate.
+	IdentitySANURI IdentitySource = "san-uri"
+	// Clients are identified by the SPIFFE ID of their certificate, the URI
+	// SAN with the spiffe scheme.
+	IdentitySPIFFE IdentitySource = "spiffe"
+)
+
+var (
+	ErrIdentitySource = errors.New("unknown client identity source")
+	ErrNoIdentity     = errors.New("client certificate does not carry the configured identity")
+)
+
+// Numbers connections, telling apart connections of the same client identity
+// across all acceptors.
+var connectionCounter atomic.Uint64
+
+// ParseIdentitySource parses an identity source by its name.
+func ParseIdentitySource(name string) (IdentitySource, error) {
+	switch source := IdentitySource(name); source {
+	case IdentityAddress, IdentityCommonName, IdentitySANURI, IdentitySPIFFE:
+		return source, nil
+	}
+	return IdentityAddress, fmt.Errorf("%q: %w", name, ErrIdentitySource)
+}
+
+// IdentityAddr is the remote address of TLS connections whose clients are
+// identified by their certificate. Connections of the same client are told
+// apart by a sequence number.
+type IdentityAddr struct {
+	Source   IdentitySource
+	Identity string
+	// The address the client connected from.
+	Remote     net.Addr
+	Connection uint64
+}
+
+func (addr *IdentityAddr) Network() string {
+	return addr.Remote.Network()
+}
+
+func (addr *IdentityAddr) String() string {
+	return fmt.Sprintf("tls:%s=%s,conn=%d", addr.Source, addr.Identity, addr.Connection)
+}
+
+// Returns the identity of the client of a completed handshake, taken from its
+// verified certificate.
+func clientIdentity(source IdentitySource, state tls.ConnectionState) (string, error) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", ErrNoIdentity
+	}
+	cert := state.VerifiedChains[0][0]
+
+	switch source {
+	case IdentityCommonName:
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, nil
+		}
+	case IdentitySANURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String(), nil
+		}
+	case IdentitySPIFFE:
+		for _, uri := range cert.URIs {
+			if uri.Scheme == "spiffe" {
+				return uri.String(), nil
+			}
+		}
+	}
+	return "", ErrNoIdentity
+}
+
+// A connection reporting another remote address than the one of the
+// underlying connection.
+type remoteAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (conn *remoteAddrConn) RemoteAddr() net.Addr {
+	return conn.addr
+}
@@ -0,0 +1,158 @@
+package connection
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestHandshakeFirst_ClientIdentity(t *testing.T) {
+	ca, caKey := newTestCA(t)
+	uris := []string{"https://example.org/billing", "spiffe://example.org/billing"}
+	withURIs := issueTestCert(t, ca, caKey, "billing", uris)
+	withoutURIs := issueTestCert(t, ca, caKey, "billing", nil)
+
+	tests := []struct {
+		source   IdentitySource
+		cert     tls.Certificate
+		expected string
+	}{
+		{IdentityCommonName, withURIs, `^tls:cn=billing,conn=\d+$`},
+		{IdentitySANURI, withURIs, `^tls:san-uri=https://example.org/billing,conn=\d+$`},
+		{IdentitySPIFFE, withURIs, `^tls:spiffe=spiffe://example.org/billing,conn=\d+$`},
+		{IdentitySPIFFE, withoutURIs, ""},
+		{IdentitySANURI, withoutURIs, ""},
+	}
+	for _, test := range tests {
+		got := identify(t, ca, test.source, test.cert)
+		if test.expected == "" {
+			if got != "" {
+				t.Errorf("%s: expected the client to be disconnected, got %q", test.source, got)
+			}
+			continue
+		}
+		if !regexp.MustCompile(test.expected).MatchString(got) {
+			t.Errorf("%s: expected an address matching %s, got %q", test.source, test.expected, got)
+		}
+	}
+
+	// Connections of the same client are told apart.
+	if identify(t, ca, IdentityCommonName, withURIs) == identify(t, ca, IdentityCommonName, withURIs) {
+		t.Error("Expected connections of the same client to have different addresses")
+	}
+}
+
+func TestParseIdentitySource(t *testing.T) {
+	for _, name := range []string{"", "cn", "san-uri", "spiffe"} {
+		if source, err := ParseIdentitySource(name); err != nil || string(source) != name {
+			t.Errorf("Failed to parse %q: %v", name, err)
+		}
+	}
+	if _, err := ParseIdentitySource("dn"); !errors.Is(err, ErrIdentitySource) {
+		t.Error("Expected an unknown source to be rejected, got", err)
+	}
+}
+
+// Connects a client with the certificate to a handler identifying clients by
+// the source, returning the remote address the handler saw, or an empty
+// string if the client was disconnected.
+func identify(t *testing.T, ca *x509.Certificate, source IdentitySource, cert tls.Certificate) string {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	addresses := make(chan string, 1)
+	go func() {
+		defer close(addresses)
+		defer serverConn.Close()
+		handshakeFirst(time.Second, source, func(conn net.Conn) {
+			addresses <- conn.RemoteAddr().String()
+		})(tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}))
+	}()
+	go func() {
+		client := tls.Client(clientConn, &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{cert},
+		})
+		if client.Handshake() == nil {
+			_, _ = io.Copy(io.Discard, client)
+		}
+	}()
+
+	select {
+	case address := <-addresses:
+		return address
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the handshake")
+	}
+	return ""
+}
+
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+// Issues a certificate signed by the CA, usable by both clients and servers.
+func issueTestCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, commonName string, uris []string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
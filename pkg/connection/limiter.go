@@ -0,0 +1,126 @@
+package connection
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rejectedConnectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "locksmith_connections_rejected",
+	Help: "The number of connections closed right after being accepted due to connection limits",
+}, []string{"reason"})
+
+// Reasons for rejecting connections, as labeled in the rejection metric.
+const (
+	RejectMaxConnections      = "max_connections"
+	RejectMaxConnectionsPerIP = "max_connections_per_ip"
+)
+
+type LimiterOptions struct {
+	// The maximum number of open connections, zero for no limit.
+	MaxConnections int
+	// The maximum number of open connections from a single source IP, zero
+	// for no limit. Connections without an IP, such as those on Unix domain
+	// sockets, only count towards MaxConnections.
+	MaxConnectionsPerIP int
+}
+
+// Limiter keeps count of open connections and admits new ones as long as
+// they stay within the limits. A single Limiter may be shared by several
+// acceptors, limiting their connections together.
+type Limiter struct {
+	maxConnections      int
+	maxConnectionsPerIP int
+
+	mutex       sync.Mutex
+	connections int
+	perIP       map[string]int
+}
+
+func NewLimiter(options *LimiterOptions) *Limiter {
+	return &Limiter{
+		maxConnections:      options.MaxConnections,
+		maxConnectionsPerIP: options.MaxConnectionsPerIP,
+		perIP:               make(map[string]int),
+	}
+}
+
+// Admits the connection if within limits, returning a function to call once
+// the connection has closed. Otherwise the reason for rejecting it is
+// returned. A nil Limiter admits every connection.
+func (limiter *Limiter) admit(conn net.Conn) (release func(), reason string) {
+	if limiter == nil {
+		return func() {}, ""
+	}
+	ip := sourceIP(conn.RemoteAddr())
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if limiter.maxConnections > 0 && limiter.connections >= limiter.maxConnections {
+		return nil, RejectMaxConnections
+	}
+	if ip != "" && limiter.maxConnectionsPerIP > 0 && limiter.perIP[ip] >= limiter.maxConnectionsPerIP {
+		return nil, RejectMaxConnectionsPerIP
+	}
+	return limiter.count(ip), ""
+}
+
+// Add counts a connection admitted before, like one handed over by another
+// server, without checking the limits, as it already holds locks. It may
+// take the count over the limits, new connections are then rejected until
+// enough have closed. Returns a function to call once the connection has
+// closed. A nil Limiter counts nothing.
+func (limiter *Limiter) Add(conn net.Conn) (release func()) {
+	if limiter == nil {
+		return func() {}
+	}
+	ip := sourceIP(conn.RemoteAddr())
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.count(ip)
+}
+
+// Counts a connection from the IP, with the mutex held.
+func (limiter *Limiter) count(ip string) func() {
+	limiter.connections++
+	if ip != "" {
+		limiter.perIP[ip]++
+	}
+	return func() {
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+		limiter.connections--
+		if ip != "" {
+			if limiter.perIP[ip]--; limiter.perIP[ip] == 0 {
+				delete(limiter.perIP, ip)
+			}
+		}
+	}
+}
+
+// Returns the IP of a TCP address, or an empty string for other addresses.
+// Handed over TCP connections keep their address as a string, the IP is
+// parsed from it.
+func sourceIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *handedOverAddr:
+		if !strings.HasPrefix(addr.network, "tcp") {
+			return ""
+		}
+		host, _, err := net.SplitHostPort(addr.addr)
+		if err != nil {
+			return ""
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
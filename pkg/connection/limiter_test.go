@@ -0,0 +1,145 @@
+package connection
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLimiter_Limits(t *testing.T) {
+	limiter := NewLimiter(&LimiterOptions{MaxConnections: 3, MaxConnectionsPerIP: 2})
+	release := make(chan interface{})
+	handled := make(chan interface{}, 10)
+	handler := func(conn net.Conn) {
+		handled <- nil
+		<-release
+	}
+	// Two acceptors sharing the limiter.
+	listeners := []net.Listener{listenLocal(t), listenLocal(t)}
+	for _, listener := range listeners {
+		tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{Handler: handler, Listener: listener, Limiter: limiter})
+		if err := tcpAcceptor.Start(); err != nil {
+			t.Fatal("Failed to start TCP acceptor:", err)
+		}
+		defer tcpAcceptor.Stop()
+	}
+	perIPBefore := rejectedConnections(t, RejectMaxConnectionsPerIP)
+	maxBefore := rejectedConnections(t, RejectMaxConnections)
+
+	// Connects from the source IP to the address.
+	dial := func(sourceIP string, address string) net.Conn {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(sourceIP)}}
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			t.Fatal("Failed to dial:", err)
+		}
+		return conn
+	}
+	admitted := func(conn net.Conn) bool {
+		select {
+		case <-handled:
+			return true
+		case <-time.After(200 * time.Millisecond):
+		}
+		// Rejected connections are closed right away.
+		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatal("Expected a rejected connection to be closed, got", err)
+		}
+		return false
+	}
+
+	first := dial("127.0.0.1", listeners[0].Addr().String())
+	defer first.Close()
+	second := dial("127.0.0.1", listeners[0].Addr().String())
+	defer second.Close()
+	if !admitted(first) || !admitted(second) {
+		t.Fatal("Expected connections within limits to be admitted")
+	}
+	third := dial("127.0.0.1", listeners[0].Addr().String())
+	defer third.Close()
+	if admitted(third) {
+		t.Fatal("Expected a third connection from the same IP to be rejected")
+	}
+
+	// Another IP is limited by the connection count alone.
+	fourth := dial("127.0.0.2", listeners[1].Addr().String())
+	defer fourth.Close()
+	if !admitted(fourth) {
+		t.Fatal("Expected a connection from another IP to be admitted")
+	}
+	fifth := dial("127.0.0.2", listeners[1].Addr().String())
+	defer fifth.Close()
+	if admitted(fifth) {
+		t.Fatal("Expected a connection beyond the maximum to be rejected")
+	}
+
+	if got := rejectedConnections(t, RejectMaxConnectionsPerIP) - perIPBefore; got != 1 {
+		t.Fatal("Expected one per IP rejection, got", got)
+	}
+	if got := rejectedConnections(t, RejectMaxConnections) - maxBefore; got != 1 {
+		t.Fatal("Expected one maximum connections rejection, got", got)
+	}
+
+	// Closed connections make room for new ones.
+	close(release)
+	time.Sleep(10 * time.Millisecond)
+	sixth := dial("127.0.0.1", listeners[0].Addr().String())
+	defer sixth.Close()
+	if !admitted(sixth) {
+		t.Fatal("Expected a connection to be admitted once others closed")
+	}
+}
+
+// Returns the number of connections rejected for the reason so far.
+func rejectedConnections(t *testing.T, reason string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal("Failed to gather metrics:", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "locksmith_connections_rejected" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == reason {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestLimiter_Add(t *testing.T) {
+	limiter := NewLimiter(&LimiterOptions{MaxConnections: 2, MaxConnectionsPerIP: 1})
+	withAddr := func(addr net.Addr) net.Conn {
+		conn, other := net.Pipe()
+		t.Cleanup(func() { conn.Close(); other.Close() })
+		return &remoteAddrConn{Conn: conn, addr: addr}
+	}
+	handedOver := withAddr(&handedOverAddr{network: "tcp", addr: "127.0.0.1:5000"})
+
+	// Handed over connections count towards the limits, but are never
+	// rejected by them.
+	releases := []func(){limiter.Add(handedOver), limiter.Add(handedOver)}
+	if release, reason := limiter.admit(withAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.2")})); release != nil {
+		t.Fatal("Expected handed over connections to count towards the maximum")
+	} else if reason != RejectMaxConnections {
+		t.Fatal("Unexpected reason:", reason)
+	}
+
+	releases[0]()
+	if release, reason := limiter.admit(withAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")})); release != nil {
+		t.Fatal("Expected handed over connections to count towards their IP")
+	} else if reason != RejectMaxConnectionsPerIP {
+		t.Fatal("Unexpected reason:", reason)
+	}
+
+	releases[1]()
+	if release, _ := limiter.admit(withAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")})); release == nil {
+		t.Fatal("Expected a connection to be admitted once handed over ones closed")
+	}
+}
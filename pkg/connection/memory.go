@@ -0,0 +1,98 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryAddr is the address of a MemoryListener, and the remote address of
+// the connections it accepts, numbered to tell them apart.
+type MemoryAddr struct {
+	Name string
+	// Zero for the listener itself.
+	Connection uint64
+}
+
+func (addr *MemoryAddr) Network() string {
+	return "memory"
+}
+
+func (addr *MemoryAddr) String() string {
+	if addr.Connection == 0 {
+		return "memory:" + addr.Name
+	}
+	return fmt.Sprintf("memory:%s,conn=%d", addr.Name, addr.Connection)
+}
+
+// MemoryListener is a net.Listener accepting connections dialed through it
+// rather than over the network, so that clients and servers can be run
+// against each other without opening sockets. Connections are synchronous
+// and unbuffered, see net.Pipe.
+type MemoryListener struct {
+	name      string
+	conns     chan net.Conn
+	closed    chan interface{}
+	closeOnce sync.Once
+	counter   atomic.Uint64
+}
+
+func NewMemoryListener(name string) *MemoryListener {
+	return &MemoryListener{
+		name:   name,
+		conns:  make(chan net.Conn),
+		closed: make(chan interface{}),
+	}
+}
+
+// Waits for the next connection to be dialed.
+func (listener *MemoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Stops accepting connections, connections already accepted stay open.
+func (listener *MemoryListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+	})
+	return nil
+}
+
+func (listener *MemoryListener) Addr() net.Addr {
+	return &MemoryAddr{Name: listener.name}
+}
+
+// Dial connects to the listener, blocking until the connection is accepted.
+func (listener *MemoryListener) Dial() (net.Conn, error) {
+	return listener.DialContext(context.Background(), "memory", listener.name)
+}
+
+// DialContext works like Dial, giving up once the context is done. The
+// network and address are ignored, the signature matches that of
+// net.Dialer.DialContext so that it can take its place.
+func (listener *MemoryListener) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	var err error
+	server, client := net.Pipe()
+	accepted := &remoteAddrConn{
+		Conn: server,
+		addr: &MemoryAddr{Name: listener.name, Connection: listener.counter.Add(1)},
+	}
+	select {
+	case listener.conns <- accepted:
+		return &remoteAddrConn{Conn: client, addr: listener.Addr()}, nil
+	case <-listener.closed:
+		err = net.ErrClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	server.Close()
+	client.Close()
+	return nil, &net.OpError{Op: "dial", Net: "memory", Addr: listener.Addr(), Err: err}
+}
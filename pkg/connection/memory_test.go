@@ -0,0 +1,52 @@
+package connection
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemoryListener(t *testing.T) {
+	listener := NewMemoryListener("test")
+	tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
+		Handler: func(conn net.Conn) {
+			_, _ = conn.Write([]byte(conn.RemoteAddr().String() + "\n"))
+		},
+		Listener: listener,
+	})
+	if err := tcpAcceptor.Start(); err != nil {
+		t.Fatal("Failed to start acceptor:", err)
+	}
+
+	// Connections are told apart by their remote address.
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal("Failed to dial:", err)
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		answer, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal("Failed to read:", err)
+		}
+		seen[string(answer)] = true
+		if conn.RemoteAddr().String() != "memory:test" {
+			t.Fatal("Unexpected remote address:", conn.RemoteAddr())
+		}
+	}
+	if !seen["memory:test,conn=1\n"] || !seen["memory:test,conn=2\n"] {
+		t.Fatal("Unexpected connection addresses:", seen)
+	}
+
+	if _, err := tcpAcceptor.File(); !errors.Is(err, ErrNotTransferable) {
+		t.Fatal("Expected in-memory listeners not to be transferable, got", err)
+	}
+	tcpAcceptor.Stop()
+	if _, err := listener.Dial(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("Expected dialing a stopped acceptor to fail, got", err)
+	}
+}
@@ -0,0 +1,27 @@
+package connection
+
+import (
+	"net"
+	"syscall"
+)
+
+// Reads the user and process IDs of the peer through SO_PEERCRED, as they
+// were when the peer connected.
+func peerCredentials(conn *net.UnixConn) (uid int, pid int, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return -1, -1, err
+	}
+	var ucred *syscall.Ucred
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, sockoptErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return -1, -1, err
+	}
+	if sockoptErr != nil {
+		return -1, -1, sockoptErr
+	}
+	return int(ucred.Uid), int(ucred.Pid), nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package connection
+
+import (
+	"errors"
+	"net"
+)
+
+// Peer credentials are only read on Linux, elsewhere peers are told apart by
+// connection alone.
+func peerCredentials(conn *net.UnixConn) (uid int, pid int, err error) {
+	return -1, -1, errors.ErrUnsupported
+}
@@ -0,0 +1,240 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var proxyHeaderErrorCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "locksmith_proxy_header_errors",
+	Help: "The number of connections from trusted proxies closed due to a missing or malformed PROXY protocol header",
+})
+
+// How long trusted proxies have to send the PROXY protocol header, unless a
+// handshake timeout is configured.
+const proxyHeaderTimeout = 10 * time.Second
+
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Longest possible v1 header, including the line ending.
+const proxyV1MaxLength = 107
+
+// ParseTrustedProxies parses a comma separated list of CIDRs, for example:
+//
+//	10.0.0.0/8,192.168.1.10,fd00::/8
+//
+// Plain IPs are taken as single address networks.
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: entry}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Accepts connections whose PROXY protocol header, if they come from a
+// trusted proxy, gives their remote address. Connections from other sources
+// are taken as they are, their first bytes are never read as a header.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+func (listener *proxyListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !listener.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: listener.timeout}, nil
+}
+
+func (listener *proxyListener) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range listener.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// A connection from a trusted proxy. The header is read on the first call to
+// Read or RemoteAddr rather than on accepting, so that slow proxies do not
+// hold up the accept loop. Connections with a bad header fail their reads.
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (conn *proxyConn) Read(b []byte) (int, error) {
+	conn.once.Do(conn.readHeader)
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.reader.Read(b)
+}
+
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	conn.once.Do(conn.readHeader)
+	return conn.remote
+}
+
+func (conn *proxyConn) readHeader() {
+	conn.remote = conn.Conn.RemoteAddr()
+	_ = conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout))
+	remote, err := readProxyHeader(conn.reader)
+	_ = conn.Conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		proxyHeaderErrorCounter.Inc()
+		log.Warn().
+			Err(err).
+			Str("proxy", conn.remote.String()).
+			Msg("failed to read PROXY protocol header, closing connection")
+		conn.err = err
+		conn.Conn.Close()
+		return
+	}
+	// Local connections, such as proxy health checks, and unknown address
+	// families keep the proxy's address.
+	if remote != nil {
+		conn.remote = remote
+	}
+}
+
+// Reads a v1 or v2 PROXY protocol header, returning the client's address
+// from it. The address is nil for headers which carry no TCP address.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	start, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2Header(reader)
+	case bytes.HasPrefix(start, proxyV1Prefix):
+		return readProxyV1Header(reader)
+	}
+	return nil, fmt.Errorf("%w: missing header", ErrProxyHeader)
+}
+
+// Reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 9000\r\n".
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, fmt.Errorf("%w: header too long", ErrProxyHeader)
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Reads a binary header, which is the signature followed by the version and
+// command, the address family and protocol, the length of the rest, the
+// addresses and ports, and optional TLVs, which are skipped.
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrProxyHeader, versionCommand>>4)
+	}
+	switch versionCommand & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrProxyHeader, versionCommand&0x0f)
+	}
+
+	var ipLength int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLength = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLength = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(payload) < 2*ipLength+4 {
+		return nil, fmt.Errorf("%w: short address block", ErrProxyHeader)
+	}
+	ip := make(net.IP, ipLength)
+	copy(ip, payload[:ipLength])
+	port := binary.BigEndian.Uint16(payload[2*ipLength:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
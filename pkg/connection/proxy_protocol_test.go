@@ -0,0 +1,142 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, addresses ...byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family, 0, byte(len(addresses)))
+		return string(append(header, addresses...))
+	}
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdb, 0xf4, 0x23, 0x28}
+	ipv6 := append(append(make([]byte, 15), 1), make([]byte, 16)...)
+	ipv6 = append(ipv6, 0xdb, 0xf4, 0x23, 0x28)
+
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+		err      bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 192.0.2.2 56308 9000\r\n", "192.0.2.1:56308", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56308 9000\r\n", "[2001:db8::1]:56308", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 2001:db8::2 56308 9000\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 192.0.2.2 port 9000\r\n", "", true},
+		{"v1 too long", "PROXY " + strings.Repeat("x", 200) + "\r\n", "", true},
+		{"v2 TCP4", v2(1, 0x11, ipv4...), "192.0.2.1:56308", false},
+		{"v2 TCP6", v2(1, 0x21, ipv6...), "[::1]:56308", false},
+		{"v2 TLVs", v2(1, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0xff)...), "192.0.2.1:56308", false},
+		{"v2 LOCAL", v2(0, 0x00), "", false},
+		{"v2 unspecified family", v2(1, 0x00), "", false},
+		{"v2 short addresses", v2(1, 0x11, ipv4[:8]...), "", true},
+		{"missing", "\x81\x00\x00\x04lock and more", "", true},
+	}
+	for _, test := range tests {
+		// The stream continues after the header, which must be left unread.
+		reader := bufio.NewReader(strings.NewReader(test.header + "rest"))
+		addr, err := readProxyHeader(reader)
+		if test.err {
+			if !errors.Is(err, ErrProxyHeader) {
+				t.Errorf("%s: expected a header error, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got := addrString(addr); got != test.expected {
+			t.Errorf("%s: expected address %q, got %q", test.name, test.expected, got)
+		}
+		if rest, _ := io.ReadAll(reader); string(rest) != "rest" {
+			t.Errorf("%s: expected the stream to continue after the header, got %q", test.name, rest)
+		}
+	}
+}
+
+func TestTcpAcceptor_ProxyProtocol(t *testing.T) {
+	for _, test := range []struct {
+		trusted  string
+		expected string
+	}{
+		// Trusted, so the header gives the address and is not passed on.
+		{"127.0.0.0/8", "192.0.2.1:56308|lock"},
+		// Untrusted, so the header is passed on as it is.
+		{"10.0.0.0/8,192.168.1.10", "127.0.0.1|PROXY TCP4 192.0.2.1 192.0.2.2 56308 9000\r\nlock"},
+	} {
+		trusted, err := ParseTrustedProxies(test.trusted)
+		if err != nil {
+			t.Fatal("Failed to parse trusted proxies:", err)
+		}
+		listener := listenLocal(t)
+		tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
+			Handler: func(conn net.Conn) {
+				data := make([]byte, 64)
+				n, _ := conn.Read(data)
+				addr := conn.RemoteAddr().String()
+				if !strings.HasPrefix(addr, "192.0.2.1") {
+					addr, _, _ = net.SplitHostPort(addr)
+				}
+				_, _ = conn.Write(append([]byte(addr+"|"), data[:n]...))
+			},
+			Listener:       listener,
+			TrustedProxies: trusted,
+		})
+		if err := tcpAcceptor.Start(); err != nil {
+			t.Fatal("Failed to start TCP acceptor:", err)
+		}
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			tcpAcceptor.Stop()
+			t.Fatal("Failed to dial:", err)
+		}
+		_, _ = conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56308 9000\r\nlock"))
+		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		tcpAcceptor.Stop()
+		if !bytes.Equal(got, []byte(test.expected)) {
+			t.Errorf("Trusting %s: expected %q, got %q", test.trusted, test.expected, got)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := ParseTrustedProxies(" 10.0.0.0/8, 192.168.1.10,fd00::/8,::1")
+	if err != nil {
+		t.Fatal("Failed to parse trusted proxies:", err)
+	}
+	expected := []string{"10.0.0.0/8", "192.168.1.10/32", "fd00::/8", "::1/128"}
+	if len(networks) != len(expected) {
+		t.Fatal("Unexpected networks:", networks)
+	}
+	for i, network := range networks {
+		if network.String() != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], network)
+		}
+	}
+
+	for _, list := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := ParseTrustedProxies(list); err == nil {
+			t.Errorf("Expected %q to be rejected", list)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
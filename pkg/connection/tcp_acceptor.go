@@ -2,38 +2,116 @@
 package connection
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog/log"
 )
 
+var handshakeTimeoutCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "locksmith_handshake_timeouts",
+	Help: "The number of connections closed due to not completing their TLS handshake in time",
+})
+
 type TCPAcceptor interface {
 	Start() error
 	Stop()
+	// File returns a copy of the listening socket of a started acceptor, for
+	// handing it over to another process. The socket keeps listening after
+	// Stop for as long as the copy is open.
+	File() (*os.File, error)
 }
 
 type TCPAcceptorOptions struct {
-	Handler   func(net.Conn)
-	Port      uint16
+	Handler func(net.Conn)
+	Port    uint16
+	// The address to listen on, as host:port, for binding to a specific
+	// interface. Takes precedence over Port, which listens on all
+	// interfaces.
+	Address   string
 	TlsConfig *tls.Config
+	// Limits the connections accepted, may be shared with other acceptors.
+	// Nil accepts every connection.
+	Limiter *Limiter
+	// How long clients have to complete the TLS handshake before they are
+	// disconnected, the handler is only called for connections that
+	// completed it. Zero leaves the handshake to the handler's first read or
+	// write, without a time limit.
+	HandshakeTimeout time.Duration
+	// Where the identity of TLS clients comes from, see IdentitySource.
+	// Connections of clients identified by their certificate report an
+	// IdentityAddr as remote address. Clients whose certificate lacks the
+	// identity are disconnected.
+	ClientIdentity IdentitySource
+	// Proxies trusted to send a PROXY protocol header, v1 or v2, ahead of
+	// their connections. The connections of trusted proxies then report the
+	// address from the header as remote address, and must send a header
+	// within the handshake timeout. Connections from other sources are taken
+	// as they are. Empty disables the PROXY protocol.
+	TrustedProxies []*net.IPNet
+	// A listening socket handed over by another process, or passed by socket
+	// activation, adopted in place of listening on the address. The acceptor
+	// takes ownership of the file.
+	File *os.File
+	// A listener to accept connections from in place of listening on the
+	// address, such as a MemoryListener. The acceptor closes it on stopping.
+	// Takes precedence over File, which is then closed right away.
+	Listener net.Listener
 }
 
 type tcpAcceptorImpl struct {
-	port      uint16
-	handler   func(net.Conn)
-	tlsConfig *tls.Config
-	listener  net.Listener
-	stop      chan interface{}
+	address        string
+	handler        func(net.Conn)
+	tlsConfig      *tls.Config
+	limiter        *Limiter
+	trustedProxies []*net.IPNet
+	proxyTimeout   time.Duration
+	file           *os.File
+	provided       net.Listener
+	// The listener as created or adopted, before any wrapping.
+	raw      net.Listener
+	listener net.Listener
+	stop     chan interface{}
 }
 
 func NewTCPAcceptor(options *TCPAcceptorOptions) TCPAcceptor {
+	address := options.Address
+	if options.Listener != nil {
+		address = options.Listener.Addr().String()
+	} else if address == "" {
+		address = fmt.Sprintf(":%d", options.Port)
+	}
+	handler := options.Handler
+	if options.TlsConfig != nil && (options.HandshakeTimeout > 0 || options.ClientIdentity != IdentityAddress) {
+		handler = handshakeFirst(options.HandshakeTimeout, options.ClientIdentity, handler)
+	}
+	proxyTimeout := options.HandshakeTimeout
+	if proxyTimeout <= 0 {
+		proxyTimeout = proxyHeaderTimeout
+	}
+	file := options.File
+	if options.Listener != nil && file != nil {
+		log.Warn().Str("address", address).Msg("listener given along with a socket to adopt, closing the socket")
+		file.Close()
+		file = nil
+	}
 	return &tcpAcceptorImpl{
-		port:      options.Port,
-		handler:   options.Handler,
-		tlsConfig: options.TlsConfig,
-		stop:      make(chan interface{}),
+		address:        address,
+		handler:        handler,
+		tlsConfig:      options.TlsConfig,
+		limiter:        options.Limiter,
+		trustedProxies: options.TrustedProxies,
+		proxyTimeout:   proxyTimeout,
+		file:           file,
+		provided:       options.Listener,
+		stop:           make(chan interface{}),
 	}
 }
 
@@ -41,16 +119,34 @@ func NewTCPAcceptor(options *TCPAcceptorOptions) TCPAcceptor {
 // to net/tls.Listen(...).
 // This is NOT a blocking call.
 func (tcpAcceptor *tcpAcceptorImpl) Start() (err error) {
-	if tcpAcceptor.tlsConfig == nil {
-		tcpAcceptor.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", tcpAcceptor.port))
-		log.Info().Uint16("port", tcpAcceptor.port).Msg("starting listener")
+	var listener net.Listener
+	if tcpAcceptor.provided != nil {
+		listener = tcpAcceptor.provided
+	} else if tcpAcceptor.file != nil {
+		listener, err = adoptListener(tcpAcceptor.file)
+		log.Info().Str("address", tcpAcceptor.address).Msg("adopted listener")
 	} else {
-		tcpAcceptor.listener, err = tls.Listen("tcp", fmt.Sprintf(":%d", tcpAcceptor.port), tcpAcceptor.tlsConfig)
-		log.Info().Uint16("port", tcpAcceptor.port).Msg("starting TLS listener on port")
+		listener, err = net.Listen("tcp", tcpAcceptor.address)
 	}
 	if err != nil {
 		return err
 	}
+	tcpAcceptor.raw = listener
+	// The PROXY protocol header comes ahead of the TLS handshake.
+	if len(tcpAcceptor.trustedProxies) > 0 {
+		listener = &proxyListener{
+			Listener: listener,
+			trusted:  tcpAcceptor.trustedProxies,
+			timeout:  tcpAcceptor.proxyTimeout,
+		}
+	}
+	if tcpAcceptor.tlsConfig == nil {
+		log.Info().Str("address", tcpAcceptor.address).Msg("starting listener")
+	} else {
+		listener = tls.NewListener(listener, tcpAcceptor.tlsConfig)
+		log.Info().Str("address", tcpAcceptor.address).Msg("starting TLS listener")
+	}
+	tcpAcceptor.listener = listener
 
 	go tcpAcceptor.startListener()
 
@@ -64,28 +160,109 @@ func (tcpAcceptor *tcpAcceptorImpl) Stop() {
 	tcpAcceptor.listener.Close()
 }
 
+// Returns a copy of the listening socket.
+func (tcpAcceptor *tcpAcceptorImpl) File() (*os.File, error) {
+	listener, ok := tcpAcceptor.raw.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, ErrNotTransferable
+	}
+	return listener.File()
+}
+
 // Listening loop for the TCP acceptor, is able to stop gracefully if Stop()
 // is called. Any incoming connection is dispatched to the registered handler.
 func (tcpAcceptor *tcpAcceptorImpl) startListener() {
-	defer tcpAcceptor.listener.Close()
+	serve(tcpAcceptor.listener, tcpAcceptor.stop, tcpAcceptor.limiter, tcpAcceptor.handler)
+}
+
+// Accepts connections off the listener until it is closed, dispatching each
+// to the handler in a Go-routine of its own. The connection is closed once
+// the handler returns. Connections over the limiter's limits are closed right
+// away instead. The limits are checked off the accept loop, as finding the
+// remote address of proxied connections means reading from them. Closing stop
+// before the listener tells a graceful stop apart from a failure.
+func serve(listener net.Listener, stop chan interface{}, limiter *Limiter, handler func(net.Conn)) {
+	defer listener.Close()
 	for {
-		conn, err := tcpAcceptor.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
-			case <-tcpAcceptor.stop:
+			case <-stop:
 				log.Info().Msg("stopping accept loop gracefully")
 			default:
 				log.Error().Err(err).Msg("a non stop related error occurred")
 			}
 			break
 		}
-		log.Debug().
-			Str("address", conn.RemoteAddr().String()).
-			Msg("listener accepted connection")
 
 		go func() {
 			defer conn.Close()
-			tcpAcceptor.handler(conn)
+			log.Debug().
+				Str("address", conn.RemoteAddr().String()).
+				Msg("listener accepted connection")
+
+			release, reason := limiter.admit(conn)
+			if release == nil {
+				rejectedConnectionsCounter.WithLabelValues(reason).Inc()
+				log.Warn().
+					Str("address", conn.RemoteAddr().String()).
+					Str("reason", reason).
+					Msg("connection limit reached, closing connection")
+				return
+			}
+			defer release()
+			handler(conn)
 		}()
 	}
 }
+
+// Wraps the handler to complete the TLS handshake, within the timeout if
+// there is one, before handing the connection on. The connection is handed on
+// with the client's identity as remote address, unless clients are identified
+// by their address.
+func handshakeFirst(timeout time.Duration, identity IdentitySource, handler func(net.Conn)) func(net.Conn) {
+	return func(conn net.Conn) {
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			handler(conn)
+			return
+		}
+
+		ctx, cancel := context.Background(), func() {}
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				handshakeTimeoutCounter.Inc()
+			}
+			log.Warn().
+				Err(err).
+				Str("address", conn.RemoteAddr().String()).
+				Msg("TLS handshake failed, closing connection")
+			return
+		}
+		if identity == IdentityAddress {
+			handler(conn)
+			return
+		}
+
+		id, err := clientIdentity(identity, tlsConn.ConnectionState())
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("address", conn.RemoteAddr().String()).
+				Str("source", string(identity)).
+				Msg("no client identity, closing connection")
+			return
+		}
+		handler(&remoteAddrConn{Conn: conn, addr: &IdentityAddr{
+			Source:     identity,
+			Identity:   id,
+			Remote:     conn.RemoteAddr(),
+			Connection: connectionCounter.Add(1),
+		}})
+	}
+}
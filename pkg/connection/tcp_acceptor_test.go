@@ -3,8 +3,11 @@ package connection
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"io"
 	"net"
 	"os"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -12,6 +15,24 @@ import (
 	"github.com/maansthoernvik/locksmith/pkg/client"
 )
 
+// Listens on a free port of the loopback interface, for an acceptor to accept
+// connections from.
+func listenLocal(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	return listener
+}
+
+// The port of a listener from listenLocal.
+func localPort(listener net.Listener) uint16 {
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	number, _ := strconv.Atoi(port)
+	return uint16(number)
+}
+
 func TestTcpAcceptor_AcceptConnections(t *testing.T) {
 	// Start a TCP acceptor with a handler function, expect the function to be
 	// called on establishing a connection.
@@ -19,6 +40,7 @@ func TestTcpAcceptor_AcceptConnections(t *testing.T) {
 	wg.Add(1)
 
 	handled_connection := false
+	listener := listenLocal(t)
 	tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
 		Handler: func(conn net.Conn) {
 			t.Log("Connection handler called!")
@@ -26,10 +48,8 @@ func TestTcpAcceptor_AcceptConnections(t *testing.T) {
 			defer conn.Close()
 			wg.Done()
 		},
-		Port: 30009,
+		Listener: listener,
 	})
-	// Use a port that isn't likely in use nor in a range that could be
-	// privileged.
 	err := tcpAcceptor.Start()
 	if err != nil {
 		t.Error("Failed to start TCP acceptor %w", err)
@@ -44,9 +64,9 @@ func TestTcpAcceptor_AcceptConnections(t *testing.T) {
 		}
 	}(wg)
 
-	client_conn, err := net.Dial("tcp", "localhost:30009")
+	client_conn, err := net.Dial("tcp", listener.Addr().String())
 	if err != nil {
-		t.Error("Error when dialing localhost:30009")
+		t.Error("Error when dialing", listener.Addr())
 	}
 	defer client_conn.Close()
 
@@ -68,6 +88,7 @@ func TestTcpAcceptor_ClientEvictedNoTls(t *testing.T) {
 	wg.Add(1)
 	pool := x509.NewCertPool()
 	pool.AppendCertsFromPEM(clientCaCert)
+	listener := listenLocal(t)
 	tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
 		Handler: func(conn net.Conn) {
 			defer conn.Close()
@@ -80,7 +101,7 @@ func TestTcpAcceptor_ClientEvictedNoTls(t *testing.T) {
 			}
 			wg.Done()
 		},
-		Port: 30001,
+		Listener: listener,
 		TlsConfig: &tls.Config{
 			Certificates: []tls.Certificate{cert},
 			ClientAuth:   tls.RequireAndVerifyClientCert,
@@ -97,7 +118,7 @@ func TestTcpAcceptor_ClientEvictedNoTls(t *testing.T) {
 
 	c := client.NewClient(&client.ClientOptions{
 		Host: "localhost",
-		Port: 30001,
+		Port: localPort(listener),
 	})
 
 	err = c.Connect()
@@ -126,6 +147,7 @@ func TestTcpAcceptor_MutualTls(t *testing.T) {
 	wg.Add(1)
 	pool := x509.NewCertPool()
 	pool.AppendCertsFromPEM(clientCaCert)
+	listener := listenLocal(t)
 	tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
 		Handler: func(conn net.Conn) {
 			defer conn.Close()
@@ -138,7 +160,7 @@ func TestTcpAcceptor_MutualTls(t *testing.T) {
 			}
 			wg.Done()
 		},
-		Port: 30002,
+		Listener: listener,
 		TlsConfig: &tls.Config{
 			Certificates: []tls.Certificate{cert},
 			ClientAuth:   tls.RequireAndVerifyClientCert,
@@ -159,7 +181,7 @@ func TestTcpAcceptor_MutualTls(t *testing.T) {
 	}
 	c := client.NewClient(&client.ClientOptions{
 		Host: "localhost",
-		Port: 30002,
+		Port: localPort(listener),
 		TlsConfig: &tls.Config{
 			Certificates: []tls.Certificate{clientCert},
 			RootCAs:      pool,
@@ -177,3 +199,88 @@ func TestTcpAcceptor_MutualTls(t *testing.T) {
 	t.Log("Awaiting listener read...")
 	wg.Wait()
 }
+
+func TestTcpAcceptor_HandshakeTimeout(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testcerts/testcert.pem", "testcerts/testkey.key")
+	if err != nil {
+		t.Fatal("Error when loading cert and key pair", err)
+	}
+
+	handled := make(chan interface{}, 1)
+	listener := listenLocal(t)
+	tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
+		Handler:          func(conn net.Conn) { handled <- nil },
+		Listener:         listener,
+		TlsConfig:        &tls.Config{Certificates: []tls.Certificate{cert}},
+		HandshakeTimeout: 50 * time.Millisecond,
+	})
+	if err := tcpAcceptor.Start(); err != nil {
+		t.Fatal("Error when starting tcp acceptor:", err)
+	}
+	defer tcpAcceptor.Stop()
+
+	// A client that never starts the handshake is disconnected without
+	// reaching the handler.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Error when dialing:", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected the connection to be closed, got", err)
+	}
+	select {
+	case <-handled:
+		t.Fatal("Handler called without a handshake")
+	default:
+	}
+
+	// Clients completing the handshake in time reach the handler.
+	tlsConn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal("Error when dialing TLS:", err)
+	}
+	defer tlsConn.Close()
+	select {
+	case <-handled:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Handler not called after the handshake")
+	}
+}
+
+func TestTcpAcceptor_ListenerOverFile(t *testing.T) {
+	adopted := listenLocal(t)
+	file, err := adopted.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal("Failed to get listener file:", err)
+	}
+	adopted.Close()
+
+	handled := make(chan interface{}, 1)
+	listener := listenLocal(t)
+	tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
+		Handler:  func(conn net.Conn) { handled <- nil },
+		File:     file,
+		Listener: listener,
+	})
+	// The listener is used, the file is not left open.
+	if err := file.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Fatal("Expected the file to be closed, got", err)
+	}
+	if err := tcpAcceptor.Start(); err != nil {
+		t.Fatal("Error when starting tcp acceptor:", err)
+	}
+	defer tcpAcceptor.Stop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Error when dialing:", err)
+	}
+	defer conn.Close()
+	select {
+	case <-handled:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Handler not called for the listener's connection")
+	}
+}
@@ -0,0 +1,177 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The permissions of the socket file unless told otherwise, letting the
+// owning user and group connect.
+const DefaultUnixSocketMode os.FileMode = 0660
+
+var ErrNotASocket = errors.New("path exists and is not a socket")
+
+type UnixAcceptorOptions struct {
+	Handler func(net.Conn)
+	// Path of the socket file to listen on.
+	Path string
+	// Permissions of the socket file, which decide who may connect. Defaults
+	// to DefaultUnixSocketMode.
+	Mode os.FileMode
+	// Limits the connections accepted, may be shared with other acceptors.
+	// Nil accepts every connection.
+	Limiter *Limiter
+	// A listening socket handed over by another process, or passed by socket
+	// activation, adopted in place of creating the socket file. The acceptor
+	// takes ownership of the file, but leaves the socket file in place on
+	// stopping.
+	File *os.File
+}
+
+type unixAcceptorImpl struct {
+	path     string
+	mode     os.FileMode
+	handler  func(net.Conn)
+	limiter  *Limiter
+	file     *os.File
+	raw      *net.UnixListener
+	listener net.Listener
+	stop     chan interface{}
+}
+
+// NewUnixAcceptor returns an acceptor listening on a Unix domain socket.
+// Connections handed to the handler report the peer's credentials as their
+// remote address, see PeerAddr.
+func NewUnixAcceptor(options *UnixAcceptorOptions) TCPAcceptor {
+	mode := options.Mode
+	if mode == 0 {
+		mode = DefaultUnixSocketMode
+	}
+	return &unixAcceptorImpl{
+		path:    options.Path,
+		mode:    mode,
+		handler: options.Handler,
+		limiter: options.Limiter,
+		file:    options.File,
+		stop:    make(chan interface{}),
+	}
+}
+
+// Starts the Unix acceptor. A socket file left behind by an earlier run is
+// removed first, any other file in its place is left alone and reported as
+// ErrNotASocket. An adopted socket is used as it is.
+// This is NOT a blocking call.
+func (unixAcceptor *unixAcceptorImpl) Start() error {
+	if unixAcceptor.file != nil {
+		listener, err := adoptListener(unixAcceptor.file)
+		if err != nil {
+			return err
+		}
+		unixListener, ok := listener.(*net.UnixListener)
+		if !ok {
+			listener.Close()
+			return fmt.Errorf("%s: %w", unixAcceptor.path, ErrNotASocket)
+		}
+		// The socket file belongs to whoever created the socket.
+		unixListener.SetUnlinkOnClose(false)
+		log.Info().Str("path", unixAcceptor.path).Msg("adopted Unix socket listener")
+		unixAcceptor.serve(unixListener)
+		return nil
+	}
+
+	if info, err := os.Lstat(unixAcceptor.path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return fmt.Errorf("%s: %w", unixAcceptor.path, ErrNotASocket)
+		}
+		if err := os.Remove(unixAcceptor.path); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: unixAcceptor.path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(unixAcceptor.path, unixAcceptor.mode); err != nil {
+		listener.Close()
+		return err
+	}
+	log.Info().
+		Str("path", unixAcceptor.path).
+		Stringer("mode", unixAcceptor.mode).
+		Msg("starting Unix socket listener")
+	unixAcceptor.serve(listener)
+
+	return nil
+}
+
+func (unixAcceptor *unixAcceptorImpl) serve(listener *net.UnixListener) {
+	unixAcceptor.raw = listener
+	unixAcceptor.listener = &peerListener{Listener: listener}
+	go serve(unixAcceptor.listener, unixAcceptor.stop, unixAcceptor.limiter, unixAcceptor.handler)
+}
+
+// Stop the Unix acceptor gracefully, closing the listener removes the socket
+// file, unless the socket has been handed over.
+func (unixAcceptor *unixAcceptorImpl) Stop() {
+	log.Info().Msg("stopping Unix acceptor")
+	close(unixAcceptor.stop)
+	unixAcceptor.listener.Close()
+}
+
+// Returns a copy of the listening socket. The socket file is left in place
+// on stopping from then on, as the socket lives on in the copy.
+func (unixAcceptor *unixAcceptorImpl) File() (*os.File, error) {
+	unixAcceptor.raw.SetUnlinkOnClose(false)
+	return unixAcceptor.raw.File()
+}
+
+// PeerAddr is the remote address of connections accepted on Unix domain
+// sockets, which otherwise have none. It identifies the peer by the
+// credentials of the process that connected, and the connection by a
+// sequence number, since one process may connect more than once. UID and PID
+// are -1 where the platform does not tell them.
+type PeerAddr struct {
+	UID        int
+	PID        int
+	Connection uint64
+}
+
+func (addr *PeerAddr) Network() string {
+	return "unix"
+}
+
+func (addr *PeerAddr) String() string {
+	if addr.UID < 0 {
+		return fmt.Sprintf("unix:conn=%d", addr.Connection)
+	}
+	return fmt.Sprintf("unix:uid=%d,pid=%d,conn=%d", addr.UID, addr.PID, addr.Connection)
+}
+
+// Wraps accepted connections to report the peer's credentials as their
+// remote address.
+type peerListener struct {
+	net.Listener
+}
+
+func (listener *peerListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr := &PeerAddr{UID: -1, PID: -1, Connection: connectionCounter.Add(1)}
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		if addr.UID, addr.PID, err = peerCredentials(unixConn); err != nil {
+			if !errors.Is(err, errors.ErrUnsupported) {
+				log.Warn().Err(err).Msg("failed to read peer credentials")
+			}
+			addr.UID, addr.PID = -1, -1
+		}
+	}
+	return &remoteAddrConn{Conn: conn, addr: addr}, nil
+}
@@ -0,0 +1,85 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestUnixAcceptor_PeerCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locksmith.sock")
+	// A socket file left behind by an earlier run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal("Failed to create stale socket:", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	addresses := make(chan net.Addr, 2)
+	unixAcceptor := NewUnixAcceptor(&UnixAcceptorOptions{
+		Handler: func(conn net.Conn) {
+			addresses <- conn.RemoteAddr()
+		},
+		Path: path,
+		Mode: 0600,
+	})
+	if err := unixAcceptor.Start(); err != nil {
+		t.Fatal("Failed to start Unix acceptor:", err)
+	}
+	defer unixAcceptor.Stop()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("Failed to stat socket:", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatal("Unexpected socket permissions:", info.Mode().Perm())
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal("Failed to dial:", err)
+		}
+		defer conn.Close()
+
+		select {
+		case addr := <-addresses:
+			peer, ok := addr.(*PeerAddr)
+			if !ok {
+				t.Fatalf("Unexpected remote address %T", addr)
+			}
+			if runtime.GOOS == "linux" && (peer.UID != os.Getuid() || peer.PID != os.Getpid()) {
+				t.Fatal("Unexpected peer credentials:", peer)
+			}
+			seen[peer.String()] = true
+		case <-time.After(1 * time.Second):
+			t.Fatal("Connection was not handled")
+		}
+	}
+	// Connections from the same process are told apart.
+	if len(seen) != 2 {
+		t.Fatal("Expected distinct addresses, got", seen)
+	}
+}
+
+func TestUnixAcceptor_NotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locksmith.sock")
+	if err := os.WriteFile(path, []byte("keep me"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	unixAcceptor := NewUnixAcceptor(&UnixAcceptorOptions{Handler: func(net.Conn) {}, Path: path})
+	if err := unixAcceptor.Start(); !errors.Is(err, ErrNotASocket) {
+		t.Fatal("Expected ErrNotASocket, got", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "keep me" {
+		t.Fatal("File was overwritten")
+	}
+}
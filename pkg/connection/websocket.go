@@ -0,0 +1,333 @@
+package connection
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The subset of WebSocket (RFC 6455) needed to carry a byte stream, like the
+// binary protocol frames, over binary WebSocket messages. Message boundaries
+// carry no meaning, the byte stream is the concatenation of all binary
+// messages, which is fine for protocols that delimit their own messages.
+
+var (
+	ErrWebSocketHandshake = errors.New("invalid WebSocket handshake")
+	ErrWebSocketFrame     = errors.New("invalid WebSocket frame")
+)
+
+// The GUID appended to handshake keys, see RFC 6455 section 1.3.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	webSocketContinuation = 0x0
+	webSocketText         = 0x1
+	webSocketBinary       = 0x2
+	webSocketClose        = 0x8
+	webSocketPing         = 0x9
+	webSocketPong         = 0xA
+)
+
+// Close status codes sent when closing the connection.
+const (
+	webSocketNormalClosure   = 1000
+	webSocketProtocolError   = 1002
+	webSocketUnsupportedData = 1003
+)
+
+// Control frames carry at most this many payload bytes.
+const webSocketMaxControlPayload = 125
+
+type webSocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// Clients mask the frames they send, servers require masked frames.
+	client bool
+
+	// State of the data frame currently being read, only touched by Read.
+	remaining  uint64
+	masked     bool
+	mask       [4]byte
+	maskOffset int
+
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+}
+
+// AcceptWebSocket performs the server side of the WebSocket handshake on a
+// freshly accepted connection and returns a net.Conn reading and writing the
+// payloads of binary WebSocket messages. Failed handshakes are answered with a
+// 400 Bad Request and ErrWebSocketHandshake is returned. The request path is
+// not checked.
+func AcceptWebSocket(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	key := request.Header.Get("Sec-WebSocket-Key")
+	decodedKey, keyErr := base64.StdEncoding.DecodeString(key)
+	if request.Method != http.MethodGet ||
+		!headerContains(request.Header, "Connection", "upgrade") ||
+		!headerContains(request.Header, "Upgrade", "websocket") ||
+		request.Header.Get("Sec-WebSocket-Version") != "13" ||
+		keyErr != nil || len(decodedKey) != 16 {
+		_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nSec-WebSocket-Version: 13\r\nConnection: close\r\n\r\n"))
+		return nil, ErrWebSocketHandshake
+	}
+
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &webSocketConn{Conn: conn, reader: reader}, nil
+}
+
+// ConnectWebSocket performs the client side of the WebSocket handshake on an
+// established connection, requesting the given host and path, and returns a
+// net.Conn reading and writing the payloads of binary WebSocket messages.
+func ConnectWebSocket(conn net.Conn, host string, path string) (net.Conn, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(random)
+
+	_, err := conn.Write([]byte("GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols ||
+		response.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, ErrWebSocketHandshake
+	}
+
+	return &webSocketConn{Conn: conn, reader: reader, client: true}, nil
+}
+
+// Read reads payload bytes of binary messages. Control frames are handled on
+// the way: pings are answered, and a close frame is answered and turned into
+// io.EOF.
+func (ws *webSocketConn) Read(p []byte) (int, error) {
+	for ws.remaining == 0 {
+		if err := ws.readFrameHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > ws.remaining {
+		p = p[:ws.remaining]
+	}
+
+	n, err := ws.reader.Read(p)
+	if ws.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= ws.mask[(ws.maskOffset+i)%4]
+		}
+		ws.maskOffset = (ws.maskOffset + n) % 4
+	}
+	ws.remaining -= uint64(n)
+
+	return n, err
+}
+
+// Reads frame headers until one for a data frame is found, handling control
+// frames in between.
+func (ws *webSocketConn) readFrameHeader() error {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	if header[0]&0x70 != 0 || masked == ws.client {
+		return ws.fail(webSocketProtocolError)
+	}
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+		if length>>63 != 0 {
+			return ws.fail(webSocketProtocolError)
+		}
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+
+	switch opcode {
+	case webSocketBinary, webSocketContinuation:
+		ws.remaining = length
+		ws.masked = masked
+		ws.mask = mask
+		ws.maskOffset = 0
+		return nil
+	case webSocketText:
+		return ws.fail(webSocketUnsupportedData)
+	case webSocketClose, webSocketPing, webSocketPong:
+		if !fin || length > webSocketMaxControlPayload {
+			return ws.fail(webSocketProtocolError)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.reader, payload); err != nil {
+			return unexpectedEOF(err)
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch opcode {
+		case webSocketPing:
+			return ws.writeFrame(webSocketPong, payload)
+		case webSocketClose:
+			ws.closeOnce.Do(func() {
+				// Echo the status code, as the closing handshake expects.
+				if len(payload) >= 2 {
+					payload = payload[:2]
+				}
+				_ = ws.writeFrame(webSocketClose, payload)
+			})
+			return io.EOF
+		}
+		return nil
+	}
+
+	return ws.fail(webSocketProtocolError)
+}
+
+// Write writes p as a single binary message.
+func (ws *webSocketConn) Write(p []byte) (int, error) {
+	if err := ws.writeFrame(webSocketBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame, unless one has already been exchanged, and closes
+// the underlying connection.
+func (ws *webSocketConn) Close() error {
+	ws.closeOnce.Do(func() {
+		_ = ws.writeFrame(webSocketClose, binary.BigEndian.AppendUint16(nil, webSocketNormalClosure))
+	})
+	return ws.Conn.Close()
+}
+
+// Sends a close frame with the given status code, returning an error for Read
+// to report.
+func (ws *webSocketConn) fail(status uint16) error {
+	ws.closeOnce.Do(func() {
+		_ = ws.writeFrame(webSocketClose, binary.BigEndian.AppendUint16(nil, status))
+	})
+	return ErrWebSocketFrame
+}
+
+// Writes a complete frame in one write to the underlying connection, frames
+// written from different Go-routines never interleave.
+func (ws *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := byte(0)
+	if ws.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if ws.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	_, err := ws.Conn.Write(frame)
+
+	return err
+}
+
+// The Sec-WebSocket-Accept value for a Sec-WebSocket-Key.
+func webSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Tells if a comma separated header contains the token, ignoring case.
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Makes sure the WebSocket connection can stand in for any connection.
+var _ net.Conn = (*webSocketConn)(nil)
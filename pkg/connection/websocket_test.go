@@ -0,0 +1,133 @@
+package connection
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket_Echo(t *testing.T) {
+	// Start a TCP acceptor echoing everything read from WebSocket connections.
+	listener := listenLocal(t)
+	tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
+		Handler: func(conn net.Conn) {
+			webSocketConn, err := AcceptWebSocket(conn)
+			if err != nil {
+				return
+			}
+			defer webSocketConn.Close()
+			_, _ = io.Copy(webSocketConn, webSocketConn)
+		},
+		Listener: listener,
+	})
+	if err := tcpAcceptor.Start(); err != nil {
+		t.Fatal("Failed to start TCP acceptor:", err)
+	}
+	defer tcpAcceptor.Stop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Error when dialing:", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(1 * time.Second))
+	webSocketConn, err := ConnectWebSocket(conn, "localhost", "/")
+	if err != nil {
+		t.Fatal("WebSocket handshake failed:", err)
+	}
+
+	// Messages form a byte stream, regardless of their boundaries.
+	for _, message := range []string{"hello", " ", strings.Repeat("x", 70000)} {
+		if _, err := webSocketConn.Write([]byte(message)); err != nil {
+			t.Fatal("Failed to write message:", err)
+		}
+	}
+	echo := make([]byte, 5+1+70000)
+	if _, err := io.ReadFull(webSocketConn, echo); err != nil {
+		t.Fatal("Failed to read echo:", err)
+	}
+	if string(echo[:6]) != "hello " || strings.Count(string(echo), "x") != 70000 {
+		t.Fatal("Unexpected echo:", string(echo[:6]))
+	}
+
+	// Closing is echoed by the server, which ends the stream.
+	if err := webSocketConn.Close(); err != nil {
+		t.Fatal("Failed to close:", err)
+	}
+}
+
+func TestWebSocket_BadHandshake(t *testing.T) {
+	listener := listenLocal(t)
+	tcpAcceptor := NewTCPAcceptor(&TCPAcceptorOptions{
+		Handler: func(conn net.Conn) {
+			if _, err := AcceptWebSocket(conn); err != ErrWebSocketHandshake {
+				t.Error("Expected a handshake error, got:", err)
+			}
+		},
+		Listener: listener,
+	})
+	if err := tcpAcceptor.Start(); err != nil {
+		t.Fatal("Failed to start TCP acceptor:", err)
+	}
+	defer tcpAcceptor.Stop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Error when dialing:", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(1 * time.Second))
+
+	// A plain HTTP request, not asking for an upgrade.
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || status != "HTTP/1.1 400 Bad Request\r\n" {
+		t.Fatal("Expected a 400 response, got:", status, err)
+	}
+}
+
+func TestWebSocket_ControlFrames(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	serverConn := &webSocketConn{Conn: server, reader: bufio.NewReader(server)}
+
+	go func() {
+		// A masked ping, then a masked binary message split in two frames,
+		// the first one not final.
+		mask := []byte{1, 2, 3, 4}
+		masked := func(payload string) []byte {
+			out := append([]byte{}, mask...)
+			for i := range payload {
+				out = append(out, payload[i]^mask[i%4])
+			}
+			return out
+		}
+		_, _ = client.Write(append([]byte{0x80 | webSocketPing, 0x80 | 2}, masked("hi")...))
+		pong := make([]byte, 4)
+		_, _ = io.ReadFull(client, pong)
+		if string(pong) != "\x8a\x02hi" {
+			t.Error("Expected a pong echoing the ping, got:", pong)
+		}
+		_, _ = client.Write(append([]byte{webSocketBinary, 0x80 | 3}, masked("abc")...))
+		_, _ = client.Write(append([]byte{0x80 | webSocketContinuation, 0x80 | 3}, masked("def")...))
+		// A text message is refused with a close frame.
+		_, _ = client.Write(append([]byte{0x80 | webSocketText, 0x80 | 1}, masked("?")...))
+		closing := make([]byte, 4)
+		_, _ = io.ReadFull(client, closing)
+		if string(closing) != "\x88\x02\x03\xeb" {
+			t.Error("Expected a close frame with status 1003, got:", closing)
+		}
+	}()
+
+	payload := make([]byte, 6)
+	if _, err := io.ReadFull(serverConn, payload); err != nil || string(payload) != "abcdef" {
+		t.Fatal("Expected the fragmented message, got:", string(payload), err)
+	}
+	if _, err := serverConn.Read(payload); err != ErrWebSocketFrame {
+		t.Fatal("Expected a frame error for the text message, got:", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 )
 
 const LOCKSMITH_LOG_LEVEL string = "LOCKSMITH_LOG_LEVEL"
@@ -18,6 +19,36 @@ const LOCKSMITH_METRICS_DEFAULT bool = false
 const LOCKSMITH_PORT string = "LOCKSMITH_PORT"
 const LOCKSMITH_PORT_DEFAULT uint16 = 9000
 
+const LOCKSMITH_LISTEN string = "LOCKSMITH_LISTEN"
+const LOCKSMITH_LISTEN_DEFAULT string = ""
+
+const LOCKSMITH_TEXT string = "LOCKSMITH_TEXT"
+const LOCKSMITH_TEXT_DEFAULT bool = false
+const LOCKSMITH_TEXT_PORT string = "LOCKSMITH_TEXT_PORT"
+const LOCKSMITH_TEXT_PORT_DEFAULT uint16 = 9001
+
+const LOCKSMITH_RESP string = "LOCKSMITH_RESP"
+const LOCKSMITH_RESP_DEFAULT bool = false
+const LOCKSMITH_RESP_PORT string = "LOCKSMITH_RESP_PORT"
+const LOCKSMITH_RESP_PORT_DEFAULT uint16 = 6379
+
+const LOCKSMITH_WEBSOCKET string = "LOCKSMITH_WEBSOCKET"
+const LOCKSMITH_WEBSOCKET_DEFAULT bool = false
+const LOCKSMITH_WEBSOCKET_PORT string = "LOCKSMITH_WEBSOCKET_PORT"
+const LOCKSMITH_WEBSOCKET_PORT_DEFAULT uint16 = 9002
+
+const LOCKSMITH_UNIX_SOCKET string = "LOCKSMITH_UNIX_SOCKET"
+const LOCKSMITH_UNIX_SOCKET_DEFAULT string = ""
+const LOCKSMITH_UNIX_SOCKET_MODE string = "LOCKSMITH_UNIX_SOCKET_MODE"
+const LOCKSMITH_UNIX_SOCKET_MODE_DEFAULT int = 0660
+
+const LOCKSMITH_HTTP string = "LOCKSMITH_HTTP"
+const LOCKSMITH_HTTP_DEFAULT bool = false
+const LOCKSMITH_HTTP_PORT string = "LOCKSMITH_HTTP_PORT"
+const LOCKSMITH_HTTP_PORT_DEFAULT uint16 = 20001
+const LOCKSMITH_HTTP_SESSION_TIMEOUT string = "LOCKSMITH_HTTP_SESSION_TIMEOUT"
+const LOCKSMITH_HTTP_SESSION_TIMEOUT_DEFAULT time.Duration = 30 * time.Second
+
 const LOCKSMITH_Q_TYPE string = "LOCKSMITH_Q_TYPE"
 const LOCKSMITH_Q_TYPE_DEFAULT string = "multi"
 const LOCKSMITH_Q_CONCURRENCY string = "LOCKSMITH_Q_CONCURRENCY"
@@ -25,6 +56,39 @@ const LOCKSMITH_Q_CONCURRENCY_DEFAULT int = 10
 const LOCKSMITH_Q_CAPACITY string = "LOCKSMITH_Q_CAPACITY"
 const LOCKSMITH_Q_CAPACITY_DEFAULT int = 100
 
+const LOCKSMITH_HEARTBEAT_TIMEOUT string = "LOCKSMITH_HEARTBEAT_TIMEOUT"
+const LOCKSMITH_HEARTBEAT_TIMEOUT_DEFAULT time.Duration = 0
+
+const LOCKSMITH_DRAIN_TIMEOUT string = "LOCKSMITH_DRAIN_TIMEOUT"
+const LOCKSMITH_DRAIN_TIMEOUT_DEFAULT time.Duration = 5 * time.Second
+
+const LOCKSMITH_HANDSHAKE_TIMEOUT string = "LOCKSMITH_HANDSHAKE_TIMEOUT"
+const LOCKSMITH_HANDSHAKE_TIMEOUT_DEFAULT time.Duration = 10 * time.Second
+const LOCKSMITH_IDLE_TIMEOUT string = "LOCKSMITH_IDLE_TIMEOUT"
+const LOCKSMITH_IDLE_TIMEOUT_DEFAULT time.Duration = 0
+const LOCKSMITH_WRITE_TIMEOUT string = "LOCKSMITH_WRITE_TIMEOUT"
+const LOCKSMITH_WRITE_TIMEOUT_DEFAULT time.Duration = 0
+const LOCKSMITH_WRITE_QUEUE_SIZE string = "LOCKSMITH_WRITE_QUEUE_SIZE"
+const LOCKSMITH_WRITE_QUEUE_SIZE_DEFAULT int = 1024
+
+const LOCKSMITH_MAX_LOCK_TAG_SIZE string = "LOCKSMITH_MAX_LOCK_TAG_SIZE"
+const LOCKSMITH_MAX_LOCK_TAG_SIZE_DEFAULT int = 1024
+
+const LOCKSMITH_MAX_CONNECTIONS string = "LOCKSMITH_MAX_CONNECTIONS"
+const LOCKSMITH_MAX_CONNECTIONS_DEFAULT int = 0
+const LOCKSMITH_MAX_CONNECTIONS_PER_IP string = "LOCKSMITH_MAX_CONNECTIONS_PER_IP"
+const LOCKSMITH_MAX_CONNECTIONS_PER_IP_DEFAULT int = 0
+const LOCKSMITH_RATE_LIMIT string = "LOCKSMITH_RATE_LIMIT"
+const LOCKSMITH_RATE_LIMIT_DEFAULT float64 = 0
+const LOCKSMITH_RATE_LIMIT_BURST string = "LOCKSMITH_RATE_LIMIT_BURST"
+const LOCKSMITH_RATE_LIMIT_BURST_DEFAULT int = 1
+const LOCKSMITH_IDENTITY_RATE_LIMIT string = "LOCKSMITH_IDENTITY_RATE_LIMIT"
+const LOCKSMITH_IDENTITY_RATE_LIMIT_DEFAULT float64 = 0
+const LOCKSMITH_IDENTITY_RATE_LIMIT_BURST string = "LOCKSMITH_IDENTITY_RATE_LIMIT_BURST"
+const LOCKSMITH_IDENTITY_RATE_LIMIT_BURST_DEFAULT int = 1
+const LOCKSMITH_RATE_LIMIT_POLICY string = "LOCKSMITH_RATE_LIMIT_POLICY"
+const LOCKSMITH_RATE_LIMIT_POLICY_DEFAULT string = "delay"
+
 const LOCKSMITH_TLS string = "LOCKSMITH_TLS"
 const LOCKSMITH_TLS_DEFAULT bool = false
 const LOCKSMITH_TLS_CERT_PATH string = "LOCKSMITH_TLS_CERT_PATH"
@@ -33,8 +97,16 @@ const LOCKSMITH_TLS_KEY_PATH string = "LOCKSMITH_TLS_KEY_PATH"
 const LOCKSMITH_TLS_KEY_PATH_DEFAULT string = "/etc/cert/locksmith.key"
 const LOCKSMITH_TLS_REQUIRE_CLIENT_CERT string = "LOCKSMITH_TLS_REQUIRE_CLIENT_CERT"
 const LOCKSMITH_TLS_REQUIRE_CLIENT_CERT_DEFAULT bool = false
+const LOCKSMITH_HANDOFF_SOCKET string = "LOCKSMITH_HANDOFF_SOCKET"
+const LOCKSMITH_HANDOFF_SOCKET_DEFAULT string = ""
+const LOCKSMITH_TRUSTED_PROXIES string = "LOCKSMITH_TRUSTED_PROXIES"
+const LOCKSMITH_TRUSTED_PROXIES_DEFAULT string = ""
+const LOCKSMITH_TLS_CLIENT_IDENTITY string = "LOCKSMITH_TLS_CLIENT_IDENTITY"
+const LOCKSMITH_TLS_CLIENT_IDENTITY_DEFAULT string = "cn"
 const LOCKSMITH_TLS_CLIENT_CA_CERT_PATH string = "LOCKSMITH_TLS_CLIENT_CA_CERT_PATH"
 const LOCKSMITH_TLS_CLIENT_CA_CERT_PATH_DEFAULT string = "/etc/cert/client_ca.cert"
+const LOCKSMITH_TLS_RELOAD_INTERVAL string = "LOCKSMITH_TLS_RELOAD_INTERVAL"
+const LOCKSMITH_TLS_RELOAD_INTERVAL_DEFAULT time.Duration = 10 * time.Second
 
 type ErrorNotFound struct {
 	name string
@@ -94,6 +166,13 @@ func GetRequiredInteger(name string) (int, error) {
 	return 0, newErrorNotFound(name)
 }
 
+func GetOptionalFloat(name string, def float64) (float64, error) {
+	if v, e := os.LookupEnv(name); e {
+		return strconv.ParseFloat(v, 64)
+	}
+	return def, nil
+}
+
 func GetOptionalUint16(name string, def uint16) (uint16, error) {
 	if v, e := os.LookupEnv(name); e {
 		// by setting a base of 0, the base is implied by the string's format
@@ -102,3 +181,11 @@ func GetOptionalUint16(name string, def uint16) (uint16, error) {
 	}
 	return def, nil
 }
+
+func GetOptionalDuration(name string, def time.Duration) (time.Duration, error) {
+	if v, e := os.LookupEnv(name); e {
+		// durations are given in Go's duration format, e.g. "30s" or "1m30s"
+		return time.ParseDuration(v)
+	}
+	return def, nil
+}
@@ -3,6 +3,7 @@ package env
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func Test_RequiredAndOptionalVariables(t *testing.T) {
@@ -93,3 +94,45 @@ func Test_RequiredAndOptionalVariables(t *testing.T) {
 		t.Fatalf("Expected integer to be '666' but was %d", i)
 	}
 }
+
+func Test_OptionalDuration(t *testing.T) {
+	d, _ := GetOptionalDuration("OPTIONAL_D", 5*time.Second)
+	if d != 5*time.Second {
+		t.Fatalf("Expected duration to use default of '5s', but was %v", d)
+	}
+
+	os.Setenv("PRESENT_OPTIONAL_D", "1m30s")
+	d, err := GetOptionalDuration("PRESENT_OPTIONAL_D", 0)
+	if err != nil {
+		t.Fatal("Failed to parse duration:", err)
+	}
+	if d != 90*time.Second {
+		t.Fatalf("Expected duration to be '1m30s' but was %v", d)
+	}
+
+	os.Setenv("BAD_OPTIONAL_D", "soon")
+	if _, err := GetOptionalDuration("BAD_OPTIONAL_D", 0); err == nil {
+		t.Fatal("Expected an error when parsing a malformed duration")
+	}
+}
+
+func Test_OptionalFloat(t *testing.T) {
+	f, _ := GetOptionalFloat("OPTIONAL_F", 2)
+	if f != 2 {
+		t.Fatalf("Expected float to use default of '2', but was %v", f)
+	}
+
+	os.Setenv("PRESENT_OPTIONAL_F", "0.5")
+	f, err := GetOptionalFloat("PRESENT_OPTIONAL_F", 0)
+	if err != nil {
+		t.Fatal("Failed to parse float:", err)
+	}
+	if f != 0.5 {
+		t.Fatalf("Expected float to be '0.5' but was %v", f)
+	}
+
+	os.Setenv("BAD_OPTIONAL_F", "fast")
+	if _, err := GetOptionalFloat("BAD_OPTIONAL_F", 0); err == nil {
+		t.Fatal("Expected an error when parsing a malformed float")
+	}
+}
@@ -0,0 +1,546 @@
+package locksmith
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maansthoernvik/locksmith/pkg/connection"
+	"github.com/maansthoernvik/locksmith/pkg/protocol"
+	"github.com/maansthoernvik/locksmith/pkg/vault"
+	"github.com/rs/zerolog/log"
+)
+
+// How long handing over may take, from the request to the successor
+// confirming it has received everything, and how long clients have to be
+// paused.
+const handoffTimeout = 10 * time.Second
+
+// The largest handoff message, a client may carry a frame of the largest
+// size along with data read past it.
+const maxHandoffMessageSize = 1 << 18
+
+var (
+	ErrNoHandoff      = errors.New("no server to take over from")
+	ErrHandoffMessage = errors.New("unexpected handoff message")
+)
+
+// Codecs by the names they are handed over by.
+var handoffCodecs = map[string]protocol.Codec{
+	"binary": protocol.BinaryCodec{},
+	"json":   protocol.JSONCodec{},
+}
+
+// Handoff is what a server receives from the server it takes over from: its
+// listening sockets, its binary protocol clients, its HTTP gateway sessions,
+// and its locks.
+type Handoff struct {
+	listeners map[string]*os.File
+	clients   []*handedOverClient
+	sessions  []string
+	locks     []vault.LockState
+	sequence  uint64
+}
+
+// Messages sent over the handoff socket, one after another. The listeners
+// come first along with their sockets, then every client along with its
+// socket, then every HTTP session, then every lock, and then a message
+// telling that's all.
+type handoffMessage struct {
+	Listeners []string `json:"listeners,omitempty"`
+	// The latest connection number, see connection.ConnectionSequence.
+	Sequence uint64            `json:"sequence,omitempty"`
+	Client   *handedOverClient `json:"client,omitempty"`
+	Session  string            `json:"session,omitempty"`
+	Lock     *vault.LockState  `json:"lock,omitempty"`
+	Done     bool              `json:"done,omitempty"`
+}
+
+type handedOverClient struct {
+	// The client's identity, which its locks are held by.
+	Address string `json:"address"`
+	// The name of the negotiated codec, empty if there is none yet.
+	Codec string `json:"codec,omitempty"`
+	// Data read from the client but not yet handled.
+	Pending []byte            `json:"pending,omitempty"`
+	Watches []handedOverWatch `json:"watches,omitempty"`
+
+	file *os.File
+}
+
+type handedOverWatch struct {
+	LockTag string `json:"tag"`
+	Prefix  bool   `json:"prefix,omitempty"`
+}
+
+// ReceiveHandoff asks the server listening on the handoff socket to hand over
+// its listeners, clients, sessions and locks, and returns them once received, for
+// passing to New as LocksmithOptions.Handoff. The old server stops serving
+// as it hands over, and Start returns once it is done. ErrNoHandoff is
+// returned if no server listens on the socket.
+func ReceiveHandoff(path string) (*Handoff, error) {
+	control, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, fmt.Errorf("%s: %w", path, ErrNoHandoff)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer control.Close()
+	_ = control.SetDeadline(time.Now().Add(handoffTimeout))
+	log.Info().Str("path", path).Msg("taking over from running server")
+
+	handoff := &Handoff{listeners: make(map[string]*os.File)}
+	buffer := make([]byte, maxHandoffMessageSize)
+	for {
+		data, files, err := connection.ReceiveFiles(control, buffer)
+		if err != nil {
+			handoff.Close()
+			return nil, err
+		}
+		message := handoffMessage{}
+		if err := json.Unmarshal(data, &message); err != nil {
+			closeFiles(files)
+			handoff.Close()
+			return nil, err
+		}
+
+		switch {
+		case message.Done:
+			closeFiles(files)
+			// Confirming lets the old server go.
+			if _, err := control.Write([]byte{1}); err != nil {
+				handoff.Close()
+				return nil, err
+			}
+			log.Info().
+				Int("listeners", len(handoff.listeners)).
+				Int("clients", len(handoff.clients)).
+				Int("sessions", len(handoff.sessions)).
+				Int("locks", len(handoff.locks)).
+				Msg("received handoff")
+			return handoff, nil
+		case message.Client != nil && len(files) == 1:
+			message.Client.file = files[0]
+			handoff.clients = append(handoff.clients, message.Client)
+		case message.Session != "" && len(files) == 0:
+			handoff.sessions = append(handoff.sessions, message.Session)
+		case message.Lock != nil && len(files) == 0:
+			handoff.locks = append(handoff.locks, *message.Lock)
+		case message.Client == nil && message.Lock == nil && len(files) == len(message.Listeners):
+			for i, name := range message.Listeners {
+				handoff.listeners[name] = files[i]
+			}
+			handoff.sequence = message.Sequence
+		default:
+			closeFiles(files)
+			handoff.Close()
+			return nil, ErrHandoffMessage
+		}
+	}
+}
+
+// Close closes the sockets of a handoff which will not be taken over.
+func (handoff *Handoff) Close() {
+	for name, file := range handoff.listeners {
+		file.Close()
+		delete(handoff.listeners, name)
+	}
+	for _, client := range handoff.clients {
+		client.file.Close()
+	}
+	handoff.clients = nil
+}
+
+// Returns the handed over listening socket of the name, if any, handing
+// ownership of it to the caller. Nil handoffs have none.
+func (handoff *Handoff) listener(name string) *os.File {
+	if handoff == nil {
+		return nil
+	}
+	file := handoff.listeners[name]
+	delete(handoff.listeners, name)
+	return file
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// Listens for handoff requests, replacing a socket file left behind. Only
+// the owner may ask for the server's clients.
+func listenHandoff(path string) (*net.UnixListener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Accepts a single handoff request. The socket file is left for the
+// successor to replace.
+func acceptHandoff(listener *net.UnixListener) <-chan *net.UnixConn {
+	requests := make(chan *net.UnixConn, 1)
+	go func() {
+		control, err := listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		listener.SetUnlinkOnClose(false)
+		listener.Close()
+		requests <- control
+	}()
+	return requests
+}
+
+// Hands the listeners, clients, sessions and locks over to the server at the
+// other end of the control connection. Accepting stops, but the listening
+// sockets are kept open for the successor, so connection attempts wait in
+// their backlog. HTTP sessions stop taking requests, binary protocol clients
+// are paused between frames, and others are closed. The vault is then frozen,
+// so that no lock changes hands once the paused clients have been written
+// what is queued for them, and the paused clients and the locks are sent.
+func (locksmith *Locksmith) handOver(acceptors []connection.TCPAcceptor, control *net.UnixConn) error {
+	defer control.Close()
+	_ = control.SetDeadline(time.Now().Add(handoffTimeout))
+	log.Info().Msg("handing over to new server")
+
+	names := []string{}
+	listeners := []*os.File{}
+	for _, acceptor := range acceptors {
+		file, err := acceptor.File()
+		if err != nil {
+			log.Error().Err(err).Str("listener", locksmith.acceptorNames[acceptor]).Msg("failed to hand over listener")
+		} else {
+			names = append(names, locksmith.acceptorNames[acceptor])
+			listeners = append(listeners, file)
+		}
+		acceptor.Stop()
+	}
+	defer closeFiles(listeners)
+
+	sessions := locksmith.httpSessions.handOver()
+	paused := locksmith.connections.pauseAll()
+	// Closed clients have their locks cleaned up, and operations of paused
+	// clients are handled, before the locks are exported. Nothing is granted
+	// after that, this server's vault stays frozen for good.
+	locksmith.vault.Freeze()
+	locksmith.connections.flushPaused()
+	err := locksmith.sendHandoff(control, names, listeners, paused, sessions)
+	for _, client := range paused {
+		client.file.Close()
+	}
+	// The paused handlers return, closing this server's copies of their
+	// connections.
+	locksmith.connections.resumeAll()
+	locksmith.connections.handlers.Wait()
+	if err != nil {
+		log.Error().Err(err).Msg("handing over failed, closed connections")
+		return err
+	}
+	log.Info().Msg("handed over to new server")
+	return nil
+}
+
+// Sends the listeners, the paused clients, the sessions and the locks they
+// and RESP clients hold, and waits for the successor to confirm it has
+// received them.
+func (locksmith *Locksmith) sendHandoff(
+	control *net.UnixConn,
+	names []string,
+	listeners []*os.File,
+	paused []*handedOverClient,
+	sessions []string,
+) error {
+	err := sendHandoff(control, handoffMessage{Listeners: names, Sequence: connection.ConnectionSequence()}, listeners)
+	if err != nil {
+		return err
+	}
+	addresses := make(map[string]bool, len(paused))
+	for _, client := range paused {
+		addresses[client.Address] = true
+		if err := sendHandoff(control, handoffMessage{Client: client}, []*os.File{client.file}); err != nil {
+			return err
+		}
+	}
+	owners := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		owners[httpClientPrefix+session] = true
+		if err := sendHandoff(control, handoffMessage{Session: session}, nil); err != nil {
+			return err
+		}
+	}
+	locks := 0
+	for _, state := range locksmith.vault.Export() {
+		// Locks are handed over along with their clients and sessions, RESP
+		// locks are owned by their value and need no connection. Locks of
+		// closed clients are left behind, and so are the long-polled acquires
+		// of sessions, as their requests are answered by this server.
+		if !addresses[state.Owner] && !owners[state.Owner] && !strings.HasPrefix(state.Owner, respClientPrefix) {
+			state.Owner = ""
+		}
+		waiting := state.Waiting
+		state.Waiting = nil
+		for _, client := range waiting {
+			if addresses[client] {
+				state.Waiting = append(state.Waiting, client)
+			}
+		}
+		if state.Owner == "" && len(state.Waiting) == 0 {
+			continue
+		}
+		locks++
+		if err := sendHandoff(control, handoffMessage{Lock: &state}, nil); err != nil {
+			return err
+		}
+	}
+	if err := sendHandoff(control, handoffMessage{Done: true}, nil); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(control, make([]byte, 1)); err != nil {
+		return err
+	}
+
+	log.Info().
+		Int("listeners", len(listeners)).
+		Int("clients", len(paused)).
+		Int("sessions", len(sessions)).
+		Int("locks", locks).
+		Msg("sent handoff")
+	return nil
+}
+
+func sendHandoff(control *net.UnixConn, message handoffMessage, files []*os.File) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return connection.SendFiles(control, data, files)
+}
+
+// Serves the clients of a handoff and restores their locks. Waitlisted
+// clients are notified once they get their locks, as if they had asked this
+// server.
+func (locksmith *Locksmith) takeOver(handoff *Handoff) {
+	connection.ResumeConnectionSequence(handoff.sequence)
+	// Listeners not taken over by an acceptor are no longer listened on.
+	for name, file := range handoff.listeners {
+		log.Warn().Str("listener", name).Msg("no listener to take over, closing it")
+		file.Close()
+	}
+
+	conns := make(map[string]*clientConn, len(handoff.clients))
+	clients := make(map[*clientConn]*handedOverClient, len(handoff.clients))
+	for _, client := range handoff.clients {
+		netConn, err := connection.FileConn(client.file, client.Address)
+		client.file.Close()
+		if err != nil {
+			log.Error().Err(err).Str("address", client.Address).Msg("failed to take over client")
+			continue
+		}
+		conn := locksmith.newClientConn(netConn)
+		conns[client.Address] = conn
+		clients[conn] = client
+	}
+
+	// Sessions exist before their locks, which expiring sessions clean up.
+	locksmith.httpSessions.restore(handoff.sessions)
+	locksmith.vault.Restore(handoff.locks, func(client, lockTag string) func(error) error {
+		conn, ok := conns[client]
+		if !ok {
+			// The client could not be taken over, let the next in line have
+			// the lock.
+			return func(error) error { return net.ErrClosed }
+		}
+		conn.inFlight.Add(1)
+		return locksmith.acquireCallback(conn, lockTag, nil)
+	})
+
+	for conn, client := range clients {
+		conn, client := conn, client
+		// Counted before going on, so that new connections are limited with
+		// the taken over ones in mind.
+		release := locksmith.limiter.Add(conn.Conn)
+		go func() {
+			defer conn.Conn.Close()
+			defer release()
+			locksmith.connections.track(func(net.Conn) {
+				log.Info().
+					Str("address", client.Address).
+					Msg("connection taken over")
+				locksmith.serveClient(conn, client)
+			})(conn.Conn)
+		}()
+	}
+}
+
+// Picks up a handed over client's codec and watches, before its loop starts.
+func (locksmith *Locksmith) resumeClient(conn *clientConn, client *handedOverClient, events *chan vault.Event) {
+	if codec, ok := handoffCodecs[client.Codec]; ok {
+		conn.codec = codec
+		locksmith.connections.addClient(conn)
+	}
+	for _, watch := range client.Watches {
+		*events = locksmith.handleWatch(conn, *events, watch.LockTag, watch.Prefix)
+	}
+}
+
+// Pauses the client for handing over, blocking until handing over is done.
+// Returns false if the client can not be handed over, the connection is then
+// handled as closed.
+func (locksmith *Locksmith) pause(conn *clientConn, reader *bufio.Reader, recorder *frameRecorder, pending *bytes.Reader) bool {
+	file, err := connection.File(conn.Conn)
+	if err != nil {
+		log.Info().
+			Err(err).
+			Str("address", conn.RemoteAddr().String()).
+			Msg("closing connection which can not be handed over")
+		return false
+	}
+
+	client := &handedOverClient{
+		Address: conn.RemoteAddr().String(),
+		Watches: conn.watches,
+		file:    file,
+	}
+	for name, codec := range handoffCodecs {
+		if conn.codec == codec {
+			client.Codec = name
+		}
+	}
+	if recorder != nil {
+		client.Pending = append(client.Pending, recorder.frame...)
+	}
+	buffered, _ := reader.Peek(reader.Buffered())
+	client.Pending = append(client.Pending, buffered...)
+	if pending != nil {
+		rest, _ := io.ReadAll(pending)
+		client.Pending = append(client.Pending, rest...)
+	}
+
+	locksmith.connections.pause(client)
+	return true
+}
+
+// Records what has been read of the current frame, so that a frame cut short
+// can be handed over.
+type frameRecorder struct {
+	reader io.Reader
+	frame  []byte
+}
+
+func (recorder *frameRecorder) Read(p []byte) (int, error) {
+	n, err := recorder.reader.Read(p)
+	recorder.frame = append(recorder.frame, p[:n]...)
+	return n, err
+}
+
+// Starts recording the next frame.
+func (recorder *frameRecorder) reset() {
+	recorder.frame = recorder.frame[:0]
+}
+
+func (connections *connections) addBinary(conn *clientConn) {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	connections.binary[conn] = struct{}{}
+}
+
+func (connections *connections) removeBinary(conn *clientConn) {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	delete(connections.binary, conn)
+}
+
+// Writes what is queued for the paused clients, including the outcome of
+// their operations the vault drained, ahead of handing them over.
+func (connections *connections) flushPaused() {
+	connections.mutex.Lock()
+	paused := make([]*clientConn, 0, len(connections.binary))
+	for conn := range connections.binary {
+		paused = append(paused, conn)
+	}
+	connections.mutex.Unlock()
+
+	flushed := sync.WaitGroup{}
+	for _, conn := range paused {
+		flushed.Add(1)
+		go func(conn *clientConn) {
+			defer flushed.Done()
+			conn.queue.flush()
+		}(conn)
+	}
+	flushed.Wait()
+}
+
+// Pauses binary protocol clients between frames, and closes every other
+// connection. Returns the paused clients once every connection has been
+// paused or has closed, or the handoff timeout has passed.
+func (connections *connections) pauseAll() []*handedOverClient {
+	connections.mutex.Lock()
+	connections.shuttingDown = true
+	handedOver := make(map[net.Conn]bool, len(connections.binary))
+	for conn := range connections.binary {
+		conn.handingOver.Store(true)
+		// Ends a read in progress, the handler then pauses.
+		_ = conn.SetReadDeadline(time.Now())
+		handedOver[conn.Conn] = true
+	}
+	for conn := range connections.conns {
+		if !handedOver[conn] {
+			conn.Close()
+		}
+	}
+	connections.mutex.Unlock()
+
+	deadline := time.Now().Add(handoffTimeout)
+	for {
+		connections.mutex.Lock()
+		settled := len(connections.conns) == len(connections.paused)
+		paused := connections.paused
+		connections.mutex.Unlock()
+		if settled {
+			return paused
+		}
+		if time.Now().After(deadline) {
+			log.Warn().Msg("not every connection paused in time for handing over")
+			return paused
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// Called by a client's handler to be handed over, blocks until handing over
+// is done.
+func (connections *connections) pause(client *handedOverClient) {
+	connections.mutex.Lock()
+	connections.paused = append(connections.paused, client)
+	connections.mutex.Unlock()
+	<-connections.resume
+}
+
+// Lets paused handlers return, closing their connections.
+func (connections *connections) resumeAll() {
+	close(connections.resume)
+}
@@ -0,0 +1,561 @@
+package locksmith
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/maansthoernvik/locksmith/pkg/protocol"
+	"github.com/maansthoernvik/locksmith/pkg/vault"
+	"github.com/rs/zerolog/log"
+)
+
+// Vault clients of the HTTP gateway are named after their session, the prefix
+// keeps them from clashing with connection addresses.
+const httpClientPrefix = "http:"
+
+const (
+	// Used when LocksmithOptions.HTTPSessionTimeout is not set.
+	DefaultHTTPSessionTimeout = 30 * time.Second
+	// Acquires without a timeout wait this long, and no acquire waits longer
+	// than the maximum.
+	defaultHTTPAcquireTimeout = 10 * time.Second
+	maxHTTPAcquireTimeout     = time.Minute
+	// Request bodies are tiny, anything larger is not a gateway request.
+	maxHTTPRequestSize = protocol.MaxLockTagSize + 1024
+)
+
+// States of a long-polled acquire, whoever gets to change the state first
+// decides the outcome, either the vault granting the lock or the request
+// giving up on it.
+const (
+	httpAcquirePending int32 = iota
+	httpAcquireGranted
+	httpAcquireAbandoned
+)
+
+var (
+	errHTTPSession  = errors.New("unknown or expired session")
+	errHTTPLockTag  = errors.New("lock tag missing, too long or not valid UTF8")
+	errHTTPTimeout  = errors.New("timeout must not be negative")
+	errHTTPBody     = errors.New("request body is not a valid JSON object")
+	errHTTPAbandon  = errors.New("acquire abandoned by HTTP client")
+	errHTTPInternal = errors.New("internal server error")
+	errHTTPHandoff  = errors.New("server is handing over to another, try again")
+)
+
+// The JSON body accepted by all gateway endpoints, fields not used by an
+// endpoint are ignored.
+type httpRequest struct {
+	Session string `json:"session"`
+	LockTag string `json:"lock_tag"`
+	// Milliseconds to wait for an acquire, or for a try-acquired lock to live.
+	TimeoutMs int64 `json:"timeout_ms"`
+	TTLMs     int64 `json:"ttl_ms"`
+}
+
+// The JSON body of gateway replies.
+type httpResponse struct {
+	Session  string `json:"session,omitempty"`
+	LockTag  string `json:"lock_tag,omitempty"`
+	Acquired *bool  `json:"acquired,omitempty"`
+	Released *bool  `json:"released,omitempty"`
+	Locked   *bool  `json:"locked,omitempty"`
+	Owned    *bool  `json:"owned,omitempty"`
+	Waiting  *int   `json:"waiting,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// An HTTP session stands in for a connection, owning the locks acquired
+// through it. Sessions expire once idle for longer than the session timeout,
+// releasing their locks like a closed connection would. Requests in flight,
+// like long-polling acquires, keep a session from expiring.
+type httpSession struct {
+	id       string
+	inFlight int
+	timer    *time.Timer
+	// Long-polled acquires not answered yet, abandoned when the session ends.
+	acquires map[*httpAcquire]struct{}
+}
+
+// A long-polled acquire, the result is sent once the state has left pending.
+type httpAcquire struct {
+	state  atomic.Int32
+	result chan error
+}
+
+type httpSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*httpSession
+	timeout  time.Duration
+	vault    vault.Vault
+	// Set once the sessions have been handed over, they are then left alone.
+	handedOver bool
+}
+
+func newHTTPSessions(v vault.Vault, timeout time.Duration) *httpSessions {
+	if timeout <= 0 {
+		timeout = DefaultHTTPSessionTimeout
+	}
+	return &httpSessions{
+		sessions: make(map[string]*httpSession),
+		timeout:  timeout,
+		vault:    v,
+	}
+}
+
+// Creates a new session and returns its ID. Fails with errHTTPHandoff once
+// the sessions have been handed over.
+func (sessions *httpSessions) create() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	session := &httpSession{
+		id:       hex.EncodeToString(random),
+		acquires: make(map[*httpAcquire]struct{}),
+	}
+
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if sessions.handedOver {
+		return "", errHTTPHandoff
+	}
+	sessions.add(session)
+
+	return session.id, nil
+}
+
+// Adds a session and starts its idle timer. Must be called with the mutex
+// held.
+func (sessions *httpSessions) add(session *httpSession) {
+	sessions.sessions[session.id] = session
+	session.timer = time.AfterFunc(sessions.timeout, func() { sessions.expire(session) })
+}
+
+// Marks the start of a request for the session, keeping it from expiring until
+// done is called. Fails with errHTTPSession if the session does not exist, and
+// with errHTTPHandoff once the sessions have been handed over.
+func (sessions *httpSessions) begin(id string) error {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if sessions.handedOver {
+		return errHTTPHandoff
+	}
+	session, ok := sessions.sessions[id]
+	if !ok {
+		return errHTTPSession
+	}
+	session.inFlight++
+	session.timer.Stop()
+
+	return nil
+}
+
+// Marks the end of a request for the session, restarting its idle timer once
+// no requests are left in flight.
+func (sessions *httpSessions) done(id string) {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	session, ok := sessions.sessions[id]
+	if !ok {
+		return
+	}
+	session.inFlight--
+	if session.inFlight == 0 {
+		session.timer.Reset(sessions.timeout)
+	}
+}
+
+// Registers a long-polled acquire with a session, so that the acquire is
+// abandoned if the session ends. Returns false if the session does not exist.
+func (sessions *httpSessions) track(id string, acquire *httpAcquire) bool {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	session, ok := sessions.sessions[id]
+	if ok {
+		session.acquires[acquire] = struct{}{}
+	}
+	return ok
+}
+
+func (sessions *httpSessions) untrack(id string, acquire *httpAcquire) {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if session, ok := sessions.sessions[id]; ok {
+		delete(session.acquires, acquire)
+	}
+}
+
+// Tells if the session still exists. Called from grant callbacks, refusing
+// locks to sessions that have ended.
+func (sessions *httpSessions) alive(id string) bool {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	_, ok := sessions.sessions[id]
+	return ok
+}
+
+// Grants a long-polled acquire the lock, unless the acquire has been abandoned
+// or its session has ended. Checking the session under the mutex keeps end
+// from slipping in between the check and the grant.
+func (sessions *httpSessions) grant(id string, acquire *httpAcquire) bool {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if _, ok := sessions.sessions[id]; !ok {
+		return false
+	}
+	return acquire.state.CompareAndSwap(httpAcquirePending, httpAcquireGranted)
+}
+
+// Expires a session unless it has become busy since its timer fired.
+func (sessions *httpSessions) expire(session *httpSession) {
+	sessions.mutex.Lock()
+	if sessions.sessions[session.id] != session || session.inFlight > 0 || sessions.handedOver {
+		sessions.mutex.Unlock()
+		return
+	}
+	sessions.end(session)
+	sessions.mutex.Unlock()
+
+	log.Info().Str("session", session.id).Msg("HTTP session expired")
+	sessions.cleanup(session)
+}
+
+// Ends a session right away, releasing its locks. Returns false if the
+// session does not exist.
+func (sessions *httpSessions) close(id string) bool {
+	sessions.mutex.Lock()
+	session, ok := sessions.sessions[id]
+	if ok {
+		sessions.end(session)
+		session.timer.Stop()
+	}
+	sessions.mutex.Unlock()
+
+	if ok {
+		sessions.cleanup(session)
+	}
+	return ok
+}
+
+// Removes a session and abandons its pending acquires, answering them with
+// errHTTPSession. Must be called with the mutex held.
+func (sessions *httpSessions) end(session *httpSession) {
+	delete(sessions.sessions, session.id)
+	for acquire := range session.acquires {
+		if acquire.state.CompareAndSwap(httpAcquirePending, httpAcquireAbandoned) {
+			acquire.result <- errHTTPSession
+		}
+	}
+}
+
+// Stops the sessions from expiring and from taking requests, and returns
+// their IDs for handing them over along with their locks. Requests already
+// in flight are answered by this server.
+func (sessions *httpSessions) handOver() []string {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	sessions.handedOver = true
+	ids := make([]string, 0, len(sessions.sessions))
+	for id, session := range sessions.sessions {
+		session.timer.Stop()
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Recreates handed over sessions, idle from now on.
+func (sessions *httpSessions) restore(ids []string) {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	for _, id := range ids {
+		sessions.add(&httpSession{id: id, acquires: make(map[*httpAcquire]struct{})})
+	}
+}
+
+// Releases the locks of an ended session. Grants are refused once the session
+// has ended, but one handed out just before may still be on its way into the
+// vault, draining first lets Cleanup see it.
+func (sessions *httpSessions) cleanup(session *httpSession) {
+	sessions.vault.Drain()
+	sessions.vault.Cleanup(httpClientPrefix + session.id)
+}
+
+// HTTPHandler returns the handler of the HTTP/JSON gateway, letting clients
+// that cannot keep a TCP connection open use Locksmith. All endpoints take a
+// JSON object in a POST request:
+//
+//	/v1/sessions          {}                                    create a session
+//	/v1/sessions/close    {session}                             end a session, releasing its locks
+//	/v1/keepalive         {session}                             keep an idle session alive
+//	/v1/acquire           {session, lock_tag, timeout_ms}       wait for a lock
+//	/v1/try-acquire       {session, lock_tag, ttl_ms}           acquire a lock if free
+//	/v1/release           {session, lock_tag}                   release a lock
+//	/v1/inspect           {session, lock_tag}                   the state of a lock
+//
+// Sessions take the place of connections, locks are owned by the session that
+// acquired them and released when the session expires. Acquires and releases
+// go to the same vault as those of other clients.
+func (locksmith *Locksmith) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/sessions", locksmith.handleHTTPCreateSession)
+	mux.HandleFunc("/v1/sessions/close", locksmith.httpSessionHandler(locksmith.handleHTTPCloseSession))
+	mux.HandleFunc("/v1/keepalive", locksmith.httpSessionHandler(locksmith.handleHTTPKeepalive))
+	mux.HandleFunc("/v1/acquire", locksmith.httpSessionHandler(locksmith.handleHTTPAcquire))
+	mux.HandleFunc("/v1/try-acquire", locksmith.httpSessionHandler(locksmith.handleHTTPTryAcquire))
+	mux.HandleFunc("/v1/release", locksmith.httpSessionHandler(locksmith.handleHTTPRelease))
+	mux.HandleFunc("/v1/inspect", locksmith.httpSessionHandler(locksmith.handleHTTPInspect))
+
+	return mux
+}
+
+func (locksmith *Locksmith) handleHTTPCreateSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeHTTPError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	id, err := locksmith.httpSessions.create()
+	if err == errHTTPHandoff {
+		writeHTTPError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create HTTP session")
+		writeHTTPError(w, http.StatusInternalServerError, errHTTPInternal)
+		return
+	}
+	log.Info().Str("session", id).Msg("HTTP session created")
+	writeHTTPResponse(w, http.StatusCreated, &httpResponse{Session: id})
+}
+
+// Wraps the handlers of endpoints acting on a session, decoding the request
+// and keeping the session alive while the request is handled.
+func (locksmith *Locksmith) httpSessionHandler(
+	handler func(http.ResponseWriter, *http.Request, *httpRequest),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeHTTPError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		request := &httpRequest{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHTTPRequestSize)).Decode(request); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, errHTTPBody)
+			return
+		}
+		if err := locksmith.httpSessions.begin(request.Session); err == errHTTPHandoff {
+			writeHTTPError(w, http.StatusServiceUnavailable, err)
+			return
+		} else if err != nil {
+			writeHTTPError(w, http.StatusNotFound, err)
+			return
+		}
+		defer locksmith.httpSessions.done(request.Session)
+
+		handler(w, r, request)
+	}
+}
+
+func (locksmith *Locksmith) handleHTTPCloseSession(w http.ResponseWriter, _ *http.Request, request *httpRequest) {
+	if !locksmith.httpSessions.close(request.Session) {
+		writeHTTPError(w, http.StatusNotFound, errHTTPSession)
+		return
+	}
+	log.Info().Str("session", request.Session).Msg("HTTP session closed")
+	writeHTTPResponse(w, http.StatusOK, &httpResponse{Session: request.Session})
+}
+
+func (locksmith *Locksmith) handleHTTPKeepalive(w http.ResponseWriter, _ *http.Request, request *httpRequest) {
+	writeHTTPResponse(w, http.StatusOK, &httpResponse{Session: request.Session})
+}
+
+// Long-polls for a lock, answering once the lock is acquired or the timeout
+// runs out. An acquire that times out, whose HTTP client goes away, or whose
+// session ends, is abandoned: once the vault gets to it, the callback refuses
+// the lock and the vault moves on to the next waiting client. Acquiring a lock
+// the session already holds succeeds without changing anything.
+func (locksmith *Locksmith) handleHTTPAcquire(w http.ResponseWriter, r *http.Request, request *httpRequest) {
+	if !locksmith.validHTTPLockTag(w, request) {
+		return
+	}
+	timeout := time.Duration(request.TimeoutMs) * time.Millisecond
+	if timeout < 0 {
+		writeHTTPError(w, http.StatusBadRequest, errHTTPTimeout)
+		return
+	}
+	if timeout == 0 {
+		timeout = defaultHTTPAcquireTimeout
+	}
+	if timeout > maxHTTPAcquireTimeout {
+		timeout = maxHTTPAcquireTimeout
+	}
+
+	acquire := &httpAcquire{result: make(chan error, 1)}
+	if !locksmith.httpSessions.track(request.Session, acquire) {
+		writeHTTPError(w, http.StatusNotFound, errHTTPSession)
+		return
+	}
+	defer locksmith.httpSessions.untrack(request.Session, acquire)
+	locksmith.vault.IdempotentAcquire(
+		request.LockTag,
+		httpClientPrefix+request.Session,
+		func(err error) error {
+			if !locksmith.httpSessions.grant(request.Session, acquire) {
+				return errHTTPAbandon
+			}
+			acquire.result <- err
+			return nil
+		},
+	)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-acquire.result:
+	case <-timer.C:
+		err = abandonHTTPAcquire(request, acquire)
+	case <-r.Context().Done():
+		err = abandonHTTPAcquire(request, acquire)
+	}
+	if err == errHTTPSession {
+		writeHTTPError(w, http.StatusNotFound, err)
+		return
+	}
+	if err == errHTTPAbandon {
+		writeHTTPResponse(w, http.StatusOK, &httpResponse{LockTag: request.LockTag, Acquired: boolPointer(false)})
+		return
+	}
+	if err != nil {
+		writeHTTPError(w, http.StatusConflict, err)
+		return
+	}
+
+	writeHTTPResponse(w, http.StatusOK, &httpResponse{LockTag: request.LockTag, Acquired: boolPointer(true)})
+}
+
+// Gives up on a long-polled acquire, returning errHTTPAbandon if the vault had
+// not granted the lock yet, or the result the acquire got otherwise.
+func abandonHTTPAcquire(request *httpRequest, acquire *httpAcquire) error {
+	if !acquire.state.CompareAndSwap(httpAcquirePending, httpAcquireAbandoned) {
+		// Granted, or abandoned by the session ending, just now, the result
+		// is on its way.
+		return <-acquire.result
+	}
+	log.Info().
+		Str("session", request.Session).
+		Str("tag", request.LockTag).
+		Msg("HTTP acquire abandoned")
+	return errHTTPAbandon
+}
+
+// Acquires a lock only if it is free, with an optional time to live.
+func (locksmith *Locksmith) handleHTTPTryAcquire(w http.ResponseWriter, _ *http.Request, request *httpRequest) {
+	if !locksmith.validHTTPLockTag(w, request) {
+		return
+	}
+	if request.TTLMs < 0 {
+		writeHTTPError(w, http.StatusBadRequest, errHTTPTimeout)
+		return
+	}
+
+	result := make(chan error, 1)
+	locksmith.vault.TryAcquire(
+		request.LockTag,
+		httpClientPrefix+request.Session,
+		time.Duration(request.TTLMs)*time.Millisecond,
+		func(err error) error {
+			if err == nil && !locksmith.httpSessions.alive(request.Session) {
+				err = errHTTPSession
+			}
+			result <- err
+			return err
+		},
+	)
+	err := <-result
+	if err == errHTTPSession {
+		writeHTTPError(w, http.StatusNotFound, err)
+		return
+	}
+	acquired := err == nil
+
+	writeHTTPResponse(w, http.StatusOK, &httpResponse{LockTag: request.LockTag, Acquired: &acquired})
+}
+
+func (locksmith *Locksmith) handleHTTPRelease(w http.ResponseWriter, _ *http.Request, request *httpRequest) {
+	if !locksmith.validHTTPLockTag(w, request) {
+		return
+	}
+
+	result := make(chan error, 1)
+	locksmith.vault.Release(
+		request.LockTag,
+		httpClientPrefix+request.Session,
+		func(err error) error {
+			result <- err
+			return nil
+		},
+	)
+	if err := <-result; err != nil {
+		writeHTTPError(w, http.StatusConflict, err)
+		return
+	}
+
+	writeHTTPResponse(w, http.StatusOK, &httpResponse{LockTag: request.LockTag, Released: boolPointer(true)})
+}
+
+// Tells whether a lock is held, and if so whether by the requesting session,
+// without revealing other owners since session IDs double as credentials.
+func (locksmith *Locksmith) handleHTTPInspect(w http.ResponseWriter, _ *http.Request, request *httpRequest) {
+	if !locksmith.validHTTPLockTag(w, request) {
+		return
+	}
+
+	infos := make(chan vault.LockInfo, 1)
+	locksmith.vault.Inspect(request.LockTag, func(info vault.LockInfo) {
+		infos <- info
+	})
+	info := <-infos
+
+	writeHTTPResponse(w, http.StatusOK, &httpResponse{
+		LockTag: request.LockTag,
+		Locked:  boolPointer(info.Owner != ""),
+		Owned:   boolPointer(info.Owner == httpClientPrefix+request.Session),
+		Waiting: &info.Waiting,
+	})
+}
+
+// Lock tags need to pass the same checks as lock tags decoded from binary
+// frames, writes an error reply if they do not.
+func (locksmith *Locksmith) validHTTPLockTag(w http.ResponseWriter, request *httpRequest) bool {
+	if request.LockTag == "" ||
+		len(request.LockTag) > locksmith.maxLockTagSize ||
+		!utf8.ValidString(request.LockTag) {
+		writeHTTPError(w, http.StatusBadRequest, errHTTPLockTag)
+		return false
+	}
+	return true
+}
+
+func writeHTTPResponse(w http.ResponseWriter, status int, response *httpResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error().Err(err).Msg("failed to write HTTP response")
+	}
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	writeHTTPResponse(w, status, &httpResponse{Error: err.Error()})
+}
+
+func boolPointer(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,55 @@
+package locksmith
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The scheme marking a listen address as TLS enabled in a listener list.
+const tlsScheme = "tls://"
+
+var ErrListenerTls = errors.New("TLS listener without TLS configuration")
+
+// Listener is an address the server listens on for binary protocol
+// connections.
+type Listener struct {
+	// The address to listen on, as host:port. An empty host listens on all
+	// interfaces.
+	Address string
+	// TLS configuration for connections to this address, nil for plaintext.
+	TlsConfig *tls.Config
+}
+
+// ParseListeners parses a comma separated list of listen addresses, where
+// addresses prefixed with "tls://" get the TLS configuration and the rest are
+// plaintext, for example:
+//
+//	127.0.0.1:9000,tls://10.0.0.5:9443,[::1]:9000
+//
+// Listing a TLS address without a TLS configuration is an error.
+func ParseListeners(list string, tlsConfig *tls.Config) ([]Listener, error) {
+	listeners := []Listener{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		listener := Listener{Address: entry}
+		if strings.HasPrefix(entry, tlsScheme) {
+			if tlsConfig == nil {
+				return nil, fmt.Errorf("%s: %w", entry, ErrListenerTls)
+			}
+			listener.Address = strings.TrimPrefix(entry, tlsScheme)
+			listener.TlsConfig = tlsConfig
+		}
+		if _, _, err := net.SplitHostPort(listener.Address); err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
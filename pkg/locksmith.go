@@ -2,27 +2,156 @@
 package locksmith
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/maansthoernvik/locksmith/pkg/connection"
 	"github.com/maansthoernvik/locksmith/pkg/protocol"
 	"github.com/maansthoernvik/locksmith/pkg/vault"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+var (
+	heartbeatTimeoutCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "locksmith_heartbeat_timeouts",
+		Help: "The number of connections closed due to missed heartbeats",
+	})
+	idleTimeoutCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "locksmith_idle_timeouts",
+		Help: "The number of connections closed due to staying idle without holding or waiting for locks",
+	})
+	writeTimeoutCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "locksmith_write_timeouts",
+		Help: "The number of connections closed due to writes not completing in time",
+	})
+)
+
+// Frame buffers are pooled, both for reading frames off connections and for
+// encoding messages to write to them. Buffers grown beyond
+// maxPooledBufferSize by large frames are left to the garbage collector, so
+// that the pool does not pin down rarely needed memory.
+var frameBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, 0, 256)
+		return &buffer
+	},
+}
+
+const maxPooledBufferSize = 4096
+
+func getFrameBuffer() *[]byte {
+	return frameBuffers.Get().(*[]byte)
+}
+
+func putFrameBuffer(buffer *[]byte) {
+	if cap(*buffer) > maxPooledBufferSize {
+		return
+	}
+	*buffer = (*buffer)[:0]
+	frameBuffers.Put(buffer)
+}
+
+// A client connection along with the codec negotiated for it, client
+// messages are written to the connection encoded by the codec.
+type clientConn struct {
+	net.Conn
+	codec protocol.Codec
+	// Client messages waiting to be written.
+	queue *writeQueue
+	// Rate limits of the client's requests.
+	limit *requestLimit
+
+	// Unix nano timestamp of the latest frame read or message written.
+	lastActivity atomic.Int64
+	// Operations handed to the vault which have yet to call back, including
+	// waitlisted acquires.
+	inFlight atomic.Int32
+	// Set once the client has started watching.
+	watching atomic.Bool
+	// Set when the connection is closed for staying idle.
+	idleClosed atomic.Bool
+	// Set when the server hands its clients over to another server.
+	handingOver atomic.Bool
+	// What the client watches, only touched by the connection's handler.
+	watches []handedOverWatch
+}
+
+func (conn *clientConn) active() {
+	conn.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Encodes the client message into a pooled buffer and queues it to be
+// written to the connection in a single write, see writeQueue. Returns an
+// error if the message does not encode, or the connection is closed or its
+// queue full.
+func (conn *clientConn) writeClientMessage(clientMessage *protocol.ClientMessage) error {
+	return conn.queueClientMessage(clientMessage, nil)
+}
+
+// Works like writeClientMessage, calling written, if not nil, once the
+// message has actually been written.
+func (conn *clientConn) queueClientMessage(clientMessage *protocol.ClientMessage, written func()) error {
+	buffer := getFrameBuffer()
+	encoded, err := conn.codec.AppendClientMessage((*buffer)[:0], clientMessage)
+	if err != nil {
+		putFrameBuffer(buffer)
+		return err
+	}
+	*buffer = encoded
+
+	return conn.queue.push(buffer, written)
+}
+
 // Locksmith is the root level object containing the implementation of the Locksmith server.
 type Locksmith struct {
-	tcpAcceptor connection.TCPAcceptor
-	vault       vault.Vault
+	tcpAcceptors      []connection.TCPAcceptor
+	textAcceptor      connection.TCPAcceptor
+	respAcceptor      connection.TCPAcceptor
+	webSocketAcceptor connection.TCPAcceptor
+	unixAcceptor      connection.TCPAcceptor
+	vault             vault.Vault
+	httpSessions      *httpSessions
+	connections       *connections
+	drainTimeout      time.Duration
+	heartbeatTimeout  time.Duration
+	idleTimeout       time.Duration
+	writeTimeout      time.Duration
+	writeQueueSize    int
+	rateLimiter       *rateLimiter
+	limiter           *connection.Limiter
+	handshakeTimeout  time.Duration
+	maxLockTagSize    int
+	watchBufferSize   int
+	handoffSocket     string
+	handoff           *Handoff
+	// Names of the acceptors, telling which listening socket is which when
+	// handed over.
+	acceptorNames map[connection.TCPAcceptor]string
+	// SHA1 sums of the unlock scripts RESP clients have loaded or evaluated.
+	respScripts sync.Map
 }
 
 // LocksmithOptions exposes the possible options to pass to a new Locksmith instance.
 type LocksmithOptions struct {
 	// Denotes the port which will listen for incoming connections.
 	Port uint16
+	// Addresses to listen on for incoming connections, each with TLS
+	// settings of its own, in place of Port and TlsConfig. All listeners
+	// share the same vault and are started and stopped together.
+	Listeners []Listener
 	// Selects the type of queue layer the vault will use.
 	QueueType vault.QueueType
 	// Sets the number of synchronization threads, the higher the number the less the chance of congestion.
@@ -30,8 +159,122 @@ type LocksmithOptions struct {
 	// Determines the buffer size of each synchronization thread, after the buffer limit is reached, calls
 	// to the queue layer will block until the congestion is resolved.
 	QueueCapacity int
-	// TLS configuration for the TCP acceptor.
+	// TLS configuration for the TCP acceptor, also used by the text protocol,
+	// RESP and WebSocket acceptors.
 	TlsConfig *tls.Config
+	// Denotes the port which will listen for incoming text protocol
+	// connections. Zero disables the text protocol.
+	TextPort uint16
+	// Denotes the port which will listen for incoming RESP (Redis protocol)
+	// connections. Zero disables RESP.
+	RESPPort uint16
+	// Denotes the port which will listen for incoming WebSocket connections,
+	// carrying binary protocol frames in binary messages. Zero disables
+	// WebSockets.
+	WebSocketPort uint16
+	// How long a session of the HTTP gateway may stay idle before it expires
+	// and its locks are released. Defaults to DefaultHTTPSessionTimeout.
+	HTTPSessionTimeout time.Duration
+	// The maximum time a connection may stay silent before it is considered
+	// dead, closed, and its locks cleaned up. Clients are expected to send
+	// pings more often than this. Zero disables liveness checking.
+	HeartbeatTimeout time.Duration
+	// How long clients have to complete the TLS or WebSocket handshake
+	// before they are disconnected. Zero leaves TLS handshakes without a
+	// limit, and WebSocket handshakes with the default limit.
+	HandshakeTimeout time.Duration
+	// Where the identity of TLS clients comes from, for client certificate
+	// verifying TLS configurations. Clients identified by their certificate
+	// own locks by that identity, told apart per connection, rather than by
+	// their address. Defaults to connection.IdentityAddress.
+	ClientIdentity connection.IdentitySource
+	// Load balancers trusted to send a PROXY protocol header ahead of their
+	// connections, on all TCP listeners. Their clients are identified by the
+	// address from the header, rather than the load balancer's. Empty
+	// disables the PROXY protocol.
+	TrustedProxies []*net.IPNet
+	// How long clients get to release their locks once the server starts
+	// shutting down, after having been sent a ShuttingDown message. Clients
+	// still connected after it are disconnected. Zero disconnects clients
+	// right away.
+	DrainTimeout time.Duration
+	// How long a connection that neither holds nor waits for locks, nor
+	// watches any, may stay without traffic before it is closed. Unlike the
+	// heartbeat timeout, holders are never closed for going quiet. Zero
+	// disables idle checking.
+	IdleTimeout time.Duration
+	// How long writing a message to a client may take before the client is
+	// considered stuck and disconnected, having its locks cleaned up. Zero
+	// disables the limit.
+	WriteTimeout time.Duration
+	// The number of messages queued per connection while waiting to be
+	// written, connections with full queues are closed. Defaults to
+	// DefaultWriteQueueSize.
+	WriteQueueSize int
+	// The largest lock tag, in bytes, clients are allowed to send. Connections
+	// sending larger lock tags are closed. Defaults to protocol.MaxLockTagSize.
+	MaxLockTagSize int
+	// The number of events buffered per watching connection, events for
+	// connections with full buffers are dropped. Defaults to
+	// DefaultWatchBufferSize.
+	WatchBufferSize int
+	// Path of a Unix domain socket which will listen for incoming binary
+	// protocol connections, next to the TCP port. Clients on it are
+	// identified by their peer credentials. Empty disables the socket.
+	UnixSocketPath string
+	// Permissions of the Unix domain socket file, which decide who may
+	// connect. Defaults to connection.DefaultUnixSocketMode.
+	UnixSocketMode os.FileMode
+	// The maximum number of connections open at once, over all listeners.
+	// Connections beyond it are closed as soon as they are accepted.
+	// Connections taken over from another server count towards it, but are
+	// never closed for it. Zero disables the limit.
+	MaxConnections int
+	// The maximum number of connections open at once from a single source
+	// IP, over all listeners. Zero disables the limit.
+	MaxConnectionsPerIP int
+	// Acquires, releases and batches allowed per second on a single binary,
+	// WebSocket, text or RESP connection, where RESP counts SET and releases.
+	// Zero disables the limit.
+	RequestRate float64
+	// Requests a connection may make at once after having been quiet.
+	// Defaults to 1.
+	RequestBurst int
+	// Requests allowed per second from a single client identity, over all of
+	// its connections. Clients are identified by their certificate when
+	// ClientIdentity is set, by their user on the Unix domain socket, or else
+	// by their source IP. Zero disables the limit.
+	IdentityRequestRate float64
+	// Requests a client identity may make at once. Defaults to 1.
+	IdentityRequestBurst int
+	// What happens to requests over the rate limits. Defaults to
+	// RateLimitDelay.
+	RateLimitPolicy RateLimitPolicy
+	// Path of a Unix domain socket on which another server, started with the
+	// same options, may ask to take over this one's listeners, clients and
+	// locks, see ReceiveHandoff. Once it has, Start returns. Empty disables
+	// handing over. Only supported on Linux.
+	HandoffSocket string
+	// What was received from the server this one takes over from, nil to
+	// start afresh.
+	Handoff *Handoff
+	// Accepts binary protocol connections from the listener in place of
+	// listening on Port, such as a connection.MemoryListener to run clients
+	// against the server without opening sockets. Not used along with
+	// Listeners. Takes precedence over a socket adopted for the listener.
+	Listener net.Listener
+	// Like Listener, for the text protocol, RESP and WebSocket listeners.
+	// Setting one enables the protocol without a port.
+	TextListener      net.Listener
+	RESPListener      net.Listener
+	WebSocketListener net.Listener
+	// Listening sockets to adopt in place of listening, by the name of the
+	// listener they are for: "binary", "binary:<address>" for Listeners,
+	// "text", "resp", "websocket" or "unix". A single socket named after no
+	// listener is taken for the binary protocol one, as systemd names sockets
+	// after their socket unit unless told otherwise. See
+	// connection.ActivationListeners. Those handed over take precedence.
+	ListenerFiles map[string]*os.File
 }
 
 func New(options *LocksmithOptions) *Locksmith {
@@ -41,122 +284,673 @@ func New(options *LocksmithOptions) *Locksmith {
 			QueueConcurrency: options.QueueConcurrency,
 			QueueCapacity:    options.QueueCapacity,
 		}),
+		heartbeatTimeout: options.HeartbeatTimeout,
+		idleTimeout:      options.IdleTimeout,
+		writeTimeout:     options.WriteTimeout,
+		writeQueueSize:   options.WriteQueueSize,
+		rateLimiter:      newRateLimiter(options),
+		handshakeTimeout: options.HandshakeTimeout,
+		drainTimeout:     options.DrainTimeout,
+		connections:      newConnections(),
+		maxLockTagSize:   options.MaxLockTagSize,
+		watchBufferSize:  options.WatchBufferSize,
+		handoffSocket:    options.HandoffSocket,
+		handoff:          options.Handoff,
+		acceptorNames:    make(map[connection.TCPAcceptor]string),
 	}
-	locksmith.tcpAcceptor = connection.NewTCPAcceptor(&connection.TCPAcceptorOptions{
-		Handler:   locksmith.handleConnection,
-		Port:      options.Port,
-		TlsConfig: options.TlsConfig,
+	if locksmith.watchBufferSize <= 0 {
+		locksmith.watchBufferSize = DefaultWatchBufferSize
+	}
+	if locksmith.maxLockTagSize <= 0 || locksmith.maxLockTagSize > protocol.MaxLockTagSize {
+		locksmith.maxLockTagSize = protocol.MaxLockTagSize
+	}
+	locksmith.httpSessions = newHTTPSessions(locksmith.vault, options.HTTPSessionTimeout)
+	// Shared by all acceptors, so that the limits apply to them together.
+	// Connections taken over from another server count towards them too.
+	limiter := connection.NewLimiter(&connection.LimiterOptions{
+		MaxConnections:      options.MaxConnections,
+		MaxConnectionsPerIP: options.MaxConnectionsPerIP,
 	})
+	locksmith.limiter = limiter
+	if len(options.Listeners) == 0 {
+		locksmith.tcpAcceptors = append(locksmith.tcpAcceptors, locksmith.named("binary", connection.NewTCPAcceptor(&connection.TCPAcceptorOptions{
+			Handler:          locksmith.connections.track(locksmith.handleConnection),
+			File:             options.listener("binary"),
+			Listener:         options.Listener,
+			Port:             options.Port,
+			TlsConfig:        options.TlsConfig,
+			Limiter:          limiter,
+			HandshakeTimeout: options.HandshakeTimeout,
+			ClientIdentity:   options.ClientIdentity,
+			TrustedProxies:   options.TrustedProxies,
+		})))
+	}
+	for _, listener := range options.Listeners {
+		name := "binary:" + listener.Address
+		locksmith.tcpAcceptors = append(locksmith.tcpAcceptors, locksmith.named(name, connection.NewTCPAcceptor(&connection.TCPAcceptorOptions{
+			Handler:          locksmith.connections.track(locksmith.handleConnection),
+			File:             options.listener(name),
+			Address:          listener.Address,
+			TlsConfig:        listener.TlsConfig,
+			Limiter:          limiter,
+			HandshakeTimeout: options.HandshakeTimeout,
+			ClientIdentity:   options.ClientIdentity,
+			TrustedProxies:   options.TrustedProxies,
+		})))
+	}
+	if options.TextPort != 0 || options.TextListener != nil {
+		locksmith.textAcceptor = locksmith.named("text", connection.NewTCPAcceptor(&connection.TCPAcceptorOptions{
+			Handler:          locksmith.connections.track(locksmith.handleTextConnection),
+			File:             options.listener("text"),
+			Listener:         options.TextListener,
+			Port:             options.TextPort,
+			TlsConfig:        options.TlsConfig,
+			Limiter:          limiter,
+			HandshakeTimeout: options.HandshakeTimeout,
+			ClientIdentity:   options.ClientIdentity,
+			TrustedProxies:   options.TrustedProxies,
+		}))
+	}
+	if options.RESPPort != 0 || options.RESPListener != nil {
+		locksmith.respAcceptor = locksmith.named("resp", connection.NewTCPAcceptor(&connection.TCPAcceptorOptions{
+			Handler:          locksmith.connections.track(locksmith.handleRESPConnection),
+			File:             options.listener("resp"),
+			Listener:         options.RESPListener,
+			Port:             options.RESPPort,
+			TlsConfig:        options.TlsConfig,
+			Limiter:          limiter,
+			HandshakeTimeout: options.HandshakeTimeout,
+			ClientIdentity:   options.ClientIdentity,
+			TrustedProxies:   options.TrustedProxies,
+		}))
+	}
+
+	if options.WebSocketPort != 0 || options.WebSocketListener != nil {
+		locksmith.webSocketAcceptor = locksmith.named("websocket", connection.NewTCPAcceptor(&connection.TCPAcceptorOptions{
+			Handler:          locksmith.connections.track(locksmith.handleWebSocketConnection),
+			File:             options.listener("websocket"),
+			Listener:         options.WebSocketListener,
+			Port:             options.WebSocketPort,
+			TlsConfig:        options.TlsConfig,
+			Limiter:          limiter,
+			HandshakeTimeout: options.HandshakeTimeout,
+			ClientIdentity:   options.ClientIdentity,
+			TrustedProxies:   options.TrustedProxies,
+		}))
+	}
+	if options.UnixSocketPath != "" {
+		locksmith.unixAcceptor = locksmith.named("unix", connection.NewUnixAcceptor(&connection.UnixAcceptorOptions{
+			Handler: locksmith.connections.track(locksmith.handleConnection),
+			File:    options.listener("unix"),
+			Path:    options.UnixSocketPath,
+			Mode:    options.UnixSocketMode,
+			Limiter: limiter,
+		}))
+	}
+	for name, file := range options.ListenerFiles {
+		if !locksmith.hasAcceptor(name) {
+			log.Warn().Str("name", name).Msg("no listener for adopted socket, closing it")
+			file.Close()
+		}
+	}
 
 	return locksmith
 }
 
+// Returns the listening socket to adopt for the named listener, if any.
+func (options *LocksmithOptions) listener(name string) *os.File {
+	if file := options.Handoff.listener(name); file != nil {
+		return file
+	}
+	if file, ok := options.ListenerFiles[name]; ok {
+		return file
+	}
+	if name == "binary" && len(options.ListenerFiles) == 1 {
+		for other, file := range options.ListenerFiles {
+			if !isListenerName(other) {
+				options.ListenerFiles = map[string]*os.File{name: file}
+				return file
+			}
+		}
+	}
+	return nil
+}
+
+// Tells whether the name is one given to listeners.
+func isListenerName(name string) bool {
+	switch name {
+	case "binary", "text", "resp", "websocket", "unix":
+		return true
+	}
+	return strings.HasPrefix(name, "binary:")
+}
+
 // Starts the Locksmith instance. This is a blocking call that can be unblocked
-// by cancelling the provided context.
+// by cancelling the provided context, which shuts the server down gracefully:
+// listeners are closed, binary protocol clients are sent a ShuttingDown
+// message and given the drain timeout to release their locks, after which
+// remaining connections are closed. Start returns once all connection
+// handlers have returned and the vault has handled all their operations.
+//
+// With a handoff socket, Start also returns once another server has taken
+// over, see HandoffSocket.
 func (locksmith *Locksmith) Start(ctx context.Context) error {
-	err := locksmith.tcpAcceptor.Start()
-	if err != nil {
-		log.Error().Msg("failed to start TCP acceptor")
-		return err
+	// Clients handed over are served before new ones are accepted.
+	if locksmith.handoff != nil {
+		locksmith.takeOver(locksmith.handoff)
+	}
+	var handoffListener *net.UnixListener
+	var handoffRequests <-chan *net.UnixConn
+	if locksmith.handoffSocket != "" {
+		var err error
+		if handoffListener, err = listenHandoff(locksmith.handoffSocket); err != nil {
+			log.Error().Err(err).Msg("failed to listen for handoff requests")
+			return err
+		}
+		handoffRequests = acceptHandoff(handoffListener)
+	}
+
+	acceptors := locksmith.acceptors()
+	for i, acceptor := range acceptors {
+		if err := acceptor.Start(); err != nil {
+			log.Error().Err(err).Msg("failed to start acceptor")
+			for _, started := range acceptors[:i] {
+				started.Stop()
+			}
+			if handoffListener != nil {
+				handoffListener.Close()
+			}
+			return err
+		}
 	}
 	log.Info().Msg("started locksmith")
 
-	<-ctx.Done()
+	select {
+	case <-ctx.Done():
+	case control := <-handoffRequests:
+		return locksmith.handOver(acceptors, control)
+	}
 	log.Info().Msg("stopping locksmith")
-	locksmith.tcpAcceptor.Stop()
+	if handoffListener != nil {
+		handoffListener.Close()
+	}
+	for _, acceptor := range acceptors {
+		acceptor.Stop()
+	}
+
+	locksmith.connections.shutDown()
+	if locksmith.drainTimeout > 0 {
+		log.Info().Dur("timeout", locksmith.drainTimeout).Msg("draining connections")
+	}
+	remaining := locksmith.connections.drain(locksmith.vault, locksmith.drainTimeout)
+	log.Info().Int("connections", remaining).Msg("closing remaining connections")
+	locksmith.connections.closeAll()
+	// Disconnected clients have their locks cleaned up through the vault.
+	locksmith.vault.Drain()
+	log.Info().Msg("stopped locksmith")
+
+	return nil
+}
+
+// Records the name of the acceptor, returning it.
+func (locksmith *Locksmith) named(name string, acceptor connection.TCPAcceptor) connection.TCPAcceptor {
+	locksmith.acceptorNames[acceptor] = name
+	return acceptor
+}
+
+// Tells whether an acceptor goes by the name.
+func (locksmith *Locksmith) hasAcceptor(name string) bool {
+	for _, acceptorName := range locksmith.acceptorNames {
+		if acceptorName == name {
+			return true
+		}
+	}
+	return false
+}
 
-	return err
+// Returns the enabled acceptors, the binary protocol ones first.
+func (locksmith *Locksmith) acceptors() []connection.TCPAcceptor {
+	acceptors := append([]connection.TCPAcceptor{}, locksmith.tcpAcceptors...)
+	for _, acceptor := range []connection.TCPAcceptor{
+		locksmith.textAcceptor,
+		locksmith.respAcceptor,
+		locksmith.webSocketAcceptor,
+		locksmith.unixAcceptor,
+	} {
+		if acceptor != nil {
+			acceptors = append(acceptors, acceptor)
+		}
+	}
+	return acceptors
 }
 
 // Handler for connections accepted by the TCP acceptor. This function contains
 // a connection loop which only ends upon the client connection encountering an
-// error, either due to a problem or shutdown of the client connection. Gotten
-// messages will be attempted to be decoded, if decoding fails the loop is
-// broken and the client connection disconnected.
-func (locksmith *Locksmith) handleConnection(conn net.Conn) {
+// error, either due to a problem or shutdown of the client connection. The
+// codec of the connection is negotiated from the first byte the client sends,
+// after which messages will be read frame by frame and attempted to be
+// decoded, if reading a frame fails or its lock tag is too large, or decoding
+// fails, the loop is broken and the client connection disconnected. If a
+// heartbeat timeout is set, a connection that stays silent for longer than the
+// timeout is treated as dead and disconnected as well.
+//
+// The frame buffer and decoded message are reused from one message to the
+// next, nothing handed on from the loop may keep references to them.
+func (locksmith *Locksmith) handleConnection(netConn net.Conn) {
+	conn := locksmith.newClientConn(netConn)
 	log.Info().
 		Str("address", conn.RemoteAddr().String()).
 		Msg("connection accepted")
+	locksmith.serveClient(conn, nil)
+}
+
+func (locksmith *Locksmith) newClientConn(netConn net.Conn) *clientConn {
+	conn := &clientConn{Conn: netConn}
+	conn.queue = newWriteQueue(netConn, locksmith.writeQueueSize, locksmith.writeTimeout, conn.active)
+	conn.active()
+	return conn
+}
+
+// Runs the connection loop of handleConnection, continuing where another
+// server left off for clients handed over from it. Once this server starts
+// handing over, the loop is paused between frames and the client is handed
+// over as it is, without cleaning up after it.
+func (locksmith *Locksmith) serveClient(conn *clientConn, handedOver *handedOverClient) {
+	address := conn.RemoteAddr().String()
+	locksmith.connections.addBinary(conn)
+	defer locksmith.connections.removeBinary(conn)
+	conn.queue.start()
+	limit, release := locksmith.rateLimiter.connect(conn.RemoteAddr())
+	defer release()
+	conn.limit = limit
 
+	if locksmith.idleTimeout > 0 {
+		done := make(chan interface{})
+		defer close(done)
+		go locksmith.closeWhenIdle(conn, address, done)
+	}
+
+	// Created once the client starts watching.
+	var events chan vault.Event
+	pausedForHandoff := false
 	// On connection close, clean up client data
-	defer locksmith.vault.Cleanup(conn.RemoteAddr().String())
+	defer func() {
+		// Queued messages of paused clients are written once the vault has
+		// been drained, see handOver.
+		if pausedForHandoff {
+			return
+		}
+		// Writes are stopped first, so that acquires granted from now on
+		// fail rather than leave a lock with a client already cleaned up.
+		conn.queue.stopWriting()
+		locksmith.vault.Cleanup(address)
+		// Cleanup removes the client's watches, nothing is sent after it.
+		if events != nil {
+			close(events)
+		}
+		conn.queue.flush()
+	}()
 
+	// Data read by the server that handed the client over, which has yet to
+	// be handled, comes first.
+	var source io.Reader = conn
+	var pending *bytes.Reader
+	if handedOver != nil && len(handedOver.Pending) > 0 {
+		pending = bytes.NewReader(handedOver.Pending)
+		source = io.MultiReader(pending, conn)
+	}
+	reader := bufio.NewReader(source)
+	// Frames cut short by pausing are handed over along with the client, so
+	// they are recorded as they are read when handing over is enabled.
+	var recorder *frameRecorder
+	var frames io.Reader = reader
+	if locksmith.handoffSocket != "" {
+		recorder = &frameRecorder{reader: reader}
+		frames = recorder
+	}
+	buffer := getFrameBuffer()
+	defer putFrameBuffer(buffer)
+	incomingMessage := &protocol.ServerMessage{}
+	defer locksmith.connections.removeClient(conn)
+	if handedOver != nil {
+		locksmith.resumeClient(conn, handedOver, &events)
+	}
 	for {
-		buffer := make([]byte, 257)
-		n, err := conn.Read(buffer)
+		if locksmith.heartbeatTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(locksmith.heartbeatTimeout))
+		}
+		if recorder != nil {
+			recorder.reset()
+		}
+		// Checked after setting the deadline, which would otherwise override
+		// the deadline set for pausing.
+		if conn.handingOver.Load() {
+			pausedForHandoff = locksmith.pause(conn, reader, recorder, pending)
+			break
+		}
+		frame, err := locksmith.readFrame(conn, reader, frames, *buffer)
 		if err != nil {
-			if err == io.EOF {
+			var netErr net.Error
+			if conn.handingOver.Load() {
+				pausedForHandoff = locksmith.pause(conn, reader, recorder, pending)
+			} else if conn.idleClosed.Load() {
+				log.Info().
+					Str("address", address).
+					Dur("timeout", locksmith.idleTimeout).
+					Msg("idle timeout, closed connection")
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				heartbeatTimeoutCounter.Inc()
+				log.Warn().
+					Str("address", address).
+					Dur("timeout", locksmith.heartbeatTimeout).
+					Msg("heartbeat timeout, closing connection")
+			} else if err == io.EOF {
 				log.Info().
-					Str("address", conn.RemoteAddr().String()).
+					Str("address", address).
 					Msg("connection closed by remote (EOF)")
+			} else if errors.Is(err, protocol.ErrLockTagTooLong) {
+				log.Error().
+					Str("address", address).
+					Int("max", locksmith.maxLockTagSize).
+					Msg("lock tag too long, closing connection")
 			} else {
 				log.Error().Err(err).Msg("connection read error, closing connection")
 			}
 
 			break
 		}
+		// Keep the buffer, should reading the frame have grown it.
+		*buffer = frame[:0]
+		conn.active()
 
-		log.Debug().Int("bytes", n).Msg("read from connection")
-		log.Debug().Bytes("buffer", buffer[:n]).Send()
+		if e := log.Debug(); e.Enabled() {
+			e.Int("bytes", len(frame)).Bytes("buffer", frame).Msg("read from connection")
+		}
 
-		incomingMessage, err := protocol.DecodeServerMessage(buffer[:n])
-		if err != nil {
+		if err := conn.codec.DecodeServerMessage(frame, incomingMessage); err != nil {
 			log.Error().
 				Err(err).
-				Str("address", conn.RemoteAddr().String()).
+				Str("address", address).
 				Msg("decoding error, closing connection")
 			break
 		}
+		// Not every codec can tell the size of lock tags before decoding.
+		if len(incomingMessage.LockTag) > locksmith.maxLockTagSize {
+			log.Error().
+				Str("address", address).
+				Int("max", locksmith.maxLockTagSize).
+				Msg("lock tag too long, closing connection")
+			break
+		}
 
+		if incomingMessage.Type == protocol.Watch || incomingMessage.Type == protocol.WatchPrefix {
+			events = locksmith.handleWatch(conn, events, incomingMessage.LockTag, incomingMessage.Type == protocol.WatchPrefix)
+			continue
+		}
 		locksmith.handleIncomingMessage(conn, incomingMessage)
 	}
 }
 
+// Closes the connection once it has gone without traffic for the idle
+// timeout, unless it holds or waits for locks, or watches any, until done is
+// closed. Closing the connection ends handleConnection's read loop, which
+// cleans up after the client as for any other disconnect.
+func (locksmith *Locksmith) closeWhenIdle(conn *clientConn, address string, done chan interface{}) {
+	timer := time.NewTimer(locksmith.idleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		quiet := time.Since(time.Unix(0, conn.lastActivity.Load()))
+		if quiet < locksmith.idleTimeout || conn.handingOver.Load() {
+			timer.Reset(locksmith.idleTimeout - quiet)
+			continue
+		}
+		if conn.inFlight.Load() > 0 || conn.watching.Load() || locksmith.vault.Holds(address) {
+			timer.Reset(locksmith.idleTimeout)
+			continue
+		}
+
+		idleTimeoutCounter.Inc()
+		conn.idleClosed.Store(true)
+		conn.Close()
+		return
+	}
+}
+
+// Reads the next frame off the connection, negotiating the connection's codec
+// first if that has yet to be done. Once the codec is known, the client can be
+// told about the server shutting down. Frames are read from frames, which
+// reads from reader.
+func (locksmith *Locksmith) readFrame(
+	conn *clientConn,
+	reader *bufio.Reader,
+	frames io.Reader,
+	buffer []byte,
+) ([]byte, error) {
+	if conn.codec == nil {
+		codec, err := protocol.NegotiateCodec(reader)
+		if err != nil {
+			return nil, err
+		}
+		conn.codec = codec
+		locksmith.connections.addClient(conn)
+	}
+	return conn.codec.ReadFrame(frames, buffer, locksmith.maxLockTagSize)
+}
+
 // After decoding, this function determines the handling of the decoded
 // message.
 func (locksmith *Locksmith) handleIncomingMessage(
-	conn net.Conn,
+	conn *clientConn,
 	serverMessage *protocol.ServerMessage,
 ) {
+	switch serverMessage.Type {
+	case protocol.Acquire, protocol.Release, protocol.Batch:
+		if allowed, reason := conn.limit.allow(); !allowed {
+			throttle(conn, serverMessage, reason)
+			return
+		}
+	}
+
 	switch serverMessage.Type {
 	case protocol.Acquire:
-		locksmith.vault.Acquire(
+		trace := vault.NewTrace(protocol.TraceID(serverMessage.TraceParent))
+		conn.inFlight.Add(1)
+		locksmith.vault.TracedAcquire(
 			serverMessage.LockTag,
 			conn.RemoteAddr().String(),
-			locksmith.acquireCallback(conn, serverMessage.LockTag),
+			trace,
+			locksmith.acquireCallback(conn, serverMessage.LockTag, trace),
 		)
 	case protocol.Release:
-		locksmith.vault.Release(
+		trace := vault.NewTrace(protocol.TraceID(serverMessage.TraceParent))
+		conn.inFlight.Add(1)
+		locksmith.vault.TracedRelease(
 			serverMessage.LockTag,
 			conn.RemoteAddr().String(),
-			locksmith.releaseCallback(conn),
+			trace,
+			locksmith.releaseCallback(conn, serverMessage.LockTag, trace),
 		)
+	case protocol.Ping:
+		if err := conn.writeClientMessage(&protocol.ClientMessage{
+			Type: protocol.Pong,
+		}); err != nil {
+			log.Error().Err(err).Msg("failed to write pong to client")
+		}
+	case protocol.Batch:
+		locksmith.handleBatch(conn, serverMessage.Operations)
 	default:
 		log.Error().Msg("invalid message type")
 	}
 }
 
+// Answers a request rejected for exceeding the rate limit. Throttled
+// batches have every operation reported as throttled.
+func throttle(conn *clientConn, serverMessage *protocol.ServerMessage, reason string) {
+	log.Debug().
+		Str("address", conn.RemoteAddr().String()).
+		Str("reason", reason).
+		Msg("request over rate limit, rejecting it")
+	clientMessage := &protocol.ClientMessage{Type: protocol.Throttled, LockTag: serverMessage.LockTag}
+	if serverMessage.Type == protocol.Batch {
+		results := make([]protocol.OperationResult, len(serverMessage.Operations))
+		for i, operation := range serverMessage.Operations {
+			results[i] = protocol.OperationResult{
+				Type:    operation.Type,
+				LockTag: operation.LockTag,
+				Code:    protocol.ResultThrottled,
+			}
+		}
+		clientMessage = &protocol.ClientMessage{Type: protocol.BatchResult, Results: results}
+	}
+	if err := conn.writeClientMessage(clientMessage); err != nil {
+		log.Error().Err(err).Msg("failed to tell client it was throttled")
+	}
+}
+
+// Hands a batch's operations to the vault in one go. Unlike single acquires
+// and releases, misbehaving operations in a batch do not disconnect the client,
+// their outcome is reported in the batch result instead. The batch result is
+// sent once every operation has completed, meaning once all acquires have been
+// granted.
+func (locksmith *Locksmith) handleBatch(
+	conn *clientConn,
+	operations []protocol.Operation,
+) {
+	for _, operation := range operations {
+		if len(operation.LockTag) > locksmith.maxLockTagSize {
+			log.Error().
+				Str("address", conn.RemoteAddr().String()).
+				Int("max", locksmith.maxLockTagSize).
+				Msg("lock tag too long in batch, closing connection")
+			conn.Close()
+			return
+		}
+	}
+
+	results := make([]protocol.OperationResult, len(operations))
+	remaining := atomic.Int32{}
+	remaining.Store(int32(len(operations)))
+	vaultOperations := make([]vault.Operation, len(operations))
+	for i, operation := range operations {
+		vaultOperations[i] = vault.Operation{
+			LockTag: operation.LockTag,
+			Callback: locksmith.batchCallback(
+				conn, results, &remaining, i, operation,
+			),
+		}
+		if operation.Type == protocol.Release {
+			vaultOperations[i].Type = vault.ReleaseOperation
+		} else {
+			vaultOperations[i].Type = vault.AcquireOperation
+		}
+	}
+
+	// The batch is in flight until its result has been sent.
+	conn.inFlight.Add(1)
+	locksmith.vault.Batch(conn.RemoteAddr().String(), vaultOperations)
+}
+
+// Returns a callback for the i:th operation of a batch, recording its result.
+// Whichever callback completes the batch sends the batch result, callbacks
+// are called from different synchronization Go-routines, so the remaining
+// counter is what orders their writes to results before the final read.
+func (locksmith *Locksmith) batchCallback(
+	conn *clientConn,
+	results []protocol.OperationResult,
+	remaining *atomic.Int32,
+	i int,
+	operation protocol.Operation,
+) func(error) error {
+	return func(err error) error {
+		results[i] = protocol.OperationResult{
+			Type:    operation.Type,
+			LockTag: operation.LockTag,
+			Code:    resultCode(err),
+		}
+		if remaining.Add(-1) > 0 {
+			return nil
+		}
+		defer conn.inFlight.Add(-1)
+
+		batchResult := &protocol.ClientMessage{
+			Type:    protocol.BatchResult,
+			Results: results,
+		}
+		if writeErr := conn.writeClientMessage(batchResult); writeErr != nil {
+			if errors.Is(writeErr, protocol.ErrBatchSize) {
+				// Results echo the batch's lock tags, so this only happens for
+				// batches too large to be answered in one frame.
+				log.Error().Err(writeErr).Msg("failed to encode batch result, closing connection")
+				conn.Close()
+				return nil
+			}
+			log.Error().Err(writeErr).Msg("failed to write batch result to client")
+		}
+
+		return nil
+	}
+}
+
+// Translates vault errors into batch result codes.
+func resultCode(err error) protocol.ResultCode {
+	switch {
+	case err == nil:
+		return protocol.ResultOK
+	case errors.Is(err, vault.ErrUnnecessaryAcquire):
+		return protocol.ResultUnnecessaryAcquire
+	case errors.Is(err, vault.ErrUnnecessaryRelease):
+		return protocol.ResultUnnecessaryRelease
+	default:
+		return protocol.ResultBadManners
+	}
+}
+
 // Returns a callback function to call once a lock has been acquired, to send
 // feedback down the client connection. If the callback is called with an error,
-// the client has misbehaved in some way and needs to be disconnected.
+// the client has misbehaved in some way and needs to be disconnected. Traced
+// acquires have their timings logged along with the trace ID.
 func (locksmith *Locksmith) acquireCallback(
-	conn net.Conn,
+	conn *clientConn,
 	lockTag string,
+	trace *vault.Trace,
 ) func(error) error {
 	return func(err error) error {
+		defer conn.inFlight.Add(-1)
 		if err != nil {
-			log.Error().Err(err).Msg("got error in acquire callback")
+			logTrace(log.Error(), trace).Err(err).Msg("got error in acquire callback")
 			conn.Close()
 			return nil
 		}
 
 		log.Debug().Str("locktag", lockTag).Msg("notifying client of acquisition")
-		_, writeErr := conn.Write(protocol.EncodeClientMessage(&protocol.ClientMessage{
+		// The lock tag was decoded from a valid frame, so it always encodes.
+		// The write is only queued, a slow client does not hold up others, so
+		// the write stage of traced acquires is recorded once the message
+		// has been written.
+		var written func()
+		if trace != nil {
+			queued := time.Now()
+			written = func() {
+				write := time.Since(queued)
+				trace.Observe(vault.StageWrite, write)
+				logTrace(log.Info(), trace).
+					Str("tag", lockTag).
+					Dur("write", write).
+					Msg("acquired")
+			}
+		}
+		writeErr := conn.queueClientMessage(&protocol.ClientMessage{
 			Type:    protocol.Acquired,
 			LockTag: lockTag,
-		}))
+		}, written)
 		if writeErr != nil {
-			log.Error().Err(writeErr).Msg("failed to write to client")
+			logTrace(log.Error(), trace).Err(writeErr).Msg("failed to write to client")
 			return writeErr
 		}
 
@@ -168,14 +962,33 @@ func (locksmith *Locksmith) acquireCallback(
 // callback is called with an error, the client has misbehaved in some way and
 // needs to be disconnected.
 func (locksmith *Locksmith) releaseCallback(
-	conn net.Conn,
+	conn *clientConn,
+	lockTag string,
+	trace *vault.Trace,
 ) func(error) error {
 	return func(err error) error {
+		defer conn.inFlight.Add(-1)
 		if err != nil {
-			log.Error().Err(err).Msg("got error in release callback")
+			logTrace(log.Error(), trace).Err(err).Msg("got error in release callback")
 			conn.Close()
+			return nil
+		}
+		if trace != nil {
+			logTrace(log.Info(), trace).Str("tag", lockTag).Msg("released")
 		}
 
 		return nil
 	}
 }
+
+// Adds the trace ID and the timings recorded so far to a log event, if the
+// operation is traced.
+func logTrace(event *zerolog.Event, trace *vault.Trace) *zerolog.Event {
+	if trace == nil {
+		return event
+	}
+	return event.
+		Str("trace_id", trace.TraceID).
+		Dur("queue_wait", trace.QueueWait).
+		Dur("waitlist_wait", trace.WaitlistWait)
+}
@@ -1,13 +1,67 @@
 package locksmith
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/maansthoernvik/locksmith/pkg/client"
+	"github.com/maansthoernvik/locksmith/pkg/connection"
+	"github.com/maansthoernvik/locksmith/pkg/protocol"
+	"github.com/maansthoernvik/locksmith/pkg/vault"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
 )
 
+// Listens on a free port of the loopback interface, for tests needing
+// connections to come from an IP, or a socket to hand over.
+func listenLocal(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	return listener
+}
+
+// The port of a listener from listenLocal.
+func localPort(listener net.Listener) uint16 {
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Listens like listenLocal, returning the listening socket as a file to adopt
+// along with its port. The listener itself is closed.
+func listenLocalFile(t *testing.T) (*os.File, uint16) {
+	t.Helper()
+	listener := listenLocal(t)
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal("Failed to get listener file:", err)
+	}
+	return file, localPort(listener)
+}
+
 func TestServer_Stop(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	locksmith := New(&LocksmithOptions{Port: 30001})
+	locksmith := New(&LocksmithOptions{Listener: connection.NewMemoryListener("stop")})
 
 	go func() {
 		cancel()
@@ -20,3 +74,1849 @@ func TestServer_Stop(t *testing.T) {
 
 	t.Log("Locksmith stopped")
 }
+
+func TestServer_InMemory(t *testing.T) {
+	listener := connection.NewMemoryListener("locksmith")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{
+			Listener:         listener,
+			QueueConcurrency: 2,
+			QueueCapacity:    10,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	first, second := make(chan string, 1), make(chan string, 1)
+	firstClient := client.NewClient(&client.ClientOptions{
+		DialContext: listener.DialContext,
+		OnAcquired:  func(lockTag string) { first <- lockTag },
+	})
+	secondClient := client.NewClient(&client.ClientOptions{
+		DialContext: listener.DialContext,
+		OnAcquired:  func(lockTag string) { second <- lockTag },
+	})
+	for _, c := range []client.Client{firstClient, secondClient} {
+		if err := c.Connect(); err != nil {
+			t.Fatal("Failed to connect client:", err)
+		}
+		defer c.Close()
+	}
+
+	// The clients are told apart, the second waits for the first to release.
+	_ = firstClient.Acquire("abc")
+	<-first
+	_ = secondClient.Acquire("abc")
+	select {
+	case <-second:
+		t.Fatal("Expected the second client to wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_ = firstClient.Release("abc")
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Fatal("Lock was never handed to the second client")
+	}
+}
+
+func TestServer_HeartbeatTimeout(t *testing.T) {
+	listener := connection.NewMemoryListener("heartbeat")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	locksmith := New(&LocksmithOptions{
+		Listener:         listener,
+		QueueConcurrency: 1,
+		QueueCapacity:    10,
+		HeartbeatTimeout: 50 * time.Millisecond,
+	})
+	go func() {
+		_ = locksmith.Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal("Failed to dial Locksmith:", err)
+	}
+	defer conn.Close()
+
+	// A ping is answered with a pong.
+	writeServerMessage(t, conn, &protocol.ServerMessage{Type: protocol.Ping})
+	buffer := make([]byte, 257)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal("Failed to read pong:", err)
+	}
+	if cm, err := protocol.DecodeClientMessage(buffer[:n]); err != nil || cm.Type != protocol.Pong {
+		t.Fatal("Expected a pong, got:", buffer[:n], err)
+	}
+
+	writeServerMessage(t, conn, &protocol.ServerMessage{Type: protocol.Acquire, LockTag: "lt"})
+	if _, err := conn.Read(buffer); err != nil {
+		t.Fatal("Failed to read acquired:", err)
+	}
+
+	// Going silent should get the connection closed by the server...
+	_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, err := conn.Read(buffer); err != io.EOF {
+		t.Fatal("Expected the server to close the silent connection, got:", err)
+	}
+
+	// ...and its lock released for others to acquire.
+	other, err := listener.Dial()
+	if err != nil {
+		t.Fatal("Failed to dial Locksmith:", err)
+	}
+	defer other.Close()
+	writeServerMessage(t, other, &protocol.ServerMessage{Type: protocol.Acquire, LockTag: "lt"})
+	_ = other.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, err = other.Read(buffer)
+	if err != nil {
+		t.Fatal("Expected the lock to be acquirable after cleanup:", err)
+	}
+	if cm, err := protocol.DecodeClientMessage(buffer[:n]); err != nil || cm.Type != protocol.Acquired {
+		t.Fatal("Expected an acquired message, got:", buffer[:n], err)
+	}
+}
+
+func writeServerMessage(t *testing.T, conn net.Conn, serverMessage *protocol.ServerMessage) {
+	t.Helper()
+	bytes, err := protocol.EncodeServerMessage(serverMessage)
+	if err != nil {
+		t.Fatal("Failed to encode server message:", err)
+	}
+	if _, err := conn.Write(bytes); err != nil {
+		t.Fatal("Failed to write server message:", err)
+	}
+}
+
+func TestServer_Batch(t *testing.T) {
+	listener := connection.NewMemoryListener("batch")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{Listener: listener, QueueConcurrency: 4, QueueCapacity: 10}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	batchResults := make(chan []protocol.OperationResult)
+	c := client.NewClient(&client.ClientOptions{
+		DialContext: listener.DialContext,
+		OnBatchResult: func(results []protocol.OperationResult) {
+			batchResults <- results
+		},
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal("Failed to connect client:", err)
+	}
+	defer c.Close()
+
+	err := c.(client.BatchClient).Batch([]protocol.Operation{
+		{Type: protocol.Acquire, LockTag: "a"},
+		{Type: protocol.Acquire, LockTag: "b"},
+		{Type: protocol.Release, LockTag: "a"},
+		{Type: protocol.Release, LockTag: "c"},
+	})
+	if err != nil {
+		t.Fatal("Failed to send batch:", err)
+	}
+
+	expected := []protocol.ResultCode{
+		protocol.ResultOK, protocol.ResultOK, protocol.ResultOK, protocol.ResultUnnecessaryRelease,
+	}
+	select {
+	case results := <-batchResults:
+		if len(results) != len(expected) {
+			t.Fatal("Unexpected number of results:", results)
+		}
+		for i, code := range expected {
+			if results[i].Code != code {
+				t.Errorf("Result %d: expected code %d, got %d", i, code, results[i].Code)
+			}
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Timed out waiting for batch result")
+	}
+
+	// The client is still connected despite the unnecessary release, and
+	// still holds "b".
+	if err := c.(client.BatchClient).Batch([]protocol.Operation{{Type: protocol.Release, LockTag: "b"}}); err != nil {
+		t.Fatal("Failed to send batch:", err)
+	}
+	select {
+	case results := <-batchResults:
+		if results[0].Code != protocol.ResultOK {
+			t.Error("Expected release of b to succeed, got code:", results[0].Code)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Timed out waiting for batch result")
+	}
+}
+
+// Compares acquiring and releasing a set of lock tags one message at a time
+// against doing the same with one batch for acquires and one for releases.
+func Benchmark_Batch(b *testing.B) {
+	listener := connection.NewMemoryListener("benchmark")
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.TraceLevel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{Listener: listener, QueueConcurrency: 10, QueueCapacity: 100}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	const numberOfTags = 50
+	lockTags := make([]string, numberOfTags)
+	for i := range lockTags {
+		lockTags[i] = fmt.Sprintf("benchmark-lock-tag-%d", i)
+	}
+
+	b.Run("Individual", func(b *testing.B) {
+		acquired := make(chan string, numberOfTags)
+		c := client.NewClient(&client.ClientOptions{
+			DialContext: listener.DialContext,
+			OnAcquired:  func(lockTag string) { acquired <- lockTag },
+		})
+		if err := c.Connect(); err != nil {
+			b.Fatal("Failed to connect client:", err)
+		}
+		defer c.Close()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, lockTag := range lockTags {
+				_ = c.Acquire(lockTag)
+			}
+			for range lockTags {
+				<-acquired
+			}
+			for _, lockTag := range lockTags {
+				_ = c.Release(lockTag)
+			}
+		}
+	})
+
+	b.Run("Batched", func(b *testing.B) {
+		batchResults := make(chan []protocol.OperationResult, 1)
+		c := client.NewClient(&client.ClientOptions{
+			DialContext:   listener.DialContext,
+			OnBatchResult: func(results []protocol.OperationResult) { batchResults <- results },
+		})
+		if err := c.Connect(); err != nil {
+			b.Fatal("Failed to connect client:", err)
+		}
+		defer c.Close()
+
+		acquires := make([]protocol.Operation, numberOfTags)
+		releases := make([]protocol.Operation, numberOfTags)
+		for i, lockTag := range lockTags {
+			acquires[i] = protocol.Operation{Type: protocol.Acquire, LockTag: lockTag}
+			releases[i] = protocol.Operation{Type: protocol.Release, LockTag: lockTag}
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = c.(client.BatchClient).Batch(acquires)
+			<-batchResults
+			_ = c.(client.BatchClient).Batch(releases)
+			<-batchResults
+		}
+	})
+}
+
+func TestServer_TextProtocol(t *testing.T) {
+	textListener := connection.NewMemoryListener("text")
+	listener := connection.NewMemoryListener("binary")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{
+			Listener:         listener,
+			TextListener:     textListener,
+			QueueConcurrency: 1,
+			QueueCapacity:    10,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := textListener.Dial()
+	if err != nil {
+		t.Fatal("Failed to dial text listener:", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	reader := bufio.NewReader(conn)
+	expectLine := func(expected string) {
+		t.Helper()
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal("Failed to read line:", err)
+		}
+		if line != expected {
+			t.Fatalf("Expected %q, got %q", expected, line)
+		}
+	}
+
+	_, _ = conn.Write([]byte("PING\nacquire lt\n"))
+	expectLine("PONG\n")
+	expectLine("ACQUIRED lt\n")
+	_, _ = conn.Write([]byte("BOGUS\n"))
+	expectLine("ERROR unknown command\n")
+
+	// Binary clients wait for locks held by text clients.
+	acquired := make(chan string, 1)
+	c := client.NewClient(&client.ClientOptions{
+		DialContext: listener.DialContext,
+		OnAcquired:  func(lockTag string) { acquired <- lockTag },
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal("Failed to connect client:", err)
+	}
+	defer c.Close()
+	_ = c.Acquire("lt")
+
+	select {
+	case <-acquired:
+		t.Fatal("Binary client acquired a lock held by the text client")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	_, _ = conn.Write([]byte("RELEASE lt\n"))
+	expectLine("RELEASED lt\n")
+	select {
+	case <-acquired:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Binary client did not acquire the released lock")
+	}
+
+	// Releasing a lock held by someone else gets the text client disconnected.
+	_, _ = conn.Write([]byte("RELEASE lt\n"))
+	expectLine("ERROR " + vault.ErrBadManners.Error() + "\n")
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Fatal("Expected the text connection to be closed, got:", err)
+	}
+}
+
+func TestServer_RESP(t *testing.T) {
+	respListener := connection.NewMemoryListener("resp")
+	listener := connection.NewMemoryListener("binary")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{
+			Listener:         listener,
+			RESPListener:     respListener,
+			QueueConcurrency: 2,
+			QueueCapacity:    10,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := respListener.Dial()
+		if err != nil {
+			t.Fatal("Failed to dial RESP listener:", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	// A minimal RESP client, sending commands as arrays of bulk strings and
+	// reading back single line replies, or bulk strings.
+	command := func(conn net.Conn, reader *bufio.Reader, arguments ...string) string {
+		t.Helper()
+		request := fmt.Sprintf("*%d\r\n", len(arguments))
+		for _, argument := range arguments {
+			request += fmt.Sprintf("$%d\r\n%s\r\n", len(argument), argument)
+		}
+		if _, err := conn.Write([]byte(request)); err != nil {
+			t.Fatal("Failed to write RESP command:", err)
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal("Failed to read RESP reply:", err)
+		}
+		if reply[0] == '$' && reply != "$-1\r\n" {
+			bulk, _ := reader.ReadString('\n')
+			reply += bulk
+		}
+		return reply
+	}
+
+	conn, reader := dial()
+	defer conn.Close()
+	other, otherReader := dial()
+	defer other.Close()
+	// As sent by redsync, and its SHA1 as clients compute it.
+	unlockScript := `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+	unlockSHA := fmt.Sprintf("%x", sha1.Sum([]byte(unlockScript)))
+
+	expectations := []struct {
+		conn      net.Conn
+		reader    *bufio.Reader
+		arguments []string
+		reply     string
+	}{
+		{conn, reader, []string{"PING"}, "+PONG\r\n"},
+		{conn, reader, []string{"SET", "lock", "token1", "NX", "PX", "30000"}, "+OK\r\n"},
+		{other, otherReader, []string{"SET", "lock", "token2", "NX"}, "$-1\r\n"},
+		{other, otherReader, []string{"GET", "lock"}, "$6\r\ntoken1\r\n"},
+		{other, otherReader, []string{"DELIFEQ", "lock", "token2"}, ":0\r\n"},
+		// Ownership follows the value, not the connection.
+		{other, otherReader, []string{"DELIFEQ", "lock", "token1"}, ":1\r\n"},
+		{conn, reader, []string{"GET", "lock"}, "$-1\r\n"},
+		{conn, reader, []string{"SET", "lock", "token1"}, "-ERR only SET with NX is supported\r\n"},
+		{conn, reader, []string{"SET", "lock", "token1", "NX", "PX", "soon"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{conn, reader, []string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'\r\n"},
+		{conn, reader, []string{"SET", "expiring", "token1", "NX", "PX", "20"}, "+OK\r\n"},
+		// The compare-and-delete script Redis lock libraries unlock with.
+		{conn, reader, []string{"SET", "script", "token1", "NX"}, "+OK\r\n"},
+		{other, otherReader, []string{"EVAL", unlockScript, "1", "script", "token2"}, ":0\r\n"},
+		{conn, reader, []string{"EVAL", unlockScript, "1", "script", "token1"}, ":1\r\n"},
+		{conn, reader, []string{"EVAL", "return 1", "0"}, "-ERR only the compare-and-delete unlock script is supported\r\n"},
+		{conn, reader, []string{"EVALSHA", strings.Repeat("0", 40), "1", "script", "token1"}, "-NOSCRIPT No matching script. Please use EVAL.\r\n"},
+		{conn, reader, []string{"SCRIPT", "LOAD", unlockScript}, "$40\r\n" + unlockSHA + "\r\n"},
+		{conn, reader, []string{"SET", "script", "token1", "NX"}, "+OK\r\n"},
+		{other, otherReader, []string{"EVALSHA", unlockSHA, "1", "script", "token1"}, ":1\r\n"},
+		// redis-py's variant of the script.
+		{conn, reader, []string{"SET", "script", "token1", "NX"}, "+OK\r\n"},
+		{conn, reader, []string{"EVAL", "\n    local token = redis.call('get', KEYS[1])\n    if not token or token ~= ARGV[1] then\n        return 0\n    end\n    redis.call('del', KEYS[1])\n    return 1\n", "1", "script", "token1"}, ":1\r\n"},
+		// DEL releases RESP locks whatever their value.
+		{conn, reader, []string{"SET", "deleted", "token1", "NX"}, "+OK\r\n"},
+		{other, otherReader, []string{"DEL", "deleted", "missing"}, ":1\r\n"},
+		{conn, reader, []string{"GET", "deleted"}, "$-1\r\n"},
+	}
+	for _, expectation := range expectations {
+		reply := command(expectation.conn, expectation.reader, expectation.arguments...)
+		if reply != expectation.reply {
+			t.Fatalf("%v: expected %q, got %q", expectation.arguments, expectation.reply, reply)
+		}
+	}
+
+	// Locks with a time to live are released once it runs out.
+	time.Sleep(50 * time.Millisecond)
+	if reply := command(other, otherReader, "SET", "expiring", "token2", "NX"); reply != "+OK\r\n" {
+		t.Fatal("Expected the expired lock to be acquirable, got:", reply)
+	}
+
+	if reply := command(conn, reader, "QUIT"); reply != "+OK\r\n" {
+		t.Fatal("Unexpected QUIT reply:", reply)
+	}
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Fatal("Expected QUIT to close the connection, got:", err)
+	}
+}
+
+func TestServer_HTTPGateway(t *testing.T) {
+	locksmith := New(&LocksmithOptions{
+		QueueConcurrency:   2,
+		QueueCapacity:      10,
+		HTTPSessionTimeout: 200 * time.Millisecond,
+	})
+	server := httptest.NewServer(locksmith.HTTPHandler())
+	defer server.Close()
+
+	post := func(path string, request any) (int, map[string]any) {
+		t.Helper()
+		body, _ := json.Marshal(request)
+		response, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal("Request failed:", err)
+		}
+		defer response.Body.Close()
+		reply := map[string]any{}
+		if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+			t.Fatal("Failed to decode reply:", err)
+		}
+		return response.StatusCode, reply
+	}
+	expect := func(path string, request any, status int, field string, value any) {
+		t.Helper()
+		gotStatus, reply := post(path, request)
+		if gotStatus != status || reply[field] != value {
+			t.Fatalf("%s %v: expected %d with %s=%v, got %d %v", path, request, status, field, value, gotStatus, reply)
+		}
+	}
+	newSession := func() string {
+		t.Helper()
+		status, reply := post("/v1/sessions", map[string]any{})
+		if status != http.StatusCreated {
+			t.Fatal("Failed to create session:", status, reply)
+		}
+		return reply["session"].(string)
+	}
+	type request map[string]any
+
+	a, b := newSession(), newSession()
+	expect("/v1/try-acquire", request{"session": a, "lock_tag": "lt"}, http.StatusOK, "acquired", true)
+	expect("/v1/try-acquire", request{"session": b, "lock_tag": "lt"}, http.StatusOK, "acquired", false)
+	// Times out, leaving an abandoned acquire behind in the waitlist.
+	expect("/v1/acquire", request{"session": b, "lock_tag": "lt", "timeout_ms": 20}, http.StatusOK, "acquired", false)
+
+	acquired := make(chan map[string]any)
+	go func() {
+		_, reply := post("/v1/acquire", request{"session": b, "lock_tag": "lt", "timeout_ms": 1000})
+		acquired <- reply
+	}()
+	time.Sleep(20 * time.Millisecond)
+	expect("/v1/inspect", request{"session": a, "lock_tag": "lt"}, http.StatusOK, "owned", true)
+	expect("/v1/inspect", request{"session": b, "lock_tag": "lt"}, http.StatusOK, "owned", false)
+
+	// The abandoned acquire is skipped, the long-polling one gets the lock.
+	expect("/v1/release", request{"session": a, "lock_tag": "lt"}, http.StatusOK, "released", true)
+	select {
+	case reply := <-acquired:
+		if reply["acquired"] != true {
+			t.Fatal("Expected the long-polled acquire to succeed, got:", reply)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Long-polled acquire did not return")
+	}
+	expect("/v1/inspect", request{"session": a, "lock_tag": "lt"}, http.StatusOK, "waiting", float64(0))
+	expect("/v1/release", request{"session": a, "lock_tag": "lt"}, http.StatusConflict, "error", vault.ErrBadManners.Error())
+	// Acquiring again keeps the lock rather than giving it up.
+	expect("/v1/acquire", request{"session": b, "lock_tag": "lt"}, http.StatusOK, "acquired", true)
+	expect("/v1/inspect", request{"session": b, "lock_tag": "lt"}, http.StatusOK, "owned", true)
+
+	expect("/v1/acquire", request{"session": "nope", "lock_tag": "lt"}, http.StatusNotFound, "error", errHTTPSession.Error())
+	expect("/v1/acquire", request{"session": a, "lock_tag": ""}, http.StatusBadRequest, "error", errHTTPLockTag.Error())
+
+	// Idle sessions expire, releasing their locks. Session a is kept alive.
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		expect("/v1/keepalive", request{"session": a}, http.StatusOK, "session", a)
+	}
+	expect("/v1/inspect", request{"session": b, "lock_tag": "lt"}, http.StatusNotFound, "error", errHTTPSession.Error())
+	expect("/v1/try-acquire", request{"session": a, "lock_tag": "lt"}, http.StatusOK, "acquired", true)
+
+	expect("/v1/sessions/close", request{"session": a}, http.StatusOK, "session", a)
+	expect("/v1/keepalive", request{"session": a}, http.StatusNotFound, "error", errHTTPSession.Error())
+}
+
+func TestServer_HTTPSessionClose(t *testing.T) {
+	locksmith := New(&LocksmithOptions{
+		QueueConcurrency: 2,
+		QueueCapacity:    10,
+	})
+	server := httptest.NewServer(locksmith.HTTPHandler())
+	defer server.Close()
+
+	post := func(path string, request map[string]any) (int, map[string]any) {
+		body, _ := json.Marshal(request)
+		response, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Error("Request failed:", err)
+			return 0, nil
+		}
+		defer response.Body.Close()
+		reply := map[string]any{}
+		_ = json.NewDecoder(response.Body).Decode(&reply)
+		return response.StatusCode, reply
+	}
+	newSession := func() string {
+		_, reply := post("/v1/sessions", map[string]any{})
+		return reply["session"].(string)
+	}
+
+	holder, waiter, next := newSession(), newSession(), newSession()
+	if _, reply := post("/v1/try-acquire", map[string]any{"session": holder, "lock_tag": "lt"}); reply["acquired"] != true {
+		t.Fatal("Expected the holder to get the lock, got:", reply)
+	}
+	waited := make(chan int)
+	go func() {
+		status, _ := post("/v1/acquire", map[string]any{"session": waiter, "lock_tag": "lt", "timeout_ms": 5000})
+		waited <- status
+	}()
+	for {
+		if _, reply := post("/v1/inspect", map[string]any{"session": holder, "lock_tag": "lt"}); reply["waiting"] == float64(1) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Closing the session answers its queued acquire right away.
+	if status, reply := post("/v1/sessions/close", map[string]any{"session": waiter}); status != http.StatusOK {
+		t.Fatal("Failed to close session:", status, reply)
+	}
+	select {
+	case status := <-waited:
+		if status != http.StatusNotFound {
+			t.Fatal("Expected the queued acquire to end with 404, got:", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Queued acquire was not answered when its session closed")
+	}
+
+	// The closed session never gets the lock, the next session does.
+	post("/v1/release", map[string]any{"session": holder, "lock_tag": "lt"})
+	if _, reply := post("/v1/acquire", map[string]any{"session": next, "lock_tag": "lt", "timeout_ms": 1000}); reply["acquired"] != true {
+		t.Fatal("Expected the next session to get the lock, got:", reply)
+	}
+}
+
+func TestServer_WebSocket(t *testing.T) {
+	webSocketListener := connection.NewMemoryListener("websocket")
+	listener := connection.NewMemoryListener("binary")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{
+			Listener:          listener,
+			WebSocketListener: webSocketListener,
+			QueueConcurrency:  2,
+			QueueCapacity:     10,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := webSocketListener.Dial()
+		if err != nil {
+			t.Fatal("Failed to dial WebSocket listener:", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(1 * time.Second))
+		webSocketConn, err := connection.ConnectWebSocket(conn, "localhost", "/")
+		if err != nil {
+			t.Fatal("WebSocket handshake failed:", err)
+		}
+		return webSocketConn, bufio.NewReader(webSocketConn)
+	}
+	expectAcquired := func(reader *bufio.Reader) {
+		t.Helper()
+		frame, err := protocol.ReadFrame(reader, protocol.MaxLockTagSize)
+		if err != nil {
+			t.Fatal("Failed to read frame:", err)
+		}
+		if cm, err := protocol.DecodeClientMessage(frame); err != nil || cm.Type != protocol.Acquired || cm.LockTag != "lt" {
+			t.Fatal("Expected an acquired message, got:", frame, err)
+		}
+	}
+
+	first, firstReader := dial()
+	writeServerMessage(t, first, &protocol.ServerMessage{Type: protocol.Acquire, LockTag: "lt"})
+	expectAcquired(firstReader)
+
+	second, secondReader := dial()
+	defer second.Close()
+	writeServerMessage(t, second, &protocol.ServerMessage{Type: protocol.Acquire, LockTag: "lt"})
+
+	// Closing the first WebSocket releases its lock, just like for plain
+	// connections.
+	first.Close()
+	expectAcquired(secondReader)
+}
+
+func TestServer_Watch(t *testing.T) {
+	listener := connection.NewMemoryListener("watch")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{Listener: listener, QueueConcurrency: 2, QueueCapacity: 10}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	type event struct {
+		lockTag string
+		kind    protocol.EventKind
+	}
+	events := make(chan event, 10)
+	watcher := client.NewClient(&client.ClientOptions{
+		DialContext: listener.DialContext,
+		OnEvent: func(lockTag string, kind protocol.EventKind, owner string) {
+			events <- event{lockTag, kind}
+		},
+	})
+	if err := watcher.Connect(); err != nil {
+		t.Fatal("Failed to connect watcher:", err)
+	}
+	defer watcher.Close()
+	if err := watcher.(client.Watcher).Watch("db/", true); err != nil {
+		t.Fatal("Failed to watch:", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	acquired := make(chan string, 1)
+	holder := client.NewClient(&client.ClientOptions{
+		DialContext: listener.DialContext,
+		OnAcquired:  func(lockTag string) { acquired <- lockTag },
+	})
+	if err := holder.Connect(); err != nil {
+		t.Fatal("Failed to connect holder:", err)
+	}
+	_ = holder.Acquire("other")
+	_ = holder.Acquire("db/users")
+	<-acquired
+	<-acquired
+	_ = holder.Release("db/users")
+	_ = holder.Acquire("db/orders")
+	<-acquired
+	// Disconnecting releases db/orders through cleanup.
+	holder.Close()
+
+	for _, expected := range []event{
+		{"db/users", protocol.EventAcquire},
+		{"db/users", protocol.EventRelease},
+		{"db/orders", protocol.EventAcquire},
+		{"db/orders", protocol.EventCleanup},
+	} {
+		select {
+		case got := <-events:
+			if got != expected {
+				t.Fatalf("Expected %v, got %v", expected, got)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("Missing event", expected)
+		}
+	}
+}
+
+func TestServer_JSONCodec(t *testing.T) {
+	listener := connection.NewMemoryListener("json")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{Listener: listener, QueueConcurrency: 2, QueueCapacity: 10}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Plain JSON frames, as written by hand.
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal("Failed to dial Locksmith:", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for _, exchange := range []struct{ request, response string }{
+		{"31\n{\"type\":\"acquire\",\"tag\":\"abc\"}\n", "32\n{\"type\":\"acquired\",\"tag\":\"abc\"}\n"},
+		{"16\n{\"type\":\"ping\"}\n", "16\n{\"type\":\"pong\"}\n"},
+	} {
+		if _, err := conn.Write([]byte(exchange.request)); err != nil {
+			t.Fatal("Failed to write:", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		response := make([]byte, len(exchange.response))
+		if _, err := io.ReadFull(reader, response); err != nil || string(response) != exchange.response {
+			t.Fatalf("Expected %q, got %q %v", exchange.response, response, err)
+		}
+	}
+
+	// The sample client speaks JSON when asked to, binary clients share locks
+	// with it.
+	results := make(chan []protocol.OperationResult, 1)
+	jsonClient := client.NewClient(&client.ClientOptions{
+		DialContext:   listener.DialContext,
+		Codec:         protocol.JSONCodec{},
+		OnBatchResult: func(r []protocol.OperationResult) { results <- r },
+	})
+	if err := jsonClient.Connect(); err != nil {
+		t.Fatal("Failed to connect client:", err)
+	}
+	if err := jsonClient.(client.BatchClient).Batch([]protocol.Operation{
+		{Type: protocol.Acquire, LockTag: "def"},
+		{Type: protocol.Release, LockTag: "ghi"},
+	}); err != nil {
+		t.Fatal("Failed to send batch:", err)
+	}
+	select {
+	case r := <-results:
+		if len(r) != 2 || r[0].Code != protocol.ResultOK || r[1].Code != protocol.ResultUnnecessaryRelease {
+			t.Fatal("Unexpected batch results:", r)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Missing batch result")
+	}
+
+	acquired := make(chan string, 1)
+	binaryClient := client.NewClient(&client.ClientOptions{
+		DialContext: listener.DialContext,
+		OnAcquired:  func(lockTag string) { acquired <- lockTag },
+	})
+	if err := binaryClient.Connect(); err != nil {
+		t.Fatal("Failed to connect client:", err)
+	}
+	defer binaryClient.Close()
+	_ = binaryClient.Acquire("def")
+	select {
+	case lockTag := <-acquired:
+		t.Fatal("Expected def to still be held by the JSON client, got", lockTag)
+	case <-time.After(50 * time.Millisecond):
+	}
+	jsonClient.Close()
+	select {
+	case <-acquired:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Expected def to be granted once the JSON client disconnected")
+	}
+}
+
+func TestServer_Trace(t *testing.T) {
+	listener := connection.NewMemoryListener("trace")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{Listener: listener, QueueConcurrency: 2, QueueCapacity: 10}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// In-memory connections are unbuffered, the grant cannot be written until
+	// it is read.
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	defer conn.Close()
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	frame, _ := protocol.EncodeServerMessage(&protocol.ServerMessage{
+		Type:        protocol.Acquire,
+		LockTag:     "lt",
+		TraceParent: traceParent,
+	})
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal("Failed to acquire:", err)
+	}
+	const readDelay = 50 * time.Millisecond
+	time.Sleep(readDelay)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if frame, err := protocol.ReadFrame(bufio.NewReader(conn), protocol.MaxLockTagSize); err != nil {
+		t.Fatal("Lock was never acquired:", err)
+	} else if message, _ := protocol.DecodeClientMessage(frame); message == nil || message.Type != protocol.Acquired {
+		t.Fatal("Expected an Acquired message, got:", message)
+	}
+
+	c := client.NewClient(&client.ClientOptions{DialContext: listener.DialContext})
+	if err := c.Connect(); err != nil {
+		t.Fatal("Failed to connect client:", err)
+	}
+	defer c.Close()
+	if err := c.(client.TracingClient).TracedAcquire("lt", "00-nope"); err == nil {
+		t.Fatal("Expected an invalid trace parent to be refused")
+	}
+
+	// The trace ID follows the acquire from the vault to the write, which
+	// lasts until the client has read the grant.
+	traced := func() map[string]float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal("Failed to gather metrics:", err)
+		}
+		traced := map[string]float64{}
+		for _, family := range families {
+			if family.GetName() != "locksmith_stage_duration_seconds" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				for _, bucket := range metric.GetHistogram().GetBucket() {
+					for _, label := range bucket.GetExemplar().GetLabel() {
+						if label.GetName() == "trace_id" && label.GetValue() == "4bf92f3577b34da6a3ce929d0e0e4736" {
+							traced[metric.GetLabel()[0].GetValue()] = bucket.GetExemplar().GetValue()
+						}
+					}
+				}
+			}
+		}
+		return traced
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		stages := traced()
+		_, queueWait := stages[vault.StageQueueWait]
+		if queueWait && stages[vault.StageWrite] >= readDelay.Seconds() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected queue wait and a write lasting until the read to be tagged with the trace ID, got:", stages)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServer_UnixSocket(t *testing.T) {
+	listener := connection.NewMemoryListener("binary")
+	socketPath := filepath.Join(t.TempDir(), "locksmith.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{
+			Listener:         listener,
+			QueueConcurrency: 2,
+			QueueCapacity:    10,
+			UnixSocketPath:   socketPath,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	owners := make(chan string, 10)
+	watcher := client.NewClient(&client.ClientOptions{
+		SocketPath: socketPath,
+		OnEvent: func(lockTag string, kind protocol.EventKind, owner string) {
+			if kind == protocol.EventAcquire {
+				owners <- owner
+			}
+		},
+	})
+	if err := watcher.Connect(); err != nil {
+		t.Fatal("Failed to connect watcher:", err)
+	}
+	defer watcher.Close()
+	if err := watcher.(client.Watcher).Watch("abc", false); err != nil {
+		t.Fatal("Failed to watch:", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Both clients connect from this process, they are still told apart.
+	first, second := make(chan string, 1), make(chan string, 1)
+	firstClient := client.NewClient(&client.ClientOptions{
+		SocketPath: socketPath,
+		OnAcquired: func(lockTag string) { first <- lockTag },
+	})
+	secondClient := client.NewClient(&client.ClientOptions{
+		SocketPath: socketPath,
+		OnAcquired: func(lockTag string) { second <- lockTag },
+	})
+	for _, c := range []client.Client{firstClient, secondClient} {
+		if err := c.Connect(); err != nil {
+			t.Fatal("Failed to connect client:", err)
+		}
+		defer c.Close()
+	}
+
+	_ = firstClient.Acquire("abc")
+	<-first
+	_ = secondClient.Acquire("abc")
+	select {
+	case <-second:
+		t.Fatal("Second client was granted a held lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_ = firstClient.Release("abc")
+	select {
+	case <-second:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Second client was not granted the lock")
+	}
+
+	// Owners are identified by their peer credentials.
+	prefix := fmt.Sprintf("unix:uid=%d,pid=%d,conn=", os.Getuid(), os.Getpid())
+	for i := 0; i < 2; i++ {
+		select {
+		case owner := <-owners:
+			if runtime.GOOS == "linux" && !strings.HasPrefix(owner, prefix) {
+				t.Fatalf("Expected owner starting with %q, got %q", prefix, owner)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("Missing acquire event")
+		}
+	}
+}
+
+func TestServer_Listeners(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("connection/testcerts/testcert.pem", "connection/testcerts/testkey.key")
+	if err != nil {
+		t.Fatal("Failed to load cert and key pair:", err)
+	}
+	caCert, err := os.ReadFile("connection/testcerts/rootCACert.pem")
+	if err != nil {
+		t.Fatal("Failed to read CA cert:", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caCert)
+
+	// Bound ahead, and adopted by the listeners, so that their addresses are
+	// known.
+	plainFile, plainPort := listenLocalFile(t)
+	tlsFile, tlsPort := listenLocalFile(t)
+	plainAddress, tlsAddress := fmt.Sprintf("127.0.0.1:%d", plainPort), fmt.Sprintf("localhost:%d", tlsPort)
+	listeners, err := ParseListeners(plainAddress+", tls://"+tlsAddress, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal("Failed to parse listeners:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- New(&LocksmithOptions{
+			Listeners: listeners,
+			ListenerFiles: map[string]*os.File{
+				"binary:" + plainAddress: plainFile,
+				"binary:" + tlsAddress:   tlsFile,
+			},
+			QueueConcurrency: 2,
+			QueueCapacity:    10,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Plaintext on one address, mutual TLS on the other, sharing locks.
+	plainAcquired, tlsAcquired := make(chan string, 1), make(chan string, 1)
+	plainClient := client.NewClient(&client.ClientOptions{
+		Host:       "127.0.0.1",
+		Port:       plainPort,
+		OnAcquired: func(lockTag string) { plainAcquired <- lockTag },
+	})
+	tlsClient := client.NewClient(&client.ClientOptions{
+		Host: "localhost",
+		Port: tlsPort,
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+		},
+		OnAcquired: func(lockTag string) { tlsAcquired <- lockTag },
+	})
+	for _, c := range []client.Client{plainClient, tlsClient} {
+		if err := c.Connect(); err != nil {
+			t.Fatal("Failed to connect client:", err)
+		}
+		defer c.Close()
+	}
+
+	_ = plainClient.Acquire("abc")
+	<-plainAcquired
+	_ = tlsClient.Acquire("abc")
+	_ = plainClient.Release("abc")
+	select {
+	case <-tlsAcquired:
+	case <-time.After(1 * time.Second):
+		t.Fatal("TLS client was not granted the lock")
+	}
+
+	// The TLS address does not take plaintext connections.
+	conn, err := net.Dial("tcp", tlsAddress)
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	_, _ = conn.Write([]byte{0x00, 0x01, 'x', 0x00, 0x00})
+	_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Fatal("Plaintext client was answered on the TLS address")
+	}
+	conn.Close()
+
+	// All listeners stop together.
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Fatal("Unexpected error stopping:", err)
+	}
+	for _, address := range []string{plainAddress, tlsAddress} {
+		if conn, err := net.DialTimeout("tcp", address, 100*time.Millisecond); err == nil {
+			conn.Close()
+			t.Fatal("Listener still accepting on", address)
+		}
+	}
+}
+
+func TestServer_ListenersStartTogether(t *testing.T) {
+	// The second address is taken, so the first is not left listening.
+	taken := listenLocal(t)
+	defer taken.Close()
+	first, port := listenLocalFile(t)
+	firstAddress := fmt.Sprintf("127.0.0.1:%d", port)
+
+	err := New(&LocksmithOptions{
+		Listeners:        []Listener{{Address: firstAddress}, {Address: taken.Addr().String()}},
+		ListenerFiles:    map[string]*os.File{"binary:" + firstAddress: first},
+		QueueConcurrency: 2,
+		QueueCapacity:    10,
+	}).Start(context.Background())
+	if err == nil {
+		t.Fatal("Expected an error starting on a taken address")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if conn, err := net.DialTimeout("tcp", firstAddress, 100*time.Millisecond); err == nil {
+		conn.Close()
+		t.Fatal("First listener was left accepting")
+	}
+}
+
+func TestParseListeners(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	listeners, err := ParseListeners("127.0.0.1:9000,tls://10.0.0.5:9443, [::1]:9000,", tlsConfig)
+	if err != nil {
+		t.Fatal("Failed to parse listeners:", err)
+	}
+	expected := []Listener{
+		{Address: "127.0.0.1:9000"},
+		{Address: "10.0.0.5:9443", TlsConfig: tlsConfig},
+		{Address: "[::1]:9000"},
+	}
+	if len(listeners) != len(expected) {
+		t.Fatal("Unexpected listeners:", listeners)
+	}
+	for i := range expected {
+		if listeners[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected[i], listeners[i])
+		}
+	}
+
+	if _, err := ParseListeners("tls://10.0.0.5:9443", nil); !errors.Is(err, ErrListenerTls) {
+		t.Fatal("Expected ErrListenerTls, got", err)
+	}
+	if _, err := ParseListeners("10.0.0.5", tlsConfig); err == nil {
+		t.Fatal("Expected an error for an address without port")
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	listener := connection.NewMemoryListener("idle")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{
+			Listener:         listener,
+			QueueConcurrency: 2,
+			QueueCapacity:    10,
+			IdleTimeout:      100 * time.Millisecond,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal("Failed to dial Locksmith:", err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	send := func(conn net.Conn, messageType protocol.ServerMessageType, lockTag string) {
+		frame, _ := protocol.EncodeServerMessage(&protocol.ServerMessage{Type: messageType, LockTag: lockTag})
+		if _, err := conn.Write(frame); err != nil {
+			t.Fatal("Failed to write:", err)
+		}
+	}
+	expectAcquired := func(reader *bufio.Reader, conn net.Conn) {
+		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		if _, err := protocol.ReadFrameInto(reader, nil, protocol.MaxLockTagSize); err != nil {
+			t.Fatal("Expected acquired, got", err)
+		}
+	}
+
+	// A connection that never sends anything is closed.
+	silent, silentReader := dial()
+	defer silent.Close()
+	// The holder and the waiter go quiet as well, but are not idle.
+	holder, holderReader := dial()
+	defer holder.Close()
+	send(holder, protocol.Acquire, "abc")
+	expectAcquired(holderReader, holder)
+	waiter, waiterReader := dial()
+	defer waiter.Close()
+	send(waiter, protocol.Acquire, "abc")
+
+	_ = silent.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, err := silentReader.ReadByte(); err != io.EOF {
+		t.Fatal("Expected the silent connection to be closed, got", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	send(holder, protocol.Release, "abc")
+	expectAcquired(waiterReader, waiter)
+}
+
+func TestServer_WriteTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &clientConn{Conn: server, codec: protocol.BinaryCodec{}}
+	conn.queue = newWriteQueue(server, 1, 50*time.Millisecond, nil)
+	conn.queue.start()
+	defer conn.queue.flush()
+
+	// Nobody reads from the pipe, so the write cannot complete.
+	if err := conn.writeClientMessage(&protocol.ClientMessage{Type: protocol.Pong}); err != nil {
+		t.Fatal("Failed to queue message:", err)
+	}
+	// The connection is closed, as a partial frame may have been written.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected the connection to be closed, got", err)
+	}
+	if err := conn.writeClientMessage(&protocol.ClientMessage{Type: protocol.Pong}); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("Expected the queue to be closed, got", err)
+	}
+}
+
+func TestServer_SlowReader(t *testing.T) {
+	listener := connection.NewMemoryListener("binary")
+	socketPath := filepath.Join(t.TempDir(), "locksmith.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{
+			Listener: listener,
+			// Every lock is handled by the same synchronization Go-routine.
+			QueueConcurrency: 1,
+			QueueCapacity:    10,
+			UnixSocketPath:   socketPath,
+			WriteQueueSize:   4,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Never reads, Unix domain sockets have small buffers which fill up fast.
+	stalled, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal("Failed to dial Locksmith:", err)
+	}
+	defer stalled.Close()
+	padding := strings.Repeat("x", 1000)
+	closed := false
+	for i := 0; i < 10000 && !closed; i++ {
+		frame, _ := protocol.EncodeServerMessage(&protocol.ServerMessage{
+			Type:    protocol.Acquire,
+			LockTag: fmt.Sprintf("%s%d", padding, i),
+		})
+		_ = stalled.SetWriteDeadline(time.Now().Add(time.Second))
+		_, err := stalled.Write(frame)
+		closed = err != nil
+	}
+	if !closed {
+		t.Fatal("Expected the stalled client to be disconnected")
+	}
+
+	acquired := make(chan string, 1)
+	other := client.NewClient(&client.ClientOptions{
+		SocketPath: socketPath,
+		OnAcquired: func(lockTag string) { acquired <- lockTag },
+	})
+	if err := other.Connect(); err != nil {
+		t.Fatal("Failed to connect client:", err)
+	}
+	defer other.Close()
+	_ = other.Acquire("abc")
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Grant was held up by the stalled client")
+	}
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	// Connections from the same IP share its identity.
+	listener := listenLocal(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{
+			Listener:             listener,
+			QueueConcurrency:     2,
+			QueueCapacity:        10,
+			RequestRate:          0.1,
+			RequestBurst:         2,
+			IdentityRequestRate:  0.1,
+			IdentityRequestBurst: 3,
+			RateLimitPolicy:      RateLimitReject,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal("Failed to dial Locksmith:", err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	acquire := func(conn net.Conn, reader *bufio.Reader, lockTag string) protocol.ClientMessageType {
+		writeServerMessage(t, conn, &protocol.ServerMessage{Type: protocol.Acquire, LockTag: lockTag})
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		frame, err := protocol.ReadFrameInto(reader, nil, protocol.MaxLockTagSize)
+		if err != nil {
+			t.Fatal("Failed to read answer:", err)
+		}
+		clientMessage, err := protocol.DecodeClientMessage(frame)
+		if err != nil || clientMessage.LockTag != lockTag {
+			t.Fatal("Unexpected answer:", clientMessage, err)
+		}
+		return clientMessage.Type
+	}
+	connectionThrottled := throttledRequests(t, ThrottleConnectionRate)
+	identityThrottled := throttledRequests(t, ThrottleIdentityRate)
+
+	first, firstReader := dial()
+	defer first.Close()
+	for _, lockTag := range []string{"a", "b"} {
+		if messageType := acquire(first, firstReader, lockTag); messageType != protocol.Acquired {
+			t.Fatal("Expected acquired within the burst, got", messageType)
+		}
+	}
+	if messageType := acquire(first, firstReader, "c"); messageType != protocol.Throttled {
+		t.Fatal("Expected the connection to be throttled, got", messageType)
+	}
+
+	// Connections from the same source IP share the rest of its burst.
+	second, secondReader := dial()
+	defer second.Close()
+	if messageType := acquire(second, secondReader, "d"); messageType != protocol.Acquired {
+		t.Fatal("Expected acquired within the identity's burst, got", messageType)
+	}
+	if messageType := acquire(second, secondReader, "e"); messageType != protocol.Throttled {
+		t.Fatal("Expected the identity to be throttled, got", messageType)
+	}
+
+	if throttledRequests(t, ThrottleConnectionRate) != connectionThrottled+1 ||
+		throttledRequests(t, ThrottleIdentityRate) != identityThrottled+1 {
+		t.Fatal("Expected throttled requests to be counted by reason")
+	}
+}
+
+func TestServer_RateLimitDelay(t *testing.T) {
+	listener := connection.NewMemoryListener("rate-limit")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{
+			Listener:         listener,
+			QueueConcurrency: 2,
+			QueueCapacity:    10,
+			RequestRate:      10,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	acquired := make(chan string, 3)
+	c := client.NewClient(&client.ClientOptions{
+		DialContext: listener.DialContext,
+		OnAcquired:  func(lockTag string) { acquired <- lockTag },
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	for _, lockTag := range []string{"a", "b", "c"} {
+		_ = c.Acquire(lockTag)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-acquired:
+		case <-time.After(time.Second):
+			t.Fatal("Delayed acquire was never granted")
+		}
+	}
+	// The first acquire uses up the burst, the others wait their turn.
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Fatal("Expected acquires to be delayed, took", elapsed)
+	}
+}
+
+func TestServer_RateLimitTextRESP(t *testing.T) {
+	for _, policy := range []RateLimitPolicy{RateLimitReject, RateLimitDelay} {
+		t.Run(string(policy), func(t *testing.T) {
+			textListener := connection.NewMemoryListener("rate-limit-text")
+			respListener := connection.NewMemoryListener("rate-limit-resp")
+			listener := connection.NewMemoryListener("rate-limit-binary")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				_ = New(&LocksmithOptions{
+					Listener:         listener,
+					TextListener:     textListener,
+					RESPListener:     respListener,
+					QueueConcurrency: 2,
+					QueueCapacity:    10,
+					RequestRate:      10,
+					RateLimitPolicy:  policy,
+				}).Start(ctx)
+			}()
+			time.Sleep(10 * time.Millisecond)
+
+			// Both requests are sent at once, the second is over the limit.
+			exchange := func(listener *connection.MemoryListener, request string, replies int) []string {
+				t.Helper()
+				conn, err := listener.Dial()
+				if err != nil {
+					t.Fatal("Failed to dial:", err)
+				}
+				defer conn.Close()
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				go func() { _, _ = conn.Write([]byte(request)) }()
+				reader := bufio.NewReader(conn)
+				lines := make([]string, replies)
+				for i := range lines {
+					if lines[i], err = reader.ReadString('\n'); err != nil {
+						t.Fatal("Failed to read reply:", err)
+					}
+				}
+				return lines
+			}
+
+			start := time.Now()
+			text := exchange(textListener, "ACQUIRE a\nACQUIRE b\n", 2)
+			resp := exchange(respListener,
+				"*4\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\nv\r\n$2\r\nNX\r\n"+
+					"*4\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\nv\r\n$2\r\nNX\r\n", 2)
+
+			expectedText := []string{"ACQUIRED a\n", "ACQUIRED b\n"}
+			expectedRESP := []string{"+OK\r\n", "+OK\r\n"}
+			if policy == RateLimitReject {
+				expectedText[1] = "ERROR " + ErrThrottled.Error() + "\n"
+				expectedRESP[1] = "-ERR " + ErrThrottled.Error() + "\r\n"
+			} else if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+				t.Fatal("Expected requests to be delayed, took", elapsed)
+			}
+			// Text replies to acquires come once granted, after a rejection.
+			sort.Strings(text)
+			sort.Strings(expectedText)
+			for i := range expectedText {
+				if text[i] != expectedText[i] || resp[i] != expectedRESP[i] {
+					t.Fatalf("Expected %q and %q, got %q and %q", expectedText, expectedRESP, text, resp)
+				}
+			}
+		})
+	}
+}
+
+// Returns the number of requests throttled for the reason so far.
+func throttledRequests(t *testing.T, reason string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal("Failed to gather metrics:", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "locksmith_requests_throttled" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == reason {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestServer_DisconnectWhileWaitlisted(t *testing.T) {
+	listener := connection.NewMemoryListener("disconnect-waitlisted")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = New(&LocksmithOptions{
+			Listener:         listener,
+			QueueConcurrency: 2,
+			QueueCapacity:    10,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	acquired := make(chan string, 10)
+	holder := client.NewClient(&client.ClientOptions{
+		DialContext: listener.DialContext,
+		OnAcquired:  func(lockTag string) { acquired <- lockTag },
+	})
+	if err := holder.Connect(); err != nil {
+		t.Fatal("Failed to connect holder:", err)
+	}
+	defer holder.Close()
+	awaitAcquired := func(lockTag string) {
+		t.Helper()
+		select {
+		case got := <-acquired:
+			if got != lockTag {
+				t.Fatal("Unexpected acquire of", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Lock was never granted:", lockTag)
+		}
+	}
+
+	// The lock is released as the waiter disconnects, granting it to the
+	// waiter on its way out, which must not keep it.
+	for i := 0; i < 20; i++ {
+		lockTag := fmt.Sprintf("lt%d", i)
+		_ = holder.Acquire(lockTag)
+		awaitAcquired(lockTag)
+
+		waiter := client.NewClient(&client.ClientOptions{DialContext: listener.DialContext})
+		if err := waiter.Connect(); err != nil {
+			t.Fatal("Failed to connect waiter:", err)
+		}
+		_ = waiter.Acquire(lockTag)
+		time.Sleep(time.Millisecond)
+		waiter.Close()
+		_ = holder.Release(lockTag)
+
+		_ = holder.Acquire(lockTag)
+		awaitAcquired(lockTag)
+		_ = holder.Release(lockTag)
+	}
+}
+
+func TestServer_GracefulShutdown(t *testing.T) {
+	listener := connection.NewMemoryListener("shutdown")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error)
+	go func() {
+		stopped <- New(&LocksmithOptions{
+			Listener:         listener,
+			QueueConcurrency: 2,
+			QueueCapacity:    10,
+			DrainTimeout:     5 * time.Second,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	acquired := make(chan string, 1)
+	shuttingDown := make(chan interface{}, 1)
+	holder := client.NewClient(&client.ClientOptions{
+		DialContext:          listener.DialContext,
+		OnAcquired:           func(lockTag string) { acquired <- lockTag },
+		OnServerShuttingDown: func() { shuttingDown <- nil },
+	})
+	if err := holder.Connect(); err != nil {
+		t.Fatal("Failed to connect client:", err)
+	}
+	defer holder.Close()
+	_ = holder.Acquire("abc")
+	<-acquired
+
+	// A client without locks is told as well.
+	idle, err := listener.Dial()
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	defer idle.Close()
+	ping, _ := protocol.EncodeServerMessage(&protocol.ServerMessage{Type: protocol.Ping})
+	_, _ = idle.Write(ping)
+	idleReader := bufio.NewReader(idle)
+	_ = idle.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if frame, err := protocol.ReadFrameInto(idleReader, nil, protocol.MaxLockTagSize); err != nil || frame[0] != byte(protocol.Pong) {
+		t.Fatal("Expected pong, got", frame, err)
+	}
+
+	cancel()
+	select {
+	case <-shuttingDown:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Holder was not told about the shutdown")
+	}
+	_ = idle.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if frame, err := protocol.ReadFrameInto(idleReader, nil, protocol.MaxLockTagSize); err != nil || frame[0] != byte(protocol.ShuttingDown) {
+		t.Fatal("Expected shutting down, got", frame, err)
+	}
+
+	// The server waits for the holder to release its lock.
+	select {
+	case <-stopped:
+		t.Fatal("Server stopped while a lock was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Listeners are closed while draining.
+	if conn, err := listener.Dial(); err == nil {
+		conn.Close()
+		t.Fatal("Listener still accepting while draining")
+	}
+	_ = holder.Release("abc")
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal("Unexpected error stopping:", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Server did not stop once drained")
+	}
+
+	// Remaining connections are closed by the time Start returns.
+	_ = idle.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, err := idleReader.ReadByte(); err != io.EOF {
+		t.Fatal("Expected the connection to be closed, got", err)
+	}
+}
+
+func TestServer_DrainTimeout(t *testing.T) {
+	listener := connection.NewMemoryListener("drain")
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- New(&LocksmithOptions{
+			Listener:         listener,
+			QueueConcurrency: 2,
+			QueueCapacity:    10,
+			DrainTimeout:     100 * time.Millisecond,
+		}).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	acquire, _ := protocol.EncodeServerMessage(&protocol.ServerMessage{Type: protocol.Acquire, LockTag: "abc"})
+	_, _ = conn.Write(acquire)
+	_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, err := protocol.ReadFrameInto(reader, nil, protocol.MaxLockTagSize); err != nil {
+		t.Fatal("Expected acquired, got", err)
+	}
+
+	// The holder never releases, so it is disconnected once the drain
+	// window has passed.
+	start := time.Now()
+	cancel()
+	if frame, err := protocol.ReadFrameInto(reader, nil, protocol.MaxLockTagSize); err != nil || frame[0] != byte(protocol.ShuttingDown) {
+		t.Fatal("Expected shutting down, got", frame, err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Server did not stop after the drain timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatal("Server stopped before the drain timeout:", elapsed)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatal("Expected the connection to be closed, got", err)
+	}
+}
+
+func TestServer_Handoff(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Handing over is only supported on Linux")
+	}
+	handoffSocket := filepath.Join(t.TempDir(), "handoff.sock")
+	options := LocksmithOptions{
+		QueueConcurrency: 2,
+		QueueCapacity:    10,
+		HandoffSocket:    handoffSocket,
+	}
+	// The old server's listener is handed over to the new one.
+	listener := listenLocal(t)
+	oldOptions := options
+	oldOptions.Listener = listener
+	stopped := make(chan error)
+	go func() {
+		stopped <- New(&oldOptions).Start(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	acquired := make(chan string, 1)
+	shuttingDown := make(chan interface{}, 1)
+	holder := client.NewClient(&client.ClientOptions{
+		Host:                 "127.0.0.1",
+		Port:                 localPort(listener),
+		OnAcquired:           func(lockTag string) { acquired <- lockTag },
+		OnServerShuttingDown: func() { shuttingDown <- nil },
+	})
+	if err := holder.Connect(); err != nil {
+		t.Fatal("Failed to connect client:", err)
+	}
+	defer holder.Close()
+	_ = holder.Acquire("abc")
+	<-acquired
+
+	waiter, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	defer waiter.Close()
+	writeServerMessage(t, waiter, &protocol.ServerMessage{Type: protocol.Acquire, LockTag: "abc"})
+	time.Sleep(10 * time.Millisecond)
+	// Half a frame is read by the old server, the rest by the new one.
+	ping, _ := protocol.EncodeServerMessage(&protocol.ServerMessage{Type: protocol.Ping})
+	_, _ = waiter.Write(ping[:1])
+	time.Sleep(10 * time.Millisecond)
+
+	handoff, err := ReceiveHandoff(handoffSocket)
+	if err != nil {
+		t.Fatal("Failed to receive handoff:", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal("Unexpected error handing over:", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Old server did not stop once handed over")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newOptions := options
+	newOptions.Handoff = handoff
+	go func() {
+		_ = New(&newOptions).Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	_, _ = waiter.Write(ping[1:])
+	waiterReader := bufio.NewReader(waiter)
+	_ = waiter.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if frame, err := protocol.ReadFrameInto(waiterReader, nil, protocol.MaxLockTagSize); err != nil || frame[0] != byte(protocol.Pong) {
+		t.Fatal("Expected pong, got", frame, err)
+	}
+
+	// The waiter is still in line for the lock, which the holder still holds.
+	_ = holder.Release("abc")
+	_ = waiter.SetReadDeadline(time.Now().Add(1 * time.Second))
+	frame, err := protocol.ReadFrameInto(waiterReader, nil, protocol.MaxLockTagSize)
+	if err != nil {
+		t.Fatal("Expected the waiter to acquire the lock:", err)
+	}
+	if message, err := protocol.DecodeClientMessage(frame); err != nil || message.Type != protocol.Acquired || message.LockTag != "abc" {
+		t.Fatal("Expected acquired, got", frame, err)
+	}
+
+	// New clients are accepted on the handed over listener.
+	newcomer := client.NewClient(&client.ClientOptions{
+		Host:       "127.0.0.1",
+		Port:       localPort(listener),
+		OnAcquired: func(lockTag string) { acquired <- lockTag },
+	})
+	if err := newcomer.Connect(); err != nil {
+		t.Fatal("Failed to connect client:", err)
+	}
+	defer newcomer.Close()
+	_ = newcomer.Acquire("def")
+	select {
+	case <-acquired:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Newcomer did not acquire its lock")
+	}
+
+	select {
+	case <-shuttingDown:
+		t.Fatal("Holder was told about a shutdown")
+	default:
+	}
+}
+
+func TestServer_HandoffRESPAndHTTP(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Handing over is only supported on Linux")
+	}
+	handoffSocket := filepath.Join(t.TempDir(), "handoff.sock")
+	options := LocksmithOptions{
+		QueueConcurrency:   2,
+		QueueCapacity:      10,
+		HandoffSocket:      handoffSocket,
+		HTTPSessionTimeout: time.Second,
+	}
+	oldOptions := options
+	oldOptions.Listener = listenLocal(t)
+	oldOptions.RESPListener = connection.NewMemoryListener("resp")
+	old := New(&oldOptions)
+	oldGateway := httptest.NewServer(old.HTTPHandler())
+	defer oldGateway.Close()
+	stopped := make(chan error)
+	go func() {
+		stopped <- old.Start(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	resp := func(listener *connection.MemoryListener, arguments ...string) string {
+		t.Helper()
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal("Failed to dial RESP listener:", err)
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		request := fmt.Sprintf("*%d\r\n", len(arguments))
+		for _, argument := range arguments {
+			request += fmt.Sprintf("$%d\r\n%s\r\n", len(argument), argument)
+		}
+		if _, err := conn.Write([]byte(request)); err != nil {
+			t.Fatal("Failed to write RESP command:", err)
+		}
+		reader := bufio.NewReader(conn)
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal("Failed to read RESP reply:", err)
+		}
+		if reply[0] == '$' && reply != "$-1\r\n" {
+			bulk, _ := reader.ReadString('\n')
+			reply += bulk
+		}
+		return reply
+	}
+	post := func(gateway *httptest.Server, path string, request any) (int, map[string]any) {
+		t.Helper()
+		body, _ := json.Marshal(request)
+		response, err := http.Post(gateway.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal("Request failed:", err)
+		}
+		defer response.Body.Close()
+		reply := map[string]any{}
+		if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+			t.Fatal("Failed to decode reply:", err)
+		}
+		return response.StatusCode, reply
+	}
+	expect := func(gateway *httptest.Server, path string, request any, status int, field string, value any) {
+		t.Helper()
+		gotStatus, reply := post(gateway, path, request)
+		if gotStatus != status || reply[field] != value {
+			t.Fatalf("%s %v: expected %d with %s=%v, got %d %v", path, request, status, field, value, gotStatus, reply)
+		}
+	}
+	type request map[string]any
+
+	if reply := resp(oldOptions.RESPListener.(*connection.MemoryListener), "SET", "expiring", "token", "NX", "PX", "300"); reply != "+OK\r\n" {
+		t.Fatal("Expected the RESP lock to be acquired, got", reply)
+	}
+	if reply := resp(oldOptions.RESPListener.(*connection.MemoryListener), "SET", "held", "token", "NX"); reply != "+OK\r\n" {
+		t.Fatal("Expected the RESP lock to be acquired, got", reply)
+	}
+	_, reply := post(oldGateway, "/v1/sessions", map[string]any{})
+	session, _ := reply["session"].(string)
+	expect(oldGateway, "/v1/try-acquire", request{"session": session, "lock_tag": "http"}, http.StatusOK, "acquired", true)
+
+	handoff, err := ReceiveHandoff(handoffSocket)
+	if err != nil {
+		t.Fatal("Failed to receive handoff:", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal("Unexpected error handing over:", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Old server did not stop once handed over")
+	}
+	// The old server no longer takes gateway requests.
+	expect(oldGateway, "/v1/sessions", map[string]any{}, http.StatusServiceUnavailable, "error", errHTTPHandoff.Error())
+	expect(oldGateway, "/v1/keepalive", request{"session": session}, http.StatusServiceUnavailable, "error", errHTTPHandoff.Error())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	respListener := connection.NewMemoryListener("resp")
+	newOptions := options
+	newOptions.RESPListener = respListener
+	newOptions.Handoff = handoff
+	successor := New(&newOptions)
+	gateway := httptest.NewServer(successor.HTTPHandler())
+	defer gateway.Close()
+	go func() {
+		_ = successor.Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// RESP locks are still owned by their value, until their time to live
+	// runs out.
+	if reply := resp(respListener, "SET", "held", "other", "NX"); reply != "$-1\r\n" {
+		t.Error("Expected the handed over RESP lock to be held, got", reply)
+	}
+	if reply := resp(respListener, "GET", "expiring"); reply != "$5\r\ntoken\r\n" {
+		t.Error("Expected the handed over RESP lock to be held, got", reply)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if reply := resp(respListener, "GET", "expiring"); reply != "$-1\r\n" {
+		t.Error("Expected the handed over RESP lock to expire, got", reply)
+	}
+	if reply := resp(respListener, "DELIFEQ", "held", "token"); reply != ":1\r\n" {
+		t.Error("Expected the handed over RESP lock to be released, got", reply)
+	}
+
+	// The session carries on with its lock.
+	expect(gateway, "/v1/inspect", request{"session": session, "lock_tag": "http"}, http.StatusOK, "owned", true)
+	expect(gateway, "/v1/release", request{"session": session, "lock_tag": "http"}, http.StatusOK, "released", true)
+	expect(gateway, "/v1/sessions/close", request{"session": session}, http.StatusOK, "session", session)
+}
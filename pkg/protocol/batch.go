@@ -0,0 +1,236 @@
+package protocol
+
+import (
+	"encoding/binary"
+)
+
+// Operation is a single Acquire or Release carried by a Batch message.
+//
+// Batch payloads are a sequence of operations:
+//
+//	msg type  lock tag size  lock tag
+//	1 byte    2 bytes        1 - 65535 bytes
+type Operation struct {
+	Type    ServerMessageType
+	LockTag string
+}
+
+// ResultCode tells the outcome of a single operation in a batch.
+type ResultCode byte
+
+const (
+	// The lock was acquired or released.
+	ResultOK ResultCode = 0
+	// The client tried to acquire a lock it already held, which it keeps.
+	ResultUnnecessaryAcquire ResultCode = 1
+	// The client tried to release a lock that was not acquired.
+	ResultUnnecessaryRelease ResultCode = 2
+	// The client tried to release a lock held by someone else.
+	ResultBadManners ResultCode = 3
+	// The batch was dropped for exceeding the server's rate limit.
+	ResultThrottled ResultCode = 4
+)
+
+// OperationResult is the outcome of an Operation, carried by a BatchResult
+// message.
+//
+// BatchResult payloads are a sequence of results:
+//
+//	msg type  result code  lock tag size  lock tag
+//	1 byte    1 byte       2 bytes        1 - 65535 bytes
+type OperationResult struct {
+	Type    ServerMessageType
+	LockTag string
+	Code    ResultCode
+}
+
+const (
+	operationHeaderSize       = 3
+	operationResultHeaderSize = 4
+)
+
+// serverMessagePayloadSize validates a ServerMessage and returns the size of
+// the payload of the frame that will carry it.
+func serverMessagePayloadSize(serverMessage *ServerMessage) (int, error) {
+	if serverMessage.TraceParent != "" {
+		if serverMessage.Type != Acquire && serverMessage.Type != Release {
+			return 0, ErrServerMessageType
+		}
+		if !ValidTraceParent(serverMessage.TraceParent) {
+			return 0, ErrTraceParent
+		}
+	}
+	if serverMessage.Type != Batch {
+		if err := validateLockTag(serverMessage.LockTag); err != nil {
+			return 0, err
+		}
+		size := len(serverMessage.LockTag)
+		if serverMessage.TraceParent != "" {
+			size += 1 + len(serverMessage.TraceParent)
+		}
+		if size > MaxLockTagSize {
+			return 0, ErrLockTagTooLong
+		}
+		return size, nil
+	}
+
+	if len(serverMessage.Operations) == 0 {
+		return 0, ErrBatchSize
+	}
+	size := 0
+	for _, operation := range serverMessage.Operations {
+		if operation.Type != Acquire && operation.Type != Release {
+			return 0, ErrServerMessageType
+		}
+		if err := validateLockTag(operation.LockTag); err != nil {
+			return 0, err
+		}
+		size += operationHeaderSize + len(operation.LockTag)
+	}
+	if size > MaxLockTagSize {
+		return 0, ErrBatchSize
+	}
+
+	return size, nil
+}
+
+// appendServerMessagePayload appends the payload of a validated ServerMessage.
+func appendServerMessagePayload(dst []byte, serverMessage *ServerMessage) []byte {
+	if serverMessage.Type != Batch {
+		if serverMessage.TraceParent != "" {
+			dst = append(dst, byte(len(serverMessage.TraceParent)))
+			dst = append(dst, serverMessage.TraceParent...)
+		}
+		return append(dst, serverMessage.LockTag...)
+	}
+	for _, operation := range serverMessage.Operations {
+		dst = append(dst, byte(operation.Type))
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(operation.LockTag)))
+		dst = append(dst, operation.LockTag...)
+	}
+	return dst
+}
+
+// clientMessagePayloadSize validates a ClientMessage and returns the size of
+// the payload of the frame that will carry it.
+func clientMessagePayloadSize(clientMessage *ClientMessage) (int, error) {
+	if clientMessage.Type == Event {
+		return eventPayloadSize(clientMessage)
+	}
+	if clientMessage.Type != BatchResult {
+		if err := validateLockTag(clientMessage.LockTag); err != nil {
+			return 0, err
+		}
+		return len(clientMessage.LockTag), nil
+	}
+
+	if len(clientMessage.Results) == 0 {
+		return 0, ErrBatchSize
+	}
+	size := 0
+	for _, result := range clientMessage.Results {
+		if err := validateLockTag(result.LockTag); err != nil {
+			return 0, err
+		}
+		size += operationResultHeaderSize + len(result.LockTag)
+	}
+	if size > MaxLockTagSize {
+		return 0, ErrBatchSize
+	}
+
+	return size, nil
+}
+
+// appendClientMessagePayload appends the payload of a validated ClientMessage.
+func appendClientMessagePayload(dst []byte, clientMessage *ClientMessage) []byte {
+	switch clientMessage.Type {
+	case Event:
+		return appendEventPayload(dst, clientMessage)
+	case BatchResult:
+		for _, result := range clientMessage.Results {
+			dst = append(dst, byte(result.Type), byte(result.Code))
+			dst = binary.BigEndian.AppendUint16(dst, uint16(len(result.LockTag)))
+			dst = append(dst, result.LockTag...)
+		}
+		return dst
+	}
+	return append(dst, clientMessage.LockTag...)
+}
+
+// decodeOperations decodes a Batch payload into operations, reusing its
+// memory and, where unchanged, its lock tags.
+func decodeOperations(payload []byte, operations []Operation) ([]Operation, error) {
+	previous := operations[:cap(operations)]
+	operations = operations[:0]
+	for len(payload) > 0 {
+		if len(payload) < operationHeaderSize {
+			return nil, ErrServerMessageDecode
+		}
+		operationType, err := decodeServerMessageType(payload)
+		if err != nil {
+			return nil, err
+		}
+		if operationType != Acquire && operationType != Release {
+			return nil, ErrServerMessageType
+		}
+		lockTagSize := int(binary.BigEndian.Uint16(payload[1:]))
+		payload = payload[operationHeaderSize:]
+		if lockTagSize == 0 {
+			return nil, ErrServerMessageDecode
+		}
+		if lockTagSize > len(payload) {
+			return nil, ErrLockTagSize
+		}
+		reused := ""
+		if len(operations) < len(previous) {
+			reused = previous[len(operations)].LockTag
+		}
+		lockTag, err := decodeLockTagReusing(payload[:lockTagSize], reused)
+		if err != nil {
+			return nil, err
+		}
+		payload = payload[lockTagSize:]
+
+		operations = append(operations, Operation{Type: operationType, LockTag: lockTag})
+	}
+
+	return operations, nil
+}
+
+// decodeOperationResults decodes a BatchResult payload into results, reusing
+// its memory and, where unchanged, its lock tags.
+func decodeOperationResults(payload []byte, results []OperationResult) ([]OperationResult, error) {
+	previous := results[:cap(results)]
+	results = results[:0]
+	for len(payload) > 0 {
+		if len(payload) < operationResultHeaderSize {
+			return nil, ErrClientMessageDecode
+		}
+		operationType, err := decodeServerMessageType(payload)
+		if err != nil {
+			return nil, err
+		}
+		code := ResultCode(payload[1])
+		lockTagSize := int(binary.BigEndian.Uint16(payload[2:]))
+		payload = payload[operationResultHeaderSize:]
+		if lockTagSize == 0 {
+			return nil, ErrClientMessageDecode
+		}
+		if lockTagSize > len(payload) {
+			return nil, ErrLockTagSize
+		}
+		reused := ""
+		if len(results) < len(previous) {
+			reused = previous[len(results)].LockTag
+		}
+		lockTag, err := decodeLockTagReusing(payload[:lockTagSize], reused)
+		if err != nil {
+			return nil, err
+		}
+		payload = payload[lockTagSize:]
+
+		results = append(results, OperationResult{Type: operationType, LockTag: lockTag, Code: code})
+	}
+
+	return results, nil
+}
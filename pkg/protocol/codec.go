@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+)
+
+// Codec reads, decodes and encodes messages in one wire format. Codecs hold
+// no state, a single Codec serves any number of connections.
+type Codec interface {
+	// ReadFrame reads exactly one frame from the reader into buffer, like
+	// ReadFrameInto, and returns it ready to be passed to a decoding method.
+	// Lock tags larger than maxLockTagSize are rejected with
+	// ErrLockTagTooLong, where the format allows telling before the frame has
+	// been read in full.
+	ReadFrame(reader io.Reader, buffer []byte, maxLockTagSize int) ([]byte, error)
+	// DecodeServerMessage decodes a frame into serverMessage.
+	DecodeServerMessage(frame []byte, serverMessage *ServerMessage) error
+	// DecodeClientMessage decodes a frame into clientMessage.
+	DecodeClientMessage(frame []byte, clientMessage *ClientMessage) error
+	// AppendServerMessage appends serverMessage's frame to dst. Nothing is
+	// appended on error.
+	AppendServerMessage(dst []byte, serverMessage *ServerMessage) ([]byte, error)
+	// AppendClientMessage appends clientMessage's frame to dst. Nothing is
+	// appended on error.
+	AppendClientMessage(dst []byte, clientMessage *ClientMessage) ([]byte, error)
+}
+
+// BinaryCodec is the Codec for binary frames, see ReadFrame for their layout.
+type BinaryCodec struct{}
+
+func (BinaryCodec) ReadFrame(reader io.Reader, buffer []byte, maxLockTagSize int) ([]byte, error) {
+	return ReadFrameInto(reader, buffer, maxLockTagSize)
+}
+
+func (BinaryCodec) DecodeServerMessage(frame []byte, serverMessage *ServerMessage) error {
+	return DecodeServerMessageInto(frame, serverMessage)
+}
+
+func (BinaryCodec) DecodeClientMessage(frame []byte, clientMessage *ClientMessage) error {
+	return DecodeClientMessageInto(frame, clientMessage)
+}
+
+func (BinaryCodec) AppendServerMessage(dst []byte, serverMessage *ServerMessage) ([]byte, error) {
+	return AppendServerMessage(dst, serverMessage)
+}
+
+func (BinaryCodec) AppendClientMessage(dst []byte, clientMessage *ClientMessage) ([]byte, error) {
+	return AppendClientMessage(dst, clientMessage)
+}
+
+// NegotiateCodec picks the codec of a connection by peeking at the first byte
+// the client sent, without consuming it. Binary frames start with a message
+// type or a frame version, JSON frames with the non-zero digit starting their
+// length. Binary message types stay below '0' so that the two never clash.
+// Errors from the reader are returned as is.
+func NegotiateCodec(reader *bufio.Reader) (Codec, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		return JSONCodec{}, nil
+	}
+	return BinaryCodec{}, nil
+}
+
+// Makes sure both codecs implement the interface.
+var (
+	_ Codec = BinaryCodec{}
+	_ Codec = JSONCodec{}
+)
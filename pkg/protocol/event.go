@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"unicode/utf8"
+)
+
+// EventKind tells what happened to a lock in an Event message.
+//
+// Event payloads hold the kind, the lock tag and the lock's owner:
+//
+//	event kind  lock tag size  lock tag        owner
+//	1 byte      2 bytes        1 - 65535 bytes the rest of the payload
+type EventKind byte
+
+const (
+	// The lock was acquired by the owner.
+	EventAcquire EventKind = 0
+	// The lock was released by the owner.
+	EventRelease EventKind = 1
+	// The owner's time to live for the lock ran out.
+	EventExpire EventKind = 2
+	// The owner disconnected while holding the lock.
+	EventCleanup EventKind = 3
+)
+
+const eventHeaderSize = 3
+
+// eventPayloadSize validates an Event message and returns the size of the
+// payload of the frame that will carry it.
+func eventPayloadSize(clientMessage *ClientMessage) (int, error) {
+	if clientMessage.EventKind > EventCleanup {
+		return 0, ErrClientMessageType
+	}
+	if clientMessage.LockTag == "" {
+		return 0, ErrClientMessageDecode
+	}
+	if err := validateLockTag(clientMessage.LockTag); err != nil {
+		return 0, err
+	}
+	if !utf8.ValidString(clientMessage.Owner) {
+		return 0, ErrLockTagEncoding
+	}
+	size := eventHeaderSize + len(clientMessage.LockTag) + len(clientMessage.Owner)
+	if size > MaxLockTagSize {
+		return 0, ErrLockTagTooLong
+	}
+
+	return size, nil
+}
+
+// appendEventPayload appends the payload of a validated Event message.
+func appendEventPayload(dst []byte, clientMessage *ClientMessage) []byte {
+	dst = append(dst, byte(clientMessage.EventKind))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(clientMessage.LockTag)))
+	dst = append(dst, clientMessage.LockTag...)
+	return append(dst, clientMessage.Owner...)
+}
+
+// decodeEvent decodes an Event payload into clientMessage, reusing its lock
+// tag and owner where unchanged.
+func decodeEvent(payload []byte, clientMessage *ClientMessage) error {
+	if len(payload) < eventHeaderSize {
+		return ErrClientMessageDecode
+	}
+	kind := EventKind(payload[0])
+	if kind > EventCleanup {
+		return ErrClientMessageType
+	}
+	lockTagSize := int(binary.BigEndian.Uint16(payload[1:]))
+	payload = payload[eventHeaderSize:]
+	if lockTagSize == 0 {
+		return ErrClientMessageDecode
+	}
+	if lockTagSize > len(payload) {
+		return ErrLockTagSize
+	}
+	lockTag, err := decodeLockTagReusing(payload[:lockTagSize], clientMessage.LockTag)
+	if err != nil {
+		return err
+	}
+	owner, err := decodeLockTagReusing(payload[lockTagSize:], clientMessage.Owner)
+	if err != nil {
+		return err
+	}
+
+	clientMessage.Type = Event
+	clientMessage.LockTag = lockTag
+	clientMessage.EventKind = kind
+	clientMessage.Owner = owner
+	return nil
+}
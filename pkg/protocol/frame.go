@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Frame layout constants.
+//
+// Version 0 (legacy) frames have no version byte and a one byte lock tag size:
+//
+//	msg type  lock tag size  lock tag
+//	1 byte    1 byte         0 - 255 bytes
+//
+// Versioned frames start with a byte that has FrameVersionFlag set, the lower
+// bits carry the version. Version 1 frames have a two byte, big endian, lock
+// tag size:
+//
+//	version  msg type  lock tag size  lock tag
+//	1 byte   1 byte    2 bytes        0 - 65535 bytes
+//
+// Message types are all below FrameVersionFlag, which is how the two are told
+// apart. Encoders pick version 0 whenever the lock tag fits, so that peers
+// unaware of versioned frames keep working for short lock tags.
+const (
+	FrameVersionFlag byte = 0x80
+	FrameVersion1    byte = 1
+
+	// The largest lock tag a version 0 frame can carry.
+	LegacyMaxLockTagSize = 255
+	// The largest lock tag any frame can carry.
+	MaxLockTagSize = 65535
+
+	legacyHeaderSize = 2
+	v1HeaderSize     = 4
+)
+
+// ReadFrame reads exactly one frame, of any version, from the reader and
+// returns it in full, ready to be passed to a decoding function. Lock tags
+// larger than maxLockTagSize are rejected with ErrLockTagTooLong before their
+// payload is read, batch frames are only bound by MaxLockTagSize, and traced
+// frames get room for their trace parent on top. Errors from
+// the reader are returned as is, an io.EOF is only returned if the reader
+// ended cleanly between two frames.
+func ReadFrame(reader io.Reader, maxLockTagSize int) ([]byte, error) {
+	return ReadFrameInto(reader, nil, maxLockTagSize)
+}
+
+// ReadFrameInto works like ReadFrame, but reads the frame into buffer, which
+// is only reallocated if the frame does not fit its capacity. The returned
+// frame shares buffer's memory, pass it back in to read the next frame without
+// allocating.
+func ReadFrameInto(reader io.Reader, buffer []byte, maxLockTagSize int) ([]byte, error) {
+	header := growFrame(buffer, v1HeaderSize)
+	if _, err := io.ReadFull(reader, header[:legacyHeaderSize]); err != nil {
+		return nil, err
+	}
+
+	typeIndex, headerSize := 0, legacyHeaderSize
+	if header[0]&FrameVersionFlag != 0 {
+		if header[0] != FrameVersionFlag|FrameVersion1 {
+			return nil, ErrFrameVersion
+		}
+		if _, err := io.ReadFull(reader, header[legacyHeaderSize:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		typeIndex, headerSize = 1, v1HeaderSize
+	}
+
+	lockTagSize, err := lockTagSizeFromHeader(header[:headerSize])
+	if err != nil {
+		return nil, err
+	}
+	// Batch frames carry several lock tags, which are checked individually
+	// once decoded. Traced frames carry a trace parent next to the lock tag.
+	if header[typeIndex]&TraceFlag != 0 {
+		maxLockTagSize += 1 + maxTraceParentSize
+	}
+	if lockTagSize > maxLockTagSize && header[typeIndex] != batchMessageType {
+		return nil, ErrLockTagTooLong
+	}
+
+	frame := growFrame(header, headerSize+lockTagSize)
+	if _, err := io.ReadFull(reader, frame[headerSize:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return frame, nil
+}
+
+// splitFrame splits a frame into its message type byte, communicated lock tag
+// size, and actual lock tag. errDecode is returned if the frame length is out
+// of bounds for its version.
+func splitFrame(bytes []byte, errDecode error) (byte, int, []byte, error) {
+	if len(bytes) < legacyHeaderSize {
+		return 0, 0, nil, errDecode
+	}
+
+	typeIndex, headerSize, maxLockTagSize := 0, legacyHeaderSize, LegacyMaxLockTagSize
+	if bytes[0]&FrameVersionFlag != 0 {
+		if bytes[0] != FrameVersionFlag|FrameVersion1 {
+			return 0, 0, nil, ErrFrameVersion
+		}
+		typeIndex, headerSize, maxLockTagSize = 1, v1HeaderSize, MaxLockTagSize
+	}
+	if len(bytes) < headerSize || len(bytes) > headerSize+maxLockTagSize {
+		return 0, 0, nil, errDecode
+	}
+
+	lockTagSize, err := lockTagSizeFromHeader(bytes[:headerSize])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return bytes[typeIndex], lockTagSize, bytes[headerSize:], nil
+}
+
+// Returns a slice of the given size, keeping buffer's contents and reusing
+// its memory if large enough.
+func growFrame(buffer []byte, size int) []byte {
+	if cap(buffer) >= size {
+		return buffer[:size]
+	}
+	grown := make([]byte, size)
+	copy(grown, buffer)
+	return grown
+}
+
+// appendFrameHeader appends the header of a frame holding the given message
+// type and payload size to dst, using the oldest frame version able to carry
+// the payload. The payload size may not exceed MaxLockTagSize.
+func appendFrameHeader(dst []byte, messageType byte, payloadSize int) []byte {
+	if payloadSize <= LegacyMaxLockTagSize {
+		return append(dst, messageType, byte(payloadSize))
+	}
+	dst = append(dst, FrameVersionFlag|FrameVersion1, messageType)
+	return binary.BigEndian.AppendUint16(dst, uint16(payloadSize))
+}
+
+func lockTagSizeFromHeader(header []byte) (int, error) {
+	switch len(header) {
+	case legacyHeaderSize:
+		return int(header[1]), nil
+	case v1HeaderSize:
+		return int(binary.BigEndian.Uint16(header[2:])), nil
+	}
+	return 0, ErrFrameVersion
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
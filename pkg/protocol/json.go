@@ -0,0 +1,321 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// JSONCodec is the Codec for length-prefixed JSON frames, for clients that
+// would rather not deal with binary frames, and for reading traffic with
+// plain tools. A JSON frame is the length of the JSON document in decimal,
+// a newline, and the document, which encoders end with a newline of its own:
+//
+//	31
+//	{"type":"acquire","tag":"abc"}
+//
+// Messages are JSON objects with a type and the fields that type needs:
+//
+//	{"type":"acquire","tag":"abc"}
+//	{"type":"release","tag":"abc"}
+//	{"type":"acquire","tag":"abc","traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+//	{"type":"ping"}
+//	{"type":"batch","operations":[{"type":"acquire","tag":"abc"}]}
+//	{"type":"watch","tag":"abc"}
+//	{"type":"watch_prefix","tag":"ab"}
+//	{"type":"acquired","tag":"abc"}
+//	{"type":"pong"}
+//	{"type":"shutting_down"}
+//	{"type":"batch_result","results":[{"type":"acquire","tag":"abc","code":"ok"}]}
+//	{"type":"event","tag":"abc","event":"acquire","owner":"127.0.0.1:50000"}
+//
+// Messages are held to the same limits as in binary frames, a message that
+// does not fit a binary frame is not valid in a JSON frame either.
+type JSONCodec struct{}
+
+// The largest JSON document a JSON frame may carry. Lock tags are bound by
+// MaxLockTagSize as in binary frames, this leaves room for escaping them.
+const MaxJSONFrameSize = 1 << 21
+
+// The number of digits needed for the length of the largest JSON frame.
+var maxJSONLengthDigits = len(strconv.Itoa(MaxJSONFrameSize))
+
+var serverMessageTypeNames = map[ServerMessageType]string{
+	Acquire:     "acquire",
+	Release:     "release",
+	Ping:        "ping",
+	Batch:       "batch",
+	Watch:       "watch",
+	WatchPrefix: "watch_prefix",
+}
+
+var clientMessageTypeNames = map[ClientMessageType]string{
+	Acquired:     "acquired",
+	Pong:         "pong",
+	ShuttingDown: "shutting_down",
+	BatchResult:  "batch_result",
+	Event:        "event",
+	Throttled:    "throttled",
+}
+
+var resultCodeNames = map[ResultCode]string{
+	ResultOK:                 "ok",
+	ResultUnnecessaryAcquire: "unnecessary_acquire",
+	ResultUnnecessaryRelease: "unnecessary_release",
+	ResultBadManners:         "bad_manners",
+	ResultThrottled:          "throttled",
+}
+
+var eventKindNames = map[EventKind]string{
+	EventAcquire: "acquire",
+	EventRelease: "release",
+	EventExpire:  "expire",
+	EventCleanup: "cleanup",
+}
+
+type jsonServerMessage struct {
+	Type        string          `json:"type"`
+	LockTag     string          `json:"tag,omitempty"`
+	Operations  []jsonOperation `json:"operations,omitempty"`
+	TraceParent string          `json:"traceparent,omitempty"`
+}
+
+type jsonOperation struct {
+	Type    string `json:"type"`
+	LockTag string `json:"tag"`
+}
+
+type jsonClientMessage struct {
+	Type    string                `json:"type"`
+	LockTag string                `json:"tag,omitempty"`
+	Results []jsonOperationResult `json:"results,omitempty"`
+	Event   string                `json:"event,omitempty"`
+	Owner   string                `json:"owner,omitempty"`
+}
+
+type jsonOperationResult struct {
+	Type    string `json:"type"`
+	LockTag string `json:"tag"`
+	Code    string `json:"code"`
+}
+
+// ReadFrame reads a JSON frame and returns the JSON document it carries.
+// Lock tags are only checked against maxLockTagSize once decoded, the length
+// of a JSON frame does not tell the size of its lock tags. Frames with a
+// malformed length, or longer than MaxJSONFrameSize, are rejected with
+// ErrFrameLength.
+func (JSONCodec) ReadFrame(reader io.Reader, buffer []byte, maxLockTagSize int) ([]byte, error) {
+	digit := growFrame(buffer, 1)
+	size := 0
+	for digits := 0; ; digits++ {
+		if _, err := io.ReadFull(reader, digit); err != nil {
+			if digits > 0 {
+				return nil, unexpectedEOF(err)
+			}
+			return nil, err
+		}
+		if digit[0] == '\n' && digits > 0 {
+			break
+		}
+		if digit[0] < '0' || digit[0] > '9' || (digits == 0 && digit[0] == '0') || digits == maxJSONLengthDigits {
+			return nil, ErrFrameLength
+		}
+		size = size*10 + int(digit[0]-'0')
+	}
+	if size > MaxJSONFrameSize {
+		return nil, ErrFrameLength
+	}
+
+	frame := growFrame(digit, size)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return frame, nil
+}
+
+func (JSONCodec) DecodeServerMessage(frame []byte, serverMessage *ServerMessage) error {
+	decoded := jsonServerMessage{}
+	if err := json.Unmarshal(frame, &decoded); err != nil {
+		return ErrServerMessageDecode
+	}
+	messageType, ok := lookupName(serverMessageTypeNames, decoded.Type)
+	if !ok {
+		return ErrServerMessageType
+	}
+
+	serverMessage.Type = messageType
+	serverMessage.LockTag = decoded.LockTag
+	serverMessage.TraceParent = decoded.TraceParent
+	serverMessage.Operations = serverMessage.Operations[:0]
+	switch messageType {
+	case Ping:
+		if decoded.LockTag != "" || len(decoded.Operations) != 0 || decoded.TraceParent != "" {
+			return ErrServerMessageDecode
+		}
+		return nil
+	case Batch:
+		if decoded.LockTag != "" {
+			return ErrServerMessageDecode
+		}
+		for _, operation := range decoded.Operations {
+			operationType, ok := lookupName(serverMessageTypeNames, operation.Type)
+			if !ok {
+				return ErrServerMessageType
+			}
+			if operation.LockTag == "" {
+				return ErrServerMessageDecode
+			}
+			serverMessage.Operations = append(serverMessage.Operations, Operation{
+				Type:    operationType,
+				LockTag: operation.LockTag,
+			})
+		}
+	default:
+		if decoded.LockTag == "" || len(decoded.Operations) != 0 {
+			return ErrServerMessageDecode
+		}
+	}
+
+	// The same limits as for binary frames apply.
+	_, err := serverMessagePayloadSize(serverMessage)
+	return err
+}
+
+func (JSONCodec) DecodeClientMessage(frame []byte, clientMessage *ClientMessage) error {
+	decoded := jsonClientMessage{}
+	if err := json.Unmarshal(frame, &decoded); err != nil {
+		return ErrClientMessageDecode
+	}
+	messageType, ok := lookupName(clientMessageTypeNames, decoded.Type)
+	if !ok {
+		return ErrClientMessageType
+	}
+
+	clientMessage.Type = messageType
+	clientMessage.LockTag = decoded.LockTag
+	clientMessage.Results = clientMessage.Results[:0]
+	clientMessage.EventKind = 0
+	clientMessage.Owner = ""
+	switch messageType {
+	case Pong, ShuttingDown:
+		if decoded.LockTag != "" {
+			return ErrClientMessageDecode
+		}
+		return nil
+	case BatchResult:
+		if decoded.LockTag != "" {
+			return ErrClientMessageDecode
+		}
+		for _, result := range decoded.Results {
+			operationType, ok := lookupName(serverMessageTypeNames, result.Type)
+			if !ok {
+				return ErrClientMessageType
+			}
+			code, ok := lookupName(resultCodeNames, result.Code)
+			if !ok || result.LockTag == "" {
+				return ErrClientMessageDecode
+			}
+			clientMessage.Results = append(clientMessage.Results, OperationResult{
+				Type:    operationType,
+				LockTag: result.LockTag,
+				Code:    code,
+			})
+		}
+	case Event:
+		kind, ok := lookupName(eventKindNames, decoded.Event)
+		if !ok {
+			return ErrClientMessageType
+		}
+		clientMessage.EventKind = kind
+		clientMessage.Owner = decoded.Owner
+	default:
+		if decoded.LockTag == "" {
+			return ErrClientMessageDecode
+		}
+	}
+
+	// The same limits as for binary frames apply.
+	_, err := clientMessagePayloadSize(clientMessage)
+	return err
+}
+
+func (JSONCodec) AppendServerMessage(dst []byte, serverMessage *ServerMessage) ([]byte, error) {
+	if _, err := serverMessagePayloadSize(serverMessage); err != nil {
+		return dst, err
+	}
+	messageType, ok := serverMessageTypeNames[serverMessage.Type]
+	if !ok {
+		return dst, ErrServerMessageType
+	}
+
+	encoded := jsonServerMessage{
+		Type:        messageType,
+		LockTag:     serverMessage.LockTag,
+		TraceParent: serverMessage.TraceParent,
+	}
+	for _, operation := range serverMessage.Operations {
+		encoded.Operations = append(encoded.Operations, jsonOperation{
+			Type:    serverMessageTypeNames[operation.Type],
+			LockTag: operation.LockTag,
+		})
+	}
+
+	return appendJSONFrame(dst, &encoded)
+}
+
+func (JSONCodec) AppendClientMessage(dst []byte, clientMessage *ClientMessage) ([]byte, error) {
+	if _, err := clientMessagePayloadSize(clientMessage); err != nil {
+		return dst, err
+	}
+	messageType, ok := clientMessageTypeNames[clientMessage.Type]
+	if !ok {
+		return dst, ErrClientMessageType
+	}
+
+	encoded := jsonClientMessage{Type: messageType, LockTag: clientMessage.LockTag}
+	for _, result := range clientMessage.Results {
+		encoded.Results = append(encoded.Results, jsonOperationResult{
+			Type:    serverMessageTypeNames[result.Type],
+			LockTag: result.LockTag,
+			Code:    resultCodeNames[result.Code],
+		})
+	}
+	if clientMessage.Type == Event {
+		encoded.Event = eventKindNames[clientMessage.EventKind]
+		encoded.Owner = clientMessage.Owner
+	}
+
+	return appendJSONFrame(dst, &encoded)
+}
+
+// Encodes the value as a JSON document ending with a newline, and appends it
+// to dst with its length in front.
+func appendJSONFrame(dst []byte, value any) ([]byte, error) {
+	document := bytes.Buffer{}
+	encoder := json.NewEncoder(&document)
+	// Lock tags are not headed for a browser, keep them readable.
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return dst, err
+	}
+	if document.Len() > MaxJSONFrameSize {
+		return dst, ErrFrameLength
+	}
+
+	dst = strconv.AppendInt(dst, int64(document.Len()), 10)
+	dst = append(dst, '\n')
+	return append(dst, document.Bytes()...), nil
+}
+
+// Finds the value going by the name.
+func lookupName[T comparable](names map[T]string, name string) (T, bool) {
+	for value, valueName := range names {
+		if valueName == name {
+			return value, true
+		}
+	}
+	var zero T
+	return zero, false
+}
@@ -15,6 +15,16 @@ type ServerMessageType byte
 const (
 	Acquire ServerMessageType = 0
 	Release ServerMessageType = 1
+	// Ping is a heartbeat carrying no lock tag, answered by a Pong.
+	Ping ServerMessageType = 2
+	// Batch carries several Acquire and Release operations, answered by a
+	// BatchResult once all of them have completed.
+	Batch ServerMessageType = ServerMessageType(batchMessageType)
+	// Watch subscribes to Event messages for the lock tag.
+	Watch ServerMessageType = 4
+	// WatchPrefix subscribes to Event messages for all lock tags starting with
+	// the lock tag.
+	WatchPrefix ServerMessageType = 5
 )
 
 // ClientMessageType encompasses all messages: Locksmith -> Client.
@@ -22,8 +32,25 @@ type ClientMessageType byte
 
 const (
 	Acquired ClientMessageType = 0
+	// Pong is the answer to a Ping, it carries no lock tag.
+	Pong ClientMessageType = 1
+	// ShuttingDown tells the client that the server is shutting down, and
+	// will close the connection once its locks have been released or the
+	// drain window has passed. It carries no lock tag.
+	ShuttingDown ClientMessageType = 2
+	// BatchResult carries the results of a Batch's operations.
+	BatchResult ClientMessageType = ClientMessageType(batchMessageType)
+	// Event tells a watching client what happened to a lock.
+	Event ClientMessageType = 4
+	// Throttled tells the client that its Acquire or Release of the lock tag
+	// was dropped for exceeding the server's rate limit.
+	Throttled ClientMessageType = 5
 )
 
+// Batch messages share their type number in both directions, so that frames
+// carrying batches can be recognized without knowing the direction.
+const batchMessageType byte = 3
+
 // Errors returned by encoding/decoding functions.
 var (
 	ErrServerMessageDecode = errors.New("server message decoding error")
@@ -32,117 +59,246 @@ var (
 	ErrClientMessageType   = errors.New("client message type not found")
 	ErrLockTagSize         = errors.New("lock tag size does not match actual lock tag size")
 	ErrLockTagEncoding     = errors.New("lock tag was not valid UTF8")
+	ErrLockTagTooLong      = errors.New("lock tag exceeds the maximum lock tag size")
+	ErrFrameVersion        = errors.New("frame version not supported")
+	ErrBatchSize           = errors.New("batch is empty or exceeds the maximum frame size")
+	ErrFrameLength         = errors.New("frame length is malformed or exceeds the maximum frame size")
 )
 
 // ServerMessage models a server-bound message.
 type ServerMessage struct {
 	Type    ServerMessageType
 	LockTag string
+	// Operations of a Batch message, each either an Acquire or a Release.
+	Operations []Operation
+	// An optional W3C traceparent of an Acquire or Release, see TraceFlag.
+	TraceParent string
 }
 
 // ClientMessage models a client-bound message.
 type ClientMessage struct {
 	Type    ClientMessageType
 	LockTag string
+	// Results of a BatchResult message, in the order of the batch's operations.
+	Results []OperationResult
+	// What happened to the lock, and to whom, in an Event message.
+	EventKind EventKind
+	Owner     string
 }
 
 // DecodeServerMessage decodes a slice of bytes into a ServerMessage pointer.
+// Both legacy and versioned frames are accepted, see ReadFrame.
 //
 // There are a few possible errors:
 //   - The length exceeds or is shorter than the possible bounds.
+//   - The frame version is not supported.
 //   - The lock tag size does not match the communicated size.
 //   - The server message type is not recognized.
 //   - The lock tag is not valid UTF8.
 func DecodeServerMessage(bytes []byte) (*ServerMessage, error) {
-	log.Debug().
-		Bytes("bytes", bytes).
-		Msg("decoding server message")
-	if len(bytes) < 3 || len(bytes) > 257 {
-		return nil, ErrServerMessageDecode
-	}
-	log.Debug().Str("tag", string(bytes[2:])).Send()
-	log.Debug().Int("tag-size", int(bytes[1])).Send()
-	if len(bytes[2:]) != int(bytes[1]) {
-		return nil, ErrLockTagSize
-	}
-	messageType, err := decodeServerMessageType(bytes)
-	if err != nil {
+	serverMessage := &ServerMessage{}
+	if err := DecodeServerMessageInto(bytes, serverMessage); err != nil {
 		return nil, err
 	}
-	lockTag, err := decodeLockTag(bytes)
+
+	return serverMessage, nil
+}
+
+// DecodeServerMessageInto works like DecodeServerMessage, but decodes into
+// the given ServerMessage, reusing the memory of its operations. Lock tags
+// equal to the ones already held by serverMessage are kept rather than
+// allocated again, so decoding a stream of messages into the same
+// ServerMessage only allocates for lock tags that change. On error,
+// serverMessage is left in an unspecified state.
+func DecodeServerMessageInto(bytes []byte, serverMessage *ServerMessage) error {
+	if e := log.Debug(); e.Enabled() {
+		e.Bytes("bytes", bytes).Msg("decoding server message")
+	}
+	typeByte, lockTagSize, rawLockTag, err := splitFrame(bytes, ErrServerMessageDecode)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	traced := typeByte&TraceFlag != 0
+	messageType, err := decodeServerMessageType([]byte{typeByte &^ TraceFlag})
+	if err != nil {
+		return err
+	}
+	if traced && messageType != Acquire && messageType != Release {
+		return ErrServerMessageType
+	}
+	serverMessage.Type = messageType
+	previousTraceParent := serverMessage.TraceParent
+	serverMessage.TraceParent = ""
+	if messageType == Ping {
+		if lockTagSize != 0 || len(rawLockTag) != 0 {
+			return ErrServerMessageDecode
+		}
+		serverMessage.LockTag = ""
+		serverMessage.Operations = serverMessage.Operations[:0]
+		return nil
+	}
+	if len(rawLockTag) == 0 {
+		return ErrServerMessageDecode
+	}
+	if len(rawLockTag) != lockTagSize {
+		return ErrLockTagSize
+	}
+	if messageType == Batch {
+		operations, err := decodeOperations(rawLockTag, serverMessage.Operations)
+		if err != nil {
+			return err
+		}
+		serverMessage.LockTag = ""
+		serverMessage.Operations = operations
+		return nil
 	}
+	if traced {
+		traceParent, rest, err := splitTraceParent(rawLockTag, previousTraceParent)
+		if err != nil {
+			return err
+		}
+		serverMessage.TraceParent = traceParent
+		rawLockTag = rest
+	}
+	lockTag, err := decodeLockTagReusing(rawLockTag, serverMessage.LockTag)
+	if err != nil {
+		return err
+	}
+	serverMessage.LockTag = lockTag
+	serverMessage.Operations = serverMessage.Operations[:0]
 
-	return &ServerMessage{Type: messageType, LockTag: lockTag}, nil
+	return nil
 }
 
 // EncodeServerMessage converts a ServerMessage into a slice of bytes to be sent over a wire.
-func EncodeServerMessage(serverMessage *ServerMessage) []byte {
-	bytes := make([]byte, 2+len(serverMessage.LockTag))
-	bytes[0] = byte(serverMessage.Type)
-	bytes[1] = byte(len(serverMessage.LockTag))
-	for i := 0; i < len(serverMessage.LockTag); i++ {
-		bytes[i+2] = byte(serverMessage.LockTag[i])
-	}
-	return bytes
+// Lock tags longer than LegacyMaxLockTagSize are encoded in a versioned frame.
+// An error is returned if the lock tag is too long to be encoded at all, or if
+// it is not valid UTF8. Batch messages are encoded from their operations, which
+// must not be empty nor add up to more than MaxLockTagSize bytes.
+func EncodeServerMessage(serverMessage *ServerMessage) ([]byte, error) {
+	return AppendServerMessage(nil, serverMessage)
+}
+
+// AppendServerMessage works like EncodeServerMessage, but appends the frame
+// to dst and returns the extended slice, only allocating if dst lacks the
+// capacity. Nothing is appended on error.
+func AppendServerMessage(dst []byte, serverMessage *ServerMessage) ([]byte, error) {
+	size, err := serverMessagePayloadSize(serverMessage)
+	if err != nil {
+		return dst, err
+	}
+	if dst == nil {
+		dst = make([]byte, 0, v1HeaderSize+size)
+	}
+	messageType := byte(serverMessage.Type)
+	if serverMessage.TraceParent != "" {
+		messageType |= TraceFlag
+	}
+	dst = appendFrameHeader(dst, messageType, size)
+
+	return appendServerMessagePayload(dst, serverMessage), nil
 }
 
 // DecodeClientMessage decodes a slice of bytes into a ClientMessage pointer.
+// Both legacy and versioned frames are accepted, see ReadFrame.
 //
 // There are a few possible errors:
 //   - The length exceeds or is shorter than the possible bounds.
+//   - The frame version is not supported.
 //   - The lock tag size does not match the communicated size.
 //   - The client message type is not recognized.
 //   - The lock tag is not valid UTF8.
 func DecodeClientMessage(bytes []byte) (*ClientMessage, error) {
-	log.Debug().
-		Bytes("bytes", bytes).
-		Msg("decoding client message")
-	if len(bytes) < 3 || len(bytes) > 257 {
-		return nil, ErrClientMessageDecode
-	}
-	log.Debug().Str("tag", string(bytes[2:])).Send()
-	log.Debug().Int("tag-size", int(bytes[1])).Send()
-	if len(bytes[2:]) != int(bytes[1]) {
-		return nil, ErrLockTagSize
-	}
-	messageType, err := decodeClientMessageType(bytes)
-	if err != nil {
+	clientMessage := &ClientMessage{}
+	if err := DecodeClientMessageInto(bytes, clientMessage); err != nil {
 		return nil, err
 	}
-	lockTag, err := decodeLockTag(bytes)
+
+	return clientMessage, nil
+}
+
+// DecodeClientMessageInto works like DecodeClientMessage, but decodes into the
+// given ClientMessage, reusing its memory like DecodeServerMessageInto. On
+// error, clientMessage is left in an unspecified state.
+func DecodeClientMessageInto(bytes []byte, clientMessage *ClientMessage) error {
+	if e := log.Debug(); e.Enabled() {
+		e.Bytes("bytes", bytes).Msg("decoding client message")
+	}
+	typeByte, lockTagSize, rawLockTag, err := splitFrame(bytes, ErrClientMessageDecode)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	messageType, err := decodeClientMessageType([]byte{typeByte})
+	if err != nil {
+		return err
+	}
+	clientMessage.Type = messageType
+	clientMessage.Results = clientMessage.Results[:0]
+	if messageType != Event {
+		clientMessage.EventKind = 0
+		clientMessage.Owner = ""
+	}
+	if messageType == Pong || messageType == ShuttingDown {
+		if lockTagSize != 0 || len(rawLockTag) != 0 {
+			return ErrClientMessageDecode
+		}
+		clientMessage.LockTag = ""
+		return nil
 	}
+	if len(rawLockTag) == 0 {
+		return ErrClientMessageDecode
+	}
+	if len(rawLockTag) != lockTagSize {
+		return ErrLockTagSize
+	}
+	switch messageType {
+	case BatchResult:
+		results, err := decodeOperationResults(rawLockTag, clientMessage.Results)
+		if err != nil {
+			return err
+		}
+		clientMessage.LockTag = ""
+		clientMessage.Results = results
+		return nil
+	case Event:
+		return decodeEvent(rawLockTag, clientMessage)
+	}
+	lockTag, err := decodeLockTagReusing(rawLockTag, clientMessage.LockTag)
+	if err != nil {
+		return err
+	}
+	clientMessage.LockTag = lockTag
 
-	return &ClientMessage{Type: messageType, LockTag: lockTag}, nil
+	return nil
 }
 
-// EncodeServerMessage converts a ServerMessage into a slice of bytes to be sent over a wire.
-func EncodeClientMessage(clientMessage *ClientMessage) []byte {
-	log.Debug().Msg("encoding client message")
-	bytes := make([]byte, 2+len(clientMessage.LockTag))
-	log.Debug().Int("len", len(bytes)).Msg("made slice")
-	bytes[0] = byte(Acquired)
-	log.Debug().
-		Bytes("bytes", bytes).
-		Msg("added 'Acquired' message type")
-	bytes[1] = byte(len(clientMessage.LockTag))
-	log.Debug().
-		Bytes("bytes", bytes).
-		Msg("added lock tag size")
-	log.Debug().
-		Str("tag", clientMessage.LockTag).
-		Msg("encoding lock tag")
-	for i := 0; i < len(clientMessage.LockTag); i++ {
-		bytes[i+2] = byte(clientMessage.LockTag[i])
-	}
-	log.Debug().
-		Bytes("bytes", bytes).
-		Msg("encoded client message")
-
-	return bytes
+// EncodeClientMessage converts a ClientMessage into a slice of bytes to be sent over a wire.
+// Lock tags longer than LegacyMaxLockTagSize are encoded in a versioned frame.
+// An error is returned if the lock tag is too long to be encoded at all, or if
+// it is not valid UTF8. BatchResult messages are encoded from their results,
+// which must not be empty nor add up to more than MaxLockTagSize bytes.
+func EncodeClientMessage(clientMessage *ClientMessage) ([]byte, error) {
+	return AppendClientMessage(nil, clientMessage)
+}
+
+// AppendClientMessage works like EncodeClientMessage, but appends the frame
+// to dst and returns the extended slice, only allocating if dst lacks the
+// capacity. Nothing is appended on error.
+func AppendClientMessage(dst []byte, clientMessage *ClientMessage) ([]byte, error) {
+	size, err := clientMessagePayloadSize(clientMessage)
+	if err != nil {
+		return dst, err
+	}
+	if dst == nil {
+		dst = make([]byte, 0, v1HeaderSize+size)
+	}
+	dst = appendFrameHeader(dst, byte(clientMessage.Type), size)
+	dst = appendClientMessagePayload(dst, clientMessage)
+	if e := log.Debug(); e.Enabled() {
+		e.Bytes("bytes", dst).Msg("encoded client message")
+	}
+
+	return dst, nil
 }
 
 // decodeserverMessageType attempts to extract the ServerMessageType from the given byte slice.
@@ -152,6 +308,14 @@ func decodeServerMessageType(bytes []byte) (ServerMessageType, error) {
 		return Acquire, nil
 	case Release:
 		return Release, nil
+	case Ping:
+		return Ping, nil
+	case Batch:
+		return Batch, nil
+	case Watch:
+		return Watch, nil
+	case WatchPrefix:
+		return WatchPrefix, nil
 	}
 	return 0, ErrServerMessageType
 }
@@ -161,13 +325,22 @@ func decodeClientMessageType(bytes []byte) (ClientMessageType, error) {
 	switch ClientMessageType(bytes[0]) {
 	case Acquired:
 		return Acquired, nil
+	case Pong:
+		return Pong, nil
+	case ShuttingDown:
+		return ShuttingDown, nil
+	case BatchResult:
+		return BatchResult, nil
+	case Event:
+		return Event, nil
+	case Throttled:
+		return Throttled, nil
 	}
 	return 0, ErrClientMessageType
 }
 
-// decodeLockTag check whether the input byte slice contains a valid lock tag and if so returns is as a string.
-func decodeLockTag(bytes []byte) (string, error) {
-	lockTag := bytes[2:]
+// decodeLockTag check whether the input byte slice is a valid lock tag and if so returns is as a string.
+func decodeLockTag(lockTag []byte) (string, error) {
 	if !utf8.Valid(lockTag) {
 		return "", ErrLockTagEncoding
 	}
@@ -175,3 +348,24 @@ func decodeLockTag(bytes []byte) (string, error) {
 	builder.Write(lockTag)
 	return builder.String(), nil
 }
+
+// decodeLockTagReusing works like decodeLockTag, but returns previous rather
+// than a new string if it holds the same lock tag.
+func decodeLockTagReusing(lockTag []byte, previous string) (string, error) {
+	if previous == string(lockTag) {
+		return previous, nil
+	}
+	return decodeLockTag(lockTag)
+}
+
+// validateLockTag checks that a lock tag can be encoded without corrupting the
+// resulting frame.
+func validateLockTag(lockTag string) error {
+	if len(lockTag) > MaxLockTagSize {
+		return ErrLockTagTooLong
+	}
+	if !utf8.ValidString(lockTag) {
+		return ErrLockTagEncoding
+	}
+	return nil
+}
@@ -1,9 +1,15 @@
 package protocol
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"testing"
+
+	"github.com/rs/zerolog"
 )
 
 func TestProtocol_decodeType(t *testing.T) {
@@ -36,7 +42,7 @@ func TestProtocol_decodeLockTag(t *testing.T) {
 	}
 
 	for i, bytes := range messages {
-		lockTag, err := decodeLockTag(bytes)
+		lockTag, err := decodeLockTag(bytes[2:])
 		if err != nil {
 			t.Error("Failed to decode ", bytes, ": ", err)
 		}
@@ -167,7 +173,10 @@ func TestProtocol_ServerMessage(t *testing.T) {
 }
 
 func TestProtocol_EncodeClientMessage(t *testing.T) {
-	res := EncodeClientMessage(&ClientMessage{Type: Acquired, LockTag: "abc"})
+	res, err := EncodeClientMessage(&ClientMessage{Type: Acquired, LockTag: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if len(res) != 5 {
 		t.Error("Expected resulting byte array to have length 5")
@@ -187,8 +196,711 @@ func TestProtocol_EncodeClientMessage(t *testing.T) {
 	}
 }
 
+func TestProtocol_PingPong(t *testing.T) {
+	ping, _ := EncodeServerMessage(&ServerMessage{Type: Ping})
+	sm, err := DecodeServerMessage(ping)
+	if err != nil {
+		t.Fatal("Failed to decode ping:", err)
+	}
+	if sm.Type != Ping {
+		t.Error("Expected server message type to be Ping")
+	}
+
+	pong, _ := EncodeClientMessage(&ClientMessage{Type: Pong})
+	cm, err := DecodeClientMessage(pong)
+	if err != nil {
+		t.Fatal("Failed to decode pong:", err)
+	}
+	if cm.Type != Pong {
+		t.Error("Expected client message type to be Pong")
+	}
+
+	shuttingDown, _ := EncodeClientMessage(&ClientMessage{Type: ShuttingDown})
+	if !bytes.Equal(shuttingDown, []byte{2, 0}) {
+		t.Error("Unexpected shutting down frame:", shuttingDown)
+	}
+	if _, err := DecodeClientMessage([]byte{2, 1, 70}); err != ErrClientMessageDecode {
+		t.Error("Expected a shutting down message with a lock tag to be rejected, got", err)
+	}
+
+	// Heartbeats must not carry a lock tag, and other messages must.
+	badMessages := [][]byte{
+		{2, 1, 70},
+		{2, 1},
+		{0, 0},
+	}
+	for _, message := range badMessages {
+		_, err := DecodeServerMessage(message)
+		if !errors.Is(err, ErrServerMessageDecode) {
+			t.Error("Expected ServerMessageDecodeError for", message, "got:", err)
+		}
+	}
+}
+
+func TestProtocol_LongLockTag(t *testing.T) {
+	lockTag := strings.Repeat("F", 1000)
+	encoded, err := EncodeServerMessage(&ServerMessage{Type: Acquire, LockTag: lockTag})
+	if err != nil {
+		t.Fatal("Failed to encode long lock tag:", err)
+	}
+	if encoded[0] != FrameVersionFlag|FrameVersion1 {
+		t.Fatal("Expected a version 1 frame, got version byte:", encoded[0])
+	}
+	if len(encoded) != 4+len(lockTag) {
+		t.Fatal("Unexpected frame length:", len(encoded))
+	}
+
+	sm, err := DecodeServerMessage(encoded)
+	if err != nil {
+		t.Fatal("Failed to decode long lock tag:", err)
+	}
+	if sm.Type != Acquire || sm.LockTag != lockTag {
+		t.Error("Decoded message did not match the encoded one")
+	}
+
+	// Short lock tags keep using the legacy frame.
+	encoded, _ = EncodeServerMessage(&ServerMessage{Type: Acquire, LockTag: strings.Repeat("F", 255)})
+	if encoded[0] != byte(Acquire) || encoded[1] != 255 {
+		t.Error("Expected a legacy frame for a 255 byte lock tag")
+	}
+}
+
+func TestProtocol_EncodeValidation(t *testing.T) {
+	_, err := EncodeServerMessage(&ServerMessage{Type: Acquire, LockTag: strings.Repeat("F", MaxLockTagSize+1)})
+	if !errors.Is(err, ErrLockTagTooLong) {
+		t.Error("Expected LockTagTooLongError, got:", err)
+	}
+
+	_, err = EncodeClientMessage(&ClientMessage{Type: Acquired, LockTag: string([]byte{0xc3, 0x28})})
+	if !errors.Is(err, ErrLockTagEncoding) {
+		t.Error("Expected LockTagEncodingError, got:", err)
+	}
+}
+
+func TestProtocol_BadFrameVersion(t *testing.T) {
+	_, err := DecodeServerMessage([]byte{FrameVersionFlag | 2, 0, 0, 1, 70})
+	if !errors.Is(err, ErrFrameVersion) {
+		t.Error("Expected FrameVersionError, got:", err)
+	}
+
+	_, err = ReadFrame(bytes.NewReader([]byte{FrameVersionFlag | 2, 0, 0, 1, 70}), MaxLockTagSize)
+	if !errors.Is(err, ErrFrameVersion) {
+		t.Error("Expected FrameVersionError, got:", err)
+	}
+}
+
+func TestProtocol_ReadFrame(t *testing.T) {
+	stream := []byte{}
+	lockTags := []string{"a", strings.Repeat("b", 300), "c"}
+	for _, lockTag := range lockTags {
+		encoded, _ := EncodeServerMessage(&ServerMessage{Type: Release, LockTag: lockTag})
+		stream = append(stream, encoded...)
+	}
+
+	reader := bytes.NewReader(stream)
+	for _, lockTag := range lockTags {
+		frame, err := ReadFrame(reader, MaxLockTagSize)
+		if err != nil {
+			t.Fatal("Failed to read frame:", err)
+		}
+		sm, err := DecodeServerMessage(frame)
+		if err != nil {
+			t.Fatal("Failed to decode frame:", err)
+		}
+		if sm.LockTag != lockTag {
+			t.Error("Got lock tag of length", len(sm.LockTag), "expected", len(lockTag))
+		}
+	}
+	if _, err := ReadFrame(reader, MaxLockTagSize); err != io.EOF {
+		t.Error("Expected EOF after the last frame, got:", err)
+	}
+
+	// The maximum is enforced before the lock tag is read.
+	encoded, _ := EncodeServerMessage(&ServerMessage{Type: Acquire, LockTag: strings.Repeat("F", 300)})
+	if _, err := ReadFrame(bytes.NewReader(encoded[:4]), 299); !errors.Is(err, ErrLockTagTooLong) {
+		t.Error("Expected LockTagTooLongError, got:", err)
+	}
+
+	// Streams ending mid-frame are not a clean EOF.
+	if _, err := ReadFrame(bytes.NewReader(encoded[:10]), MaxLockTagSize); err != io.ErrUnexpectedEOF {
+		t.Error("Expected an unexpected EOF, got:", err)
+	}
+}
+
+func TestProtocol_Batch(t *testing.T) {
+	operations := []Operation{
+		{Type: Acquire, LockTag: "a"},
+		{Type: Release, LockTag: strings.Repeat("b", 300)},
+	}
+	encoded, err := EncodeServerMessage(&ServerMessage{Type: Batch, Operations: operations})
+	if err != nil {
+		t.Fatal("Failed to encode batch:", err)
+	}
+
+	// Batches are not bound by the lock tag maximum as a whole.
+	frame, err := ReadFrame(bytes.NewReader(encoded), 255)
+	if err != nil {
+		t.Fatal("Failed to read batch frame:", err)
+	}
+	sm, err := DecodeServerMessage(frame)
+	if err != nil {
+		t.Fatal("Failed to decode batch:", err)
+	}
+	if sm.Type != Batch || len(sm.Operations) != len(operations) {
+		t.Fatal("Unexpected decoded batch:", sm.Type, len(sm.Operations))
+	}
+	for i, operation := range operations {
+		if sm.Operations[i] != operation {
+			t.Errorf("Operation %d did not match", i)
+		}
+	}
+
+	results := []OperationResult{
+		{Type: Acquire, LockTag: "a", Code: ResultOK},
+		{Type: Release, LockTag: "b", Code: ResultBadManners},
+		{Type: Acquire, LockTag: "c", Code: ResultThrottled},
+	}
+	encoded, err = EncodeClientMessage(&ClientMessage{Type: BatchResult, Results: results})
+	if err != nil {
+		t.Fatal("Failed to encode batch result:", err)
+	}
+	cm, err := DecodeClientMessage(encoded)
+	if err != nil {
+		t.Fatal("Failed to decode batch result:", err)
+	}
+	if cm.Type != BatchResult || len(cm.Results) != len(results) {
+		t.Fatal("Unexpected decoded batch result:", cm.Type, len(cm.Results))
+	}
+	for i, result := range results {
+		if cm.Results[i] != result {
+			t.Errorf("Result %d did not match", i)
+		}
+	}
+}
+
+func TestProtocol_BadBatches(t *testing.T) {
+	if _, err := EncodeServerMessage(&ServerMessage{Type: Batch}); !errors.Is(err, ErrBatchSize) {
+		t.Error("Expected BatchSizeError for an empty batch, got:", err)
+	}
+
+	tooMany := make([]Operation, 0, 300)
+	for i := 0; i < 300; i++ {
+		tooMany = append(tooMany, Operation{Type: Acquire, LockTag: strings.Repeat("F", 250)})
+	}
+	if _, err := EncodeServerMessage(&ServerMessage{Type: Batch, Operations: tooMany}); !errors.Is(err, ErrBatchSize) {
+		t.Error("Expected BatchSizeError for an oversized batch, got:", err)
+	}
+
+	if _, err := EncodeServerMessage(&ServerMessage{
+		Type:       Batch,
+		Operations: []Operation{{Type: Ping, LockTag: "a"}},
+	}); !errors.Is(err, ErrServerMessageType) {
+		t.Error("Expected ServerMessageTypeError for a ping in a batch, got:", err)
+	}
+
+	messages := map[string][]byte{
+		"truncated header": {3, 2, 0, 0},
+		"truncated tag":    {3, 4, 0, 0, 2, 70},
+		"empty tag":        {3, 3, 0, 0, 0},
+		"nested batch":     {3, 4, 3, 0, 1, 70},
+		"invalid lock tag": {3, 5, 0, 0, 2, 0xc3, 0x28},
+	}
+	for name, message := range messages {
+		if _, err := DecodeServerMessage(message); err == nil {
+			t.Error("Expected an error decoding batch with", name)
+		}
+	}
+}
+
+func TestProtocol_Text(t *testing.T) {
+	messages := map[string]*ServerMessage{
+		"ACQUIRE abc":   {Type: Acquire, LockTag: "abc"},
+		"acquire abc\r": {Type: Acquire, LockTag: "abc"},
+		"Release ABC":   {Type: Release, LockTag: "ABC"},
+		"PING":          {Type: Ping},
+	}
+	for line, expected := range messages {
+		sm, err := DecodeTextServerMessage(line)
+		if err != nil {
+			t.Error("Failed to decode", line, ":", err)
+			continue
+		}
+		if sm.Type != expected.Type || sm.LockTag != expected.LockTag {
+			t.Error("Decoded", line, "did not match")
+		}
+	}
+
+	badMessages := map[string]error{
+		"LOCK abc":         ErrTextCommand,
+		"ACQUIRE":          ErrTextSyntax,
+		"ACQUIRE a b":      ErrTextSyntax,
+		"PING abc":         ErrTextSyntax,
+		"RELEASE \xc3\x28": ErrLockTagEncoding,
+	}
+	for line, expected := range badMessages {
+		if _, err := DecodeTextServerMessage(line); !errors.Is(err, expected) {
+			t.Error("Expected", expected, "for", line, "got:", err)
+		}
+	}
+
+	if line := string(EncodeTextLine(TextAcquired, "abc")); line != "ACQUIRED abc\n" {
+		t.Error("Unexpected encoded line:", line)
+	}
+	if line := string(EncodeTextLine(TextPong, "")); line != "PONG\n" {
+		t.Error("Unexpected encoded line:", line)
+	}
+}
+
+func TestProtocol_RESP(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader(
+		"*3\r\n$3\r\nGET\r\n$0\r\n\r\n$5\r\na b\r\n\r\n" +
+			"PING hello\r\n" +
+			"*1\r\n$4\r\nPING\r\n",
+	))
+	expected := [][]string{{"GET", "", "a b\r\n"}, {"PING", "hello"}, {"PING"}}
+	for _, arguments := range expected {
+		got, err := ReadRESPCommand(reader, 100)
+		if err != nil {
+			t.Fatal("Failed to read RESP command:", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(arguments) {
+			t.Errorf("Expected %q, got %q", arguments, got)
+		}
+	}
+	if _, err := ReadRESPCommand(reader, 100); err != io.EOF {
+		t.Error("Expected EOF, got:", err)
+	}
+
+	badCommands := map[string]error{
+		"*1\r\n$101\r\n":     ErrRESPSize,
+		"*17\r\n":            ErrRESPSize,
+		"*1\r\n:1\r\n":       ErrRESPSyntax,
+		"*1\r\n$1\r\nab\r\n": ErrRESPSyntax,
+		"*x\r\n":             ErrRESPSyntax,
+		"*2\r\n$1\r\na\r\n":  io.ErrUnexpectedEOF,
+	}
+	for command, expected := range badCommands {
+		_, err := ReadRESPCommand(bufio.NewReader(strings.NewReader(command)), 100)
+		if !errors.Is(err, expected) {
+			t.Errorf("Expected %v for %q, got %v", expected, command, err)
+		}
+	}
+
+	reply := AppendRESPSimpleString(nil, "OK")
+	reply = AppendRESPError(reply, "ERR bad")
+	reply = AppendRESPInteger(reply, 1)
+	reply = AppendRESPBulkString(reply, "abc")
+	reply = AppendRESPNull(reply)
+	if string(reply) != "+OK\r\n-ERR bad\r\n:1\r\n$3\r\nabc\r\n$-1\r\n" {
+		t.Errorf("Unexpected RESP replies: %q", reply)
+	}
+}
+
 func Benchmark_Decoding(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_, _ = DecodeServerMessage([]byte{0, 9, 49, 49, 49, 49, 49, 49, 49, 49, 49})
 	}
 }
+
+func TestProtocol_WatchAndEvent(t *testing.T) {
+	for _, messageType := range []ServerMessageType{Watch, WatchPrefix} {
+		encoded, err := EncodeServerMessage(&ServerMessage{Type: messageType, LockTag: "db/"})
+		if err != nil {
+			t.Fatal("Failed to encode watch:", err)
+		}
+		sm, err := DecodeServerMessage(encoded)
+		if err != nil || sm.Type != messageType || sm.LockTag != "db/" {
+			t.Fatal("Unexpected decoded watch:", sm, err)
+		}
+	}
+
+	event := &ClientMessage{Type: Event, LockTag: "db/users", EventKind: EventExpire, Owner: "127.0.0.1:5000"}
+	encoded, err := EncodeClientMessage(event)
+	if err != nil {
+		t.Fatal("Failed to encode event:", err)
+	}
+	cm, err := DecodeClientMessage(encoded)
+	if err != nil {
+		t.Fatal("Failed to decode event:", err)
+	}
+	if cm.Type != Event || cm.LockTag != event.LockTag || cm.EventKind != event.EventKind || cm.Owner != event.Owner {
+		t.Fatal("Unexpected decoded event:", cm)
+	}
+
+	// Unknown kinds, missing lock tags and lock tags overrunning the payload.
+	for _, payload := range [][]byte{
+		{9, 0, 1, 'a'},
+		{0, 0, 0, 'a'},
+		{0, 0, 5, 'a'},
+		{0, 0},
+	} {
+		frame := append([]byte{byte(Event), byte(len(payload))}, payload...)
+		if _, err := DecodeClientMessage(frame); err == nil {
+			t.Error("Expected an error decoding event payload", payload)
+		}
+	}
+	if _, err := EncodeClientMessage(&ClientMessage{Type: Event, LockTag: "a", EventKind: 9}); err == nil {
+		t.Error("Expected an error encoding an unknown event kind")
+	}
+}
+
+// Messages exercised by the allocation tests and benchmarks.
+var (
+	benchmarkServerMessages = []*ServerMessage{
+		{Type: Acquire, LockTag: "some/lock/tag"},
+		{Type: Release, LockTag: strings.Repeat("l", 300)},
+		{Type: Ping},
+		{Type: Batch, Operations: []Operation{{Type: Acquire, LockTag: "a"}, {Type: Release, LockTag: "b"}}},
+	}
+	benchmarkClientMessages = []*ClientMessage{
+		{Type: Acquired, LockTag: "some/lock/tag"},
+		{Type: Pong},
+		{Type: ShuttingDown},
+		{Type: BatchResult, Results: []OperationResult{{Type: Acquire, LockTag: "a", Code: ResultOK}}},
+		{Type: Event, LockTag: "some/lock/tag", EventKind: EventRelease, Owner: "127.0.0.1:5000"},
+		{Type: Throttled, LockTag: "some/lock/tag"},
+	}
+)
+
+func TestProtocol_AppendAndDecodeInto(t *testing.T) {
+	var buffer []byte
+	serverMessage := &ServerMessage{}
+	for _, sm := range benchmarkServerMessages {
+		encoded, err := AppendServerMessage(buffer[:0], sm)
+		if err != nil {
+			t.Fatal("Failed to append server message:", err)
+		}
+		if expected, _ := EncodeServerMessage(sm); !bytes.Equal(encoded, expected) {
+			t.Fatal("Appended and encoded server messages differ:", encoded, expected)
+		}
+		frame, err := ReadFrameInto(bytes.NewReader(encoded), buffer, MaxLockTagSize)
+		if err != nil {
+			t.Fatal("Failed to read frame:", err)
+		}
+		buffer = frame
+		if err := DecodeServerMessageInto(frame, serverMessage); err != nil {
+			t.Fatal("Failed to decode server message:", err)
+		}
+		if serverMessage.Type != sm.Type || serverMessage.LockTag != sm.LockTag ||
+			fmt.Sprint(serverMessage.Operations) != fmt.Sprint(sm.Operations) {
+			t.Fatal("Unexpected decoded server message:", serverMessage)
+		}
+	}
+
+	clientMessage := &ClientMessage{}
+	for _, cm := range benchmarkClientMessages {
+		encoded, err := AppendClientMessage(buffer[:0], cm)
+		if err != nil {
+			t.Fatal("Failed to append client message:", err)
+		}
+		buffer = encoded
+		if err := DecodeClientMessageInto(encoded, clientMessage); err != nil {
+			t.Fatal("Failed to decode client message:", err)
+		}
+		if clientMessage.Type != cm.Type || clientMessage.LockTag != cm.LockTag ||
+			clientMessage.Owner != cm.Owner || fmt.Sprint(clientMessage.Results) != fmt.Sprint(cm.Results) {
+			t.Fatal("Unexpected decoded client message:", clientMessage)
+		}
+	}
+
+	// Nothing is appended when encoding fails.
+	if encoded, err := AppendServerMessage([]byte{1}, &ServerMessage{Type: Acquire, LockTag: "\xff"}); err == nil || len(encoded) != 1 {
+		t.Error("Expected an encoding error and an untouched buffer, got:", encoded, err)
+	}
+}
+
+// Set when built with the race detector.
+var raceEnabled = false
+
+func TestProtocol_ZeroAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not reliable with the race detector")
+	}
+	buffer := make([]byte, 0, 1024)
+	serverMessage := &ServerMessage{}
+	clientMessage := &ClientMessage{}
+	reader := bytes.NewReader(nil)
+	for _, sm := range benchmarkServerMessages {
+		encoded, _ := EncodeServerMessage(sm)
+		allocs := testing.AllocsPerRun(100, func() {
+			buffer, _ = AppendServerMessage(buffer[:0], sm)
+			reader.Reset(encoded)
+			buffer, _ = ReadFrameInto(reader, buffer, MaxLockTagSize)
+			_ = DecodeServerMessageInto(buffer, serverMessage)
+		})
+		if allocs != 0 {
+			t.Errorf("Server message type %d: %v allocations per run", sm.Type, allocs)
+		}
+	}
+	for _, cm := range benchmarkClientMessages {
+		allocs := testing.AllocsPerRun(100, func() {
+			buffer, _ = AppendClientMessage(buffer[:0], cm)
+			_ = DecodeClientMessageInto(buffer, clientMessage)
+		})
+		if allocs != 0 {
+			t.Errorf("Client message type %d: %v allocations per run", cm.Type, allocs)
+		}
+	}
+}
+
+func BenchmarkProtocol_AppendServerMessage(b *testing.B) {
+	buffer := make([]byte, 0, 1024)
+	disableLogging(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer, _ = AppendServerMessage(buffer[:0], benchmarkServerMessages[i%len(benchmarkServerMessages)])
+	}
+}
+
+func BenchmarkProtocol_AppendClientMessage(b *testing.B) {
+	buffer := make([]byte, 0, 1024)
+	disableLogging(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer, _ = AppendClientMessage(buffer[:0], benchmarkClientMessages[i%len(benchmarkClientMessages)])
+	}
+}
+
+func BenchmarkProtocol_ReadAndDecodeServerMessage(b *testing.B) {
+	disableLogging(b)
+	// A connection sending an acquire and a release of the same lock, over
+	// and over again.
+	var stream []byte
+	stream, _ = AppendServerMessage(stream, &ServerMessage{Type: Acquire, LockTag: "some/lock/tag"})
+	stream, _ = AppendServerMessage(stream, &ServerMessage{Type: Release, LockTag: "some/lock/tag"})
+	reader := bytes.NewReader(stream)
+	buffer := make([]byte, 0, 512)
+	serverMessage := &ServerMessage{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if reader.Len() == 0 {
+			reader.Reset(stream)
+		}
+		frame, err := ReadFrameInto(reader, buffer, MaxLockTagSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		buffer = frame
+		if err := DecodeServerMessageInto(frame, serverMessage); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProtocol_DecodeClientMessage(b *testing.B) {
+	disableLogging(b)
+	encoded := make([][]byte, len(benchmarkClientMessages))
+	for i, cm := range benchmarkClientMessages {
+		encoded[i], _ = EncodeClientMessage(cm)
+	}
+	clientMessage := &ClientMessage{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Decode the same message type repeatedly, like a client would when
+		// receiving a stream of events or acquisitions.
+		_ = DecodeClientMessageInto(encoded[(i/1000)%len(encoded)], clientMessage)
+	}
+}
+
+// Benchmarks measure the protocol, not the cost of writing debug logs.
+func disableLogging(b *testing.B) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	b.Cleanup(func() { zerolog.SetGlobalLevel(level) })
+}
+
+func TestProtocol_Codecs(t *testing.T) {
+	serverMessages := append([]*ServerMessage{
+		{Type: Watch, LockTag: "w"},
+		{Type: WatchPrefix, LockTag: "w/"},
+	}, benchmarkServerMessages...)
+
+	for _, codec := range []Codec{BinaryCodec{}, JSONCodec{}} {
+		// Frames are read back to back off a stream, the codec negotiated
+		// from the first of them.
+		var stream []byte
+		for _, sm := range serverMessages {
+			var err error
+			if stream, err = codec.AppendServerMessage(stream, sm); err != nil {
+				t.Fatalf("%T failed to append server message: %v", codec, err)
+			}
+		}
+		reader := bufio.NewReader(bytes.NewReader(stream))
+		negotiated, err := NegotiateCodec(reader)
+		if err != nil || negotiated != codec {
+			t.Fatalf("Expected %T to be negotiated, got: %T %v", codec, negotiated, err)
+		}
+		var buffer []byte
+		serverMessage := &ServerMessage{}
+		for _, sm := range serverMessages {
+			frame, err := negotiated.ReadFrame(reader, buffer, MaxLockTagSize)
+			if err != nil {
+				t.Fatalf("%T failed to read frame: %v", codec, err)
+			}
+			buffer = frame
+			if err := negotiated.DecodeServerMessage(frame, serverMessage); err != nil {
+				t.Fatalf("%T failed to decode server message: %v", codec, err)
+			}
+			if serverMessage.Type != sm.Type || serverMessage.LockTag != sm.LockTag ||
+				fmt.Sprint(serverMessage.Operations) != fmt.Sprint(sm.Operations) {
+				t.Fatalf("%T decoded unexpected server message: %v", codec, serverMessage)
+			}
+		}
+		if _, err := negotiated.ReadFrame(reader, buffer, MaxLockTagSize); err != io.EOF {
+			t.Fatalf("%T expected EOF after the last frame, got: %v", codec, err)
+		}
+
+		clientMessage := &ClientMessage{}
+		for _, cm := range benchmarkClientMessages {
+			encoded, err := codec.AppendClientMessage(nil, cm)
+			if err != nil {
+				t.Fatalf("%T failed to append client message: %v", codec, err)
+			}
+			frame, err := codec.ReadFrame(bytes.NewReader(encoded), nil, MaxLockTagSize)
+			if err != nil {
+				t.Fatalf("%T failed to read frame: %v", codec, err)
+			}
+			if err := codec.DecodeClientMessage(frame, clientMessage); err != nil {
+				t.Fatalf("%T failed to decode client message: %v", codec, err)
+			}
+			if clientMessage.Type != cm.Type || clientMessage.LockTag != cm.LockTag ||
+				clientMessage.EventKind != cm.EventKind || clientMessage.Owner != cm.Owner ||
+				fmt.Sprint(clientMessage.Results) != fmt.Sprint(cm.Results) {
+				t.Fatalf("%T decoded unexpected client message: %v", codec, clientMessage)
+			}
+		}
+
+		// Both codecs hold messages to the same limits.
+		for _, sm := range []*ServerMessage{
+			{Type: Acquire, LockTag: strings.Repeat("l", MaxLockTagSize+1)},
+			{Type: Batch},
+			{Type: Batch, Operations: []Operation{{Type: Ping, LockTag: "a"}}},
+		} {
+			if encoded, err := codec.AppendServerMessage(nil, sm); err == nil {
+				t.Fatalf("%T expected an encoding error, got: %q", codec, encoded)
+			}
+		}
+	}
+}
+
+func TestProtocol_JSONCodec(t *testing.T) {
+	codec := JSONCodec{}
+	encoded, err := codec.AppendServerMessage(nil, &ServerMessage{Type: Acquire, LockTag: "abc"})
+	if err != nil || string(encoded) != "31\n{\"type\":\"acquire\",\"tag\":\"abc\"}\n" {
+		t.Fatalf("Unexpected JSON frame: %q %v", encoded, err)
+	}
+	encoded, _ = codec.AppendClientMessage(nil, &ClientMessage{Type: Pong})
+	if string(encoded) != "16\n{\"type\":\"pong\"}\n" {
+		t.Fatalf("Unexpected JSON frame: %q", encoded)
+	}
+
+	// Hand written frames, without the optional newline, decode as well.
+	frame, err := codec.ReadFrame(strings.NewReader("39\n{\"tag\": \"a<b>\", \"type\": \"watch_prefix\"}"), nil, MaxLockTagSize)
+	if err != nil {
+		t.Fatal("Failed to read frame:", err)
+	}
+	serverMessage := &ServerMessage{}
+	if err := codec.DecodeServerMessage(frame, serverMessage); err != nil ||
+		serverMessage.Type != WatchPrefix || serverMessage.LockTag != "a<b>" {
+		t.Fatal("Unexpected decoded server message:", serverMessage, err)
+	}
+
+	for input, expected := range map[string]error{
+		"":                      io.EOF,
+		"0\n":                   ErrFrameLength,
+		"12x\n":                 ErrFrameLength,
+		"99999999\n":            ErrFrameLength,
+		"3\n{}":                 io.ErrUnexpectedEOF,
+		"5":                     io.ErrUnexpectedEOF,
+		"9999999\n{\"type\":\"": ErrFrameLength,
+	} {
+		if _, err := codec.ReadFrame(strings.NewReader(input), nil, MaxLockTagSize); err != expected {
+			t.Errorf("Reading %q: expected %v, got %v", input, expected, err)
+		}
+	}
+
+	for document, expected := range map[string]error{
+		`not json`:                                     ErrServerMessageDecode,
+		`{"type":"steal","tag":"a"}`:                   ErrServerMessageType,
+		`{"type":"acquire"}`:                           ErrServerMessageDecode,
+		`{"type":"ping","tag":"a"}`:                    ErrServerMessageDecode,
+		`{"type":"batch","operations":[]}`:             ErrBatchSize,
+		`{"type":"batch","operations":[{"type":"x"}]}`: ErrServerMessageType,
+	} {
+		if err := codec.DecodeServerMessage([]byte(document), serverMessage); err != expected {
+			t.Errorf("Decoding %s: expected %v, got %v", document, expected, err)
+		}
+	}
+}
+
+func TestProtocol_TraceParent(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	for value, valid := range map[string]bool{
+		traceParent: true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":        false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":        false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":        false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":        false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7-01":        false,
+		"": false,
+	} {
+		if ValidTraceParent(value) != valid {
+			t.Errorf("Expected ValidTraceParent(%q) to be %v", value, valid)
+		}
+	}
+	if TraceID(traceParent) != "4bf92f3577b34da6a3ce929d0e0e4736" || TraceID("") != "" {
+		t.Error("Unexpected trace ID:", TraceID(traceParent))
+	}
+
+	for _, codec := range []Codec{BinaryCodec{}, JSONCodec{}} {
+		for _, sm := range []*ServerMessage{
+			{Type: Acquire, LockTag: "lt", TraceParent: traceParent},
+			{Type: Release, LockTag: strings.Repeat("l", 300), TraceParent: traceParent},
+			{Type: Acquire, LockTag: "lt"},
+		} {
+			encoded, err := codec.AppendServerMessage(nil, sm)
+			if err != nil {
+				t.Fatalf("%T failed to encode traced message: %v", codec, err)
+			}
+			frame, err := codec.ReadFrame(bytes.NewReader(encoded), nil, len(sm.LockTag))
+			if err != nil {
+				t.Fatalf("%T failed to read traced frame: %v", codec, err)
+			}
+			decoded := &ServerMessage{TraceParent: traceParent}
+			if err := codec.DecodeServerMessage(frame, decoded); err != nil {
+				t.Fatalf("%T failed to decode traced message: %v", codec, err)
+			}
+			if decoded.Type != sm.Type || decoded.LockTag != sm.LockTag || decoded.TraceParent != sm.TraceParent {
+				t.Fatalf("%T decoded unexpected message: %v", codec, decoded)
+			}
+		}
+
+		for sm, expected := range map[*ServerMessage]error{
+			{Type: Ping, TraceParent: traceParent}:                                                  ErrServerMessageType,
+			{Type: Acquire, LockTag: "lt", TraceParent: "not-a-trace"}:                              ErrTraceParent,
+			{Type: Watch, LockTag: "lt", TraceParent: traceParent}:                                  ErrServerMessageType,
+			{Type: Acquire, LockTag: strings.Repeat("l", MaxLockTagSize)}:                           nil,
+			{Type: Acquire, LockTag: strings.Repeat("l", MaxLockTagSize), TraceParent: traceParent}: ErrLockTagTooLong,
+		} {
+			if _, err := codec.AppendServerMessage(nil, sm); err != expected {
+				t.Errorf("%T encoding %v: expected %v, got %v", codec, sm.Type, expected, err)
+			}
+		}
+	}
+
+	// Old frames flagged as traced for messages that cannot carry a trace
+	// parent, or carrying broken ones, are rejected.
+	for frame, expected := range map[string]error{
+		string([]byte{byte(Ping) | TraceFlag, 0}):                 ErrServerMessageType,
+		string([]byte{byte(Acquire) | TraceFlag, 3, 1, 'x', 'y'}): ErrTraceParent,
+		string([]byte{byte(Acquire) | TraceFlag, 1, 0}):           ErrServerMessageDecode,
+	} {
+		if _, err := DecodeServerMessage([]byte(frame)); err != expected {
+			t.Errorf("Decoding %q: expected %v, got %v", frame, expected, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The subset of the Redis serialization protocol (RESP2) needed to accept
+// commands from off-the-shelf Redis clients and answer them. Commands arrive
+// either as arrays of bulk strings, which is what client libraries send, or as
+// inline commands typed by humans.
+
+// The most arguments a single RESP command may carry, commands used for
+// locking need far fewer.
+const RESPMaxArguments = 16
+
+var (
+	ErrRESPSyntax = errors.New("invalid RESP command")
+	ErrRESPSize   = errors.New("RESP command exceeds size limits")
+)
+
+// ReadRESPCommand reads one command from the reader and returns its arguments,
+// the command name being the first one. Bulk strings longer than maxBulkSize
+// are rejected with ErrRESPSize before they are read. Errors from the reader
+// are returned as is.
+func ReadRESPCommand(reader *bufio.Reader, maxBulkSize int) ([]string, error) {
+	line, err := readRESPLine(reader, maxBulkSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return []string{}, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 {
+		return nil, ErrRESPSyntax
+	}
+	if count > RESPMaxArguments {
+		return nil, ErrRESPSize
+	}
+
+	arguments := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		header, err := readRESPLine(reader, maxBulkSize)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, ErrRESPSyntax
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 {
+			return nil, ErrRESPSyntax
+		}
+		if size > maxBulkSize {
+			return nil, ErrRESPSize
+		}
+
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if bulk[size] != '\r' || bulk[size+1] != '\n' {
+			return nil, ErrRESPSyntax
+		}
+		arguments = append(arguments, string(bulk[:size]))
+	}
+
+	return arguments, nil
+}
+
+// Reads a CRLF (or LF, for inline commands) terminated line, without its
+// terminator. Lines may not be much longer than maxBulkSize.
+func readRESPLine(reader *bufio.Reader, maxBulkSize int) (string, error) {
+	builder := strings.Builder{}
+	for {
+		fragment, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		// Room for an inline command with a few arguments around the bulk.
+		if builder.Len()+len(fragment) > maxBulkSize+256 {
+			return "", ErrRESPSize
+		}
+		builder.Write(fragment)
+		if !isPrefix {
+			return builder.String(), nil
+		}
+	}
+}
+
+// AppendRESPSimpleString appends a RESP simple string, like "+OK\r\n".
+func AppendRESPSimpleString(dst []byte, s string) []byte {
+	dst = append(dst, '+')
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendRESPError appends a RESP error, like "-ERR message\r\n".
+func AppendRESPError(dst []byte, message string) []byte {
+	dst = append(dst, '-')
+	dst = append(dst, message...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendRESPInteger appends a RESP integer, like ":1\r\n".
+func AppendRESPInteger(dst []byte, i int64) []byte {
+	dst = append(dst, ':')
+	dst = strconv.AppendInt(dst, i, 10)
+	return append(dst, '\r', '\n')
+}
+
+// AppendRESPBulkString appends a RESP bulk string, like "$3\r\nabc\r\n".
+func AppendRESPBulkString(dst []byte, s string) []byte {
+	dst = append(dst, '$')
+	dst = strconv.AppendInt(dst, int64(len(s)), 10)
+	dst = append(dst, '\r', '\n')
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendRESPNull appends a RESP null bulk string, "$-1\r\n".
+func AppendRESPNull(dst []byte) []byte {
+	return append(dst, "$-1\r\n"...)
+}
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Keywords of the text protocol, a line based alternative to the binary
+// protocol meant for humans and shell scripts. Each line holds a keyword,
+// optionally followed by a space and a lock tag, and ends with a newline:
+//
+//	ACQUIRE <lock tag>   ->  ACQUIRED <lock tag>
+//	RELEASE <lock tag>   ->  RELEASED <lock tag>
+//	PING                 ->  PONG
+//
+// Keywords are case insensitive when received, lock tags are not. Errors are
+// reported as "ERROR <reason>".
+const (
+	TextAcquire  = "ACQUIRE"
+	TextRelease  = "RELEASE"
+	TextPing     = "PING"
+	TextAcquired = "ACQUIRED"
+	TextReleased = "RELEASED"
+	TextPong     = "PONG"
+	TextError    = "ERROR"
+)
+
+var (
+	ErrTextCommand = errors.New("unknown command")
+	ErrTextSyntax  = errors.New("expected a command followed by a single lock tag")
+)
+
+// DecodeTextServerMessage decodes a line of the text protocol, without its
+// trailing newline, into a ServerMessage pointer.
+//
+// There are a few possible errors:
+//   - The command is not recognized.
+//   - The command is missing its lock tag, or has trailing arguments.
+//   - The lock tag is too long or not valid UTF8.
+func DecodeTextServerMessage(line string) (*ServerMessage, error) {
+	command, lockTag, _ := strings.Cut(strings.TrimRight(line, "\r"), " ")
+
+	var messageType ServerMessageType
+	switch strings.ToUpper(command) {
+	case TextAcquire:
+		messageType = Acquire
+	case TextRelease:
+		messageType = Release
+	case TextPing:
+		if lockTag != "" {
+			return nil, ErrTextSyntax
+		}
+		return &ServerMessage{Type: Ping}, nil
+	default:
+		return nil, ErrTextCommand
+	}
+
+	if lockTag == "" || strings.IndexFunc(lockTag, unicode.IsSpace) != -1 {
+		return nil, ErrTextSyntax
+	}
+	if len(lockTag) > MaxLockTagSize {
+		return nil, ErrLockTagTooLong
+	}
+	if !utf8.ValidString(lockTag) {
+		return nil, ErrLockTagEncoding
+	}
+
+	return &ServerMessage{Type: messageType, LockTag: lockTag}, nil
+}
+
+// EncodeTextLine formats a line of the text protocol, including its trailing
+// newline. The argument is left out if empty.
+func EncodeTextLine(keyword string, argument string) []byte {
+	line := make([]byte, 0, len(keyword)+len(argument)+2)
+	line = append(line, keyword...)
+	if argument != "" {
+		line = append(line, ' ')
+		line = append(line, argument...)
+	}
+	return append(line, '\n')
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import "errors"
+
+// TraceFlag is set on the message type of Acquire and Release frames carrying
+// a trace parent. The payload of such frames starts with the trace parent:
+//
+//	trace parent size  trace parent  lock tag
+//	1 byte             55 - 255 bytes the rest of the payload
+//
+// Locksmith versions unaware of trace parents reject such frames, so clients
+// only set the flag when they have a trace parent to send.
+const TraceFlag byte = 0x40
+
+// The trace parent size is a single byte.
+const maxTraceParentSize = 255
+
+// Length of a version 00 trace parent, later versions may only be longer.
+const traceParentSize = 55
+
+var ErrTraceParent = errors.New("trace parent is not a valid W3C traceparent")
+
+// ValidTraceParent tells if the value is a valid W3C traceparent header value,
+// as in "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": a version,
+// a trace ID, a parent ID and trace flags, all in lowercase hex. Neither ID
+// may be all zeroes and version ff is invalid. Values of later versions are
+// valid as long as they start out the same way.
+func ValidTraceParent(traceParent string) bool {
+	if len(traceParent) < traceParentSize || len(traceParent) > maxTraceParentSize {
+		return false
+	}
+	if traceParent[:2] == "ff" || (traceParent[:2] == "00" && len(traceParent) != traceParentSize) {
+		return false
+	}
+	if len(traceParent) > traceParentSize && traceParent[traceParentSize] != '-' {
+		return false
+	}
+	if traceParent[2] != '-' || traceParent[35] != '-' || traceParent[52] != '-' {
+		return false
+	}
+	return lowerHex(traceParent[:2]) &&
+		lowerHex(traceParent[3:35]) && !zeroes(traceParent[3:35]) &&
+		lowerHex(traceParent[36:52]) && !zeroes(traceParent[36:52]) &&
+		lowerHex(traceParent[53:55])
+}
+
+// TraceID returns the trace ID of a valid trace parent, or an empty string if
+// there is no trace parent.
+func TraceID(traceParent string) string {
+	if len(traceParent) < traceParentSize {
+		return ""
+	}
+	return traceParent[3:35]
+}
+
+func lowerHex(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if (value[i] < '0' || value[i] > '9') && (value[i] < 'a' || value[i] > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func zeroes(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] != '0' {
+			return false
+		}
+	}
+	return true
+}
+
+// splitTraceParent splits the payload of a traced frame into its trace parent
+// and lock tag, reusing previous rather than allocating if it holds the same
+// trace parent.
+func splitTraceParent(payload []byte, previous string) (string, []byte, error) {
+	if len(payload) == 0 || len(payload) <= 1+int(payload[0]) {
+		return "", nil, ErrServerMessageDecode
+	}
+	rawTraceParent := payload[1 : 1+int(payload[0])]
+	if previous != string(rawTraceParent) {
+		previous = string(rawTraceParent)
+	}
+	if !ValidTraceParent(previous) {
+		return "", nil, ErrTraceParent
+	}
+	return previous, payload[1+int(payload[0]):], nil
+}
@@ -0,0 +1,251 @@
+package locksmith
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maansthoernvik/locksmith/pkg/connection"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var throttledCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "locksmith_requests_throttled",
+	Help: "The number of requests delayed or rejected due to rate limits",
+}, []string{"reason"})
+
+// Reasons for throttling requests, as labeled in the throttling metric.
+const (
+	ThrottleConnectionRate = "connection_rate"
+	ThrottleIdentityRate   = "identity_rate"
+)
+
+// RateLimitPolicy decides what happens to requests over the rate limit.
+type RateLimitPolicy string
+
+const (
+	// Requests over the limit are held back until they are within it, which
+	// also holds back reading further requests from the connection.
+	RateLimitDelay RateLimitPolicy = "delay"
+	// Requests over the limit are dropped, and answered with a Throttled
+	// message, or a batch result of protocol.ResultThrottled codes.
+	RateLimitReject RateLimitPolicy = "reject"
+)
+
+var (
+	ErrRateLimitPolicy = errors.New("unknown rate limit policy")
+	ErrThrottled       = errors.New("rate limit exceeded")
+)
+
+// Parses the name of a rate limit policy, empty for RateLimitDelay.
+func ParseRateLimitPolicy(policy string) (RateLimitPolicy, error) {
+	switch RateLimitPolicy(policy) {
+	case "", RateLimitDelay:
+		return RateLimitDelay, nil
+	case RateLimitReject:
+		return RateLimitReject, nil
+	}
+	return "", fmt.Errorf("%q: %w", policy, ErrRateLimitPolicy)
+}
+
+// A token bucket, filling up with rate tokens per second up to burst tokens.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Must be called with the mutex held.
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+}
+
+// Tells whether a token could be taken.
+func (bucket *tokenBucket) available(now time.Time) bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.refill(now)
+	return bucket.tokens >= 1
+}
+
+// Takes a token if there is one.
+func (bucket *tokenBucket) take(now time.Time) bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.refill(now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Takes a token ahead of time, returning how long it takes for it to become
+// available.
+func (bucket *tokenBucket) reserve(now time.Time) time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.refill(now)
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// Hands out the token buckets limiting the acquires and releases of
+// connections. Connections of the same client identity share a bucket for as
+// long as one of them is open.
+type rateLimiter struct {
+	rate          float64
+	burst         int
+	identityRate  float64
+	identityBurst int
+	policy        RateLimitPolicy
+
+	mutex      sync.Mutex
+	identities map[string]*identityBucket
+}
+
+type identityBucket struct {
+	bucket      *tokenBucket
+	connections int
+}
+
+// Returns nil if neither limit is set.
+func newRateLimiter(options *LocksmithOptions) *rateLimiter {
+	if options.RequestRate <= 0 && options.IdentityRequestRate <= 0 {
+		return nil
+	}
+	policy := options.RateLimitPolicy
+	if policy == "" {
+		policy = RateLimitDelay
+	}
+	return &rateLimiter{
+		rate:          options.RequestRate,
+		burst:         options.RequestBurst,
+		identityRate:  options.IdentityRequestRate,
+		identityBurst: options.IdentityRequestBurst,
+		policy:        policy,
+		identities:    make(map[string]*identityBucket),
+	}
+}
+
+// The limits applying to a single connection. A nil requestLimit allows
+// every request.
+type requestLimit struct {
+	policy     RateLimitPolicy
+	connection *tokenBucket
+	identity   *tokenBucket
+}
+
+// Returns the limits of a new connection, and a function to call once it has
+// closed.
+func (limiter *rateLimiter) connect(addr net.Addr) (*requestLimit, func()) {
+	if limiter == nil {
+		return nil, func() {}
+	}
+	limit := &requestLimit{policy: limiter.policy}
+	if limiter.rate > 0 {
+		limit.connection = newTokenBucket(limiter.rate, limiter.burst)
+	}
+	identity := rateIdentity(addr)
+	if limiter.identityRate <= 0 || identity == "" {
+		return limit, func() {}
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	shared, ok := limiter.identities[identity]
+	if !ok {
+		shared = &identityBucket{bucket: newTokenBucket(limiter.identityRate, limiter.identityBurst)}
+		limiter.identities[identity] = shared
+	}
+	shared.connections++
+	limit.identity = shared.bucket
+	return limit, func() {
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+		if shared.connections--; shared.connections == 0 {
+			delete(limiter.identities, identity)
+		}
+	}
+}
+
+// Lets a request through, delaying it first under RateLimitDelay. Under
+// RateLimitReject, requests over the limits are not let through, and the
+// reason is returned.
+func (limit *requestLimit) allow() (bool, string) {
+	if limit == nil {
+		return true, ""
+	}
+	now := time.Now()
+	if limit.policy == RateLimitReject {
+		if limit.connection != nil && !limit.connection.available(now) {
+			throttledCounter.WithLabelValues(ThrottleConnectionRate).Inc()
+			return false, ThrottleConnectionRate
+		}
+		if limit.identity != nil && !limit.identity.take(now) {
+			throttledCounter.WithLabelValues(ThrottleIdentityRate).Inc()
+			return false, ThrottleIdentityRate
+		}
+		if limit.connection != nil {
+			limit.connection.take(now)
+		}
+		return true, ""
+	}
+
+	var wait time.Duration
+	reason := ""
+	if limit.connection != nil {
+		if wait = limit.connection.reserve(now); wait > 0 {
+			reason = ThrottleConnectionRate
+		}
+	}
+	if limit.identity != nil {
+		if identityWait := limit.identity.reserve(now); identityWait > wait {
+			wait = identityWait
+			reason = ThrottleIdentityRate
+		}
+	}
+	if wait > 0 {
+		throttledCounter.WithLabelValues(reason).Inc()
+		time.Sleep(wait)
+	}
+	return true, ""
+}
+
+// The identity connections are rate limited by together: the identity from
+// the client's certificate, the user of Unix domain socket clients, or the
+// source IP. Connections without one, like those handed over by another
+// server, are only limited per connection.
+func rateIdentity(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *connection.IdentityAddr:
+		return fmt.Sprintf("%s=%s", addr.Source, addr.Identity)
+	case *connection.PeerAddr:
+		if addr.UID >= 0 {
+			return fmt.Sprintf("uid=%d", addr.UID)
+		}
+	case *net.TCPAddr:
+		return addr.IP.String()
+	}
+	return ""
+}
@@ -0,0 +1,381 @@
+package locksmith
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/maansthoernvik/locksmith/pkg/protocol"
+	"github.com/maansthoernvik/locksmith/pkg/vault"
+	"github.com/rs/zerolog/log"
+)
+
+// Vault clients of RESP locks are named after the lock's value rather than the
+// connection, so the prefix keeps them from clashing with connection addresses.
+const respClientPrefix = "resp:"
+
+// Errors worded like their Redis counterparts.
+var (
+	errRESPSyntax     = errors.New("syntax error")
+	errRESPExpireTime = errors.New("invalid expire time in 'set' command")
+	errRESPNotNX      = errors.New("only SET with NX is supported")
+	errRESPNumKeys    = errors.New("value is not an integer or out of range")
+	errRESPScript     = errors.New("only the compare-and-delete unlock script is supported")
+)
+
+// Scripts are longer than most lock tags, so command arguments may be at
+// least this long even if lock tags may not.
+const respMaxScriptSize = 1024
+
+// The scripts Redis lock libraries release their locks with, comparing the
+// key's value to theirs before deleting the key. Scripts are told apart after
+// normalizeRESPScript, so that spacing, quoting and case do not matter.
+var respUnlockScripts = func() map[string]struct{} {
+	scripts := map[string]struct{}{}
+	for _, script := range []string{
+		// Redis' documentation, Redlock implementations and redsync.
+		`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`,
+		`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end`,
+		// redis-py's Lock.
+		`local token = redis.call('get', KEYS[1])
+		if not token or token ~= ARGV[1] then
+			return 0
+		end
+		redis.call('del', KEYS[1])
+		return 1`,
+	} {
+		scripts[normalizeRESPScript(script)] = struct{}{}
+	}
+	return scripts
+}()
+
+// Handler for connections accepted by the RESP acceptor, letting Redis lock
+// libraries use Locksmith. The following subset of Redis commands is mapped
+// onto the vault:
+//
+//	SET key value NX [PX ms|EX s]  try-acquire key, owned by value
+//	EVAL script 1 key value        release key if owned by value, for the
+//	EVALSHA sha1 1 key value       scripts in respUnlockScripts only
+//	SCRIPT LOAD script             the SHA1 of an unlock script
+//	DEL key [key ...]              release keys held by RESP clients
+//	DELIFEQ key value              release key if owned by value
+//	GET key                        the value owning key, if any
+//	PING [message]
+//	QUIT
+//
+// Like in Redis, RESP locks are owned by their value and not the connection,
+// so they survive the connection closing and are released by the unlock
+// script, DEL, DELIFEQ or by running out of time to live. Commands are
+// answered one at a time, in order, which is what pipelining Redis clients
+// expect. Commands acquiring or releasing locks count against the rate limits
+// like acquires and releases of other clients do.
+func (locksmith *Locksmith) handleRESPConnection(conn net.Conn) {
+	log.Info().
+		Str("address", conn.RemoteAddr().String()).
+		Msg("RESP connection accepted")
+	limit, release := locksmith.rateLimiter.connect(conn.RemoteAddr())
+	defer release()
+
+	reader := bufio.NewReader(conn)
+	for {
+		if locksmith.heartbeatTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(locksmith.heartbeatTimeout))
+		}
+		arguments, err := protocol.ReadRESPCommand(reader, max(locksmith.maxLockTagSize, respMaxScriptSize))
+		if err != nil {
+			var netErr net.Error
+			if err == io.EOF {
+				log.Info().
+					Str("address", conn.RemoteAddr().String()).
+					Msg("RESP connection closed by remote (EOF)")
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				heartbeatTimeoutCounter.Inc()
+				log.Warn().
+					Str("address", conn.RemoteAddr().String()).
+					Dur("timeout", locksmith.heartbeatTimeout).
+					Msg("heartbeat timeout, closing RESP connection")
+			} else {
+				log.Error().Err(err).Msg("RESP connection read error, closing connection")
+				_, _ = conn.Write(protocol.AppendRESPError(nil, "ERR "+err.Error()))
+			}
+
+			break
+		}
+		if len(arguments) == 0 {
+			continue
+		}
+
+		reply, quit := locksmith.handleRESPCommand(limit, arguments)
+		if _, err := conn.Write(reply); err != nil {
+			log.Error().Err(err).Msg("failed to write to RESP client")
+			break
+		}
+		if quit {
+			break
+		}
+	}
+}
+
+// Handles a single RESP command, returning the reply and whether the
+// connection should be closed after replying. Blocks until the vault has
+// handled the command, and under RateLimitDelay until the command is within
+// the rate limits.
+func (locksmith *Locksmith) handleRESPCommand(limit *requestLimit, arguments []string) ([]byte, bool) {
+	command := strings.ToUpper(arguments[0])
+	switch command {
+	case "SET", "DELIFEQ", "DEL", "EVAL", "EVALSHA":
+		if allowed, reason := limit.allow(); !allowed {
+			log.Debug().
+				Str("command", command).
+				Str("reason", reason).
+				Msg("RESP command over rate limit, rejecting it")
+			return protocol.AppendRESPError(nil, "ERR "+ErrThrottled.Error()), false
+		}
+	}
+
+	switch command {
+	case "PING":
+		if len(arguments) == 2 {
+			return protocol.AppendRESPBulkString(nil, arguments[1]), false
+		}
+		return protocol.AppendRESPSimpleString(nil, "PONG"), false
+
+	case "QUIT":
+		return protocol.AppendRESPSimpleString(nil, "OK"), true
+
+	case "SET":
+		if len(arguments) < 3 {
+			return respWrongArguments(command), false
+		}
+		if err := locksmith.validateRESPKey(arguments[1]); err != nil {
+			return protocol.AppendRESPError(nil, "ERR "+err.Error()), false
+		}
+		ttl, err := parseRESPSetOptions(arguments[3:])
+		if err != nil {
+			return protocol.AppendRESPError(nil, "ERR "+err.Error()), false
+		}
+
+		result := make(chan error, 1)
+		locksmith.vault.TryAcquire(
+			arguments[1],
+			respClientPrefix+arguments[2],
+			ttl,
+			func(err error) error {
+				result <- err
+				return nil
+			},
+		)
+		if err := <-result; err != nil {
+			return protocol.AppendRESPNull(nil), false
+		}
+		return protocol.AppendRESPSimpleString(nil, "OK"), false
+
+	case "DELIFEQ":
+		if len(arguments) != 3 {
+			return respWrongArguments(command), false
+		}
+		return locksmith.respUnlock(arguments[1], arguments[2]), false
+
+	case "EVAL", "EVALSHA":
+		if len(arguments) < 3 {
+			return respWrongArguments(command), false
+		}
+		if command == "EVAL" {
+			if !isRESPUnlockScript(arguments[1]) {
+				return protocol.AppendRESPError(nil, "ERR "+errRESPScript.Error()), false
+			}
+			locksmith.respScripts.Store(respScriptSHA(arguments[1]), struct{}{})
+		} else if _, ok := locksmith.respScripts.Load(strings.ToLower(arguments[1])); !ok {
+			return protocol.AppendRESPError(nil, "NOSCRIPT No matching script. Please use EVAL."), false
+		}
+		if keys, err := strconv.Atoi(arguments[2]); err != nil || keys < 0 {
+			return protocol.AppendRESPError(nil, "ERR "+errRESPNumKeys.Error()), false
+		} else if keys != 1 || len(arguments) != 5 {
+			return protocol.AppendRESPError(nil, "ERR "+errRESPScript.Error()), false
+		}
+		return locksmith.respUnlock(arguments[3], arguments[4]), false
+
+	case "SCRIPT":
+		if len(arguments) < 2 {
+			return respWrongArguments(command), false
+		}
+		if strings.ToUpper(arguments[1]) != "LOAD" {
+			return protocol.AppendRESPError(nil, "ERR unknown subcommand '"+arguments[1]+"'"), false
+		}
+		if len(arguments) != 3 {
+			return respWrongArguments("script|load"), false
+		}
+		if !isRESPUnlockScript(arguments[2]) {
+			return protocol.AppendRESPError(nil, "ERR "+errRESPScript.Error()), false
+		}
+		sha := respScriptSHA(arguments[2])
+		locksmith.respScripts.Store(sha, struct{}{})
+		return protocol.AppendRESPBulkString(nil, sha), false
+
+	case "DEL":
+		if len(arguments) < 2 {
+			return respWrongArguments(command), false
+		}
+		for _, key := range arguments[1:] {
+			if err := locksmith.validateRESPKey(key); err != nil {
+				return protocol.AppendRESPError(nil, "ERR "+err.Error()), false
+			}
+		}
+		released := int64(0)
+		for _, key := range arguments[1:] {
+			if locksmith.respDelete(key) {
+				released++
+			}
+		}
+		return protocol.AppendRESPInteger(nil, released), false
+
+	case "GET":
+		if len(arguments) != 2 {
+			return respWrongArguments(command), false
+		}
+		if err := locksmith.validateRESPKey(arguments[1]); err != nil {
+			return protocol.AppendRESPError(nil, "ERR "+err.Error()), false
+		}
+
+		owner := make(chan string, 1)
+		locksmith.vault.Inspect(arguments[1], func(info vault.LockInfo) {
+			owner <- info.Owner
+		})
+		value := <-owner
+		if value == "" {
+			return protocol.AppendRESPNull(nil), false
+		}
+		// Locks held by binary or text clients show the client's address.
+		return protocol.AppendRESPBulkString(nil, strings.TrimPrefix(value, respClientPrefix)), false
+	}
+
+	return protocol.AppendRESPError(nil, "ERR unknown command '"+arguments[0]+"'"), false
+}
+
+// Releases key if owned by value, answering 1 if it was released and 0
+// otherwise.
+func (locksmith *Locksmith) respUnlock(key, value string) []byte {
+	if err := locksmith.validateRESPKey(key); err != nil {
+		return protocol.AppendRESPError(nil, "ERR "+err.Error())
+	}
+	if !locksmith.respRelease(key, respClientPrefix+value) {
+		return protocol.AppendRESPInteger(nil, 0)
+	}
+	return protocol.AppendRESPInteger(nil, 1)
+}
+
+// Releases key whatever the value owning it, as long as it is held by a RESP
+// client. Locks of other clients are left alone, as they could not be told
+// that they lost them. Returns whether the key was released.
+func (locksmith *Locksmith) respDelete(key string) bool {
+	owner := make(chan string, 1)
+	locksmith.vault.Inspect(key, func(info vault.LockInfo) {
+		owner <- info.Owner
+	})
+	client := <-owner
+	if !strings.HasPrefix(client, respClientPrefix) {
+		return false
+	}
+	// Fails if the owner changed in the meantime, which leaves the new
+	// owner's lock alone.
+	return locksmith.respRelease(key, client)
+}
+
+// Releases key if held by client, blocking until the vault has handled it.
+func (locksmith *Locksmith) respRelease(key, client string) bool {
+	result := make(chan error, 1)
+	locksmith.vault.Release(key, client, func(err error) error {
+		result <- err
+		return nil
+	})
+	return <-result == nil
+}
+
+// Tells if the script is one of respUnlockScripts.
+func isRESPUnlockScript(script string) bool {
+	_, ok := respUnlockScripts[normalizeRESPScript(script)]
+	return ok
+}
+
+// Drops the whitespace and case of a script, and unifies its quotes.
+func normalizeRESPScript(script string) string {
+	builder := strings.Builder{}
+	for _, r := range script {
+		switch {
+		case unicode.IsSpace(r):
+		case r == '\'':
+			builder.WriteRune('"')
+		default:
+			builder.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return builder.String()
+}
+
+// The SHA1 sum Redis names a script by, in hex.
+func respScriptSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// Keys are lock tags, and need to pass the same checks as lock tags decoded
+// from binary frames.
+func (locksmith *Locksmith) validateRESPKey(key string) error {
+	if key == "" {
+		return protocol.ErrServerMessageDecode
+	}
+	if len(key) > locksmith.maxLockTagSize {
+		return protocol.ErrLockTagTooLong
+	}
+	if !utf8.ValidString(key) {
+		return protocol.ErrLockTagEncoding
+	}
+	return nil
+}
+
+// Parses the options following "SET key value", NX is required since only
+// acquiring an unheld lock makes sense, PX and EX set a time to live.
+func parseRESPSetOptions(options []string) (time.Duration, error) {
+	nx := false
+	var ttl time.Duration
+	for i := 0; i < len(options); i++ {
+		switch option := strings.ToUpper(options[i]); option {
+		case "NX":
+			nx = true
+		case "PX", "EX":
+			if i+1 == len(options) || ttl != 0 {
+				return 0, errRESPSyntax
+			}
+			i++
+			amount, err := strconv.ParseInt(options[i], 10, 64)
+			if err != nil || amount <= 0 {
+				return 0, errRESPExpireTime
+			}
+			if option == "PX" {
+				ttl = time.Duration(amount) * time.Millisecond
+			} else {
+				ttl = time.Duration(amount) * time.Second
+			}
+		default:
+			return 0, errRESPSyntax
+		}
+	}
+	if !nx {
+		return 0, errRESPNotNX
+	}
+	return ttl, nil
+}
+
+func respWrongArguments(command string) []byte {
+	return protocol.AppendRESPError(
+		nil, "ERR wrong number of arguments for '"+strings.ToLower(command)+"' command",
+	)
+}
@@ -0,0 +1,147 @@
+package locksmith
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maansthoernvik/locksmith/pkg/protocol"
+	"github.com/maansthoernvik/locksmith/pkg/vault"
+	"github.com/rs/zerolog/log"
+)
+
+// How often a draining server checks whether clients have let go of their
+// locks.
+const drainPollInterval = 10 * time.Millisecond
+
+// Keeps track of the connections being handled, so that shutting down can
+// notify their clients, wait for them to let go of their locks, close them,
+// and wait for their handlers to return.
+type connections struct {
+	mutex sync.Mutex
+	// Every connection handed to a handler, as accepted.
+	conns map[net.Conn]struct{}
+	// Binary protocol connections that have negotiated a codec, these can be
+	// told that the server is shutting down.
+	clients map[*clientConn]struct{}
+	// Every binary protocol connection, these can be handed over.
+	binary       map[*clientConn]struct{}
+	handlers     sync.WaitGroup
+	shuttingDown bool
+
+	// Clients paused for handing over, and closed once handing over is done.
+	paused []*handedOverClient
+	resume chan struct{}
+}
+
+func newConnections() *connections {
+	return &connections{
+		conns:   make(map[net.Conn]struct{}),
+		clients: make(map[*clientConn]struct{}),
+		binary:  make(map[*clientConn]struct{}),
+		resume:  make(chan struct{}),
+	}
+}
+
+// Wraps a connection handler to keep track of its connections. Connections
+// accepted once shutting down has begun are closed right away.
+func (connections *connections) track(handler func(net.Conn)) func(net.Conn) {
+	return func(conn net.Conn) {
+		connections.mutex.Lock()
+		if connections.shuttingDown {
+			connections.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		connections.conns[conn] = struct{}{}
+		connections.handlers.Add(1)
+		connections.mutex.Unlock()
+
+		defer func() {
+			connections.mutex.Lock()
+			delete(connections.conns, conn)
+			connections.mutex.Unlock()
+			connections.handlers.Done()
+		}()
+		handler(conn)
+	}
+}
+
+// Adds a binary protocol client, once its codec is known. A client added
+// after shutting down has begun is told so right away.
+func (connections *connections) addClient(conn *clientConn) {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	if connections.shuttingDown {
+		go notifyShuttingDown(conn)
+		return
+	}
+	connections.clients[conn] = struct{}{}
+}
+
+func (connections *connections) removeClient(conn *clientConn) {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	delete(connections.clients, conn)
+}
+
+// Stops new connections from being handled, and tells binary protocol
+// clients that the server is shutting down.
+func (connections *connections) shutDown() {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	connections.shuttingDown = true
+	for conn := range connections.clients {
+		notifyShuttingDown(conn)
+	}
+}
+
+func notifyShuttingDown(conn *clientConn) {
+	if err := conn.writeClientMessage(&protocol.ClientMessage{Type: protocol.ShuttingDown}); err != nil {
+		log.Debug().
+			Err(err).
+			Str("address", conn.RemoteAddr().String()).
+			Msg("failed to notify client of shutdown")
+	}
+}
+
+// Tells if no client holds or waits for locks.
+func (connections *connections) drained(v vault.Vault) bool {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	for conn := range connections.clients {
+		if conn.inFlight.Load() > 0 || v.Holds(conn.RemoteAddr().String()) {
+			return false
+		}
+	}
+	for conn := range connections.conns {
+		if v.Holds(conn.RemoteAddr().String()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Waits for clients to let go of their locks, for at most the drain timeout.
+// Returns the number of connections left open.
+func (connections *connections) drain(v vault.Vault, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) && !connections.drained(v) {
+		time.Sleep(drainPollInterval)
+	}
+
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	return len(connections.conns)
+}
+
+// Closes all connections and waits for their handlers to return.
+func (connections *connections) closeAll() {
+	connections.mutex.Lock()
+	for conn := range connections.conns {
+		conn.Close()
+	}
+	connections.mutex.Unlock()
+
+	connections.handlers.Wait()
+}
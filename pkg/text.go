@@ -0,0 +1,159 @@
+package locksmith
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/maansthoernvik/locksmith/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// Handler for connections accepted by the text protocol acceptor. Works like
+// handleConnection, but reads newline terminated text commands instead of
+// binary frames. Acquires and releases go to the same vault, so text clients
+// and binary clients compete for the same locks. Unknown or malformed commands
+// are answered with an error line, protocol offenses towards the vault close
+// the connection just like for binary clients.
+func (locksmith *Locksmith) handleTextConnection(conn net.Conn) {
+	log.Info().
+		Str("address", conn.RemoteAddr().String()).
+		Msg("text connection accepted")
+
+	queue := newWriteQueue(conn, locksmith.writeQueueSize, locksmith.writeTimeout, nil)
+	queue.start()
+	// On connection close, clean up client data. Writes are stopped first, so
+	// that acquires granted from then on fail rather than leave a lock with
+	// a client already cleaned up.
+	defer func() {
+		queue.stopWriting()
+		locksmith.vault.Cleanup(conn.RemoteAddr().String())
+		queue.flush()
+	}()
+	limit, release := locksmith.rateLimiter.connect(conn.RemoteAddr())
+	defer release()
+
+	scanner := bufio.NewScanner(conn)
+	// Longest keyword, a space, the lock tag and a carriage return.
+	scanner.Buffer(make([]byte, 0, 512), len(protocol.TextAcquire)+locksmith.maxLockTagSize+2)
+	for {
+		if locksmith.heartbeatTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(locksmith.heartbeatTimeout))
+		}
+		if !scanner.Scan() {
+			err := scanner.Err()
+			var netErr net.Error
+			if err == nil {
+				log.Info().
+					Str("address", conn.RemoteAddr().String()).
+					Msg("text connection closed by remote (EOF)")
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				heartbeatTimeoutCounter.Inc()
+				log.Warn().
+					Str("address", conn.RemoteAddr().String()).
+					Dur("timeout", locksmith.heartbeatTimeout).
+					Msg("heartbeat timeout, closing text connection")
+			} else if errors.Is(err, bufio.ErrTooLong) {
+				log.Error().
+					Str("address", conn.RemoteAddr().String()).
+					Int("max", locksmith.maxLockTagSize).
+					Msg("lock tag too long, closing text connection")
+				_ = writeTextLine(queue, protocol.TextError, protocol.ErrLockTagTooLong.Error())
+			} else {
+				log.Error().Err(err).Msg("text connection read error, closing connection")
+			}
+
+			break
+		}
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		incomingMessage, err := protocol.DecodeTextServerMessage(scanner.Text())
+		if err != nil {
+			log.Debug().
+				Err(err).
+				Str("address", conn.RemoteAddr().String()).
+				Msg("bad text command")
+			_ = writeTextLine(queue, protocol.TextError, err.Error())
+			continue
+		}
+		if len(incomingMessage.LockTag) > locksmith.maxLockTagSize {
+			_ = writeTextLine(queue, protocol.TextError, protocol.ErrLockTagTooLong.Error())
+			continue
+		}
+
+		locksmith.handleIncomingTextMessage(conn, queue, limit, incomingMessage)
+	}
+}
+
+// After decoding, this function determines the handling of the decoded text
+// command.
+func (locksmith *Locksmith) handleIncomingTextMessage(
+	conn net.Conn,
+	queue *writeQueue,
+	limit *requestLimit,
+	serverMessage *protocol.ServerMessage,
+) {
+	switch serverMessage.Type {
+	case protocol.Acquire, protocol.Release:
+		// Delayed under RateLimitDelay, only rejected under RateLimitReject.
+		if allowed, reason := limit.allow(); !allowed {
+			log.Debug().
+				Str("address", conn.RemoteAddr().String()).
+				Str("reason", reason).
+				Msg("text request over rate limit, rejecting it")
+			_ = writeTextLine(queue, protocol.TextError, ErrThrottled.Error())
+			return
+		}
+	}
+
+	switch serverMessage.Type {
+	case protocol.Acquire:
+		locksmith.vault.Acquire(
+			serverMessage.LockTag,
+			conn.RemoteAddr().String(),
+			textCallback(queue, protocol.TextAcquired, serverMessage.LockTag),
+		)
+	case protocol.Release:
+		locksmith.vault.Release(
+			serverMessage.LockTag,
+			conn.RemoteAddr().String(),
+			textCallback(queue, protocol.TextReleased, serverMessage.LockTag),
+		)
+	case protocol.Ping:
+		if err := writeTextLine(queue, protocol.TextPong, ""); err != nil {
+			log.Error().Err(err).Msg("failed to write pong to text client")
+		}
+	}
+}
+
+// Returns a vault callback answering a text client with the given keyword and
+// lock tag. Errors from the vault mean the client misbehaved, the reason is
+// sent to the client before it is disconnected.
+func textCallback(queue *writeQueue, keyword string, lockTag string) func(error) error {
+	return func(err error) error {
+		if err != nil {
+			log.Error().Err(err).Msg("got error in text callback")
+			_ = writeTextLine(queue, protocol.TextError, err.Error())
+			queue.closeConn()
+			return nil
+		}
+
+		writeErr := writeTextLine(queue, keyword, lockTag)
+		if writeErr != nil {
+			log.Error().Err(writeErr).Msg("failed to write to text client")
+			return writeErr
+		}
+
+		return nil
+	}
+}
+
+// Queues a text line to be written to the client.
+func writeTextLine(queue *writeQueue, keyword string, argument string) error {
+	line := protocol.EncodeTextLine(keyword, argument)
+	return queue.push(&line, nil)
+}
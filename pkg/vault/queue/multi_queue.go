@@ -2,6 +2,7 @@ package queue
 
 import (
 	"math"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 )
@@ -46,7 +47,7 @@ func NewMultiQueue(
 			log.Info().Int("number", i).Msg("starting multi queue go routine")
 			for {
 				qi := <-queue
-				qi.action(qi.lockTag)
+				qi.dispatch()
 			}
 		}(i, ql.queues[i])
 	}
@@ -68,6 +69,51 @@ func (multiQueue *multiQueue) Enqueue(lockTag string, action func(string)) {
 	multiQueue.queues[queueIndex] <- &queueItem{lockTag: lockTag, action: action}
 }
 
+// Enqueue several lock tags at once. Items are grouped per queue so that each
+// queue is only handed one queue item, regardless of how many of the batch's
+// lock tags it is responsible for.
+func (multiQueue *multiQueue) EnqueueBatch(items []BatchItem) {
+	groups := make(map[uint16][]BatchItem)
+	order := make([]uint16, 0, len(multiQueue.queues))
+	for _, item := range items {
+		queueIndex := multiQueue.queueIndexFromHash(multiQueue.hashFunc(item.LockTag))
+		if _, ok := groups[queueIndex]; !ok {
+			order = append(order, queueIndex)
+		}
+		groups[queueIndex] = append(groups[queueIndex], item)
+	}
+	log.Debug().
+		Int("items", len(items)).
+		Int("queues", len(order)).
+		Msg("enqueueing batch")
+
+	for _, queueIndex := range order {
+		multiQueue.queues[queueIndex] <- &queueItem{batch: groups[queueIndex]}
+	}
+}
+
+// Drain every queue, items are handled in order by each queue's Go-routine, so
+// once a marker item at the back of every queue has been handled, so has
+// everything enqueued before it.
+func (multiQueue *multiQueue) Drain() {
+	wg := sync.WaitGroup{}
+	wg.Add(len(multiQueue.queues))
+	for _, queue := range multiQueue.queues {
+		queue <- drainMarker(&wg)
+	}
+	wg.Wait()
+}
+
+// Freeze every queue, like Drain but the marker items are never got past.
+func (multiQueue *multiQueue) Freeze() {
+	wg := sync.WaitGroup{}
+	wg.Add(len(multiQueue.queues))
+	for _, queue := range multiQueue.queues {
+		queue <- freezeMarker(&wg)
+	}
+	wg.Wait()
+}
+
 // Get a queue index from an input hash to select which queue should handle an
 // Enqueue(...) call.
 func (multiQueue *multiQueue) queueIndexFromHash(hash uint16) uint16 {
@@ -2,7 +2,9 @@ package queue
 
 import (
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Test_queueIndexDistribution(t *testing.T) {
@@ -80,6 +82,84 @@ func Test_Enqueue(t *testing.T) {
 	wg.Wait()
 }
 
+func Test_EnqueueBatch(t *testing.T) {
+	mq := NewMultiQueue(5, 10).(*multiQueue)
+
+	// Same lock tags end up on the same queue, so their order must be kept.
+	items := make([]BatchItem, 0, 100)
+	order := make(map[string][]int)
+	mutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	wg.Add(100)
+	for i := 0; i < 100; i++ {
+		i := i
+		items = append(items, BatchItem{
+			LockTag: randSeq(1),
+			Action: func(lockTag string) {
+				mutex.Lock()
+				order[lockTag] = append(order[lockTag], i)
+				mutex.Unlock()
+				wg.Done()
+			},
+		})
+	}
+	mq.EnqueueBatch(items)
+	wg.Wait()
+
+	for lockTag, indices := range order {
+		for j := 1; j < len(indices); j++ {
+			if indices[j] < indices[j-1] {
+				t.Fatal("Batch items for", lockTag, "were called out of order:", indices)
+			}
+		}
+	}
+}
+
+func Test_Drain(t *testing.T) {
+	mq := NewMultiQueue(5, 10).(*multiQueue)
+
+	handled := atomic.Int32{}
+	for i := 0; i < 100; i++ {
+		mq.Enqueue(randSeq(20), func(lockTag string) {
+			time.Sleep(100 * time.Microsecond)
+			handled.Add(1)
+		})
+	}
+	mq.Drain()
+	if handled.Load() != 100 {
+		t.Fatal("Drain returned with items left to handle:", 100-handled.Load())
+	}
+
+	// The queues are still usable after a drain.
+	done := make(chan interface{})
+	mq.Enqueue("after", func(string) { close(done) })
+	<-done
+}
+
+func Test_Freeze(t *testing.T) {
+	mq := NewMultiQueue(5, 10).(*multiQueue)
+
+	handled := atomic.Int32{}
+	for i := 0; i < 100; i++ {
+		mq.Enqueue(randSeq(20), func(lockTag string) {
+			handled.Add(1)
+		})
+	}
+	mq.Freeze()
+	if handled.Load() != 100 {
+		t.Fatal("Freeze returned with items left to handle:", 100-handled.Load())
+	}
+
+	// Nothing is handled after a freeze.
+	for i := 0; i < 10; i++ {
+		mq.Enqueue(randSeq(20), func(string) { handled.Add(1) })
+	}
+	time.Sleep(10 * time.Millisecond)
+	if handled.Load() != 100 {
+		t.Fatal("Items were handled after freezing:", handled.Load()-100)
+	}
+}
+
 const BENCHMARKING_SEQUENCE_SIZE = 100
 
 func Benchmark_queueIndex(b *testing.B) {
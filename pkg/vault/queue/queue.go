@@ -1,6 +1,8 @@
 // Package queue implements a way for the vault to ensure single-threaded handling of mutexes.
 package queue
 
+import "sync"
+
 // The vault queue layer interface specifies a way for the vault to obtain
 // a Go-routine for a given lock tag. Once the queue layer notifies the vault,
 // the vault knows that for a given lock tag, it is safe to operate as the
@@ -9,9 +11,55 @@ package queue
 type QueueLayer interface {
 	// Request a Go-routine for the given lock tag.
 	Enqueue(lockTag string, action func(lockTag string))
+	// Request Go-routines for several lock tags at once. Items handled by the
+	// same Go-routine are handed over together, and their actions are called
+	// in the order they were given.
+	EnqueueBatch(items []BatchItem)
+	// Block until everything enqueued before the call has been handled.
+	// Enqueueing remains possible during and after a drain.
+	Drain()
+	// Drain, then hold back everything enqueued later for good. Enqueueing
+	// blocks once a queue is full.
+	Freeze()
+}
+
+// BatchItem is a lock tag and action pair, as given to Enqueue.
+type BatchItem struct {
+	LockTag string
+	Action  func(lockTag string)
 }
 
+// A queue item is either a single lock tag and action pair, or a batch of
+// them.
 type queueItem struct {
 	lockTag string
 	action  func(string)
+	batch   []BatchItem
+}
+
+// Returns a queue item marking the point a drain waits for, the wait group is
+// done once a synchronization Go-routine gets to it.
+func drainMarker(wg *sync.WaitGroup) *queueItem {
+	return &queueItem{action: func(string) { wg.Done() }}
+}
+
+// Returns a queue item marking the point a freeze waits for, the
+// synchronization Go-routine getting to it never gets past it.
+func freezeMarker(wg *sync.WaitGroup) *queueItem {
+	return &queueItem{action: func(string) {
+		wg.Done()
+		select {}
+	}}
+}
+
+// Calls the queue item's action(s), only to be called from a synchronization
+// Go-routine.
+func (qi *queueItem) dispatch() {
+	if qi.batch == nil {
+		qi.action(qi.lockTag)
+		return
+	}
+	for _, item := range qi.batch {
+		item.Action(item.LockTag)
+	}
 }
@@ -1,6 +1,10 @@
 package queue
 
-import "github.com/rs/zerolog/log"
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
 
 type SingleQueue struct {
 	queue chan *queueItem
@@ -14,7 +18,7 @@ func NewSingleQueue(
 		log.Info().Msg("started single queue")
 		for {
 			qi := <-q.queue
-			qi.action(qi.lockTag)
+			qi.dispatch()
 		}
 	}()
 	return q
@@ -23,3 +27,24 @@ func NewSingleQueue(
 func (singleQueue *SingleQueue) Enqueue(lockTag string, action func(string)) {
 	singleQueue.queue <- &queueItem{lockTag: lockTag, action: action}
 }
+
+func (singleQueue *SingleQueue) EnqueueBatch(items []BatchItem) {
+	if len(items) == 0 {
+		return
+	}
+	singleQueue.queue <- &queueItem{batch: items}
+}
+
+func (singleQueue *SingleQueue) Drain() {
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	singleQueue.queue <- drainMarker(&wg)
+	wg.Wait()
+}
+
+func (singleQueue *SingleQueue) Freeze() {
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	singleQueue.queue <- freezeMarker(&wg)
+	wg.Wait()
+}
@@ -0,0 +1,85 @@
+package vault
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LockState is the state of a single lock, as exported for handing the vault
+// over to another server.
+type LockState struct {
+	LockTag string `json:"tag"`
+	// The client holding the lock, empty if it is unlocked.
+	Owner string `json:"owner,omitempty"`
+	// Clients waitlisted for the lock, first in line first.
+	Waiting []string `json:"waiting,omitempty"`
+	// The time to live the owner has left, zero if the lock does not expire.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// Export returns the state of every lock that is held or waited for, ordered
+// by lock tag. The state is only consistent if no operations are on their way
+// through the vault, so Freeze it first. Locks past their time to live, but
+// not yet expired, are exported with the shortest time to live.
+func (vault *vaultImpl) Export() []LockState {
+	vault.mapsMutex.Lock()
+	defer vault.mapsMutex.Unlock()
+
+	states := []LockState{}
+	for lockTag, lock := range vault.state {
+		waiting := vault.waitList[lockTag]
+		if !lock.isLocked() && len(waiting) == 0 {
+			continue
+		}
+		state := LockState{LockTag: lockTag, Owner: lock.owner}
+		if !lock.expires.IsZero() {
+			state.TTL = max(time.Until(lock.expires), time.Nanosecond)
+		}
+		for _, waiter := range waiting {
+			state.Waiting = append(state.Waiting, waiter.client)
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].LockTag < states[j].LockTag })
+	return states
+}
+
+// Restore recreates exported lock states, handing owners their locks and
+// waitlisting the waiting clients in order, as if they had acquired them.
+// Waiting clients get the callback returned for them, to be called once they
+// have acquired the lock. Locks without an owner go to the first waiting
+// client right away. Owners with a time to live lose their locks once it
+// runs out, as if they had been try-acquired.
+func (vault *vaultImpl) Restore(states []LockState, callback func(client, lockTag string) func(error) error) {
+	for _, state := range states {
+		state := state
+		vault.queueLayer.Enqueue(state.LockTag, func(lockTag string) {
+			log.Info().
+				Str("tag", lockTag).
+				Str("owner", state.Owner).
+				Int("waiting", len(state.Waiting)).
+				Msg("restoring lock")
+			if state.Owner != "" {
+				lock := vault.fetch(lockTag)
+				if lock.isLocked() {
+					log.Error().Str("tag", lockTag).Msg("restored lock is already held")
+					return
+				}
+				lock.lock(state.Owner)
+				locksGauge.Inc()
+				vault.appendClientLookupTable(state.Owner, lockTag)
+				if state.TTL > 0 {
+					vault.expireAfter(lockTag, lock, state.TTL)
+				}
+			}
+			for _, client := range state.Waiting {
+				vault.waitlist(lockTag, client, vault.acquireAction(client, nil, callback(client, lockTag)))
+			}
+			if state.Owner == "" {
+				vault.popWaitlist(lockTag)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package vault
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+var stageHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "locksmith_stage_duration_seconds",
+	Help:    "Time spent by traced acquires and releases in each stage of their handling, with their trace ID as exemplar",
+	Buckets: prometheus.ExponentialBuckets(0.00001, 4, 12),
+}, []string{"stage"})
+
+// Stages of an operation recorded by a Trace.
+const (
+	// From handing the operation to the vault until a synchronization
+	// Go-routine starts working on it.
+	StageQueueWait = "queue_wait"
+	// From waitlisting an acquire until it is granted.
+	StageWaitlistWait = "waitlist_wait"
+	// From queueing the outcome for the client until it has been written,
+	// recorded by the caller.
+	StageWrite = "write"
+)
+
+// Trace records how long a traced acquire or release spends in each stage of
+// its handling. The vault fills it in on the operation's synchronization
+// Go-routine before calling the operation's callback, which may read it.
+// Durations are also observed in a histogram, with the trace ID as exemplar.
+// Untraced operations have a nil Trace, which records nothing, keeping
+// tracing off their path.
+type Trace struct {
+	// The ID of the trace the operation is part of.
+	TraceID   string
+	QueueWait time.Duration
+	// Zero unless the operation was waitlisted.
+	WaitlistWait time.Duration
+
+	enqueued     time.Time
+	dequeued     bool
+	waitlistedAt time.Time
+}
+
+// NewTrace starts tracing an operation about to be handed to the vault. An
+// empty trace ID means the operation is not traced, and a nil Trace is
+// returned.
+func NewTrace(traceID string) *Trace {
+	if traceID == "" {
+		return nil
+	}
+	return &Trace{TraceID: traceID, enqueued: time.Now()}
+}
+
+// Observe records the duration of a stage in the stage histogram, unless the
+// trace is nil.
+func (trace *Trace) Observe(stage string, duration time.Duration) {
+	if trace == nil {
+		return
+	}
+	observer := stageHistogram.WithLabelValues(stage)
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok {
+		exemplarObserver.ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"trace_id": trace.TraceID})
+		return
+	}
+	observer.Observe(duration.Seconds())
+}
+
+// Called when a synchronization Go-routine starts working on the operation,
+// either fresh off the queue or popped from the waitlist. Traces are optional,
+// so a nil trace is fine.
+func (trace *Trace) started() {
+	if trace == nil {
+		return
+	}
+	if !trace.dequeued {
+		trace.dequeued = true
+		trace.QueueWait = time.Since(trace.enqueued)
+		trace.Observe(StageQueueWait, trace.QueueWait)
+	}
+	if !trace.waitlistedAt.IsZero() {
+		waited := time.Since(trace.waitlistedAt)
+		trace.waitlistedAt = time.Time{}
+		trace.WaitlistWait += waited
+		trace.Observe(StageWaitlistWait, waited)
+	}
+}
+
+// Called when the operation is waitlisted.
+func (trace *Trace) waitlisted() {
+	if trace != nil {
+		trace.waitlistedAt = time.Now()
+	}
+}
+
+// Adds the trace ID of a possibly nil trace to a log event.
+func withTrace(event *zerolog.Event, trace *Trace) *zerolog.Event {
+	if trace != nil {
+		return event.Str("trace_id", trace.TraceID)
+	}
+	return event
+}
@@ -4,6 +4,8 @@ package vault
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/maansthoernvik/locksmith/pkg/vault/queue"
 	"github.com/prometheus/client_golang/prometheus"
@@ -21,6 +23,9 @@ var (
 	ErrBadManners = errors.New(
 		"client tried to release lock that it did not own",
 	)
+	ErrLockBusy = errors.New(
+		"lock is already held",
+	)
 )
 
 var (
@@ -36,6 +41,10 @@ var (
 		Name: "locksmith_releases",
 		Help: "The number of processed releases",
 	})
+	expirationCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "locksmith_expirations",
+		Help: "The number of locks released because their time to live ran out",
+	})
 	rejectionCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "locksmith_rejections",
 		Help: "The number of rejections due to bad manners and unnecessary releases/acquires",
@@ -51,7 +60,70 @@ type Vault interface {
 	// error in case feedback handling encounters an error.
 	Acquire(lockTag string, client string, callback func(error) error)
 	Release(lockTag string, client string, callback func(error) error)
+	// TracedAcquire and TracedRelease work like Acquire and Release, filling
+	// in the trace along the way. The trace is complete by the time the
+	// callback is called, and the trace ID is logged with the operation.
+	TracedAcquire(lockTag string, client string, trace *Trace, callback func(error) error)
+	TracedRelease(lockTag string, client string, trace *Trace, callback func(error) error)
+	// IdempotentAcquire works like Acquire, except that the owner of the lock
+	// acquiring it again is not an offense: the owner keeps the lock and the
+	// callback is called as if the lock had just been acquired.
+	IdempotentAcquire(lockTag string, client string, callback func(error) error)
+	// TryAcquire acquires a lock only if it is immediately available, calling
+	// back with ErrLockBusy instead of waitlisting the client otherwise, even if
+	// the client is the one holding the lock. A positive time to live releases
+	// the lock automatically once it runs out, unless it has been released
+	// before that.
+	TryAcquire(lockTag string, client string, ttl time.Duration, callback func(error) error)
+	// Inspect calls back with the current state of a lock.
+	Inspect(lockTag string, callback func(LockInfo))
+	// Batch performs several acquires and releases for a client at once, each
+	// operation behaving as if given to Acquire or Release, and calling its own
+	// callback. Operations on the same lock tag are handled in the given order.
+	// Acquires of locks the client already holds fail with
+	// ErrUnnecessaryAcquire, but leave the lock with the client.
+	Batch(client string, operations []Operation)
+	// Watch sends events about a lock tag, or about all lock tags with a
+	// prefix, to a channel until the client is cleaned up. See vaultImpl.Watch.
+	Watch(client string, lockTag string, prefix bool, events chan<- Event)
+	// Cleanup releases the client's locks and removes its watches.
 	Cleanup(client string)
+	// Holds tells if the client holds any locks. Acquires still on their way
+	// through the vault are not counted.
+	Holds(client string) bool
+	// Drain blocks until every operation handed to the vault before the call
+	// has been handled, waitlisted acquires aside.
+	Drain()
+	// Freeze drains the vault and holds back every later operation for good,
+	// for a vault about to be exported and handed over. Handing operations to
+	// a frozen vault blocks once its queues are full.
+	Freeze()
+	// Export and Restore carry the vault's locks over to another vault, see
+	// vaultImpl.Export and vaultImpl.Restore.
+	Export() []LockState
+	Restore(states []LockState, callback func(client, lockTag string) func(error) error)
+}
+
+type OperationType int
+
+const (
+	AcquireOperation OperationType = iota
+	ReleaseOperation
+)
+
+// LockInfo describes the state of a lock at the time of inspection.
+type LockInfo struct {
+	// The client holding the lock, empty if the lock is unlocked.
+	Owner string
+	// The number of clients waitlisted for the lock.
+	Waiting int
+}
+
+// Operation is a single acquire or release in a batch.
+type Operation struct {
+	Type     OperationType
+	LockTag  string
+	Callback func(error) error
 }
 
 type lockState bool
@@ -64,6 +136,11 @@ const (
 type lock struct {
 	owner string
 	state lockState
+	// Incremented on every acquisition, so that an expiry scheduled for one
+	// acquisition never releases a later one.
+	generation uint64
+	// When the current acquisition runs out of time to live, zero for never.
+	expires time.Time
 }
 
 func newlock() *lock {
@@ -82,11 +159,14 @@ func (l *lock) isLocked() bool {
 func (l *lock) unlock() {
 	l.state = UNLOCKED
 	l.owner = ""
+	l.expires = time.Time{}
 }
 
 func (l *lock) lock(client string) {
 	l.state = LOCKED
 	l.owner = client
+	l.generation++
+	l.expires = time.Time{}
 }
 
 func (l *lock) String() string {
@@ -101,11 +181,24 @@ type vaultImpl struct {
 	state      map[string]*lock
 
 	// Waitlisted clients per lock.
-	waitList map[string][]*func(lockTag string)
+	waitList map[string][]*waiter
 
 	// Used to keep track of which locks a client owns without having to iterate over
 	// all of them. Used when clients disconnect to release locks held by them.
 	clientLookUpTable map[string][]string
+
+	// The maps above are shared by all synchronization Go-routines, and the
+	// lookup table is also read by Cleanup, so access to them is serialized.
+	// The locks themselves are only touched by their lock tag's Go-routine.
+	mapsMutex sync.Mutex
+
+	watchers watchers
+}
+
+// A waitlisted acquire, the action is called once the lock may be acquired.
+type waiter struct {
+	client string
+	action func(lockTag string)
 }
 
 type QueueType string
@@ -133,7 +226,7 @@ type VaultOptions struct {
 func NewVault(options *VaultOptions) Vault {
 	vault := &vaultImpl{
 		state:             make(map[string]*lock),
-		waitList:          make(map[string][]*func(string)),
+		waitList:          make(map[string][]*waiter),
 		clientLookUpTable: make(map[string][]string),
 	}
 	if options.QueueType == Single {
@@ -155,12 +248,23 @@ func (vault *vaultImpl) Acquire(
 	client string,
 	callback func(error) error,
 ) {
-	log.Info().
+	vault.TracedAcquire(lockTag, client, nil, callback)
+}
+
+// TracedAcquire works like Acquire, recording the acquire's progress in the
+// trace, which may be nil.
+func (vault *vaultImpl) TracedAcquire(
+	lockTag string,
+	client string,
+	trace *Trace,
+	callback func(error) error,
+) {
+	withTrace(log.Info(), trace).
 		Str("client", client).
 		Str("tag", lockTag).
 		Msg("acquiring")
 	vault.queueLayer.Enqueue(
-		lockTag, vault.acquireAction(client, callback),
+		lockTag, vault.acquireAction(client, trace, callback),
 	)
 }
 
@@ -171,9 +275,11 @@ func (vault *vaultImpl) Acquire(
 // handle acquiring locks.
 func (vault *vaultImpl) acquireAction(
 	client string,
+	trace *Trace,
 	callback func(error) error,
 ) func(string) {
 	return func(lockTag string) {
+		trace.started()
 		lock := vault.fetch(lockTag)
 		// a second acquire is a protocol offense, callback with error and
 		// release the lock, pop waitlisted client.
@@ -181,33 +287,165 @@ func (vault *vaultImpl) acquireAction(
 			lock.unlock()
 			locksGauge.Dec()
 			rejectionCounter.With(prometheus.Labels{"reason": "unnecessary_acquire"}).Inc()
+			vault.publish(lockTag, ReleasedEvent, client)
 
 			_ = callback(ErrUnnecessaryAcquire)
 
+			vault.cleanClientLookupTable(client, lockTag)
+
 			vault.popWaitlist(lockTag)
 			// client didn't match, and the lock state is LOCKED, waitlist the
 			// client
 		} else if lock.isLocked() {
+			trace.waitlisted()
 			vault.waitlist(
-				lockTag, vault.acquireAction(client, callback),
+				lockTag, client, vault.acquireAction(client, trace, callback),
 			)
 		} else {
+			// The lock is taken before calling back, so that a client whose
+			// callback succeeded is known to hold it when cleaned up, even if
+			// the cleanup starts right after.
+			lock.lock(client)
+			vault.appendClientLookupTable(client, lockTag)
 			// This means a write failure occurred and the client that was
 			// acquiring the lock has NW issues or something.
 			if err := callback(nil); err != nil {
-				// don't touch the lock state, pop from waitlist
+				// let go of the lock again, pop from waitlist
+				lock.unlock()
+				vault.cleanClientLookupTable(client, lockTag)
 				vault.popWaitlist(lockTag)
 			} else {
-				lock.lock(client)
 				locksGauge.Inc()
 				acquireCounter.Inc()
 
-				vault.appendClientLookupTable(client, lockTag)
+				vault.publish(lockTag, AcquiredEvent, client)
 			}
 		}
 	}
 }
 
+// IdempotentAcquire acquires a lock like Acquire, unless the client already
+// holds it, see the Vault interface.
+func (vault *vaultImpl) IdempotentAcquire(
+	lockTag string,
+	client string,
+	callback func(error) error,
+) {
+	log.Info().
+		Str("client", client).
+		Str("tag", lockTag).
+		Msg("acquiring idempotently")
+	acquire := vault.acquireAction(client, nil, callback)
+	vault.queueLayer.Enqueue(lockTag, func(lockTag string) {
+		if vault.fetch(lockTag).isOwner(client) {
+			_ = callback(nil)
+			return
+		}
+		acquire(lockTag)
+	})
+}
+
+// TryAcquire attempts to acquire a lock without waiting for it, see the Vault
+// interface.
+func (vault *vaultImpl) TryAcquire(
+	lockTag string,
+	client string,
+	ttl time.Duration,
+	callback func(error) error,
+) {
+	log.Info().
+		Str("client", client).
+		Str("tag", lockTag).
+		Dur("ttl", ttl).
+		Msg("trying to acquire")
+	vault.queueLayer.Enqueue(
+		lockTag, vault.tryAcquireAction(client, ttl, callback),
+	)
+}
+
+// Returns a callback handling a try-acquire, like acquireAction it may only
+// be called from the scope of a synchronization Go-routine.
+func (vault *vaultImpl) tryAcquireAction(
+	client string,
+	ttl time.Duration,
+	callback func(error) error,
+) func(string) {
+	return func(lockTag string) {
+		lock := vault.fetch(lockTag)
+		if lock.isLocked() {
+			_ = callback(ErrLockBusy)
+			return
+		}
+
+		// As for acquireAction, a callback error means the client could not be
+		// notified and should not get the lock.
+		if err := callback(nil); err != nil {
+			return
+		}
+		lock.lock(client)
+		locksGauge.Inc()
+		acquireCounter.Inc()
+
+		vault.appendClientLookupTable(client, lockTag)
+		vault.publish(lockTag, AcquiredEvent, client)
+
+		if ttl > 0 {
+			vault.expireAfter(lockTag, lock, ttl)
+		}
+	}
+}
+
+// Schedules the current acquisition of the lock to expire after the time to
+// live. Must only be called from the scope of a synchronization Go-routine.
+func (vault *vaultImpl) expireAfter(lockTag string, lock *lock, ttl time.Duration) {
+	client, generation := lock.owner, lock.generation
+	lock.expires = time.Now().Add(ttl)
+	time.AfterFunc(ttl, func() {
+		vault.queueLayer.Enqueue(
+			lockTag, vault.expireAction(client, generation),
+		)
+	})
+}
+
+// Returns a callback releasing a lock whose time to live has run out, if the
+// acquisition that scheduled the expiry is still the current one. Must only be
+// called from the scope of a synchronization Go-routine.
+func (vault *vaultImpl) expireAction(client string, generation uint64) func(string) {
+	return func(lockTag string) {
+		if lock := vault.fetch(lockTag); lock.isOwner(client) && lock.generation == generation {
+			log.Info().
+				Str("client", client).
+				Str("tag", lockTag).
+				Msg("lock expired")
+			lock.unlock()
+			locksGauge.Dec()
+			expirationCounter.Inc()
+			vault.publish(lockTag, ExpiredEvent, client)
+
+			vault.cleanClientLookupTable(client, lockTag)
+
+			vault.popWaitlist(lockTag)
+		}
+	}
+}
+
+// Inspect calls back with the state of a lock from the lock tag's
+// synchronization Go-routine, so the state is consistent at the time of the
+// call.
+func (vault *vaultImpl) Inspect(lockTag string, callback func(LockInfo)) {
+	vault.queueLayer.Enqueue(lockTag, func(lockTag string) {
+		vault.mapsMutex.Lock()
+		info := LockInfo{Waiting: len(vault.waitList[lockTag])}
+		// Not using fetch, inspecting should not create state for unknown locks.
+		lock, ok := vault.state[lockTag]
+		vault.mapsMutex.Unlock()
+		if ok && lock.isLocked() {
+			info.Owner = lock.owner
+		}
+		callback(info)
+	})
+}
+
 // Release releases a lock, leading to a queued acquire calling the vault
 // callback.
 func (vault *vaultImpl) Release(
@@ -215,11 +453,22 @@ func (vault *vaultImpl) Release(
 	client string,
 	callback func(error) error,
 ) {
-	log.Info().
+	vault.TracedRelease(lockTag, client, nil, callback)
+}
+
+// TracedRelease works like Release, recording the release's progress in the
+// trace, which may be nil.
+func (vault *vaultImpl) TracedRelease(
+	lockTag string,
+	client string,
+	trace *Trace,
+	callback func(error) error,
+) {
+	withTrace(log.Info(), trace).
 		Str("client", client).
 		Str("tag", lockTag).
 		Msg("releasing")
-	vault.queueLayer.Enqueue(lockTag, vault.releaseAction(client, callback))
+	vault.queueLayer.Enqueue(lockTag, vault.releaseAction(client, trace, callback))
 }
 
 // Returns a callback that handles the release of locks. This is the only piece
@@ -228,9 +477,11 @@ func (vault *vaultImpl) Release(
 // synchronization Go-routine.
 func (vault *vaultImpl) releaseAction(
 	client string,
+	trace *Trace,
 	callback func(error) error,
 ) func(string) {
 	return func(lockTag string) {
+		trace.started()
 		currentState := vault.fetch(lockTag)
 		// if already unlocked, kill the client for not following the protocol
 		if !currentState.isLocked() {
@@ -249,6 +500,7 @@ func (vault *vaultImpl) releaseAction(
 			currentState.unlock()
 			locksGauge.Dec()
 			releaseCounter.Inc()
+			vault.publish(lockTag, ReleasedEvent, client)
 
 			_ = callback(nil) // We don't care about release errors
 
@@ -259,17 +511,77 @@ func (vault *vaultImpl) releaseAction(
 	}
 }
 
+// Batch hands all operations to the queue layer in one go, letting it group
+// them per synchronization Go-routine instead of enqueueing them one by one.
+func (vault *vaultImpl) Batch(client string, operations []Operation) {
+	log.Info().
+		Str("client", client).
+		Int("operations", len(operations)).
+		Msg("batching")
+	items := make([]queue.BatchItem, 0, len(operations))
+	for _, operation := range operations {
+		var action func(string)
+		switch operation.Type {
+		case AcquireOperation:
+			action = vault.batchAcquireAction(client, operation.Callback)
+		case ReleaseOperation:
+			action = vault.releaseAction(client, nil, operation.Callback)
+		default:
+			log.Error().Int("type", int(operation.Type)).Msg("invalid operation type")
+			continue
+		}
+		items = append(items, queue.BatchItem{LockTag: operation.LockTag, Action: action})
+	}
+	vault.queueLayer.EnqueueBatch(items)
+}
+
+// Returns the action of an acquire in a batch. Unlike single acquires, which
+// get the client disconnected, an acquire of a lock the client already holds
+// is only answered with ErrUnnecessaryAcquire, and the client keeps the lock.
+func (vault *vaultImpl) batchAcquireAction(client string, callback func(error) error) func(string) {
+	acquire := vault.acquireAction(client, nil, callback)
+	return func(lockTag string) {
+		if vault.fetch(lockTag).isOwner(client) {
+			rejectionCounter.With(prometheus.Labels{"reason": "unnecessary_acquire"}).Inc()
+			_ = callback(ErrUnnecessaryAcquire)
+			return
+		}
+		acquire(lockTag)
+	}
+}
+
 // Cleans up all information associated with a given client.
 func (vault *vaultImpl) Cleanup(client string) {
 	log.Info().Str("client", client).Msg("cleaning up after client")
+	vault.unwatch(client)
+
+	vault.mapsMutex.Lock()
 	lockTags := vault.clientLookUpTable[client]
+	delete(vault.clientLookUpTable, client)
+	vault.mapsMutex.Unlock()
 
 	for _, lockTag := range lockTags {
 		vault.queueLayer.Enqueue(
 			lockTag, vault.cleanupAction(client),
 		)
 	}
-	delete(vault.clientLookUpTable, client)
+}
+
+// Tells if the client holds any locks, see the Vault interface.
+func (vault *vaultImpl) Holds(client string) bool {
+	vault.mapsMutex.Lock()
+	defer vault.mapsMutex.Unlock()
+	return len(vault.clientLookUpTable[client]) > 0
+}
+
+// Waits for the queue layer to catch up, see the Vault interface.
+func (vault *vaultImpl) Drain() {
+	vault.queueLayer.Drain()
+}
+
+// Freezes the queue layer, see the Vault interface.
+func (vault *vaultImpl) Freeze() {
+	vault.queueLayer.Freeze()
 }
 
 // Returns a callback that handles the cleanup of a client for a given lock tag.
@@ -282,6 +594,7 @@ func (vault *vaultImpl) cleanupAction(client string) func(string) {
 			currentState.unlock()
 			locksGauge.Dec()
 			releaseCounter.Inc()
+			vault.publish(lockTag, CleanedUpEvent, client)
 
 			vault.popWaitlist(lockTag)
 		}
@@ -289,6 +602,8 @@ func (vault *vaultImpl) cleanupAction(client string) func(string) {
 }
 
 func (vault *vaultImpl) fetch(lockTag string) *lock {
+	vault.mapsMutex.Lock()
+	defer vault.mapsMutex.Unlock()
 	lock, ok := vault.state[lockTag]
 	if !ok {
 		lock = newlock()
@@ -301,14 +616,11 @@ func (vault *vaultImpl) fetch(lockTag string) *lock {
 // IMPORTANT: only call from synchronized Go-routines.
 // Waitlist the input action, related to the given lock tag. Appends the action
 // to the back of the waitlist of the lock tag.
-func (vault *vaultImpl) waitlist(lockTag string, callback func(string)) {
+func (vault *vaultImpl) waitlist(lockTag string, client string, callback func(string)) {
 	log.Debug().Str("tag", lockTag).Msg("waitlisting client")
-	_, ok := vault.waitList[lockTag]
-	if !ok {
-		vault.waitList[lockTag] = []*func(string){&callback}
-	} else {
-		vault.waitList[lockTag] = append(vault.waitList[lockTag], &callback)
-	}
+	vault.mapsMutex.Lock()
+	defer vault.mapsMutex.Unlock()
+	vault.waitList[lockTag] = append(vault.waitList[lockTag], &waiter{client: client, action: callback})
 	log.Debug().Interface("waitlisted", len(vault.waitList[lockTag])).Send()
 }
 
@@ -317,7 +629,9 @@ func (vault *vaultImpl) waitlist(lockTag string, callback func(string)) {
 // action being called directly.
 func (vault *vaultImpl) popWaitlist(lockTag string) {
 	log.Debug().Str("tag", lockTag).Msg("popping from waitlist")
-	if wl, ok := vault.waitList[lockTag]; ok && len(wl) > 0 {
+	vault.mapsMutex.Lock()
+	wl, ok := vault.waitList[lockTag]
+	if ok && len(wl) > 0 {
 		first := wl[0]
 
 		if len(wl) == 1 {
@@ -325,17 +639,21 @@ func (vault *vaultImpl) popWaitlist(lockTag string) {
 		} else {
 			vault.waitList[lockTag] = wl[1:]
 		}
-		log.Debug().Interface("waitlist", vault.waitList).Send()
+		log.Debug().Int("waitlisted", len(wl)-1).Send()
+		vault.mapsMutex.Unlock()
 
-		f := *first
-		f(lockTag)
+		// Called without holding the mutex, the action may waitlist again.
+		first.action(lockTag)
 	} else {
+		vault.mapsMutex.Unlock()
 		log.Debug().Msg("no waitlisted clients found")
 	}
 }
 
 // Add a lock to a client's lookup table.
 func (vault *vaultImpl) appendClientLookupTable(client, lockTag string) {
+	vault.mapsMutex.Lock()
+	defer vault.mapsMutex.Unlock()
 	if _, ok := vault.clientLookUpTable[client]; !ok {
 		vault.clientLookUpTable[client] = []string{lockTag}
 	} else {
@@ -345,6 +663,8 @@ func (vault *vaultImpl) appendClientLookupTable(client, lockTag string) {
 
 // Remove a lock from a client's lookup table.
 func (vault *vaultImpl) cleanClientLookupTable(client, lockTag string) {
+	vault.mapsMutex.Lock()
+	defer vault.mapsMutex.Unlock()
 	if lts, ok := vault.clientLookUpTable[client]; ok {
 		if len(lts) == 1 {
 			delete(vault.clientLookUpTable, client)
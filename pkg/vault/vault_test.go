@@ -2,8 +2,12 @@ package vault
 
 import (
 	"errors"
+	"reflect"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/maansthoernvik/locksmith/pkg/vault/queue"
 )
 
 type tql struct{}
@@ -12,6 +16,16 @@ func (t *tql) Enqueue(locktag string, action func(string)) {
 	action(locktag)
 }
 
+func (t *tql) EnqueueBatch(items []queue.BatchItem) {
+	for _, item := range items {
+		item.Action(item.LockTag)
+	}
+}
+
+func (t *tql) Drain() {}
+
+func (t *tql) Freeze() {}
+
 func Test_Acquire(t *testing.T) {
 	v := &vaultImpl{
 		state:             make(map[string]*lock),
@@ -71,10 +85,34 @@ func Test_Release(t *testing.T) {
 	}
 }
 
+func Test_Holds(t *testing.T) {
+	v := &vaultImpl{
+		state:             make(map[string]*lock),
+		waitList:          make(map[string][]*waiter),
+		clientLookUpTable: make(map[string][]string),
+		queueLayer:        &tql{},
+	}
+	noop := func(error) error { return nil }
+
+	v.Acquire("lt", "holder", noop)
+	v.Acquire("lt", "waiter", noop)
+	if !v.Holds("holder") {
+		t.Error("Expected the holder to hold a lock")
+	}
+	if v.Holds("waiter") {
+		t.Error("Expected a waiting client not to hold a lock")
+	}
+
+	v.Release("lt", "holder", noop)
+	if v.Holds("holder") || !v.Holds("waiter") {
+		t.Error("Expected the lock to have passed on to the waiter")
+	}
+}
+
 func Test_Waitlist(t *testing.T) {
 	v := &vaultImpl{
 		state:             make(map[string]*lock),
-		waitList:          make(map[string][]*func(string)),
+		waitList:          make(map[string][]*waiter),
 		clientLookUpTable: make(map[string][]string),
 		queueLayer:        &tql{},
 	}
@@ -193,6 +231,33 @@ func Test_UnecessaryAcquire(t *testing.T) {
 	})
 
 	wg.Wait()
+	// The lock was let go of, so the client is no longer holding it.
+	if v.Holds("client") {
+		t.Error("Expected client to no longer hold the lock")
+	}
+}
+
+func Test_IdempotentAcquire(t *testing.T) {
+	v := &vaultImpl{
+		state:             make(map[string]*lock),
+		clientLookUpTable: make(map[string][]string),
+		queueLayer:        &tql{},
+	}
+
+	for i := 0; i < 2; i++ {
+		v.IdempotentAcquire("lt", "client", func(err error) error {
+			if err != nil {
+				t.Error("Expected the acquire to succeed, got:", err)
+			}
+			return nil
+		})
+	}
+	if !v.fetch("lt").isOwner("client") {
+		t.Fatal("Expected the client to keep the lock")
+	}
+	if tags := v.clientLookUpTable["client"]; len(tags) != 1 {
+		t.Fatal("Expected the lock to be looked up once, got:", tags)
+	}
 }
 
 func Test_CallbackError(t *testing.T) {
@@ -235,6 +300,29 @@ func Test_CallbackError(t *testing.T) {
 	}
 }
 
+func Test_CleanupDuringGrant(t *testing.T) {
+	v := &vaultImpl{
+		state:             make(map[string]*lock),
+		waitList:          make(map[string][]*waiter),
+		clientLookUpTable: make(map[string][]string),
+		queueLayer:        &tql{},
+	}
+
+	v.Acquire("lt", "holder", func(error) error { return nil })
+	// The waiter disconnects as it is granted the lock, after being notified.
+	v.Acquire("lt", "waiter", func(err error) error {
+		if err == nil {
+			v.Cleanup("waiter")
+		}
+		return nil
+	})
+	v.Release("lt", "holder", func(error) error { return nil })
+
+	if v.fetch("lt").isLocked() || v.Holds("waiter") {
+		t.Fatal("Expected the lock to be released along with the waiter, got", v.fetch("lt"))
+	}
+}
+
 func Test_Cleanup(t *testing.T) {
 	v := &vaultImpl{
 		state:             make(map[string]*lock),
@@ -322,3 +410,377 @@ func Test_Cleanup(t *testing.T) {
 	t.Log("Resulting lookup table after cleanup: ", v.clientLookUpTable)
 	t.Log("Resulting state after cleanup: ", v.state)
 }
+
+func Test_Batch(t *testing.T) {
+	v := &vaultImpl{
+		state:             make(map[string]*lock),
+		waitList:          make(map[string][]*waiter),
+		clientLookUpTable: make(map[string][]string),
+		queueLayer:        &tql{},
+	}
+
+	results := make([]error, 4)
+	callback := func(i int) func(error) error {
+		return func(err error) error {
+			results[i] = err
+			return nil
+		}
+	}
+	v.Batch("client", []Operation{
+		{Type: AcquireOperation, LockTag: "lt1", Callback: callback(0)},
+		{Type: AcquireOperation, LockTag: "lt2", Callback: callback(1)},
+		{Type: ReleaseOperation, LockTag: "lt1", Callback: callback(2)},
+		{Type: ReleaseOperation, LockTag: "lt3", Callback: callback(3)},
+	})
+
+	for i, expected := range []error{nil, nil, nil, ErrUnnecessaryRelease} {
+		if !errors.Is(results[i], expected) {
+			t.Errorf("Operation %d: expected %v, got %v", i, expected, results[i])
+		}
+	}
+	if v.fetch("lt1").isLocked() {
+		t.Error("Expected lt1 to have been released")
+	}
+	if !v.fetch("lt2").isOwner("client") {
+		t.Error("Expected client to own lt2")
+	}
+}
+
+func Test_BatchDuplicateAcquire(t *testing.T) {
+	v := &vaultImpl{
+		state:             make(map[string]*lock),
+		waitList:          make(map[string][]*waiter),
+		clientLookUpTable: make(map[string][]string),
+		queueLayer:        &tql{},
+	}
+
+	results := make([]error, 2)
+	v.Batch("client", []Operation{
+		{Type: AcquireOperation, LockTag: "lt", Callback: func(err error) error { results[0] = err; return nil }},
+		{Type: AcquireOperation, LockTag: "lt", Callback: func(err error) error { results[1] = err; return nil }},
+	})
+	waiterGranted := false
+	v.Acquire("lt", "other", func(err error) error {
+		waiterGranted = true
+		return nil
+	})
+
+	if results[0] != nil || !errors.Is(results[1], ErrUnnecessaryAcquire) {
+		t.Fatal("Expected the duplicate acquire to be rejected, got", results)
+	}
+	if !v.fetch("lt").isOwner("client") || waiterGranted {
+		t.Error("Expected client to keep the lock")
+	}
+	if !v.Holds("client") {
+		t.Error("Expected client to still hold the lock")
+	}
+
+	v.Cleanup("client")
+	if !waiterGranted || !v.fetch("lt").isOwner("other") {
+		t.Error("Expected the lock to go to the waiter once client was cleaned up")
+	}
+}
+
+func Test_TryAcquire(t *testing.T) {
+	v := &vaultImpl{
+		state:             make(map[string]*lock),
+		waitList:          make(map[string][]*waiter),
+		clientLookUpTable: make(map[string][]string),
+		queueLayer:        &tql{},
+	}
+
+	var results []error
+	callback := func(err error) error {
+		results = append(results, err)
+		return nil
+	}
+	v.TryAcquire("lt", "client1", 0, callback)
+	v.TryAcquire("lt", "client2", 0, callback)
+	// Unlike Acquire, a repeated try is not an offense.
+	v.TryAcquire("lt", "client1", 0, callback)
+
+	for i, expected := range []error{nil, ErrLockBusy, ErrLockBusy} {
+		if !errors.Is(results[i], expected) {
+			t.Errorf("Try %d: expected %v, got %v", i, expected, results[i])
+		}
+	}
+	if !v.fetch("lt").isOwner("client1") {
+		t.Error("Expected client1 to still own the lock")
+	}
+}
+
+func Test_TryAcquireExpiry(t *testing.T) {
+	v := NewVault(&VaultOptions{QueueType: Single, QueueCapacity: 10}).(*vaultImpl)
+
+	acquired := make(chan string, 2)
+	v.TryAcquire("lt", "client1", 20*time.Millisecond, func(err error) error {
+		acquired <- "client1"
+		return nil
+	})
+	<-acquired
+	v.Acquire("lt", "client2", func(err error) error {
+		acquired <- "client2"
+		return nil
+	})
+
+	select {
+	case client := <-acquired:
+		if client != "client2" {
+			t.Fatal("Unexpected acquisition by", client)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Lock did not expire")
+	}
+
+	info := make(chan LockInfo)
+	v.Inspect("lt", func(li LockInfo) { info <- li })
+	if li := <-info; li.Owner != "client2" || li.Waiting != 0 {
+		t.Error("Unexpected lock info after expiry:", li)
+	}
+}
+
+func Test_ExpiryAfterRelease(t *testing.T) {
+	v := NewVault(&VaultOptions{QueueType: Single, QueueCapacity: 10})
+	noop := func(err error) error { return nil }
+
+	// The first acquisition's expiry must not touch the second acquisition.
+	v.TryAcquire("lt", "client", 10*time.Millisecond, noop)
+	v.Release("lt", "client", noop)
+	v.TryAcquire("lt", "client", 0, noop)
+	time.Sleep(30 * time.Millisecond)
+
+	info := make(chan LockInfo)
+	v.Inspect("lt", func(li LockInfo) { info <- li })
+	if li := <-info; li.Owner != "client" {
+		t.Error("Expected the second acquisition to survive the first one's expiry")
+	}
+}
+
+func Test_Watch(t *testing.T) {
+	v := NewVault(&VaultOptions{QueueType: Single, QueueCapacity: 10}).(*vaultImpl)
+
+	exact := make(chan Event, 10)
+	prefixed := make(chan Event, 10)
+	v.Watch("watcher1", "db/users", false, exact)
+	v.Watch("watcher2", "db/", true, prefixed)
+
+	done := make(chan struct{}, 10)
+	callback := func(err error) error {
+		done <- struct{}{}
+		return nil
+	}
+	v.Acquire("db/users", "client1", callback)
+	<-done
+	v.TryAcquire("db/orders", "client1", 20*time.Millisecond, callback)
+	<-done
+	v.Release("db/users", "client1", callback)
+	<-done
+	v.Acquire("other", "client1", callback)
+	<-done
+	v.Acquire("db/users", "client2", callback)
+	<-done
+	v.Cleanup("client2")
+	// Lets the expiry of db/orders run.
+	time.Sleep(50 * time.Millisecond)
+
+	expect := func(events chan Event, expected []Event) {
+		t.Helper()
+		for _, e := range expected {
+			select {
+			case event := <-events:
+				if event != e {
+					t.Fatalf("Expected %v, got %v", e, event)
+				}
+			case <-time.After(1 * time.Second):
+				t.Fatal("Missing event", e)
+			}
+		}
+		if len(events) != 0 {
+			t.Fatal("Unexpected event", <-events)
+		}
+	}
+	expect(exact, []Event{
+		{LockTag: "db/users", Kind: AcquiredEvent, Owner: "client1"},
+		{LockTag: "db/users", Kind: ReleasedEvent, Owner: "client1"},
+		{LockTag: "db/users", Kind: AcquiredEvent, Owner: "client2"},
+		{LockTag: "db/users", Kind: CleanedUpEvent, Owner: "client2"},
+	})
+	expect(prefixed, []Event{
+		{LockTag: "db/users", Kind: AcquiredEvent, Owner: "client1"},
+		{LockTag: "db/orders", Kind: AcquiredEvent, Owner: "client1"},
+		{LockTag: "db/users", Kind: ReleasedEvent, Owner: "client1"},
+		{LockTag: "db/users", Kind: AcquiredEvent, Owner: "client2"},
+		{LockTag: "db/users", Kind: CleanedUpEvent, Owner: "client2"},
+		{LockTag: "db/orders", Kind: ExpiredEvent, Owner: "client1"},
+	})
+
+	// Cleaning up a watcher removes its watches.
+	v.Cleanup("watcher1")
+	v.Acquire("db/users", "client3", callback)
+	<-done
+	if len(exact) != 0 {
+		t.Fatal("Expected no events after cleanup, got", <-exact)
+	}
+}
+
+func Test_WatchSlowWatcher(t *testing.T) {
+	v := NewVault(&VaultOptions{QueueType: Single, QueueCapacity: 10}).(*vaultImpl)
+
+	// Nobody reads the events, the vault must not block on them.
+	events := make(chan Event, 1)
+	v.Watch("watcher", "lt", false, events)
+
+	done := make(chan struct{}, 1)
+	callback := func(err error) error {
+		done <- struct{}{}
+		return nil
+	}
+	for i := 0; i < 10; i++ {
+		v.Acquire("lt", "client", callback)
+		v.Release("lt", "client", callback)
+		for j := 0; j < 2; j++ {
+			select {
+			case <-done:
+			case <-time.After(1 * time.Second):
+				t.Fatal("Vault stalled by a slow watcher")
+			}
+		}
+	}
+	if event := <-events; event.Kind != AcquiredEvent {
+		t.Error("Expected the first event to be kept, got", event)
+	}
+}
+
+func Test_Trace(t *testing.T) {
+	v := &vaultImpl{
+		state:             make(map[string]*lock),
+		waitList:          make(map[string][]*waiter),
+		clientLookUpTable: make(map[string][]string),
+		queueLayer:        &tql{},
+	}
+
+	v.Acquire("lt", "holder", func(error) error { return nil })
+
+	trace := NewTrace("4bf92f3577b34da6a3ce929d0e0e4736")
+	var granted Trace
+	v.TracedAcquire("lt", "waiter", trace, func(err error) error {
+		if err != nil {
+			t.Error("Unexpected acquire error:", err)
+		}
+		// The trace is complete once the callback is called.
+		granted = *trace
+		return nil
+	})
+	time.Sleep(20 * time.Millisecond)
+	v.Release("lt", "holder", func(error) error { return nil })
+
+	if granted.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatal("Expected the callback to see the trace, got:", granted)
+	}
+	if granted.WaitlistWait < 20*time.Millisecond {
+		t.Error("Expected the waitlist wait to cover the time spent waiting, got:", granted.WaitlistWait)
+	}
+	if granted.QueueWait >= granted.WaitlistWait {
+		t.Error("Unexpected queue wait:", granted.QueueWait)
+	}
+
+	// Releases are only ever queued.
+	trace = NewTrace("4bf92f3577b34da6a3ce929d0e0e4736")
+	v.TracedRelease("lt", "waiter", trace, func(error) error { return nil })
+	if !trace.dequeued || trace.WaitlistWait != 0 {
+		t.Error("Unexpected release trace:", trace)
+	}
+
+	// Untraced operations are not traced at all.
+	if trace := NewTrace(""); trace != nil {
+		t.Fatal("Expected no trace without a trace ID, got:", trace)
+	}
+	released := false
+	v.Acquire("lt", "waiter", func(error) error { return nil })
+	v.TracedRelease("lt", "waiter", nil, func(err error) error {
+		released = err == nil
+		return nil
+	})
+	if !released {
+		t.Error("Expected the untraced release to go through")
+	}
+}
+
+func Test_ExportRestore(t *testing.T) {
+	v := &vaultImpl{
+		state:             make(map[string]*lock),
+		waitList:          make(map[string][]*waiter),
+		clientLookUpTable: make(map[string][]string),
+		queueLayer:        &tql{},
+	}
+	noop := func(error) error { return nil }
+	v.Acquire("b", "holder", noop)
+	v.Acquire("b", "first", noop)
+	v.Acquire("b", "second", noop)
+	v.Acquire("a", "holder", noop)
+	v.Acquire("c", "holder", noop)
+	v.Release("c", "holder", noop)
+
+	states := v.Export()
+	expected := []LockState{
+		{LockTag: "a", Owner: "holder"},
+		{LockTag: "b", Owner: "holder", Waiting: []string{"first", "second"}},
+	}
+	if !reflect.DeepEqual(states, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, states)
+	}
+
+	// A lock whose owner was left out goes to the first waiting client.
+	states = append(states, LockState{LockTag: "d", Waiting: []string{"third"}})
+	restored := &vaultImpl{
+		state:             make(map[string]*lock),
+		waitList:          make(map[string][]*waiter),
+		clientLookUpTable: make(map[string][]string),
+		queueLayer:        &tql{},
+	}
+	granted := []string{}
+	restored.Restore(states, func(client, lockTag string) func(error) error {
+		return func(err error) error {
+			if err != nil {
+				t.Error("Unexpected acquire error:", err)
+			}
+			granted = append(granted, client+":"+lockTag)
+			return nil
+		}
+	})
+	if !restored.Holds("holder") || !restored.Holds("third") {
+		t.Error("Expected restored owners to hold their locks")
+	}
+	restored.Release("b", "holder", noop)
+	restored.Release("b", "first", noop)
+	if !reflect.DeepEqual(granted, []string{"third:d", "first:b", "second:b"}) {
+		t.Error("Unexpected grants:", granted)
+	}
+}
+
+func Test_ExportRestoreTTL(t *testing.T) {
+	v := NewVault(&VaultOptions{QueueType: Single, QueueCapacity: 10})
+	noop := func(error) error { return nil }
+	v.TryAcquire("a", "client", time.Hour, noop)
+	v.TryAcquire("b", "client", 50*time.Millisecond, noop)
+	v.Acquire("c", "client", noop)
+	v.Freeze()
+
+	// The time to live left is exported, and dropped once released.
+	states := v.Export()
+	if len(states) != 3 || states[0].TTL <= 50*time.Millisecond || states[0].TTL > time.Hour ||
+		states[1].TTL <= 0 || states[1].TTL > 50*time.Millisecond || states[2].TTL != 0 {
+		t.Fatalf("Unexpected time to live exported: %+v", states)
+	}
+
+	restored := NewVault(&VaultOptions{QueueType: Single, QueueCapacity: 10})
+	restored.Restore(states, nil)
+	time.Sleep(100 * time.Millisecond)
+	info := make(chan LockInfo)
+	for lockTag, owner := range map[string]string{"a": "client", "b": "", "c": "client"} {
+		restored.Inspect(lockTag, func(li LockInfo) { info <- li })
+		if li := <-info; li.Owner != owner {
+			t.Errorf("Expected %s to be owned by %q after restoring, got %+v", lockTag, owner, li)
+		}
+	}
+}
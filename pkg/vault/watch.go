@@ -0,0 +1,120 @@
+package vault
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var droppedEventsCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "locksmith_dropped_events",
+	Help: "The number of lock events dropped because a watcher's buffer was full",
+})
+
+type EventKind int
+
+const (
+	// The lock was acquired by the owner.
+	AcquiredEvent EventKind = iota
+	// The lock was released by the owner, or taken from the owner for
+	// acquiring it twice.
+	ReleasedEvent
+	// The owner's time to live for the lock ran out.
+	ExpiredEvent
+	// The owner was cleaned up while holding the lock.
+	CleanedUpEvent
+)
+
+// Event tells watchers what happened to a lock.
+type Event struct {
+	LockTag string
+	Kind    EventKind
+	Owner   string
+}
+
+type watch struct {
+	client string
+	events chan<- Event
+}
+
+// Watches per exact lock tag and per prefix. Events are published from the
+// synchronization Go-routines, so watches are kept apart from the rest of the
+// vault's state behind their own lock.
+type watchers struct {
+	mutex    sync.RWMutex
+	exact    map[string][]*watch
+	prefixes map[string][]*watch
+}
+
+// Watch sends events for the lock tag, or all lock tags starting with it if
+// prefix is set, to the events channel until the client is cleaned up. Events
+// are never waited for: if the channel's buffer is full the event is dropped,
+// so a slow watcher can not stall the vault. Once Cleanup has returned for the
+// client, no more events are sent and the channel may be closed.
+func (vault *vaultImpl) Watch(client string, lockTag string, prefix bool, events chan<- Event) {
+	vault.watchers.mutex.Lock()
+	defer vault.watchers.mutex.Unlock()
+	if vault.watchers.exact == nil {
+		vault.watchers.exact = make(map[string][]*watch)
+		vault.watchers.prefixes = make(map[string][]*watch)
+	}
+
+	watches := vault.watchers.exact
+	if prefix {
+		watches = vault.watchers.prefixes
+	}
+	watches[lockTag] = append(watches[lockTag], &watch{client: client, events: events})
+}
+
+// Removes all watches of a client.
+func (vault *vaultImpl) unwatch(client string) {
+	vault.watchers.mutex.Lock()
+	defer vault.watchers.mutex.Unlock()
+	for _, watches := range []map[string][]*watch{vault.watchers.exact, vault.watchers.prefixes} {
+		for lockTag, lockTagWatches := range watches {
+			kept := lockTagWatches[:0]
+			for _, w := range lockTagWatches {
+				if w.client != client {
+					kept = append(kept, w)
+				}
+			}
+			if len(kept) == 0 {
+				delete(watches, lockTag)
+			} else {
+				watches[lockTag] = kept
+			}
+		}
+	}
+}
+
+// IMPORTANT: only call from synchronized Go-routines.
+// Publishes an event to the watchers of its lock tag, without blocking.
+func (vault *vaultImpl) publish(lockTag string, kind EventKind, owner string) {
+	vault.watchers.mutex.RLock()
+	defer vault.watchers.mutex.RUnlock()
+	if len(vault.watchers.exact) == 0 && len(vault.watchers.prefixes) == 0 {
+		return
+	}
+
+	event := Event{LockTag: lockTag, Kind: kind, Owner: owner}
+	for _, w := range vault.watchers.exact[lockTag] {
+		w.send(event)
+	}
+	for prefix, watches := range vault.watchers.prefixes {
+		if strings.HasPrefix(lockTag, prefix) {
+			for _, w := range watches {
+				w.send(event)
+			}
+		}
+	}
+}
+
+func (w *watch) send(event Event) {
+	select {
+	case w.events <- event:
+	default:
+		droppedEventsCounter.Inc()
+	}
+}
@@ -0,0 +1,81 @@
+package locksmith
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/maansthoernvik/locksmith/pkg/protocol"
+	"github.com/maansthoernvik/locksmith/pkg/vault"
+	"github.com/rs/zerolog/log"
+)
+
+// Used when LocksmithOptions.WatchBufferSize is not set.
+const DefaultWatchBufferSize = 256
+
+// Registers a watch for the connection, creating its events channel and the
+// Go-routine writing events to the connection on the first watch. Returns the
+// connection's events channel.
+func (locksmith *Locksmith) handleWatch(
+	conn *clientConn,
+	events chan vault.Event,
+	lockTag string,
+	prefix bool,
+) chan vault.Event {
+	if events == nil {
+		events = make(chan vault.Event, locksmith.watchBufferSize)
+		go writeEvents(conn, events)
+	}
+	log.Info().
+		Str("address", conn.RemoteAddr().String()).
+		Str("tag", lockTag).
+		Bool("prefix", prefix).
+		Msg("watching")
+	locksmith.vault.Watch(conn.RemoteAddr().String(), lockTag, prefix, events)
+	conn.watching.Store(true)
+	conn.watches = append(conn.watches, handedOverWatch{LockTag: lockTag, Prefix: prefix})
+
+	return events
+}
+
+// Writes events to a watching connection until the events channel is closed.
+// Events are written from this Go-routine rather than the vault's, which only
+// fills the channel's buffer.
+func writeEvents(conn *clientConn, events chan vault.Event) {
+	for event := range events {
+		err := conn.writeClientMessage(&protocol.ClientMessage{
+			Type:      protocol.Event,
+			LockTag:   event.LockTag,
+			EventKind: eventKind(event.Kind),
+			Owner:     eventOwner(event.Owner),
+		})
+		if errors.Is(err, protocol.ErrLockTagTooLong) || errors.Is(err, protocol.ErrLockTagEncoding) {
+			// The lock tag and owner do not fit in a single frame.
+			log.Error().Err(err).Str("tag", event.LockTag).Msg("failed to encode event")
+		} else if err != nil {
+			// The connection is closing, keep draining until the channel is.
+			log.Debug().Err(err).Msg("failed to write event to client")
+		}
+	}
+}
+
+// Translates vault event kinds into protocol event kinds.
+func eventKind(kind vault.EventKind) protocol.EventKind {
+	switch kind {
+	case vault.AcquiredEvent:
+		return protocol.EventAcquire
+	case vault.ReleasedEvent:
+		return protocol.EventRelease
+	case vault.ExpiredEvent:
+		return protocol.EventExpire
+	default:
+		return protocol.EventCleanup
+	}
+}
+
+// HTTP session IDs double as credentials, so they are not told to watchers.
+func eventOwner(owner string) string {
+	if strings.HasPrefix(owner, httpClientPrefix) {
+		return strings.TrimSuffix(httpClientPrefix, ":")
+	}
+	return owner
+}
@@ -0,0 +1,37 @@
+package locksmith
+
+import (
+	"net"
+	"time"
+
+	"github.com/maansthoernvik/locksmith/pkg/connection"
+	"github.com/rs/zerolog/log"
+)
+
+// How long a WebSocket client has to complete its handshake, unless a
+// handshake timeout is configured.
+const webSocketHandshakeTimeout = 10 * time.Second
+
+// Handler for connections accepted by the WebSocket acceptor. After the
+// handshake, binary WebSocket messages carry the same frames as plain
+// connections, so the connection is handed to handleConnection and is treated
+// just like any other client, including cleanup once it closes.
+func (locksmith *Locksmith) handleWebSocketConnection(conn net.Conn) {
+	handshakeTimeout := locksmith.handshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = webSocketHandshakeTimeout
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	webSocketConn, err := connection.AcceptWebSocket(conn)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("address", conn.RemoteAddr().String()).
+			Msg("WebSocket handshake failed, closing connection")
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	defer webSocketConn.Close()
+
+	locksmith.handleConnection(webSocketConn)
+}
@@ -0,0 +1,205 @@
+package locksmith
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var writeQueueOverflowCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "locksmith_write_queue_overflows",
+	Help: "The number of connections closed due to reading messages slower than they were sent",
+})
+
+// Used when LocksmithOptions.WriteQueueSize is not set. Roomy enough for
+// clients pipelining a good number of acquires, since a full queue is not
+// waited on.
+const DefaultWriteQueueSize = 1024
+
+// How long messages still queued when a write queue is stopped have to be
+// written.
+const flushTimeout = time.Second
+
+var ErrWriteQueueFull = errors.New("write queue full")
+
+// Messages waiting to be written to a connection, in order, by a Go-routine
+// of the queue's own. Vault callbacks only queue their messages, so a client
+// not reading holds up itself rather than every lock handled by the same
+// synchronization Go-routine. Clients falling a full queue behind are
+// disconnected.
+type writeQueue struct {
+	conn net.Conn
+	// Deadline for each write, zero for none.
+	timeout time.Duration
+	// Called after each write, nil for nothing.
+	written func()
+
+	frames chan queuedFrame
+	// Set once the connection is closed by the queue, from then on messages
+	// are dropped.
+	closed atomic.Bool
+	// Held while pushing, so that no push succeeds once stopWriting has
+	// returned.
+	stopMutex sync.RWMutex
+	stop      chan interface{}
+	stopOnce  sync.Once
+	done      chan interface{}
+}
+
+// A frame waiting in a write queue, a nil buffer closes the connection.
+type queuedFrame struct {
+	buffer *[]byte
+	// Called once the frame has been written, nil for nothing.
+	written func()
+}
+
+func newWriteQueue(conn net.Conn, size int, timeout time.Duration, written func()) *writeQueue {
+	if size <= 0 {
+		size = DefaultWriteQueueSize
+	}
+	return &writeQueue{
+		conn:    conn,
+		timeout: timeout,
+		written: written,
+		frames:  make(chan queuedFrame, size),
+		stop:    make(chan interface{}),
+		done:    make(chan interface{}),
+	}
+}
+
+// Starts writing queued messages.
+func (queue *writeQueue) start() {
+	go queue.run()
+}
+
+// Queues the frame to be written, taking over the pooled buffer, and calling
+// written, if not nil, once the frame has been written. Never blocks, the
+// connection is closed if the queue is full.
+func (queue *writeQueue) push(frame *[]byte, written func()) error {
+	queue.stopMutex.RLock()
+	defer queue.stopMutex.RUnlock()
+	if queue.closed.Load() {
+		putFrameBuffer(frame)
+		return net.ErrClosed
+	}
+	select {
+	case <-queue.stop:
+		putFrameBuffer(frame)
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case queue.frames <- queuedFrame{buffer: frame, written: written}:
+		return nil
+	default:
+		putFrameBuffer(frame)
+		if !queue.closed.Swap(true) {
+			writeQueueOverflowCounter.Inc()
+			log.Warn().
+				Str("address", queue.conn.RemoteAddr().String()).
+				Int("size", cap(queue.frames)).
+				Msg("write queue full, closing connection")
+			queue.conn.Close()
+		}
+		return ErrWriteQueueFull
+	}
+}
+
+// Queues closing the connection once what was queued before has been
+// written.
+func (queue *writeQueue) closeConn() {
+	select {
+	case queue.frames <- queuedFrame{}:
+	default:
+		queue.closed.Store(true)
+		queue.conn.Close()
+	}
+}
+
+// Stops the queue, what is queued still gets written within the flush
+// timeout. Messages queued after are dropped, pushing them fails with
+// net.ErrClosed once stopWriting has returned.
+func (queue *writeQueue) stopWriting() {
+	queue.stopOnce.Do(func() {
+		queue.stopMutex.Lock()
+		close(queue.stop)
+		queue.stopMutex.Unlock()
+		// Also applies to a write in progress.
+		_ = queue.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	})
+}
+
+// Stops the queue, and waits for what is queued to have been written.
+func (queue *writeQueue) flush() {
+	queue.stopWriting()
+	<-queue.done
+}
+
+func (queue *writeQueue) run() {
+	defer close(queue.done)
+	for {
+		select {
+		case frame := <-queue.frames:
+			queue.write(frame, true)
+		case <-queue.stop:
+			for {
+				select {
+				case frame := <-queue.frames:
+					queue.write(frame, false)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Writes a single frame, closing the connection should the write fail. The
+// flush timeout takes the place of the write timeout once stopped.
+func (queue *writeQueue) write(frame queuedFrame, deadline bool) {
+	if frame.buffer == nil {
+		queue.closed.Store(true)
+		queue.conn.Close()
+		return
+	}
+	defer putFrameBuffer(frame.buffer)
+	if queue.closed.Load() {
+		return
+	}
+
+	if deadline && queue.timeout > 0 {
+		_ = queue.conn.SetWriteDeadline(time.Now().Add(queue.timeout))
+	}
+	if _, err := queue.conn.Write(*frame.buffer); err != nil {
+		queue.closed.Store(true)
+		var netErr net.Error
+		if deadline && errors.As(err, &netErr) && netErr.Timeout() {
+			writeTimeoutCounter.Inc()
+			log.Warn().
+				Str("address", queue.conn.RemoteAddr().String()).
+				Dur("timeout", queue.timeout).
+				Msg("write timeout, closing connection")
+		} else {
+			log.Debug().
+				Err(err).
+				Str("address", queue.conn.RemoteAddr().String()).
+				Msg("failed to write to client, closing connection")
+		}
+		// A partial frame may have been written.
+		queue.conn.Close()
+		return
+	}
+	if queue.written != nil {
+		queue.written()
+	}
+	if frame.written != nil {
+		frame.written()
+	}
+}